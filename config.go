@@ -0,0 +1,528 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// config is the content of the configuration file.
+type config struct {
+	// Upstream is the URL of the upstream server.
+	Upstream string `yaml:"upstream"`
+
+	// Labels are the enforced labels with their value source, the first
+	// one being the proxy's label.
+	Labels []labelConfig `yaml:"labels"`
+
+	// PassthroughPaths are forwarded to the upstream without enforcement.
+	PassthroughPaths []string `yaml:"passthrough_paths"`
+
+	// PassthroughRules forward the unmatched requests matching a path
+	// pattern and the methods without enforcement.
+	PassthroughRules []passthroughRule `yaml:"passthrough_rules"`
+
+	// TLS configures the certificate of the HTTPS listener.
+	TLS *tlsConfig `yaml:"tls"`
+
+	Limits *limitsConfig `yaml:"limits"`
+
+	// QueryPolicy restricts the PromQL expressions of the query endpoints.
+	QueryPolicy *queryPolicyConfig `yaml:"query_policy"`
+
+	// ResponseHeaders are set on all the responses.
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+
+	// BlockedTenants maps the label values to block to their denial.
+	BlockedTenants map[string]denial `yaml:"blocked_tenants"`
+
+	// ReadOnlyTenants lists the label values which can't modify the upstream
+	// state (e.g. create silences).
+	ReadOnlyTenants []string `yaml:"read_only_tenants"`
+
+	// SilenceMatchers maps the label values to the additional matchers added
+	// to their silences.
+	SilenceMatchers map[string][]string `yaml:"silence_matchers"`
+
+	// Receivers maps the Alertmanager receiver names to the label values
+	// allowed to see them.
+	Receivers map[string][]string `yaml:"receivers"`
+
+	// LabelsMatchMode is either "all" or "any".
+	LabelsMatchMode string `yaml:"labels_match_mode"`
+
+	// Routes maps the route paths to their specific settings.
+	Routes map[string]routeConfig `yaml:"routes"`
+
+	// ResponseFilters define additional routes whose JSON responses are
+	// filtered by the proxy.
+	ResponseFilters []responseFilter `yaml:"response_filters"`
+}
+
+// labelConfig defines an enforced label and the source of its values. At most
+// one source can be set, the default being the query parameter with the same
+// name as the label, unless the precedence of the sources is defined.
+type labelConfig struct {
+	Name       string   `yaml:"name"`
+	QueryParam string   `yaml:"query_param"`
+	Header     string   `yaml:"header"`
+	Values     []string `yaml:"values"`
+
+	// Precedence lists the sources of the label values ("header", "query"
+	// and "static") in order of precedence.
+	Precedence []string `yaml:"precedence"`
+	// OnConflict defines how label values provided by several sources are
+	// handled: "first" (default) or "reject".
+	OnConflict string `yaml:"on_conflict"`
+}
+
+// extractLabeler returns the label extractor matching the value source.
+func (l labelConfig) extractLabeler(headerUsesListSyntax bool) (injectproxy.ExtractLabeler, error) {
+	if l.Name == "" {
+		return nil, errors.New("the label name can't be empty")
+	}
+
+	if len(l.Precedence) > 0 {
+		return l.chainEnforcer(headerUsesListSyntax)
+	}
+
+	if l.OnConflict != "" {
+		return nil, fmt.Errorf("label %q: the conflict behavior requires the precedence of the sources", l.Name)
+	}
+
+	var n int
+	for _, set := range []bool{l.QueryParam != "", l.Header != "", len(l.Values) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("label %q: at most one of the query parameter, header and values must be set", l.Name)
+	}
+
+	switch {
+	case len(l.Values) > 0:
+		return injectproxy.StaticLabelEnforcer(l.Values), nil
+	case l.Header != "":
+		return injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(l.Header), ParseListSyntax: headerUsesListSyntax}, nil
+	case l.QueryParam != "":
+		return injectproxy.HTTPFormEnforcer{ParameterName: l.QueryParam}, nil
+	}
+
+	return injectproxy.HTTPFormEnforcer{ParameterName: l.Name}, nil
+}
+
+// chainEnforcer returns the label extractor combining the sources in order of
+// precedence. The query parameter defaults to the label name.
+func (l labelConfig) chainEnforcer(headerUsesListSyntax bool) (injectproxy.ExtractLabeler, error) {
+	var (
+		sources []injectproxy.ExtractLabeler
+		seen    = map[string]struct{}{}
+	)
+	for _, src := range l.Precedence {
+		if _, found := seen[src]; found {
+			return nil, fmt.Errorf("label %q: duplicate source %q", l.Name, src)
+		}
+		seen[src] = struct{}{}
+
+		switch src {
+		case "header":
+			if l.Header == "" {
+				return nil, fmt.Errorf("label %q: the header source requires the header name", l.Name)
+			}
+			sources = append(sources, injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(l.Header), ParseListSyntax: headerUsesListSyntax})
+		case "query":
+			param := l.QueryParam
+			if param == "" {
+				param = l.Name
+			}
+			sources = append(sources, injectproxy.HTTPFormEnforcer{ParameterName: param})
+		case "static":
+			if len(l.Values) == 0 {
+				return nil, fmt.Errorf("label %q: the static source requires values", l.Name)
+			}
+			sources = append(sources, injectproxy.StaticLabelEnforcer(l.Values))
+		default:
+			return nil, fmt.Errorf("label %q: unknown value source %q, expected one of 'header', 'query' or 'static'", l.Name, src)
+		}
+	}
+
+	for src, set := range map[string]bool{"header": l.Header != "", "query": l.QueryParam != "", "static": len(l.Values) > 0} {
+		if _, found := seen[src]; set && !found {
+			return nil, fmt.Errorf("label %q: the %q source is set but missing from the precedence", l.Name, src)
+		}
+	}
+
+	onConflict := injectproxy.ChainConflictFirst
+	if l.OnConflict != "" {
+		onConflict = injectproxy.ChainConflictPolicy(l.OnConflict)
+	}
+
+	ce, err := injectproxy.NewChainEnforcer(onConflict, sources...)
+	if err != nil {
+		return nil, fmt.Errorf("label %q: %w", l.Name, err)
+	}
+
+	return ce, nil
+}
+
+type tlsConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type responseFilter struct {
+	Path   string `yaml:"path"`
+	Array  string `yaml:"array"`
+	Labels string `yaml:"labels"`
+}
+
+type passthroughRule struct {
+	Path    string   `yaml:"path"`
+	Regexp  string   `yaml:"regexp"`
+	Methods []string `yaml:"methods"`
+}
+
+type routeConfig struct {
+	// Methods overrides the HTTP methods accepted by the route.
+	Methods []string `yaml:"methods"`
+
+	// ResponseHeaders are set on the responses of the route.
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+
+	// Disabled makes the route return 404 instead of being enforced.
+	Disabled bool `yaml:"disabled"`
+
+	// Transforms modify the JSON responses of the route.
+	Transforms []responseTransform `yaml:"transforms"`
+}
+
+type responseTransform struct {
+	Action string `yaml:"action"`
+	Path   string `yaml:"path"`
+	To     string `yaml:"to"`
+	Value  string `yaml:"value"`
+}
+
+type limitsConfig struct {
+	limits `yaml:",inline"`
+
+	// Overrides maps label values to their specific limits.
+	Overrides map[string]limits `yaml:"overrides"`
+}
+
+type limits struct {
+	QueryResultLimit uint64         `yaml:"query_result_limit"`
+	MaxQueryRange    model.Duration `yaml:"max_query_range"`
+	MinQueryStep     model.Duration `yaml:"min_query_step"`
+	MaxQueryLookback model.Duration `yaml:"max_query_lookback"`
+	ClampQueryRange  bool           `yaml:"clamp_query_range"`
+}
+
+type queryPolicyConfig struct {
+	queryPolicy `yaml:",inline"`
+
+	// Overrides maps label values to their specific policy.
+	Overrides map[string]queryPolicy `yaml:"overrides"`
+}
+
+type queryPolicy struct {
+	DeniedFunctions      []string `yaml:"denied_functions"`
+	MaxTopK              int64    `yaml:"max_topk"`
+	DenyUnnamedSelectors bool     `yaml:"deny_unnamed_selectors"`
+}
+
+func (p queryPolicy) toQueryPolicy() injectproxy.QueryPolicy {
+	return injectproxy.QueryPolicy{
+		DeniedFunctions:      p.DeniedFunctions,
+		MaxTopK:              p.MaxTopK,
+		DenyUnnamedSelectors: p.DenyUnnamedSelectors,
+	}
+}
+
+type denial struct {
+	StatusCode int    `yaml:"status_code"`
+	Message    string `yaml:"message"`
+}
+
+func (l limits) toLimits() injectproxy.Limits {
+	return injectproxy.Limits{
+		QueryResultLimit: l.QueryResultLimit,
+		MaxQueryRange:    time.Duration(l.MaxQueryRange),
+		MinQueryStep:     time.Duration(l.MinQueryStep),
+		MaxQueryLookback: time.Duration(l.MaxQueryLookback),
+		ClampQueryRange:  l.ClampQueryRange,
+	}
+}
+
+func loadConfig(filename string) (*config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg config
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	return &cfg, nil
+}
+
+// loadLabelACL reads the file mapping the client identities to the label
+// values they are allowed to request.
+func loadLabelACL(filename string) (injectproxy.LabelACL, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var acl injectproxy.LabelACL
+	if err := yaml.Unmarshal(b, &acl); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	return acl, nil
+}
+
+// loadAdmins reads the file listing the identities of the administrators.
+func loadAdmins(filename string) ([]string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var admins []string
+	if err := yaml.Unmarshal(b, &admins); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	return admins, nil
+}
+
+// loadHeaderMapping loads the YAML (or JSON) file mapping the header values to
+// the label values.
+func loadHeaderMapping(filename string) (map[string][]string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var mapping map[string][]string
+	if err := yaml.Unmarshal(b, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	return mapping, nil
+}
+
+// upstreamURL returns the URL of the upstream defined either by the flag or by
+// the configuration file.
+func (c *config) upstreamURL(flag string) (*url.URL, error) {
+	upstream := flag
+	if c.Upstream != "" {
+		if flag != "" {
+			return nil, errors.New("the upstream can't be defined by both the -upstream flag and the configuration file")
+		}
+		upstream = c.Upstream
+	}
+
+	return parseUpstreamURL(upstream)
+}
+
+func parseUpstreamURL(upstream string) (*url.URL, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build parse upstream URL: %w", err)
+	}
+
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme for upstream URL %q, only 'http' and 'https' are supported", upstream)
+	}
+
+	return upstreamURL, nil
+}
+
+// enforcedLabels returns the labels defined either by the flags or by the
+// configuration file.
+func (c *config) enforcedLabels(flags []labelConfig) ([]labelConfig, error) {
+	switch {
+	case len(c.Labels) > 0 && len(flags) > 0:
+		return nil, errors.New("the labels can't be defined by both the -label flags and the configuration file")
+	case len(c.Labels) > 0:
+		return c.Labels, nil
+	case len(flags) > 0:
+		return flags, nil
+	}
+
+	return nil, errors.New("-label flag cannot be empty")
+}
+
+// certFiles returns the certificate and key files of the HTTPS listener
+// defined either by the flags or by the configuration file.
+func (c *config) certFiles(certFlag, keyFlag string) (string, string, error) {
+	certFile, keyFile := certFlag, keyFlag
+	if c.TLS != nil {
+		if certFlag != "" || keyFlag != "" {
+			return "", "", errors.New("the TLS certificate can't be defined by both the flags and the configuration file")
+		}
+		certFile, keyFile = c.TLS.CertFile, c.TLS.KeyFile
+	}
+
+	if certFile == "" || keyFile == "" {
+		return "", "", errors.New("-tls-cert-file and -tls-key-file must be set with -tls-listen-address")
+	}
+
+	return certFile, keyFile, nil
+}
+
+// blockTenants adds the blocked tenants to the deny-list. The tenants blocked
+// by the previous configuration (if any) which aren't blocked anymore are
+// removed from the deny-list. The deny-list isn't modified if any denial is
+// invalid.
+func (c *config) blockTenants(d *injectproxy.DenyList, prev *config) error {
+	valid := injectproxy.NewDenyList()
+	for lv, dn := range c.BlockedTenants {
+		if err := valid.Set(lv, injectproxy.Denial{StatusCode: dn.StatusCode, Message: dn.Message}); err != nil {
+			return fmt.Errorf("blocked tenant %q: %w", lv, err)
+		}
+	}
+
+	if prev != nil {
+		for lv := range prev.BlockedTenants {
+			if _, found := c.BlockedTenants[lv]; !found {
+				d.Delete(lv)
+			}
+		}
+	}
+
+	for lv, dn := range valid.List() {
+		if err := d.Set(lv, dn); err != nil {
+			return fmt.Errorf("blocked tenant %q: %w", lv, err)
+		}
+	}
+
+	return nil
+}
+
+// options returns the injectproxy options defined by the configuration.
+func (c *config) options() []injectproxy.Option {
+	var opts []injectproxy.Option
+
+	if c.Limits != nil {
+		overrides := make(map[string]injectproxy.Limits, len(c.Limits.Overrides))
+		for lv, l := range c.Limits.Overrides {
+			overrides[lv] = l.toLimits()
+		}
+		opts = append(opts, injectproxy.WithLimits(c.Limits.toLimits(), overrides))
+	}
+
+	if c.QueryPolicy != nil {
+		overrides := make(map[string]injectproxy.QueryPolicy, len(c.QueryPolicy.Overrides))
+		for lv, p := range c.QueryPolicy.Overrides {
+			overrides[lv] = p.toQueryPolicy()
+		}
+		opts = append(opts, injectproxy.WithQueryPolicy(c.QueryPolicy.toQueryPolicy(), overrides))
+	}
+
+	if len(c.ReadOnlyTenants) > 0 {
+		opts = append(opts, injectproxy.WithReadOnlyTenants(c.ReadOnlyTenants...))
+	}
+
+	if len(c.SilenceMatchers) > 0 {
+		opts = append(opts, injectproxy.WithSilenceMatchers(c.SilenceMatchers))
+	}
+
+	if c.Receivers != nil {
+		opts = append(opts, injectproxy.WithReceivers(c.Receivers))
+	}
+
+	if c.LabelsMatchMode != "" {
+		opts = append(opts, injectproxy.WithLabelsMatchMode(injectproxy.LabelsMatchMode(c.LabelsMatchMode)))
+	}
+
+	if len(c.ResponseHeaders) > 0 {
+		opts = append(opts, injectproxy.WithResponseHeaders(c.ResponseHeaders))
+	}
+
+	var (
+		methods    = map[string][]string{}
+		headers    = map[string]map[string]string{}
+		transforms = map[string][]injectproxy.ResponseTransform{}
+		disabled   []string
+	)
+	for path, rc := range c.Routes {
+		if rc.Disabled {
+			disabled = append(disabled, path)
+		}
+		if rc.Methods != nil {
+			methods[path] = rc.Methods
+		}
+		if len(rc.ResponseHeaders) > 0 {
+			headers[path] = rc.ResponseHeaders
+		}
+		for _, t := range rc.Transforms {
+			transforms[path] = append(transforms[path], injectproxy.ResponseTransform{
+				Action: injectproxy.TransformAction(t.Action),
+				Path:   t.Path,
+				To:     t.To,
+				Value:  t.Value,
+			})
+		}
+	}
+	if len(methods) > 0 {
+		opts = append(opts, injectproxy.WithRouteMethods(methods))
+	}
+	if len(headers) > 0 {
+		opts = append(opts, injectproxy.WithRouteResponseHeaders(headers))
+	}
+	if len(transforms) > 0 {
+		opts = append(opts, injectproxy.WithResponseTransforms(transforms))
+	}
+	if len(disabled) > 0 {
+		opts = append(opts, injectproxy.WithDisabledRoutes(disabled...))
+	}
+
+	if len(c.PassthroughRules) > 0 {
+		rules := make([]injectproxy.PassthroughRule, 0, len(c.PassthroughRules))
+		for _, r := range c.PassthroughRules {
+			rules = append(rules, injectproxy.PassthroughRule{Path: r.Path, Regexp: r.Regexp, Methods: r.Methods})
+		}
+		opts = append(opts, injectproxy.WithPassthroughRules(rules))
+	}
+
+	if len(c.ResponseFilters) > 0 {
+		filters := make([]injectproxy.ResponseFilter, 0, len(c.ResponseFilters))
+		for _, f := range c.ResponseFilters {
+			filters = append(filters, injectproxy.ResponseFilter{Path: f.Path, Array: f.Array, Labels: f.Labels})
+		}
+		opts = append(opts, injectproxy.WithResponseFilters(filters...))
+	}
+
+	return opts
+}
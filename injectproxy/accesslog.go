@@ -0,0 +1,269 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogConfig configures the access log of the proxy.
+type AccessLogConfig struct {
+	// SampleRate logs one successful request out of SampleRate. The failed
+	// requests (status code >= 400) are always logged. Zero and one log all
+	// the requests.
+	SampleRate uint64
+	// ExcludedPaths are never logged (e.g. "/healthz").
+	ExcludedPaths []string
+}
+
+// WithAccessLog logs the requests handled by the proxy.
+func WithAccessLog(cfg AccessLogConfig) Option {
+	return optionFunc(func(o *options) {
+		o.accessLog = &cfg
+	})
+}
+
+type accessLogger struct {
+	logger     *slog.Logger
+	sampleRate uint64
+	excluded   map[string]struct{}
+	requests   atomic.Uint64
+}
+
+func newAccessLogger(cfg *AccessLogConfig, logger *slog.Logger) *accessLogger {
+	l := &accessLogger{
+		logger:     logger,
+		sampleRate: max(cfg.SampleRate, 1),
+		excluded:   make(map[string]struct{}, len(cfg.ExcludedPaths)),
+	}
+	for _, p := range cfg.ExcludedPaths {
+		l.excluded[p] = struct{}{}
+	}
+
+	return l
+}
+
+// accessLogEntry collects the details of the request which are only known by
+// the route handlers.
+type accessLogEntry struct {
+	labelValues []string
+	// query and match are the original "query" and "match[]" parameters.
+	query string
+	match []string
+	// rewrittenQuery and rewrittenMatch are the parameters sent to the
+	// upstream.
+	rewrittenQuery string
+	rewrittenMatch []string
+	// forwarded is true when the request was sent to the upstream.
+	forwarded      bool
+	upstreamStatus int
+	// enforced is true when the request was handled by an enforced route.
+	enforced bool
+	// adminIdentity is the identity of the administrator when the request
+	// bypassed the enforcement.
+	adminIdentity string
+}
+
+// statusWriter is a http.ResponseWriter which records the status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack implements the http.Hijacker interface. The protocol upgrades (e.g.
+// WebSocket) hijack the connection before writing the "101 Switching
+// Protocols" response directly to it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, brw, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter (used by
+// http.ResponseController).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sampled returns true if the successful request should be logged.
+func (l *accessLogger) sampled() bool {
+	return (l.requests.Add(1)-1)%l.sampleRate == 0
+}
+
+func (l *accessLogger) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, found := l.excluded[req.URL.Path]; found {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		var (
+			start = time.Now()
+			sw    = &statusWriter{ResponseWriter: w}
+			entry = &accessLogEntry{}
+		)
+		next.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), keyAccessLogEntry, entry)))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		if sw.status < http.StatusBadRequest && !l.sampled() {
+			return
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("label_values", strings.Join(entry.labelValues, ",")),
+		}
+		if entry.forwarded {
+			attrs = append(attrs, slog.String("decision", "allow"), slog.Int("upstream_status", entry.upstreamStatus))
+		} else {
+			attrs = append(attrs, slog.String("decision", "deny"))
+		}
+		if entry.query != "" || entry.rewrittenQuery != "" {
+			attrs = append(attrs, slog.String("query", entry.query), slog.String("rewritten_query", entry.rewrittenQuery))
+		}
+		if len(entry.match) > 0 || len(entry.rewrittenMatch) > 0 {
+			attrs = append(attrs, slog.Any("match", entry.match), slog.Any("rewritten_match", entry.rewrittenMatch))
+		}
+
+		l.logger.LogAttrs(req.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
+
+// recordsRequests returns true if the details of the requests are recorded
+// for the access log or the audit log.
+func (r *routes) recordsRequests() bool {
+	return r.accessLog != nil || r.auditLogger != nil
+}
+
+// requestParams returns the URL and form-encoded body parameters of the
+// request. The body is read and restored so that the next handlers can still
+// consume it.
+func requestParams(req *http.Request) url.Values {
+	params := req.URL.Query()
+
+	if req.Method != http.MethodPost || req.Body == nil || !isFormRequest(req) {
+		return params
+	}
+
+	if req.PostForm != nil {
+		for k, vs := range req.PostForm {
+			params[k] = append(params[k], vs...)
+		}
+		return params
+	}
+
+	b, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return params
+	}
+
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		return params
+	}
+	for k, vs := range form {
+		params[k] = append(params[k], vs...)
+	}
+
+	return params
+}
+
+// isFormRequest returns true if the request body is form-encoded.
+func isFormRequest(req *http.Request) bool {
+	ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return ct == "application/x-www-form-urlencoded"
+}
+
+// logUpstreamRequest records the parameters of the request sent to the
+// upstream in the access log entry.
+func logUpstreamRequest(req *http.Request) {
+	entry, ok := req.Context().Value(keyAccessLogEntry).(*accessLogEntry)
+	if !ok {
+		return
+	}
+
+	params := requestParams(req)
+	entry.forwarded = true
+	entry.rewrittenQuery = params.Get(queryParam)
+	entry.rewrittenMatch = params[matchersParam]
+}
+
+// logUpstreamResponse records the status code of the upstream response in the
+// access log entry.
+func logUpstreamResponse(resp *http.Response) {
+	if entry, ok := resp.Request.Context().Value(keyAccessLogEntry).(*accessLogEntry); ok {
+		entry.upstreamStatus = resp.StatusCode
+	}
+}
+
+// logLabelValues records the label values and the original parameters of
+// the request in the access log entry.
+func (r *routes) logLabelValues(next http.HandlerFunc) http.HandlerFunc {
+	if !r.recordsRequests() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if entry, ok := req.Context().Value(keyAccessLogEntry).(*accessLogEntry); ok {
+			entry.labelValues = MustLabelValues(req.Context())
+
+			params := requestParams(req)
+			entry.query = params.Get(queryParam)
+			entry.match = params[matchersParam]
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestLogger returns a logger writing to buf without the time and level
+// attributes.
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+func TestAccessLog(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		cfg  AccessLogConfig
+		reqs []string
+
+		expLines []string
+	}{
+		{
+			name: "all requests",
+			reqs: []string{
+				"/api/v1/query?query=up&namespace=default",
+				"/api/v1/query?query=up&namespace=default",
+				"/healthz",
+			},
+			expLines: []string{
+				`method=GET path=/api/v1/query status=200`,
+				`method=GET path=/api/v1/query status=200`,
+				`method=GET path=/healthz status=200`,
+			},
+		},
+		{
+			name: "excluded paths",
+			cfg:  AccessLogConfig{ExcludedPaths: []string{"/healthz"}},
+			reqs: []string{
+				"/healthz",
+				"/api/v1/query?query=up&namespace=default",
+			},
+			expLines: []string{
+				`method=GET path=/api/v1/query status=200`,
+			},
+		},
+		{
+			name: "sampled successful requests",
+			cfg:  AccessLogConfig{SampleRate: 3},
+			reqs: []string{
+				"/api/v1/query?query=up&namespace=default",
+				"/api/v1/query?query=up&namespace=default",
+				"/api/v1/query?query=up&namespace=default",
+				"/api/v1/query?query=up",
+				"/api/v1/query?query=up&namespace=default",
+				"/api/v1/foo",
+			},
+			expLines: []string{
+				`method=GET path=/api/v1/query status=200`,
+				`method=GET path=/api/v1/query status=400`,
+				`method=GET path=/api/v1/query status=200`,
+				`method=GET path=/api/v1/foo status=404`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAccessLog(tc.cfg), WithLogger(newTestLogger(&buf)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, p := range tc.reqs {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+p, nil))
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != len(tc.expLines) {
+				t.Fatalf("expected %d lines, got %d:\n%s", len(tc.expLines), len(lines), buf.String())
+			}
+
+			for i, l := range lines {
+				if !strings.HasPrefix(l, "msg=access "+tc.expLines[i]) {
+					t.Fatalf("expected line %d to start with %q, got %q", i, tc.expLines[i], l)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessLogLabelValues(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace=~"a|b"}`))
+	defer m.Close()
+
+	var buf bytes.Buffer
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAccessLog(AccessLogConfig{}), WithLogger(newTestLogger(&buf)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=a&namespace=b", nil))
+
+	if !strings.Contains(buf.String(), `label_values=a,b`) {
+		t.Fatalf("expected label values in the access log, got %q", buf.String())
+	}
+}
+
+func TestAccessLogDecision(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		body   string
+
+		expAttrs []string
+	}{
+		{
+			name: "allowed query",
+			url:  "/api/v1/query?query=up&namespace=a",
+			expAttrs: []string{
+				`status=503`,
+				`decision=allow upstream_status=503`,
+				`query=up rewritten_query="up{namespace=\"a\"}"`,
+			},
+		},
+		{
+			name:   "allowed POST query",
+			method: http.MethodPost,
+			url:    "/api/v1/query?namespace=a",
+			body:   "query=up",
+			expAttrs: []string{
+				`decision=allow upstream_status=503`,
+				`query=up rewritten_query="up{namespace=\"a\"}"`,
+			},
+		},
+		{
+			name: "allowed series",
+			url:  "/api/v1/series?match[]=up&namespace=a",
+			expAttrs: []string{
+				`decision=allow upstream_status=503`,
+				`match=[up] rewritten_match="[{__name__=\"up\",namespace=\"a\"}]"`,
+			},
+		},
+		{
+			name: "denied query",
+			url:  "/api/v1/query?query=up",
+			expAttrs: []string{
+				`status=400`,
+				`decision=deny`,
+			},
+		},
+		{
+			name: "invalid query",
+			url:  "/api/v1/query?query=up{&namespace=a",
+			expAttrs: []string{
+				`status=400`,
+				`decision=deny query=up{ rewritten_query=""`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAccessLog(AccessLogConfig{}), WithLogger(newTestLogger(&buf)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			for _, a := range tc.expAttrs {
+				if !strings.Contains(buf.String(), a) {
+					t.Fatalf("expected %q in the access log, got %q", a, buf.String())
+				}
+			}
+		})
+	}
+}
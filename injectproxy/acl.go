@@ -0,0 +1,269 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Identifier returns the identity of the client which sent the request.
+type Identifier interface {
+	Identify(req *http.Request) (string, error)
+}
+
+// HeaderIdentifier reads the identity from an HTTP header (e.g. set by an
+// authenticating gateway).
+type HeaderIdentifier struct {
+	Name string
+}
+
+// Identify implements the Identifier interface.
+func (hi HeaderIdentifier) Identify(req *http.Request) (string, error) {
+	id := req.Header.Get(hi.Name)
+	if id == "" {
+		return "", fmt.Errorf("missing HTTP header %q", hi.Name)
+	}
+
+	return id, nil
+}
+
+// JWTSubjectIdentifier reads the identity from the subject ("sub" claim) of
+// the bearer token found in an HTTP header. The signature of the token isn't
+// verified: the token must be validated before reaching the proxy (e.g. by an
+// authenticating gateway).
+type JWTSubjectIdentifier struct {
+	// Header is the name of the HTTP header holding the token, the
+	// Authorization header is used if empty.
+	Header string
+}
+
+// Identify implements the Identifier interface.
+func (ji JWTSubjectIdentifier) Identify(req *http.Request) (string, error) {
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := decodeTokenClaims(req, ji.Header, nil, &claims); err != nil {
+		return "", err
+	}
+
+	if claims.Subject == "" {
+		return "", errors.New("missing subject in the token")
+	}
+
+	return claims.Subject, nil
+}
+
+// JWTClaimIdentifier reads the identity from a claim (e.g. "role") of the
+// bearer token found in an HTTP header. The claim must be a string or an
+// array of strings. When Key is set, the tokens must be signed with HS256 and
+// the key, and the expired tokens are rejected. Otherwise, as for
+// JWTSubjectIdentifier, the signature of the token isn't verified.
+type JWTClaimIdentifier struct {
+	// Header is the name of the HTTP header holding the token, the
+	// Authorization header is used if empty.
+	Header string
+	Claim  string
+	// Key is the HMAC key verifying the signature of the tokens.
+	Key []byte
+}
+
+// Identify implements the Identifier interface. It fails if the claim holds
+// more than one value.
+func (ji JWTClaimIdentifier) Identify(req *http.Request) (string, error) {
+	ids, err := ji.identities(req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) != 1 {
+		return "", fmt.Errorf("expected a single value for the claim %q, got %d", ji.Claim, len(ids))
+	}
+
+	return ids[0], nil
+}
+
+// identities returns all the values of the claim.
+func (ji JWTClaimIdentifier) identities(req *http.Request) ([]string, error) {
+	var claims map[string]json.RawMessage
+	if err := decodeTokenClaims(req, ji.Header, ji.Key, &claims); err != nil {
+		return nil, err
+	}
+
+	if exp, found := claims["exp"]; found && len(ji.Key) > 0 {
+		var t float64
+		if err := json.Unmarshal(exp, &t); err != nil {
+			return nil, errors.New("malformed expiration time in the token")
+		}
+		if time.Now().After(time.Unix(int64(t), 0)) {
+			return nil, errors.New("expired token")
+		}
+	}
+
+	raw, found := claims[ji.Claim]
+	if !found {
+		return nil, fmt.Errorf("missing claim %q in the token", ji.Claim)
+	}
+
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return removeEmptyValues([]string{id}), nil
+	}
+
+	var ids []string
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return nil, fmt.Errorf("claim %q isn't a string nor an array of strings", ji.Claim)
+	}
+
+	return removeEmptyValues(ids), nil
+}
+
+// decodeTokenClaims decodes the claims of the bearer token found in the given
+// HTTP header (or in the Authorization header if empty). If key isn't empty,
+// the token must be signed with HS256 and the key.
+func decodeTokenClaims(req *http.Request, name string, key []byte, claims any) error {
+	if name == "" {
+		name = "Authorization"
+	}
+
+	token := req.Header.Get(name)
+	if prefix, rest, found := strings.Cut(token, " "); found && strings.EqualFold(prefix, "Bearer") {
+		token = rest
+	}
+	if token == "" {
+		return fmt.Errorf("missing token in the HTTP header %q", name)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	if len(key) > 0 {
+		if err := verifyTokenSignature(parts, key); err != nil {
+			return err
+		}
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+
+	if err := json.Unmarshal(b, claims); err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+
+	return nil
+}
+
+// verifyTokenSignature verifies the HS256 signature of the token's parts.
+func verifyTokenSignature(parts []string, key []byte) error {
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+	// The algorithm is fixed so that the clients can't downgrade it (e.g.
+	// to "none").
+	if header.Algorithm != "HS256" {
+		return fmt.Errorf("unsupported token algorithm %q", header.Algorithm)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("invalid token signature")
+	}
+
+	return nil
+}
+
+// ClientCertificateIdentifier reads the identity from the common name of the
+// verified certificate of the TLS client.
+type ClientCertificateIdentifier struct{}
+
+// Identify implements the Identifier interface.
+func (ClientCertificateIdentifier) Identify(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", errors.New("missing verified client certificate")
+	}
+
+	cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return "", errors.New("no common name in the client certificate")
+	}
+
+	return cn, nil
+}
+
+// LabelACL maps the client identities to the label values they are allowed
+// to request.
+type LabelACL map[string][]string
+
+// WithLabelACL restricts the label values which the clients can request: the
+// requests for label values which aren't allowed for the client's identity
+// are rejected with 403. The ACL applies to the proxy's label only (with the
+// regex match, the expression itself must be allowed).
+func WithLabelACL(id Identifier, acl LabelACL) Option {
+	return optionFunc(func(o *options) {
+		o.aclIdentifier = id
+		o.acl = acl
+	})
+}
+
+// enforceACL rejects the requests for label values which aren't allowed for
+// the client's identity.
+func (r *routes) enforceACL(next http.HandlerFunc) http.HandlerFunc {
+	if r.aclIdentifier == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := r.aclIdentifier.Identify(req)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		allowed := r.acl[id]
+		for _, v := range MustLabelValues(req.Context()) {
+			if !slices.Contains(allowed, v) {
+				prometheusAPIError(w, fmt.Sprintf("label value %q isn't allowed", v), http.StatusForbidden)
+				return
+			}
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func jwtWithPayload(payload string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(payload)) + ".sig"
+}
+
+func TestLabelACL(t *testing.T) {
+	acl := LabelACL{
+		"alice": {"ns1", "ns2"},
+		"bob":   {"ns3"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		identifier Identifier
+		url        string
+		headers    map[string]string
+		state      *tls.ConnectionState
+
+		expCode int
+	}{
+		{
+			name:       "header identity with allowed value",
+			identifier: HeaderIdentifier{Name: "X-User"},
+			url:        "/api/v1/query?query=up&namespace=ns1",
+			headers:    map[string]string{"X-User": "alice"},
+			expCode:    http.StatusOK,
+		},
+		{
+			name:       "header identity with allowed values",
+			identifier: HeaderIdentifier{Name: "X-User"},
+			url:        "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			headers:    map[string]string{"X-User": "alice"},
+			expCode:    http.StatusOK,
+		},
+		{
+			name:       "header identity with forbidden value",
+			identifier: HeaderIdentifier{Name: "X-User"},
+			url:        "/api/v1/query?query=up&namespace=ns1&namespace=ns3",
+			headers:    map[string]string{"X-User": "alice"},
+			expCode:    http.StatusForbidden,
+		},
+		{
+			name:       "unknown identity",
+			identifier: HeaderIdentifier{Name: "X-User"},
+			url:        "/api/v1/query?query=up&namespace=ns1",
+			headers:    map[string]string{"X-User": "eve"},
+			expCode:    http.StatusForbidden,
+		},
+		{
+			name:       "missing header",
+			identifier: HeaderIdentifier{Name: "X-User"},
+			url:        "/api/v1/query?query=up&namespace=ns1",
+			expCode:    http.StatusUnauthorized,
+		},
+		{
+			name:       "JWT subject",
+			identifier: JWTSubjectIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns3",
+			headers:    map[string]string{"Authorization": "Bearer " + jwtWithPayload(`{"sub":"bob"}`)},
+			expCode:    http.StatusOK,
+		},
+		{
+			name:       "JWT subject with forbidden value",
+			identifier: JWTSubjectIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns1",
+			headers:    map[string]string{"Authorization": "Bearer " + jwtWithPayload(`{"sub":"bob"}`)},
+			expCode:    http.StatusForbidden,
+		},
+		{
+			name:       "JWT subject in custom header",
+			identifier: JWTSubjectIdentifier{Header: "X-Access-Token"},
+			url:        "/api/v1/query?query=up&namespace=ns3",
+			headers:    map[string]string{"X-Access-Token": jwtWithPayload(`{"sub":"bob"}`)},
+			expCode:    http.StatusOK,
+		},
+		{
+			name:       "JWT without subject",
+			identifier: JWTSubjectIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns3",
+			headers:    map[string]string{"Authorization": "Bearer " + jwtWithPayload(`{"iss":"bob"}`)},
+			expCode:    http.StatusUnauthorized,
+		},
+		{
+			name:       "malformed JWT",
+			identifier: JWTSubjectIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns3",
+			headers:    map[string]string{"Authorization": "Bearer foo"},
+			expCode:    http.StatusUnauthorized,
+		},
+		{
+			name:       "client certificate",
+			identifier: ClientCertificateIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns2",
+			state: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}},
+			},
+			expCode: http.StatusOK,
+		},
+		{
+			name:       "missing client certificate",
+			identifier: ClientCertificateIdentifier{},
+			url:        "/api/v1/query?query=up&namespace=ns2",
+			expCode:    http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithLabelACL(tc.identifier, acl),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req.TLS = tc.state
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+)
+
+const deleteSeriesPath = "/api/v1/admin/tsdb/delete_series"
+
+// adminEndpoints lists the TSDB admin endpoints which aren't scoped to a
+// tenant. They can be exposed with WithAdminAPIs.
+var adminEndpoints = []string{
+	"/api/v1/admin/tsdb/clean_tombstones",
+	"/api/v1/admin/tsdb/snapshot",
+}
+
+// WithAdminAPIs enables proxying to the /api/v1/admin/tsdb/clean_tombstones
+// and /api/v1/admin/tsdb/snapshot endpoints (without enforcement since they
+// act on the whole TSDB). If not set, "403 Forbidden" will be returned for
+// these endpoints. The /api/v1/admin/tsdb/delete_series endpoint is always
+// enforced.
+func WithAdminAPIs() Option {
+	return optionFunc(func(o *options) {
+		o.adminAPIs = true
+	})
+}
+
+// deleteSeries enforces the label matchers on the selectors of the series
+// to delete. Unlike the other matchers endpoints, the selectors are required
+// so that a request without selector doesn't delete all the series of the
+// tenant.
+func (r *routes) deleteSeries(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Form[matchersParam]) == 0 {
+		prometheusAPIError(w, "no match[] parameter provided", http.StatusBadRequest)
+		return
+	}
+
+	r.matcher(w, req)
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDeleteSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		method  string
+		labelv  []string
+		matches []string
+		opts    []Option
+
+		expCode  int
+		expMatch []string
+	}{
+		{
+			name:     "single selector",
+			method:   http.MethodPost,
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",namespace="default"}`},
+		},
+		{
+			name:     "many selectors with multiple label values",
+			method:   http.MethodPost,
+			labelv:   []string{"default", "something"},
+			matches:  []string{`up`, `{namespace="other"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{__name__="up",namespace=~"default|something"}`, `{namespace="other",namespace=~"default|something"}`},
+		},
+		{
+			name:    "missing selector",
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing label value",
+			method:  http.MethodPost,
+			matches: []string{`{job="prometheus"}`},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "PUT method",
+			method:  http.MethodPut,
+			labelv:  []string{"default"},
+			matches: []string{`{job="prometheus"}`},
+			expCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "GET method",
+			method:  http.MethodGet,
+			labelv:  []string{"default"},
+			matches: []string{`{job="prometheus"}`},
+			expCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "read-only label value",
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			matches: []string{`{job="prometheus"}`},
+			opts:    []Option{WithReadOnlyTenants("default")},
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(
+				checkFormParameterAbsent(
+					proxyLabel,
+					checkFormHandler(matchersParam, tc.expMatch...),
+				),
+			)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, m := range tc.matches {
+				q.Add(matchersParam, m)
+			}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/admin/tsdb/delete_series", strings.NewReader(q.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminAPIs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path string
+		opts []Option
+
+		expCode int
+	}{
+		{
+			name:    "clean tombstones",
+			path:    "/api/v1/admin/tsdb/clean_tombstones",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "snapshot",
+			path:    "/api/v1/admin/tsdb/snapshot",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "clean tombstones with admin APIs",
+			path:    "/api/v1/admin/tsdb/clean_tombstones",
+			opts:    []Option{WithAdminAPIs()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "snapshot with admin APIs",
+			path:    "/api/v1/admin/tsdb/snapshot",
+			opts:    []Option{WithAdminAPIs()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "snapshot with admin APIs and read-only label value",
+			path:    "/api/v1/admin/tsdb/snapshot",
+			opts:    []Option{WithAdminAPIs(), WithReadOnlyTenants("default")},
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.path+"?namespace=default", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
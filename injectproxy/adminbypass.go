@@ -0,0 +1,120 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// AdminBypass configures the administrators whose requests skip the
+// enforcement: they are forwarded to the upstream without modification,
+// whatever the path.
+type AdminBypass struct {
+	// Identifier returns the identity of the client. It must only return
+	// verified identities (e.g. ClientCertificateIdentifier,
+	// SecretHeaderIdentifier or JWTClaimIdentifier with a key).
+	Identifier Identifier
+	// Admins lists the identities of the administrators.
+	Admins []string
+}
+
+// WithAdminBypass forwards the requests of the administrators to the upstream
+// without enforcement. The bypassed requests are logged and recorded in the
+// audit log (if any) with the "bypass" decision.
+func WithAdminBypass(cfg AdminBypass) Option {
+	return optionFunc(func(o *options) {
+		o.adminBypass = &cfg
+	})
+}
+
+// SecretHeaderIdentifier reads the identity from an HTTP header holding a
+// shared secret. The header is never forwarded to the upstream and the secret
+// isn't logged.
+type SecretHeaderIdentifier struct {
+	Name string
+}
+
+// Identify implements the Identifier interface.
+func (si SecretHeaderIdentifier) Identify(req *http.Request) (string, error) {
+	return HeaderIdentifier(si).Identify(req)
+}
+
+// adminIdentity returns the identity of the client if it is an
+// administrator.
+func (r *routes) adminIdentity(req *http.Request) (string, bool) {
+	var (
+		ids []string
+		err error
+	)
+	if ji, ok := r.adminBypass.Identifier.(JWTClaimIdentifier); ok {
+		// Any value of the claim (e.g. one of the roles) matches.
+		ids, err = ji.identities(req)
+	} else {
+		var id string
+		id, err = r.adminBypass.Identifier.Identify(req)
+		ids = []string{id}
+	}
+	if err != nil {
+		return "", false
+	}
+
+	for _, id := range ids {
+		for _, admin := range r.adminBypass.Admins {
+			if subtle.ConstantTimeCompare([]byte(id), []byte(admin)) == 1 {
+				if si, ok := r.adminBypass.Identifier.(SecretHeaderIdentifier); ok {
+					return "header:" + si.Name, true
+				}
+				return id, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// bypassAdmins forwards the requests of the administrators to the upstream
+// without enforcement.
+func (r *routes) bypassAdmins(next http.Handler) http.Handler {
+	if r.adminBypass == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, admin := r.adminIdentity(req)
+		if si, ok := r.adminBypass.Identifier.(SecretHeaderIdentifier); ok {
+			req.Header.Del(si.Name)
+		}
+
+		if !admin {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		r.logger.Info("Bypassing the enforcement for an administrator", "identity", id, "method", req.Method, "path", req.URL.Path)
+		if entry, ok := req.Context().Value(keyAccessLogEntry).(*accessLogEntry); ok {
+			entry.adminIdentity = id
+		}
+
+		r.passthrough(w, req.WithContext(context.WithValue(req.Context(), keyAdminBypass, true)))
+	})
+}
+
+// bypassed returns true if the request of an administrator skipped the
+// enforcement.
+func bypassed(req *http.Request) bool {
+	v, _ := req.Context().Value(keyAdminBypass).(bool)
+	return v
+}
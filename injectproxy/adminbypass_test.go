@@ -0,0 +1,241 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signedJWT returns a token signed with HS256 and the key.
+func signedJWT(key []byte, payload string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	unsigned := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(payload))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + enc(mac.Sum(nil))
+}
+
+func TestAdminBypass(t *testing.T) {
+	jwtKey := []byte("0123456789abcdef")
+
+	const (
+		secretHeader = "X-Admin-Token"
+		rules        = `{"status":"success","data":{"groups":[{"name":"g","file":"f","rules":[{"name":"r","labels":{"namespace":"ns2"},"type":"recording"}]}]}}`
+	)
+	certState := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     AdminBypass
+		url     string
+		headers map[string]string
+		state   *tls.ConnectionState
+
+		expCode     int
+		expQuery    string
+		expBody     string
+		expDecision string
+		expIdentity string
+	}{
+		{
+			name:        "secret header",
+			cfg:         AdminBypass{Identifier: SecretHeaderIdentifier{Name: secretHeader}, Admins: []string{"s3cr3t"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{secretHeader: "s3cr3t"},
+			expCode:     http.StatusOK,
+			expQuery:    "up",
+			expDecision: "bypass",
+			expIdentity: "header:" + secretHeader,
+		},
+		{
+			name:        "wrong secret header",
+			cfg:         AdminBypass{Identifier: SecretHeaderIdentifier{Name: secretHeader}, Admins: []string{"s3cr3t"}},
+			url:         "/api/v1/query?query=up&namespace=ns1",
+			headers:     map[string]string{secretHeader: "guess"},
+			expCode:     http.StatusOK,
+			expQuery:    `up{namespace="ns1"}`,
+			expDecision: "allow",
+		},
+		{
+			name:        "forbidden path",
+			cfg:         AdminBypass{Identifier: SecretHeaderIdentifier{Name: secretHeader}, Admins: []string{"s3cr3t"}},
+			url:         "/api/v1/status/config",
+			headers:     map[string]string{secretHeader: "s3cr3t"},
+			expCode:     http.StatusOK,
+			expDecision: "bypass",
+			expIdentity: "header:" + secretHeader,
+		},
+		{
+			name:        "unfiltered response",
+			cfg:         AdminBypass{Identifier: SecretHeaderIdentifier{Name: secretHeader}, Admins: []string{"s3cr3t"}},
+			url:         "/api/v1/rules",
+			headers:     map[string]string{secretHeader: "s3cr3t"},
+			expCode:     http.StatusOK,
+			expBody:     rules,
+			expDecision: "bypass",
+			expIdentity: "header:" + secretHeader,
+		},
+		{
+			name:        "JWT role claim",
+			cfg:         AdminBypass{Identifier: JWTClaimIdentifier{Claim: "roles", Key: jwtKey}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{"Authorization": "Bearer " + signedJWT(jwtKey, `{"sub":"alice","roles":["viewer","admin"]}`)},
+			expCode:     http.StatusOK,
+			expQuery:    "up",
+			expDecision: "bypass",
+			expIdentity: "admin",
+		},
+		{
+			name:        "JWT without admin role",
+			cfg:         AdminBypass{Identifier: JWTClaimIdentifier{Claim: "roles", Key: jwtKey}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{"Authorization": "Bearer " + signedJWT(jwtKey, `{"sub":"bob","roles":"viewer"}`)},
+			expCode:     http.StatusBadRequest,
+			expDecision: "deny",
+		},
+		{
+			name:        "unsigned JWT",
+			cfg:         AdminBypass{Identifier: JWTClaimIdentifier{Claim: "roles", Key: jwtKey}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{"Authorization": "Bearer " + jwtWithPayload(`{"sub":"mallory","roles":["admin"]}`)},
+			expCode:     http.StatusBadRequest,
+			expDecision: "deny",
+		},
+		{
+			name:        "JWT signed with another key",
+			cfg:         AdminBypass{Identifier: JWTClaimIdentifier{Claim: "roles", Key: jwtKey}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{"Authorization": "Bearer " + signedJWT([]byte("guess"), `{"sub":"mallory","roles":["admin"]}`)},
+			expCode:     http.StatusBadRequest,
+			expDecision: "deny",
+		},
+		{
+			name:        "expired JWT",
+			cfg:         AdminBypass{Identifier: JWTClaimIdentifier{Claim: "roles", Key: jwtKey}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			headers:     map[string]string{"Authorization": "Bearer " + signedJWT(jwtKey, `{"sub":"alice","roles":["admin"],"exp":1000000000}`)},
+			expCode:     http.StatusBadRequest,
+			expDecision: "deny",
+		},
+		{
+			name:        "client certificate",
+			cfg:         AdminBypass{Identifier: ClientCertificateIdentifier{}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			state:       certState("admin"),
+			expCode:     http.StatusOK,
+			expQuery:    "up",
+			expDecision: "bypass",
+			expIdentity: "admin",
+		},
+		{
+			name:        "other client certificate",
+			cfg:         AdminBypass{Identifier: ClientCertificateIdentifier{}, Admins: []string{"admin"}},
+			url:         "/api/v1/query?query=up",
+			state:       certState("ns1"),
+			expCode:     http.StatusBadRequest,
+			expDecision: "deny",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get(secretHeader); got != "" {
+					prometheusAPIError(w, "unexpected secret header", http.StatusInternalServerError)
+					return
+				}
+				if got := req.URL.Query().Get(queryParam); got != tc.expQuery {
+					prometheusAPIError(w, fmt.Sprintf("expected query %q, got %q", tc.expQuery, got), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if req.URL.Path == "/api/v1/rules" {
+					w.Write([]byte(rules))
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var sink bufferAuditSink
+			a := newTestAuditLogger(t, &sink)
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithAdminBypass(tc.cfg),
+				WithAuditLogger(a),
+				WithLogger(newTestLogger(&bytes.Buffer{})),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req.TLS = tc.state
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expBody != "" && w.Body.String() != tc.expBody {
+				t.Fatalf("expected body %s, got %s", tc.expBody, w.Body.String())
+			}
+
+			// Wait for the record to be written.
+			a.Close()
+
+			var rec AuditRecord
+			if err := json.Unmarshal(sink.Bytes(), &rec); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Decision != tc.expDecision || rec.Identity != tc.expIdentity {
+				t.Fatalf("expected decision %q and identity %q, got %q and %q", tc.expDecision, tc.expIdentity, rec.Decision, rec.Identity)
+			}
+			if strings.Contains(sink.String(), "s3cr3t") {
+				t.Fatal("the secret is in the audit log")
+			}
+		})
+	}
+}
+
+func TestInvalidAdminBypass(t *testing.T) {
+	for _, cfg := range []AdminBypass{
+		{Admins: []string{"admin"}},
+		{Identifier: ClientCertificateIdentifier{}},
+		// The signature of the tokens must be verified.
+		{Identifier: JWTClaimIdentifier{Claim: "roles"}, Admins: []string{"admin"}},
+		{Identifier: JWTSubjectIdentifier{}, Admins: []string{"admin"}},
+		{Identifier: HeaderIdentifier{Name: "X-User"}, Admins: []string{"admin"}},
+	} {
+		if _, err := NewRoutes(nil, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithAdminBypass(cfg)); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
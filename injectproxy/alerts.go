@@ -13,14 +13,150 @@
 
 package injectproxy
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/alertmanager/pkg/labels"
+)
 
 // alerts proxies HTTP requests to the Alertmanager /api/v2/alerts endpoint.
 func (r *routes) alerts(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		r.enforceFilterParameter(w, req)
+	case "POST":
+		r.postAlerts(w, req)
 	default:
 		http.NotFound(w, req)
 	}
 }
+
+func (r *routes) postAlerts(w http.ResponseWriter, req *http.Request) {
+	enforced, err := r.enforcedSilenceMatchers(req.Context())
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var alerts models.PostableAlerts
+	if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := EnforceAlerts(alerts, enforced...); err != nil {
+		prometheusAPIError(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(alerts); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(&buf)
+	req.URL.RawQuery = ""
+	req.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	req.ContentLength = int64(buf.Len())
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// EnforceAlerts enforces the label matchers on the label sets of the alerts.
+// The label is added when the alert doesn't have it and the matcher selects
+// a single value. Otherwise the alert's label value must match.
+func EnforceAlerts(alerts models.PostableAlerts, enforced ...*labels.Matcher) error {
+	for i, a := range alerts {
+		if a == nil {
+			return fmt.Errorf("alert %d: empty alert", i)
+		}
+
+		if a.Labels == nil {
+			a.Labels = models.LabelSet{}
+		}
+
+		for _, m := range enforced {
+			v, found := a.Labels[m.Name]
+			if !found {
+				if m.Type != labels.MatchEqual {
+					return fmt.Errorf("alert %d: missing %q label", i, m.Name)
+				}
+				a.Labels[m.Name] = m.Value
+				continue
+			}
+
+			if !m.Matches(v) {
+				return fmt.Errorf("alert %d: label %q should match %s, got %q", i, m.Name, m.String(), v)
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterAlertGroups is a response modifier which removes the alerts not
+// matching the enforced labels from the alert groups of Alertmanager. The
+// groups left without alerts are removed. It ensures that the response is
+// restricted even when the upstream ignores the filter parameter.
+func (r *routes) filterAlertGroups(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// Pass non-200 responses as-is.
+		return nil
+	}
+
+	raw, err := readJSONBody(resp)
+	if err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	m, err := r.newLabelsMatcher(MustLabelValues(resp.Request.Context()), resp.Request)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+	// The Alertmanager endpoints always require all the labels, whatever
+	// the match mode.
+	m.any = false
+
+	var decodeErr error
+	b, err := filterJSONArray(raw, nil, func(group *rawObject) bool {
+		alerts, found := group.values["alerts"]
+		if !found {
+			return false
+		}
+
+		filtered, err := filterJSONArray(alerts, nil, func(alert *rawObject) bool {
+			return m.matches(labelsAt(alert, []string{"labels"}))
+		})
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		group.setRaw("alerts", filtered)
+
+		var kept []json.RawMessage
+		if err := json.Unmarshal(filtered, &kept); err != nil {
+			decodeErr = err
+			return false
+		}
+
+		return len(kept) > 0
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+
+	replaceBody(resp, append(b, '\n'))
+
+	return nil
+}
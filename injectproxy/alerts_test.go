@@ -14,12 +14,17 @@
 package injectproxy
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/prometheus/model/labels"
 )
 
 func TestGetAlerts(t *testing.T) {
@@ -130,3 +135,125 @@ func TestGetAlerts(t *testing.T) {
 		})
 	}
 }
+
+// checkAlertsHandler verifies that the posted alerts have the expected label
+// sets.
+func checkAlertsHandler(exp ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alerts models.PostableAlerts
+		if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(alerts) != len(exp) {
+			http.Error(w, fmt.Sprintf("expected %d alerts, got %d", len(exp), len(alerts)), http.StatusBadRequest)
+			return
+		}
+
+		for i, a := range alerts {
+			if got := labels.FromMap(a.Labels).String(); got != exp[i] {
+				http.Error(w, fmt.Sprintf("expected alert %d to have labels %s, got %s", i, exp[i], got), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Write(okResponse)
+	})
+}
+
+func TestPostAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		opts   []Option
+		body   string
+
+		expCode int
+		expBody []string
+	}{
+		{
+			name:    "missing label",
+			labelv:  []string{"default"},
+			body:    `[{"labels":{"alertname":"foo"}},{"labels":{"alertname":"bar"}}]`,
+			expCode: http.StatusOK,
+			expBody: []string{`{alertname="foo", namespace="default"}`, `{alertname="bar", namespace="default"}`},
+		},
+		{
+			name:    "matching label",
+			labelv:  []string{"default"},
+			body:    `[{"labels":{"alertname":"foo","namespace":"default"}}]`,
+			expCode: http.StatusOK,
+			expBody: []string{`{alertname="foo", namespace="default"}`},
+		},
+		{
+			name:    "conflicting label",
+			labelv:  []string{"default"},
+			body:    `[{"labels":{"alertname":"foo"}},{"labels":{"alertname":"bar","namespace":"other"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "multiple label values with matching label",
+			labelv:  []string{"default", "other"},
+			body:    `[{"labels":{"alertname":"foo","namespace":"other"}}]`,
+			expCode: http.StatusOK,
+			expBody: []string{`{alertname="foo", namespace="other"}`},
+		},
+		{
+			name:    "multiple label values with missing label",
+			labelv:  []string{"default", "other"},
+			body:    `[{"labels":{"alertname":"foo"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "regex match with matching label",
+			labelv:  []string{"team-.*"},
+			opts:    []Option{WithRegexMatch()},
+			body:    `[{"labels":{"alertname":"foo","namespace":"team-a"}}]`,
+			expCode: http.StatusOK,
+			expBody: []string{`{alertname="foo", namespace="team-a"}`},
+		},
+		{
+			name:    "regex match with missing label",
+			labelv:  []string{"team-.*"},
+			opts:    []Option{WithRegexMatch()},
+			body:    `[{"labels":{"alertname":"foo"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid body",
+			labelv:  []string{"default"},
+			body:    `{"labels":{"alertname":"foo"}}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing label value",
+			body:    `[{"labels":{"alertname":"foo"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkAlertsHandler(tc.expBody...))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://alertmanager.example.com/api/v2/alerts?"+q.Encode(), strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// auditReasonMaxSize is the maximum number of bytes of the error
+	// response kept to explain a denied request.
+	auditReasonMaxSize = 512
+	// defaultAuditQueueSize is the default number of records waiting to be
+	// written.
+	defaultAuditQueueSize = 1024
+)
+
+// errAuditLoggerClosed is returned when a record is logged after Close.
+var errAuditLoggerClosed = errors.New("audit logger closed")
+
+// AuditRecord is an entry of the audit log. The records are chained: each
+// record holds the HMAC of the previous one so that the removal or the
+// modification of a record can be detected by the holders of the key.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	RemoteAddr  string    `json:"remote_addr"`
+	LabelValues []string  `json:"label_values"`
+	// Decision is "allow" if the request was forwarded to the upstream,
+	// "bypass" if the request of an administrator was forwarded without
+	// enforcement, "deny" otherwise.
+	Decision string `json:"decision"`
+	// Identity is the identity of the administrator for the bypassed
+	// requests.
+	Identity string `json:"identity,omitempty"`
+	Status   int    `json:"status"`
+	// Reason is the error returned to the client for denied requests.
+	Reason         string   `json:"reason,omitempty"`
+	Query          string   `json:"query,omitempty"`
+	RewrittenQuery string   `json:"rewritten_query,omitempty"`
+	Match          []string `json:"match,omitempty"`
+	RewrittenMatch []string `json:"rewritten_match,omitempty"`
+	// PrevHash is the hash of the previous record (empty for the first
+	// record).
+	PrevHash string `json:"prev_hash"`
+	// Hash is the hex-encoded HMAC-SHA256 of the JSON encoding of the
+	// record without the hash.
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the HMAC of the record with the key.
+func (rec AuditRecord) hash(key []byte) (string, error) {
+	rec.Hash = ""
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditSink stores the JSON-encoded audit records.
+type AuditSink interface {
+	WriteRecord(b []byte) error
+}
+
+// FileAuditSink appends the audit records to a file, one record per line.
+type FileAuditSink struct {
+	f *os.File
+}
+
+// NewFileAuditSink opens (or creates) the file for appending.
+func NewFileAuditSink(filename string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAuditSink{f: f}, nil
+}
+
+// WriteRecord implements the AuditSink interface.
+func (s *FileAuditSink) WriteRecord(b []byte) error {
+	_, err := s.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+// HTTPAuditSink sends each audit record in the JSON body of a POST request.
+// The proxy doesn't keep the hash of the last record sent: unless the caller
+// passes it to NewAuditLogger, the chain restarts at each start of the proxy
+// with a record whose previous hash is empty. The receiver must verify each
+// segment of the chain separately.
+type HTTPAuditSink struct {
+	URL string
+	// Client is the client sending the requests, http.DefaultClient is
+	// used if nil.
+	Client *http.Client
+}
+
+// WriteRecord implements the AuditSink interface.
+func (s HTTPAuditSink) WriteRecord(b []byte) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// AuditConfig configures the audit logger.
+type AuditConfig struct {
+	// Key is the secret key of the HMAC chaining the records. Without the
+	// key, a record can't be modified or removed without breaking the chain.
+	Key []byte
+	// PrevHash is the hash of the last record of an existing log (see
+	// VerifyAuditLog) to continue its chain, empty for a new log.
+	PrevHash string
+	// QueueSize is the maximum number of records waiting to be written
+	// (default: 1024). The records are dropped when the queue is full.
+	QueueSize int
+	// Registerer registers the metrics of the audit logger (optional).
+	Registerer prometheus.Registerer
+	// Logger logs the errors of the sink, slog.Default() is used if nil.
+	Logger *slog.Logger
+}
+
+// AuditLogger chains the audit records and writes them to the sink. The
+// records are queued and written in the background so that a slow sink
+// doesn't delay the responses: a record which can't be queued is dropped
+// and a record which the sink fails to write leaves a gap in the chain.
+type AuditLogger struct {
+	sink   AuditSink
+	key    []byte
+	logger *slog.Logger
+
+	dropped prometheus.Counter
+	failed  prometheus.Counter
+
+	mtx      sync.Mutex
+	prevHash string
+	closed   bool
+	queue    chan []byte
+	done     chan struct{}
+}
+
+// NewAuditLogger returns an audit logger writing to the sink and starts its
+// writer. Close must be called to write the pending records.
+func NewAuditLogger(sink AuditSink, cfg AuditConfig) (*AuditLogger, error) {
+	if len(cfg.Key) == 0 {
+		return nil, errors.New("the audit log requires a key")
+	}
+
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultAuditQueueSize
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	a := &AuditLogger{
+		sink:     sink,
+		key:      cfg.Key,
+		logger:   cfg.Logger,
+		prevHash: cfg.PrevHash,
+		queue:    make(chan []byte, cfg.QueueSize),
+		done:     make(chan struct{}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_label_proxy_audit_records_dropped_total",
+			Help: "Total number of audit records dropped because the queue was full.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_label_proxy_audit_records_failed_total",
+			Help: "Total number of audit records which the sink failed to write.",
+		}),
+	}
+	if cfg.Registerer != nil {
+		cfg.Registerer.MustRegister(a.dropped, a.failed)
+	}
+
+	go a.run()
+
+	return a, nil
+}
+
+// Log chains the record to the previous one and queues it for writing. The
+// chain isn't advanced if the record is dropped.
+func (a *AuditLogger) Log(rec AuditRecord) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.closed {
+		return errAuditLoggerClosed
+	}
+
+	rec.PrevHash = a.prevHash
+	hash, err := rec.hash(a.key)
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case a.queue <- b:
+	default:
+		a.dropped.Inc()
+		return errors.New("audit queue full, record dropped")
+	}
+	a.prevHash = hash
+
+	return nil
+}
+
+// run writes the queued records to the sink until the logger is closed.
+func (a *AuditLogger) run() {
+	defer close(a.done)
+
+	for b := range a.queue {
+		if err := a.sink.WriteRecord(b); err != nil {
+			a.failed.Inc()
+			a.logger.Error("Failed to write the audit record", "err", err)
+		}
+	}
+}
+
+// Close stops accepting records and waits until the queued records are
+// written.
+func (a *AuditLogger) Close() error {
+	a.mtx.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mtx.Unlock()
+
+	<-a.done
+
+	return nil
+}
+
+// VerifyAuditLog verifies the chain of the audit records read from r (one
+// JSON record per line) with the key and returns the hash of the last
+// record.
+func VerifyAuditLog(r io.Reader, key []byte) (string, error) {
+	var (
+		prevHash string
+		n        int
+		scanner  = bufio.NewScanner(r)
+	)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		n++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if rec.PrevHash != prevHash {
+			return "", fmt.Errorf("line %d: broken chain: expected previous hash %q, got %q", n, prevHash, rec.PrevHash)
+		}
+
+		hash, err := rec.hash(key)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if !hmac.Equal([]byte(rec.Hash), []byte(hash)) {
+			return "", fmt.Errorf("line %d: record was modified: expected hash %q, got %q", n, hash, rec.Hash)
+		}
+
+		prevHash = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return prevHash, nil
+}
+
+// WithAuditLogger records the enforcement decisions of the requests handled
+// by the enforced routes in the audit log.
+func WithAuditLogger(a *AuditLogger) Option {
+	return optionFunc(func(o *options) {
+		o.auditLogger = a
+	})
+}
+
+// auditWriter is a statusWriter which keeps the beginning of the error
+// responses.
+type auditWriter struct {
+	statusWriter
+	body bytes.Buffer
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	if w.status >= http.StatusBadRequest && w.body.Len() < auditReasonMaxSize {
+		w.body.Write(b[:min(n, auditReasonMaxSize-w.body.Len())])
+	}
+
+	return n, err
+}
+
+// reason returns the error message of the response.
+func (w *auditWriter) reason() string {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.body.Bytes(), &apiErr); err == nil && apiErr.Error != "" {
+		return apiErr.Error
+	}
+
+	return strings.TrimSpace(w.body.String())
+}
+
+// auditHandler writes the audit records of the requests handled by the
+// enforced routes. It reuses the access log entry of the request if any.
+func (r *routes) auditHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		entry, ok := req.Context().Value(keyAccessLogEntry).(*accessLogEntry)
+		if !ok {
+			entry = &accessLogEntry{}
+			req = req.WithContext(context.WithValue(req.Context(), keyAccessLogEntry, entry))
+		}
+
+		var (
+			start = time.Now().UTC()
+			aw    = &auditWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		)
+		next.ServeHTTP(aw, req)
+
+		if !entry.enforced && entry.adminIdentity == "" {
+			return
+		}
+
+		rec := AuditRecord{
+			Time:           start,
+			Method:         req.Method,
+			Path:           req.URL.Path,
+			RemoteAddr:     req.RemoteAddr,
+			LabelValues:    entry.labelValues,
+			Decision:       "deny",
+			Status:         aw.status,
+			Query:          entry.query,
+			RewrittenQuery: entry.rewrittenQuery,
+			Match:          entry.match,
+			RewrittenMatch: entry.rewrittenMatch,
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		if entry.forwarded {
+			rec.Decision = "allow"
+		}
+		if entry.adminIdentity != "" {
+			rec.Decision = "bypass"
+			rec.Identity = entry.adminIdentity
+		}
+		if rec.Status >= http.StatusBadRequest {
+			rec.Reason = aw.reason()
+		}
+
+		if err := r.auditLogger.Log(rec); err != nil {
+			r.logger.Error("Failed to queue the audit record", "err", err)
+		}
+	})
+}
+
+// auditEnforced marks the request as handled by an enforced route.
+func (r *routes) auditEnforced(next http.HandlerFunc) http.HandlerFunc {
+	if r.auditLogger == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if entry, ok := req.Context().Value(keyAccessLogEntry).(*accessLogEntry); ok {
+			entry.enforced = true
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testAuditKey = []byte("audit-key")
+
+type bufferAuditSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferAuditSink) WriteRecord(b []byte) error {
+	s.Write(b)
+	s.WriteByte('\n')
+	return nil
+}
+
+// newTestAuditLogger returns an audit logger writing to the sink which is
+// closed at the end of the test.
+func newTestAuditLogger(t *testing.T, sink AuditSink) *AuditLogger {
+	t.Helper()
+
+	a, err := NewAuditLogger(sink, AuditConfig{Key: testAuditKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	return a
+}
+
+func TestAuditLog(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	var sink bufferAuditSink
+	a := newTestAuditLogger(t, &sink)
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithAuditLogger(a),
+		// The access log shares the details of the requests.
+		WithAccessLog(AccessLogConfig{}),
+		WithLogger(newTestLogger(&bytes.Buffer{})),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, u := range []string{
+		"/api/v1/query?query=up&namespace=ns1",
+		"/api/v1/query?query=up",
+		"/api/v1/series?match[]=up&namespace=ns1",
+		// Not enforced.
+		"/healthz",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+u, nil))
+	}
+	// Wait for the records to be written.
+	a.Close()
+
+	log := sink.String()
+	var got []AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Time.IsZero() || rec.Hash == "" {
+			t.Fatalf("expected time and hash, got %s", line)
+		}
+		// Clear the fields which vary between runs.
+		rec.Time, rec.RemoteAddr, rec.PrevHash, rec.Hash = time.Time{}, "", "", ""
+		got = append(got, rec)
+	}
+
+	exp := []AuditRecord{
+		{
+			Method:         http.MethodGet,
+			Path:           "/api/v1/query",
+			LabelValues:    []string{"ns1"},
+			Decision:       "allow",
+			Status:         http.StatusOK,
+			Query:          "up",
+			RewrittenQuery: `up{namespace="ns1"}`,
+		},
+		{
+			Method:   http.MethodGet,
+			Path:     "/api/v1/query",
+			Decision: "deny",
+			Status:   http.StatusBadRequest,
+			Reason:   `The "namespace" query parameter must be provided.`,
+		},
+		{
+			Method:         http.MethodGet,
+			Path:           "/api/v1/series",
+			LabelValues:    []string{"ns1"},
+			Decision:       "allow",
+			Status:         http.StatusOK,
+			Match:          []string{"up"},
+			RewrittenMatch: []string{`{__name__="up",namespace="ns1"}`},
+		},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected records\n%+v\ngot\n%+v", exp, got)
+	}
+
+	if _, err := VerifyAuditLog(strings.NewReader(log), testAuditKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+
+	write := func(prevHash string, recs ...AuditRecord) {
+		t.Helper()
+
+		sink, err := NewFileAuditSink(filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer sink.Close()
+
+		a, err := NewAuditLogger(sink, AuditConfig{Key: testAuditKey, PrevHash: prevHash})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, rec := range recs {
+			if err := a.Log(rec); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		a.Close()
+	}
+
+	verify := func() (string, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+
+		return VerifyAuditLog(f, testAuditKey)
+	}
+
+	write("", AuditRecord{Path: "/api/v1/query", LabelValues: []string{"ns1"}}, AuditRecord{Path: "/api/v1/series", LabelValues: []string{"ns2"}})
+	last, err := verify()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The chain continues after a restart.
+	write(last, AuditRecord{Path: "/federate", LabelValues: []string{"ns1"}})
+	if _, err := verify(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+
+	// Without the key, the hashes of a modified record can't be
+	// recomputed.
+	var forged AuditRecord
+	if err := json.Unmarshal([]byte(lines[1]), &forged); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	forged.LabelValues = []string{"ns3"}
+	forged.Hash, _ = forged.hash([]byte("guess"))
+	forgedLine, _ := json.Marshal(forged)
+
+	for _, tc := range []struct {
+		name   string
+		log    string
+		expErr string
+	}{
+		{
+			name:   "modified record",
+			log:    strings.Replace(string(b), `"ns2"`, `"ns3"`, 1),
+			expErr: "line 2: record was modified",
+		},
+		{
+			name:   "forged record",
+			log:    lines[0] + string(forgedLine) + "\n",
+			expErr: "line 2: record was modified",
+		},
+		{
+			name:   "removed record",
+			log:    lines[0] + lines[2],
+			expErr: "line 2: broken chain",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := VerifyAuditLog(strings.NewReader(tc.log), testAuditKey)
+			if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+				t.Fatalf("expected error %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+// blockingAuditSink blocks the writes until it is released.
+type blockingAuditSink struct {
+	release chan struct{}
+	fail    bool
+	bufferAuditSink
+}
+
+func (s *blockingAuditSink) WriteRecord(b []byte) error {
+	<-s.release
+	if s.fail {
+		return errors.New("sink failure")
+	}
+	return s.bufferAuditSink.WriteRecord(b)
+}
+
+func TestAuditLoggerSlowSink(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fail bool
+
+		expRecords int
+		expMetrics string
+	}{
+		{
+			name:       "slow sink",
+			expRecords: 2,
+			expMetrics: `
+# HELP prom_label_proxy_audit_records_dropped_total Total number of audit records dropped because the queue was full.
+# TYPE prom_label_proxy_audit_records_dropped_total counter
+prom_label_proxy_audit_records_dropped_total 1
+# HELP prom_label_proxy_audit_records_failed_total Total number of audit records which the sink failed to write.
+# TYPE prom_label_proxy_audit_records_failed_total counter
+prom_label_proxy_audit_records_failed_total 0
+`,
+		},
+		{
+			name: "failing sink",
+			fail: true,
+			expMetrics: `
+# HELP prom_label_proxy_audit_records_dropped_total Total number of audit records dropped because the queue was full.
+# TYPE prom_label_proxy_audit_records_dropped_total counter
+prom_label_proxy_audit_records_dropped_total 1
+# HELP prom_label_proxy_audit_records_failed_total Total number of audit records which the sink failed to write.
+# TYPE prom_label_proxy_audit_records_failed_total counter
+prom_label_proxy_audit_records_failed_total 2
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := &blockingAuditSink{release: make(chan struct{}), fail: tc.fail}
+			reg := prometheus.NewRegistry()
+			a, err := NewAuditLogger(sink, AuditConfig{Key: testAuditKey, QueueSize: 1, Registerer: reg, Logger: newTestLogger(&bytes.Buffer{})})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The first record is held by the writer, the second one fills
+			// the queue and the third one is dropped: Log never waits for
+			// the sink.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if err := a.Log(AuditRecord{Path: "/api/v1/query"}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				// Wait for the writer to pick the first record.
+				for len(a.queue) > 0 {
+					time.Sleep(time.Millisecond)
+				}
+				if err := a.Log(AuditRecord{Path: "/api/v1/series"}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if err := a.Log(AuditRecord{Path: "/federate"}); err == nil {
+					t.Error("expected the record to be dropped")
+				}
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Log is blocked by the sink")
+			}
+
+			close(sink.release)
+			a.Close()
+
+			if err := a.Log(AuditRecord{Path: "/federate"}); err == nil {
+				t.Fatal("expected error after Close")
+			}
+
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(tc.expMetrics)); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.expRecords == 0 {
+				return
+			}
+			if got := strings.Count(sink.String(), "\n"); got != tc.expRecords {
+				t.Fatalf("expected %d records, got %d", tc.expRecords, got)
+			}
+			// The dropped record doesn't break the chain.
+			if _, err := VerifyAuditLog(strings.NewReader(sink.String()), testAuditKey); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewAuditLoggerWithoutKey(t *testing.T) {
+	if _, err := NewAuditLogger(&bufferAuditSink{}, AuditConfig{}); err == nil {
+		t.Fatal("expected error without key")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Backend is the type of the upstream.
+type Backend string
+
+const (
+	BackendPrometheus   Backend = "prometheus"
+	BackendThanos       Backend = "thanos"
+	BackendAlertmanager Backend = "alertmanager"
+	BackendMimir        Backend = "mimir"
+	BackendLoki         Backend = "loki"
+)
+
+// routeFamily is a set of routes implemented by the same kind of backend.
+type routeFamily int
+
+const (
+	// familyPrometheus covers the /federate and /api/v1/ routes.
+	familyPrometheus routeFamily = iota
+	// familyAlertmanager covers the /api/v2/ routes.
+	familyAlertmanager
+	// familyLoki covers the /loki/api/v1/ routes.
+	familyLoki
+	// familyThanos covers the routes specific to the Thanos Querier.
+	familyThanos
+)
+
+// backendPreset is the configuration applied for a given backend.
+type backendPreset struct {
+	families []routeFamily
+	// passthroughPaths are the paths forwarded without enforcement. They
+	// are limited to the health and readiness endpoints which don't expose
+	// tenant data.
+	passthroughPaths []string
+	// enableLabelAPIs is true when the backend supports the selectors on
+	// the labels endpoints.
+	enableLabelAPIs bool
+}
+
+var backendPresets = map[Backend]backendPreset{
+	BackendPrometheus: {
+		families:         []routeFamily{familyPrometheus},
+		passthroughPaths: []string{"/-/healthy", "/-/ready"},
+		enableLabelAPIs:  true,
+	},
+	BackendThanos: {
+		families:         []routeFamily{familyPrometheus, familyThanos},
+		passthroughPaths: []string{"/-/healthy", "/-/ready"},
+		enableLabelAPIs:  true,
+	},
+	BackendAlertmanager: {
+		families:         []routeFamily{familyAlertmanager},
+		passthroughPaths: []string{"/-/healthy", "/-/ready"},
+	},
+	BackendMimir: {
+		// Mimir's readiness endpoint isn't served under the Prometheus
+		// API prefix.
+		families:        []routeFamily{familyPrometheus},
+		enableLabelAPIs: true,
+	},
+	BackendLoki: {
+		families:         []routeFamily{familyLoki},
+		passthroughPaths: []string{"/ready", "/loki/api/v1/status/buildinfo"},
+		enableLabelAPIs:  true,
+	},
+}
+
+// WithBackend configures the proxy with the preset of the given backend: only
+// the routes supported by the backend are registered, its health endpoints
+// are forwarded without enforcement and the labels API is enabled if the
+// backend supports it. By default, the Prometheus and Alertmanager routes are
+// registered.
+func WithBackend(b Backend) Option {
+	return optionFunc(func(o *options) {
+		o.backend = b
+	})
+}
+
+// WithoutPrometheusRoutes disables the /federate and /api/v1/ routes. It
+// should be used when the upstream doesn't implement the Prometheus API.
+func WithoutPrometheusRoutes() Option {
+	return optionFunc(func(o *options) {
+		o.disabledFamilies = append(o.disabledFamilies, familyPrometheus)
+	})
+}
+
+// WithoutAlertmanagerRoutes disables the /api/v2/ routes. It should be used
+// when the upstream doesn't implement the Alertmanager API.
+func WithoutAlertmanagerRoutes() Option {
+	return optionFunc(func(o *options) {
+		o.disabledFamilies = append(o.disabledFamilies, familyAlertmanager)
+	})
+}
+
+// DetectBackend probes the upstream's API to find out which backend it is.
+func DetectBackend(ctx context.Context, client *http.Client, upstream *url.URL) (Backend, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	get := func(p string) (*http.Response, error) {
+		u := *upstream
+		u.Path = strings.TrimSuffix(u.Path, "/") + p
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Do(req)
+	}
+
+	var errs []error
+
+	// The probes go from the most specific endpoint to the least specific.
+	for _, p := range []struct {
+		path    string
+		backend Backend
+	}{
+		// Only Alertmanager implements the v2 API.
+		{path: "/api/v2/status", backend: BackendAlertmanager},
+		{path: "/loki/api/v1/status/buildinfo", backend: BackendLoki},
+		// Only Thanos Query lists its stores.
+		{path: "/api/v1/stores", backend: BackendThanos},
+	} {
+		resp, err := get(p.path)
+		if err != nil {
+			return "", fmt.Errorf("can't detect the backend of %s: %w", upstream.Redacted(), err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return p.backend, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: unexpected status code %d", p.path, resp.StatusCode))
+	}
+
+	// Mimir identifies itself in the build information.
+	resp, err := get("/api/v1/status/buildinfo")
+	if err != nil {
+		return "", fmt.Errorf("can't detect the backend of %s: %w", upstream.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		var buildInfo struct {
+			Data struct {
+				Application string `json:"application"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&buildInfo); err != nil {
+			return "", fmt.Errorf("can't detect the backend of %s: invalid build information: %w", upstream.Redacted(), err)
+		}
+
+		if strings.Contains(strings.ToLower(buildInfo.Data.Application), "mimir") {
+			return BackendMimir, nil
+		}
+
+		return BackendPrometheus, nil
+	}
+	errs = append(errs, fmt.Errorf("/api/v1/status/buildinfo: unexpected status code %d", resp.StatusCode))
+
+	return "", fmt.Errorf("can't detect the backend of %s: %w", upstream.Redacted(), errors.Join(errs...))
+}
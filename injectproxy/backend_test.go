@@ -0,0 +1,223 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDetectBackend(t *testing.T) {
+	// backend returns an upstream which implements only the given paths.
+	backend := func(paths map[string]string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			body, found := paths[req.URL.Path]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(body))
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		upstream http.HandlerFunc
+
+		exp    Backend
+		expErr bool
+	}{
+		{
+			name: "prometheus",
+			upstream: backend(map[string]string{
+				"/api/v1/status/buildinfo": `{"status":"success","data":{"version":"2.51.0"}}`,
+			}),
+			exp: BackendPrometheus,
+		},
+		{
+			name: "thanos",
+			upstream: backend(map[string]string{
+				"/api/v1/status/buildinfo": `{"status":"success","data":{"version":"0.35.0"}}`,
+				"/api/v1/stores":           `{"status":"success","data":{}}`,
+			}),
+			exp: BackendThanos,
+		},
+		{
+			name: "alertmanager",
+			upstream: backend(map[string]string{
+				"/api/v2/status": `{"cluster":{"status":"ready"},"versionInfo":{"version":"0.27.0"}}`,
+			}),
+			exp: BackendAlertmanager,
+		},
+		{
+			name: "mimir",
+			path: "/prometheus",
+			upstream: backend(map[string]string{
+				"/prometheus/api/v1/status/buildinfo": `{"status":"success","data":{"application":"Grafana Mimir","version":"2.12.0"}}`,
+			}),
+			exp: BackendMimir,
+		},
+		{
+			name: "loki",
+			upstream: backend(map[string]string{
+				"/loki/api/v1/status/buildinfo": `{"version":"3.0.0"}`,
+			}),
+			exp: BackendLoki,
+		},
+		{
+			name:     "unknown",
+			upstream: backend(nil),
+			expErr:   true,
+		},
+		{
+			name: "invalid build information",
+			upstream: backend(map[string]string{
+				"/api/v1/status/buildinfo": `not json`,
+			}),
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.upstream)
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL + tc.path)
+			got, err := DetectBackend(context.Background(), nil, u)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got backend %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.exp {
+				t.Fatalf("expected backend %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestWithBackend(t *testing.T) {
+	for _, tc := range []struct {
+		backend Backend
+		opts    []Option
+
+		expRoutes   []string
+		expNoRoutes []string
+		expErr      bool
+	}{
+		{
+			expRoutes: []string{"/api/v1/query", "/api/v2/silences", "/healthz"},
+		},
+		{
+			backend:     BackendPrometheus,
+			expRoutes:   []string{"/federate", "/api/v1/query", "/api/v1/rules", "/api/v1/labels", "/-/ready", "/healthz"},
+			expNoRoutes: []string{"/api/v2/silences", "/api/v2/alerts"},
+		},
+		{
+			backend:     BackendThanos,
+			expRoutes:   []string{"/api/v1/query", "/healthz"},
+			expNoRoutes: []string{"/api/v2/silences"},
+		},
+		{
+			backend:     BackendAlertmanager,
+			expRoutes:   []string{"/api/v2/silences", "/api/v2/alerts", "/-/ready", "/healthz"},
+			expNoRoutes: []string{"/federate", "/api/v1/query", "/api/v1/status/config"},
+		},
+		{
+			backend:     BackendMimir,
+			expRoutes:   []string{"/api/v1/query", "/api/v1/labels", "/healthz"},
+			expNoRoutes: []string{"/-/ready", "/api/v2/silences"},
+		},
+		{
+			backend:     BackendLoki,
+			expRoutes:   []string{"/loki/api/v1/query", "/loki/api/v1/query_range", "/loki/api/v1/tail", "/loki/api/v1/series", "/loki/api/v1/labels", "/ready", "/healthz"},
+			expNoRoutes: []string{"/api/v1/query", "/api/v2/silences"},
+		},
+		{
+			// The preset's passthrough paths don't conflict with the
+			// user-defined ones.
+			backend:   BackendPrometheus,
+			opts:      []Option{WithPassthroughPaths([]string{"/-/ready", "/graph"})},
+			expRoutes: []string{"/-/ready", "/-/healthy", "/graph"},
+		},
+		{
+			backend: Backend("foo"),
+			expErr:  true,
+		},
+		{
+			opts:        []Option{WithoutAlertmanagerRoutes()},
+			expRoutes:   []string{"/api/v1/query", "/api/v1/status/config", "/healthz"},
+			expNoRoutes: []string{"/api/v2/silences", "/api/v2/silence/{id}", "/api/v2/alerts/groups"},
+		},
+		{
+			opts:        []Option{WithoutPrometheusRoutes()},
+			expRoutes:   []string{"/api/v2/silences", "/healthz"},
+			expNoRoutes: []string{"/federate", "/api/v1/query", "/api/v1/rules"},
+		},
+		{
+			opts:   []Option{WithoutPrometheusRoutes(), WithoutAlertmanagerRoutes()},
+			expErr: true,
+		},
+		{
+			backend: BackendAlertmanager,
+			opts:    []Option{WithoutAlertmanagerRoutes()},
+			expErr:  true,
+		},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tc.backend, len(tc.opts)), func(t *testing.T) {
+			r, err := NewRoutes(
+				&url.URL{Scheme: "http", Host: "upstream.example.com"},
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				append(tc.opts, WithBackend(tc.backend))...,
+			)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, p := range tc.expRoutes {
+				if !r.hasRoute(p) {
+					t.Errorf("expected route %q to be registered", p)
+				}
+			}
+
+			for _, p := range tc.expNoRoutes {
+				if r.hasRoute(p) {
+					t.Errorf("expected route %q not to be registered", p)
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+p+"?"+proxyLabel+"=default", nil))
+				if w.Code != http.StatusNotFound {
+					t.Errorf("expected status code 404 for %q, got %d", p, w.Code)
+				}
+			}
+		})
+	}
+}
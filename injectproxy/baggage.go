@@ -0,0 +1,65 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+const baggageHeader = "Baggage"
+
+// WithTenantBaggage adds the enforced label values to the W3C baggage header
+// (https://www.w3.org/TR/baggage/) of the upstream requests. Each enforced
+// label is a baggage member whose value is the comma-separated list of label
+// values. The members with the same keys sent by the client are replaced.
+func WithTenantBaggage() Option {
+	return optionFunc(func(o *options) {
+		o.tenantBaggage = true
+	})
+}
+
+// propagateBaggage sets the enforced label values into the baggage header.
+func (r *routes) propagateBaggage(next http.HandlerFunc) http.HandlerFunc {
+	if !r.tenantBaggage {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Invalid baggage sent by the client is discarded.
+		b, err := baggage.Parse(strings.Join(req.Header.Values(baggageHeader), ","))
+		if err != nil {
+			b = baggage.Baggage{}
+		}
+
+		for _, el := range r.enforcedLabels(req.Context()) {
+			m, err := baggage.NewMemberRaw(el.name, strings.Join(el.values, ","))
+			if err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if b, err = b.SetMember(m); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		req.Header.Set(baggageHeader, b.String())
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+func TestTenantBaggage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		baggage string
+		query   string
+
+		expMembers map[string]string
+	}{
+		{
+			name:       "disabled",
+			baggage:    "foo=bar",
+			query:      "namespace=default",
+			expMembers: map[string]string{"foo": "bar"},
+		},
+		{
+			name:       "no baggage",
+			opts:       []Option{WithTenantBaggage()},
+			query:      "namespace=default",
+			expMembers: map[string]string{"namespace": "default"},
+		},
+		{
+			name:       "client baggage is kept",
+			opts:       []Option{WithTenantBaggage()},
+			baggage:    "foo=bar;prop,namespace=other",
+			query:      "namespace=default",
+			expMembers: map[string]string{"foo": "bar", "namespace": "default"},
+		},
+		{
+			name:       "multiple values",
+			opts:       []Option{WithTenantBaggage()},
+			query:      "namespace=a&namespace=b",
+			expMembers: map[string]string{"namespace": "a,b"},
+		},
+		{
+			name:       "invalid client baggage",
+			opts:       []Option{WithTenantBaggage()},
+			baggage:    "=invalid",
+			query:      "namespace=default",
+			expMembers: map[string]string{"namespace": "default"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got baggage.Baggage
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var err error
+				got, err = baggage.Parse(req.Header.Get("Baggage"))
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+tc.query, nil)
+			if tc.baggage != "" {
+				req.Header.Set("Baggage", tc.baggage)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if got.Len() != len(tc.expMembers) {
+				t.Fatalf("expected %d members, got %q", len(tc.expMembers), got.String())
+			}
+			for k, v := range tc.expMembers {
+				if got.Member(k).Value() != v {
+					t.Fatalf("expected member %s=%s, got %q", k, v, got.String())
+				}
+			}
+		})
+	}
+}
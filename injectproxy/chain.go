@@ -0,0 +1,129 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ChainConflictPolicy defines how the ChainEnforcer handles the requests for
+// which several sources provide label values.
+type ChainConflictPolicy string
+
+const (
+	// ChainConflictFirst uses the values of the first source which provides
+	// label values, the other sources are ignored.
+	ChainConflictFirst ChainConflictPolicy = "first"
+	// ChainConflictReject rejects the requests for which the sources
+	// provide different label values.
+	ChainConflictReject ChainConflictPolicy = "reject"
+)
+
+// labelValuesGetter is implemented by the ExtractLabelers which can be
+// chained.
+type labelValuesGetter interface {
+	getLabelValues(*http.Request) ([]string, error)
+}
+
+// ChainEnforcer enforces the label values extracted from several sources
+// (e.g. an HTTP header, then a query parameter, then static values) in order
+// of precedence. The supported sources are HTTPFormEnforcer,
+// HTTPHeaderEnforcer, StaticLabelEnforcer and ClientCertificateEnforcer.
+type ChainEnforcer struct {
+	sources    []ExtractLabeler
+	onConflict ChainConflictPolicy
+}
+
+// NewChainEnforcer returns the enforcer chaining the given sources, the first
+// one having the highest precedence.
+func NewChainEnforcer(onConflict ChainConflictPolicy, sources ...ExtractLabeler) (*ChainEnforcer, error) {
+	switch onConflict {
+	case ChainConflictFirst, ChainConflictReject:
+	default:
+		return nil, fmt.Errorf("invalid conflict policy %q", onConflict)
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("at least one source is required")
+	}
+
+	for _, s := range sources {
+		if _, ok := s.(labelValuesGetter); !ok {
+			return nil, fmt.Errorf("%T can't be chained", s)
+		}
+	}
+
+	return &ChainEnforcer{sources: sources, onConflict: onConflict}, nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ce *ChainEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			labelValues []string
+			errs        []string
+		)
+		for _, s := range ce.sources {
+			values, err := s.(labelValuesGetter).getLabelValues(r)
+			if err != nil {
+				errs = append(errs, humanFriendlyErrorMessage(err))
+				continue
+			}
+
+			if labelValues == nil {
+				labelValues = values
+				if ce.onConflict == ChainConflictFirst {
+					break
+				}
+				continue
+			}
+
+			if !sameValues(labelValues, values) {
+				prometheusAPIError(w, fmt.Sprintf("conflicting label values %q and %q", labelValues, values), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if labelValues == nil {
+			prometheusAPIError(w, strings.Join(errs, ", "), http.StatusBadRequest)
+			return
+		}
+
+		// The query parameters holding the label values are removed even
+		// if another source takes precedence.
+		for _, s := range ce.sources {
+			if hff, ok := s.(HTTPFormEnforcer); ok {
+				if err := hff.removeParameter(r); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+// sameValues returns true if both lists have the same values in any order.
+func sameValues(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChainEnforcer(t *testing.T) {
+	const header = "X-Namespace"
+
+	for _, tc := range []struct {
+		name       string
+		onConflict ChainConflictPolicy
+		sources    []ExtractLabeler
+		url        string
+		header     string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "header takes precedence",
+			sources:  []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:      "/api/v1/query?query=up&namespace=ns2",
+			header:   "ns1",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "fallback to the query parameter",
+			sources:  []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:      "/api/v1/query?query=up&namespace=ns2",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns2"}`,
+		},
+		{
+			name:     "fallback to the static values",
+			sources:  []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}, StaticLabelEnforcer{"default"}},
+			url:      "/api/v1/query?query=up",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:    "no source",
+			sources: []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:     "/api/v1/query?query=up",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:       "conflicting values rejected",
+			onConflict: ChainConflictReject,
+			sources:    []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:        "/api/v1/query?query=up&namespace=ns2",
+			header:     "ns1",
+			expCode:    http.StatusBadRequest,
+		},
+		{
+			name:       "same values accepted",
+			onConflict: ChainConflictReject,
+			sources:    []ExtractLabeler{HTTPHeaderEnforcer{Name: header, ParseListSyntax: true}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:        "/api/v1/query?query=up&namespace=ns2&namespace=ns1",
+			header:     "ns1, ns2",
+			expCode:    http.StatusOK,
+			expQuery:   `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:       "single source with reject",
+			onConflict: ChainConflictReject,
+			sources:    []ExtractLabeler{HTTPHeaderEnforcer{Name: header}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			url:        "/api/v1/query?query=up",
+			header:     "ns1",
+			expCode:    http.StatusOK,
+			expQuery:   `up{namespace="ns1"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(
+				checkParameterAbsent(
+					proxyLabel,
+					checkQueryHandler("", queryParam, tc.expQuery),
+				),
+			)
+			defer m.Close()
+
+			if tc.onConflict == "" {
+				tc.onConflict = ChainConflictFirst
+			}
+			e, err := NewChainEnforcer(tc.onConflict, tc.sources...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, e)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			if tc.header != "" {
+				req.Header.Set(header, tc.header)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewChainEnforcer(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		onConflict ChainConflictPolicy
+		sources    []ExtractLabeler
+
+		expErr bool
+	}{
+		{
+			name:       "valid",
+			onConflict: ChainConflictFirst,
+			sources:    []ExtractLabeler{HTTPHeaderEnforcer{Name: "X-Namespace"}, StaticLabelEnforcer{"default"}},
+		},
+		{
+			name:       "invalid conflict policy",
+			onConflict: "last",
+			sources:    []ExtractLabeler{StaticLabelEnforcer{"default"}},
+			expErr:     true,
+		},
+		{
+			name:       "no source",
+			onConflict: ChainConflictFirst,
+			expErr:     true,
+		},
+		{
+			name:       "unsupported source",
+			onConflict: ChainConflictFirst,
+			sources:    []ExtractLabeler{&ChainEnforcer{}},
+			expErr:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewChainEnforcer(tc.onConflict, tc.sources...)
+			if tc.expErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// ClientCertificateField is the field of the client certificate which holds
+// the label values.
+type ClientCertificateField string
+
+const (
+	// ClientCertificateCommonName is the common name of the certificate's
+	// subject.
+	ClientCertificateCommonName ClientCertificateField = "cn"
+	// ClientCertificateDNSNames are the DNS names of the certificate's
+	// subject alternative names.
+	ClientCertificateDNSNames ClientCertificateField = "dns-san"
+	// ClientCertificateEmailAddresses are the email addresses of the
+	// certificate's subject alternative names.
+	ClientCertificateEmailAddresses ClientCertificateField = "email-san"
+	// ClientCertificateURIs are the URIs of the certificate's subject
+	// alternative names.
+	ClientCertificateURIs ClientCertificateField = "uri-san"
+)
+
+// ClientCertificateEnforcer enforces the label values read from the verified
+// certificate of the TLS client. The server must verify the client
+// certificates (e.g. with tls.RequireAndVerifyClientCert), the requests
+// without verified certificate are rejected.
+type ClientCertificateEnforcer struct {
+	Field ClientCertificateField
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (cce ClientCertificateEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			prometheusAPIError(w, "missing verified client certificate", http.StatusUnauthorized)
+			return
+		}
+
+		labelValues, err := cce.getLabelValues(r)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+func (cce ClientCertificateEnforcer) getLabelValues(r *http.Request) ([]string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("missing verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var values []string
+	switch cce.Field {
+	case ClientCertificateCommonName:
+		values = []string{cert.Subject.CommonName}
+	case ClientCertificateDNSNames:
+		values = slices.Clone(cert.DNSNames)
+	case ClientCertificateEmailAddresses:
+		values = slices.Clone(cert.EmailAddresses)
+	case ClientCertificateURIs:
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported client certificate field %q", cce.Field)
+	}
+
+	values = removeEmptyValues(values)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no %q value in the client certificate", cce.Field)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestClientCertificateEnforcer(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "ns1"},
+		DNSNames:       []string{"ns1", "", "ns2"},
+		EmailAddresses: []string{"ns1@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/ns/ns1"}},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		field ClientCertificateField
+		state *tls.ConnectionState
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "common name",
+			field:    ClientCertificateCommonName,
+			state:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "DNS names",
+			field:    ClientCertificateDNSNames,
+			state:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "email addresses",
+			field:    ClientCertificateEmailAddresses,
+			state:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns1@example.com"}`,
+		},
+		{
+			name:     "URIs",
+			field:    ClientCertificateURIs,
+			state:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="spiffe://example.com/ns/ns1"}`,
+		},
+		{
+			name:    "missing field",
+			field:   ClientCertificateCommonName,
+			state:   &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "unverified certificate",
+			field:   ClientCertificateCommonName,
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "plain HTTP",
+			field:   ClientCertificateCommonName,
+			expCode: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, ClientCertificateEnforcer{Field: tc.field})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.TLS = tc.state
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if len(cert.DNSNames) != 3 {
+				t.Fatalf("the certificate was modified: %v", cert.DNSNames)
+			}
+		})
+	}
+}
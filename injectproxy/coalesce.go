@@ -0,0 +1,163 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedHeaders lists the request headers which can change the upstream
+// response. Requests differing by one of these headers aren't coalesced.
+var coalescedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Authorization",
+	"Content-Type",
+	"Cookie",
+	"If-None-Match",
+	shardingControlHeader,
+	queryShardingHeader,
+}
+
+// WithQueryCoalescing causes the proxy to coalesce the identical requests to
+// the query endpoints which are in flight at the same time: only one request
+// is forwarded to the upstream and its response is sent to all the clients.
+// Requests are identical if they have the same method, enforced parameters and
+// the same values for the headers which can change the response (e.g.
+// Authorization).
+func WithQueryCoalescing() Option {
+	return optionFunc(func(o *options) {
+		o.queryCoalescing = true
+	})
+}
+
+type coalescer struct {
+	group     singleflight.Group
+	coalesced prometheus.Counter
+}
+
+func newCoalescer(reg prometheus.Registerer) *coalescer {
+	c := &coalescer{
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_label_proxy_coalesced_requests_total",
+			Help: "Total number of query requests served by the response of an identical in-flight request.",
+		}),
+	}
+	reg.MustRegister(c.coalesced)
+
+	return c
+}
+
+// bufferedResponse records the response of the upstream request so it can be
+// replayed to all the clients.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// coalesceKey returns the key identifying the request once enforced. The
+// request body is read and replaced.
+func coalesceKey(req *http.Request) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(req.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(req.URL.RequestURI())
+	for _, h := range coalescedHeaders {
+		sb.WriteByte('\n')
+		sb.WriteString(h)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+	sb.WriteByte('\n')
+	sb.Write(body)
+
+	return sb.String(), nil
+}
+
+// forward sends the request to the upstream. If query coalescing is enabled,
+// the request shares the response of an identical request already in flight.
+// The protocol upgrades (e.g. WebSocket) are never coalesced.
+func (r *routes) forward(w http.ResponseWriter, req *http.Request) {
+	if r.coalescer == nil || req.Header.Get("Upgrade") != "" {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+
+	key, err := coalesceKey(req)
+	if err != nil {
+		prometheusAPIError(w, "can't read the request body", http.StatusBadRequest)
+		return
+	}
+
+	var leader bool
+	v, _, shared := r.coalescer.group.Do(key, func() (interface{}, error) {
+		leader = true
+
+		// The upstream request shouldn't be canceled when the first client
+		// goes away while others are waiting for the response.
+		resp := &bufferedResponse{header: http.Header{}}
+		r.handler.ServeHTTP(resp, req.WithContext(context.WithoutCancel(req.Context())))
+		// The response is shared by the coalesced requests and mustn't be
+		// modified once returned.
+		if resp.code == 0 {
+			resp.code = http.StatusOK
+		}
+
+		return resp, nil
+	})
+	if shared && !leader {
+		r.coalescer.coalesced.Inc()
+	}
+
+	resp := v.(*bufferedResponse)
+	for k, vals := range resp.header {
+		w.Header()[k] = append([]string(nil), vals...)
+	}
+	w.WriteHeader(resp.code)
+	_, _ = w.Write(resp.body.Bytes())
+}
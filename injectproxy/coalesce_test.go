@@ -0,0 +1,240 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryCoalescing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		requests []*http.Request
+
+		expUpstreamCalls int
+		expCoalesced     int
+	}{
+		{
+			name: "disabled",
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+			},
+			expUpstreamCalls: 2,
+		},
+		{
+			name: "identical requests",
+			opts: []Option{WithQueryCoalescing()},
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?namespace=ns1&query=up", nil),
+			},
+			expUpstreamCalls: 1,
+			expCoalesced:     2,
+		},
+		{
+			// The enforced queries are identical.
+			name: "GET and POST requests",
+			opts: []Option{WithQueryCoalescing()},
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=ns1", strings.NewReader("query=up")),
+				httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=ns1", strings.NewReader("query=up")),
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+			},
+			expUpstreamCalls: 2,
+			expCoalesced:     1,
+		},
+		{
+			name: "different label values",
+			opts: []Option{WithQueryCoalescing()},
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil),
+				httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns2", nil),
+			},
+			expUpstreamCalls: 2,
+		},
+		{
+			name: "different authorization headers",
+			opts: []Option{WithQueryCoalescing()},
+			requests: func() []*http.Request {
+				var reqs []*http.Request
+				for _, token := range []string{"foo", "bar"} {
+					req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+					req.Header.Set("Authorization", "Bearer "+token)
+					reqs = append(reqs, req)
+				}
+				return reqs
+			}(),
+			expUpstreamCalls: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			release := make(chan struct{})
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls.Add(1)
+				<-release
+				w.Header().Set("X-Query", req.FormValue("query"))
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			reg := prometheus.NewRegistry()
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithPrometheusRegistry(reg))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			codes := make([]int, len(tc.requests))
+			for i, req := range tc.requests {
+				if req.Method == http.MethodPost {
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, req)
+					codes[i] = w.Code
+					if got := w.Header().Get("X-Query"); got != `up{namespace="ns1"}` && got != `up{namespace="ns2"}` {
+						t.Errorf("unexpected X-Query header %q", got)
+					}
+				}()
+			}
+
+			// Leave time to the requests to reach the upstream or to
+			// wait for an in-flight request.
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			for i, code := range codes {
+				if code != http.StatusOK {
+					t.Fatalf("request %d: expected status code %d, got %d", i, http.StatusOK, code)
+				}
+			}
+
+			if got := int(calls.Load()); got != tc.expUpstreamCalls {
+				t.Fatalf("expected %d upstream calls, got %d", tc.expUpstreamCalls, got)
+			}
+
+			if tc.opts == nil {
+				return
+			}
+			exp := fmt.Sprintf(`# HELP prom_label_proxy_coalesced_requests_total Total number of query requests served by the response of an identical in-flight request.
+# TYPE prom_label_proxy_coalesced_requests_total counter
+prom_label_proxy_coalesced_requests_total %d
+`, tc.expCoalesced)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(exp), "prom_label_proxy_coalesced_requests_total"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCoalescedResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "empty response",
+			handler: func(http.ResponseWriter) {},
+			expCode: http.StatusOK,
+		},
+		{
+			name: "body",
+			handler: func(w http.ResponseWriter) {
+				w.Write(okResponse)
+			},
+			expCode: http.StatusOK,
+			expBody: string(okResponse),
+		},
+		{
+			name: "error",
+			handler: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte("error"))
+			},
+			expCode: http.StatusBadGateway,
+			expBody: "error",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const callers = 10
+
+			var (
+				calls   atomic.Int32
+				release = make(chan struct{})
+			)
+			r := &routes{
+				coalescer: newCoalescer(prometheus.NewRegistry()),
+				handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					calls.Add(1)
+					<-release
+					w.Header().Set("X-Foo", "bar")
+					tc.handler(w)
+				}),
+			}
+
+			var wg sync.WaitGroup
+			recorders := make([]*httptest.ResponseRecorder, callers)
+			for i := range recorders {
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r.forward(recorders[i], httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil))
+				}()
+			}
+
+			// Leave time to the requests to wait for the in-flight request.
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if got := calls.Load(); got != 1 {
+				t.Fatalf("expected 1 upstream call, got %d", got)
+			}
+			for i, w := range recorders {
+				if w.Code != tc.expCode {
+					t.Fatalf("caller %d: expected status code %d, got %d", i, tc.expCode, w.Code)
+				}
+				if w.Body.String() != tc.expBody {
+					t.Fatalf("caller %d: expected body %q, got %q", i, tc.expBody, w.Body.String())
+				}
+				if got := w.Header().Get("X-Foo"); got != "bar" {
+					t.Fatalf("caller %d: expected X-Foo header %q, got %q", i, "bar", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentCodings are the content codings which the proxy can decode and
+// encode when it modifies the upstream responses.
+var contentCodings = map[string]struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}{
+	"gzip": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	// The "deflate" coding is the zlib format (RFC 1950).
+	"deflate": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+	},
+	"zstd": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	},
+}
+
+// restrictAcceptEncoding removes the content codings which the proxy can't
+// decode from the Accept-Encoding header of the upstream request. If none is
+// left, the header is removed and the transport negotiates the compression
+// on its own.
+func restrictAcceptEncoding(h http.Header) {
+	if h.Get("Accept-Encoding") == "" {
+		return
+	}
+
+	var accepted []string
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			coding, _, _ := strings.Cut(c, ";")
+			if _, found := contentCodings[strings.ToLower(strings.TrimSpace(coding))]; found {
+				accepted = append(accepted, c)
+			}
+		}
+	}
+
+	if len(accepted) == 0 {
+		h.Del("Accept-Encoding")
+		return
+	}
+	h.Set("Accept-Encoding", strings.Join(accepted, ", "))
+}
+
+// withDecodedBody returns a response modifier which passes the decompressed
+// body of the response to m and compresses the modified body with the
+// original content coding.
+func withDecodedBody(m func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || resp.Uncompressed {
+			return m(resp)
+		}
+
+		coding, found := contentCodings[encoding]
+		if !found {
+			return fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+
+		if err := decodeBody(resp, coding.newReader); err != nil {
+			return fmt.Errorf("%s decoding error: %w", encoding, err)
+		}
+		resp.Header.Del("Content-Encoding")
+
+		if err := m(resp); err != nil {
+			return err
+		}
+
+		if err := encodeBody(resp, coding.newWriter); err != nil {
+			return fmt.Errorf("%s encoding error: %w", encoding, err)
+		}
+		resp.Header.Set("Content-Encoding", encoding)
+
+		return nil
+	}
+}
+
+// decodeBody replaces the body of the response by the decoded stream so
+// that the modifiers don't need to hold the whole decoded body in memory.
+func decodeBody(resp *http.Response, newReader func(io.Reader) (io.ReadCloser, error)) error {
+	dec, err := newReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	resp.Body = &decodedBody{ReadCloser: dec, body: resp.Body}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	return nil
+}
+
+// decodedBody closes both the decoder and the original body.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if berr := b.body.Close(); err == nil {
+		err = berr
+	}
+
+	return err
+}
+
+func encodeBody(resp *http.Response, newWriter func(io.Writer) (io.WriteCloser, error)) error {
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	enc, err := newWriter(&buf)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(enc, resp.Body); err != nil {
+		return err
+	}
+
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	replaceBody(resp, buf.Bytes())
+
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressedResponses(t *testing.T) {
+	const (
+		alertsResponse = `{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"}},{"labels":{"namespace":"ns2"}}]}}`
+		expResponse    = `{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"}}]}}`
+	)
+
+	for _, tc := range []struct {
+		name           string
+		acceptEncoding string
+		// encoding is the content coding of the upstream response.
+		encoding string
+
+		expAcceptEncoding string
+		expCode           int
+	}{
+		{
+			name:    "no compression",
+			expCode: http.StatusOK,
+		},
+		{
+			name:              "gzip",
+			acceptEncoding:    "gzip",
+			encoding:          "gzip",
+			expAcceptEncoding: "gzip",
+			expCode:           http.StatusOK,
+		},
+		{
+			name:              "deflate",
+			acceptEncoding:    "deflate",
+			encoding:          "deflate",
+			expAcceptEncoding: "deflate",
+			expCode:           http.StatusOK,
+		},
+		{
+			name:              "zstd",
+			acceptEncoding:    "zstd",
+			encoding:          "zstd",
+			expAcceptEncoding: "zstd",
+			expCode:           http.StatusOK,
+		},
+		{
+			name:              "unsupported codings are removed",
+			acceptEncoding:    "br, zstd;q=0.9, gzip;q=0.5",
+			encoding:          "zstd",
+			expAcceptEncoding: "zstd;q=0.9, gzip;q=0.5",
+			expCode:           http.StatusOK,
+		},
+		{
+			name:           "unsupported response encoding",
+			acceptEncoding: "gzip",
+			encoding:       "br",
+			// The transport negotiates gzip on its own.
+			expAcceptEncoding: "gzip",
+			expCode:           http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Accept-Encoding"); tc.expAcceptEncoding != "" && got != tc.expAcceptEncoding {
+					prometheusAPIError(w, "unexpected Accept-Encoding header: "+got, http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				if tc.encoding == "" {
+					w.Write([]byte(alertsResponse))
+					return
+				}
+
+				w.Header().Set("Content-Encoding", tc.encoding)
+				if tc.encoding == "br" {
+					w.Write([]byte(alertsResponse))
+					return
+				}
+				w.Write(compress(t, tc.encoding, []byte(alertsResponse)))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/alerts?namespace=ns1", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := resp.Header.Get("Content-Encoding"); got != tc.encoding {
+				t.Fatalf("expected content encoding %q, got %q", tc.encoding, got)
+			}
+			if tc.encoding != "" {
+				body = decompress(t, tc.encoding, body)
+			}
+
+			if got := strings.TrimSpace(string(body)); got != expResponse {
+				t.Fatalf("expected response %q, got %q", expResponse, got)
+			}
+		})
+	}
+}
+
+func TestRestrictAcceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header []string
+		exp    string
+	}{
+		{
+			exp: "",
+		},
+		{
+			header: []string{"gzip, deflate, br, zstd"},
+			exp:    "gzip, deflate, zstd",
+		},
+		{
+			header: []string{"GZIP;q=1.0", "br;q=0.5"},
+			exp:    "GZIP;q=1.0",
+		},
+		{
+			header: []string{"br"},
+			exp:    "",
+		},
+		{
+			header: []string{"identity"},
+			exp:    "",
+		},
+	} {
+		t.Run(strings.Join(tc.header, ","), func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range tc.header {
+				h.Add("Accept-Encoding", v)
+			}
+
+			restrictAcceptEncoding(h)
+			if got := strings.Join(h.Values("Accept-Encoding"), ","); got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func compress(t *testing.T, encoding string, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := contentCodings[encoding].newWriter(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, encoding string, b []byte) []byte {
+	t.Helper()
+
+	r, err := contentCodings[encoding].newReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return b
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// WithDeepFiltering verifies the responses of the series and labels
+// endpoints for upstreams which may ignore the "match[]" selectors (e.g. some
+// remote storages). The series which don't match the enforced labels are
+// removed from the /api/v1/series responses. The labels endpoints are
+// answered from the series endpoint: the label names and values are
+// collected from the matching series, which is more expensive for the
+// upstream.
+func WithDeepFiltering() Option {
+	return optionFunc(func(o *options) {
+		o.deepFiltering = true
+	})
+}
+
+// filterSeries removes the series which don't match the enforced labels.
+func (r *routes) filterSeries(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterJSONArray(resp.Data, nil, func(s *rawObject) bool {
+		return m.matches(labelsAt(s, nil))
+	})
+}
+
+// deepFilterLabels sends the requests of the labels endpoints to the series
+// endpoint and builds the label names (or values of the "name" path
+// parameter) from the matching series. It must be followed by a handler
+// enforcing the "match[]" selectors (e.g. matcher).
+func (r *routes) deepFilterLabels(next http.HandlerFunc) http.HandlerFunc {
+	if !r.deepFiltering {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("name")
+
+		// The request is cloned since its URL is shared with the caller.
+		req = req.Clone(req.Context())
+		req.URL.Path = "/api/v1/series"
+		req.URL.RawPath = ""
+
+		// The limit applies to the label names or values, not to the series.
+		limit, err := removeLimit(req)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m := modifyAPIResponse(func(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+			return r.labelsFromSeries(lvalues, req, resp, name, limit)
+		})
+
+		next(w, req.WithContext(context.WithValue(req.Context(), keyResponseModifier, m)))
+	}
+}
+
+// removeLimit removes the "limit" parameter from the request and returns its
+// value (zero if absent). The form value takes precedence over the URL query
+// value.
+// For POST requests, only req.PostForm is modified and the body needs to be
+// re-encoded by the caller.
+func removeLimit(req *http.Request) (uint64, error) {
+	q := req.URL.Query()
+	s := q.Get(limitParam)
+	q.Del(limitParam)
+	req.URL.RawQuery = q.Encode()
+
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			return 0, err
+		}
+
+		if req.PostForm.Has(limitParam) {
+			s = req.PostForm.Get(limitParam)
+			req.PostForm.Del(limitParam)
+		}
+	}
+
+	if s == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %q parameter: %w", limitParam, err)
+	}
+
+	return limit, nil
+}
+
+// labelsFromSeries returns the sorted label names of the matching series if
+// name is empty, the sorted values of the label otherwise. At most limit
+// names or values are returned if limit is greater than zero.
+func (r *routes) labelsFromSeries(lvalues []string, req *http.Request, resp *apiResponse, name string, limit uint64) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []labels.Labels
+	if err := json.Unmarshal(resp.Data, &series); err != nil {
+		return nil, fmt.Errorf("can't decode series data: %w", err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, ls := range series {
+		if !m.matches(ls) {
+			continue
+		}
+
+		if name != "" {
+			if v := ls.Get(name); v != "" {
+				seen[v] = struct{}{}
+			}
+			continue
+		}
+
+		ls.Range(func(l labels.Label) {
+			seen[l.Name] = struct{}{}
+		})
+	}
+
+	res := make([]string, 0, len(seen))
+	for k := range seen {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+
+	if limit > 0 && uint64(len(res)) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeepFiltering(t *testing.T) {
+	// The upstream ignores the matchers and returns the series of all the
+	// tenants.
+	const series = `{"status":"success","data":[` +
+		`{"__name__":"up","job":"a","namespace":"ns1"},` +
+		`{"__name__":"up","job":"b","namespace":"ns2"},` +
+		`{"__name__":"http_requests_total","instance":"c","namespace":"ns1"},` +
+		`{"__name__":"up","job":"d"}` +
+		`]}`
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		opts     []Option
+		upstream string
+
+		expCode int
+		expPath string
+		expBody string
+	}{
+		{
+			name:     "series",
+			url:      "/api/v1/series?match[]=up&namespace=ns1",
+			opts:     []Option{WithDeepFiltering()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody: `{"status":"success","data":[` +
+				`{"__name__":"up","job":"a","namespace":"ns1"},` +
+				`{"__name__":"http_requests_total","instance":"c","namespace":"ns1"}]}`,
+		},
+		{
+			name:     "series with multiple label values",
+			url:      "/api/v1/series?match[]=up&namespace=ns1&namespace=ns2",
+			opts:     []Option{WithDeepFiltering()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody: `{"status":"success","data":[` +
+				`{"__name__":"up","job":"a","namespace":"ns1"},` +
+				`{"__name__":"up","job":"b","namespace":"ns2"},` +
+				`{"__name__":"http_requests_total","instance":"c","namespace":"ns1"}]}`,
+		},
+		{
+			name:     "series without deep filtering",
+			url:      "/api/v1/series?match[]=up&namespace=ns1",
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  series,
+		},
+		{
+			name:     "label names",
+			url:      "/api/v1/labels?namespace=ns2",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["__name__","job","namespace"]}`,
+		},
+		{
+			name:     "POST label names",
+			method:   http.MethodPost,
+			url:      "/api/v1/labels?namespace=ns2",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["__name__","job","namespace"]}`,
+		},
+		{
+			name:     "label values",
+			url:      "/api/v1/label/__name__/values?namespace=ns1",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["http_requests_total","up"]}`,
+		},
+		{
+			name:     "label values without matching series",
+			url:      "/api/v1/label/job/values?namespace=ns3",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":[]}`,
+		},
+		{
+			name:     "label values without deep filtering",
+			url:      "/api/v1/label/job/values?namespace=ns1",
+			opts:     []Option{WithEnabledLabelsAPI()},
+			upstream: `{"status":"success","data":["a","b","d"]}`,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/label/job/values",
+			expBody:  `{"status":"success","data":["a","b","d"]}`,
+		},
+		{
+			// The limit applies to the label names, not to the series.
+			name:     "label names with limit",
+			url:      "/api/v1/labels?namespace=ns1&limit=2",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["__name__","instance"]}`,
+		},
+		{
+			name:     "POST label names with limit",
+			method:   http.MethodPost,
+			url:      "/api/v1/labels?namespace=ns1&limit=3",
+			body:     "limit=2",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["__name__","instance"]}`,
+		},
+		{
+			name:     "label names with configured limit",
+			url:      "/api/v1/labels?namespace=ns1",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI(), WithMetadataLimit(3)},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["__name__","instance","job"]}`,
+		},
+		{
+			name:     "label values with limit",
+			url:      "/api/v1/label/__name__/values?namespace=ns1&limit=1",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["http_requests_total"]}`,
+		},
+		{
+			name:     "label values with zero limit",
+			url:      "/api/v1/label/__name__/values?namespace=ns1&limit=0",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: series,
+			expCode:  http.StatusOK,
+			expPath:  "/api/v1/series",
+			expBody:  `{"status":"success","data":["http_requests_total","up"]}`,
+		},
+		{
+			name:    "invalid limit",
+			url:     "/api/v1/labels?namespace=ns1&limit=abc",
+			opts:    []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid series response",
+			url:      "/api/v1/labels?namespace=ns1",
+			opts:     []Option{WithDeepFiltering(), WithEnabledLabelsAPI()},
+			upstream: `{"status":"success","data":{"foo":"bar"}}`,
+			expCode:  http.StatusBadRequest,
+			expPath:  "/api/v1/series",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != tc.expPath {
+					http.Error(w, "unexpected path "+req.URL.Path, http.StatusTeapot)
+					return
+				}
+				// The series are fetched without limit.
+				if req.URL.Path == "/api/v1/series" && req.FormValue("limit") != "" {
+					http.Error(w, "unexpected limit "+req.FormValue("limit"), http.StatusTeapot)
+					return
+				}
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
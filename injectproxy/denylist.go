@@ -0,0 +1,168 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const defaultDenialMessage = "access denied for this tenant"
+
+// Denial describes how the requests of a blocked label value are rejected.
+type Denial struct {
+	// StatusCode is either 403 (default) or 503.
+	StatusCode int `json:"status_code,omitempty"`
+	// Message is returned to the client.
+	Message string `json:"message,omitempty"`
+}
+
+func (d Denial) validate() (Denial, error) {
+	switch d.StatusCode {
+	case 0:
+		d.StatusCode = http.StatusForbidden
+	case http.StatusForbidden, http.StatusServiceUnavailable:
+	default:
+		return d, fmt.Errorf("invalid status code %d, expected %d or %d", d.StatusCode, http.StatusForbidden, http.StatusServiceUnavailable)
+	}
+
+	if d.Message == "" {
+		d.Message = defaultDenialMessage
+	}
+
+	return d, nil
+}
+
+// DenyList holds the label values whose requests are rejected by the proxy.
+// It is safe for concurrent use and can be updated while the proxy is
+// running.
+type DenyList struct {
+	mtx     sync.RWMutex
+	denials map[string]Denial
+}
+
+// NewDenyList returns an empty deny-list.
+func NewDenyList() *DenyList {
+	return &DenyList{denials: map[string]Denial{}}
+}
+
+// Set blocks the given label value.
+func (d *DenyList) Set(value string, denial Denial) error {
+	if value == "" {
+		return errors.New("empty label value")
+	}
+
+	denial, err := denial.validate()
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.denials[value] = denial
+
+	return nil
+}
+
+// Delete unblocks the given label value.
+func (d *DenyList) Delete(value string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.denials, value)
+}
+
+// List returns the blocked label values.
+func (d *DenyList) List() map[string]Denial {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	denials := make(map[string]Denial, len(d.denials))
+	for k, v := range d.denials {
+		denials[k] = v
+	}
+
+	return denials
+}
+
+// get returns the denial of the first blocked value.
+func (d *DenyList) get(values []string) (Denial, bool) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+
+	for _, v := range values {
+		if denial, found := d.denials[v]; found {
+			return denial, true
+		}
+	}
+
+	return Denial{}, false
+}
+
+// ServeHTTP implements the http.Handler interface to manage the deny-list:
+//   - GET returns the blocked label values.
+//   - PUT blocks the label value given by the "value" query parameter, the
+//     request's body is the JSON-encoded Denial (optional).
+//   - DELETE unblocks the label value given by the "value" query parameter.
+func (d *DenyList) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	value := req.URL.Query().Get("value")
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.List())
+		return
+
+	case http.MethodPut:
+		var denial Denial
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&denial); err != nil {
+				http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := d.Set(value, denial); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodDelete:
+		d.Delete(value)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// denyBlocked rejects the requests of blocked label values.
+func (r *routes) denyBlocked(next http.HandlerFunc) http.HandlerFunc {
+	if r.denyList == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if denial, found := r.denyList.get(MustLabelValues(req.Context())); found {
+			prometheusAPIError(w, denial.Message, denial.StatusCode)
+			return
+		}
+
+		next(w, req)
+	}
+}
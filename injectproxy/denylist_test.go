@@ -0,0 +1,97 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDenyList(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	d := NewDenyList()
+	if err := d.Set("ns1", Denial{StatusCode: http.StatusServiceUnavailable, Message: "maintenance"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.Set("ns2", Denial{StatusCode: http.StatusTeapot}); err == nil {
+		t.Fatal("expected error for invalid status code")
+	}
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithDenyList(d))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := func(t *testing.T, values string, expCode int, expBody string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+values, nil))
+
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != expCode {
+			t.Fatalf("expected status code %d, got %d: %s", expCode, resp.StatusCode, string(body))
+		}
+		if !strings.Contains(string(body), expBody) {
+			t.Fatalf("expected body to contain %q, got %q", expBody, string(body))
+		}
+	}
+
+	query(t, "namespace=ns1", http.StatusServiceUnavailable, "maintenance")
+	query(t, "namespace=ns2&namespace=ns1", http.StatusServiceUnavailable, "maintenance")
+	query(t, "namespace=ns2", http.StatusOK, string(okResponse))
+
+	// Update the deny-list at runtime.
+	for _, tc := range []struct {
+		method string
+		value  string
+		body   string
+
+		expCode int
+	}{
+		{method: http.MethodPut, value: "ns2", expCode: http.StatusNoContent},
+		{method: http.MethodDelete, value: "ns1", expCode: http.StatusNoContent},
+		{method: http.MethodPut, value: "ns3", body: `{"status_code":200}`, expCode: http.StatusBadRequest},
+		{method: http.MethodPut, value: "", expCode: http.StatusBadRequest},
+		{method: http.MethodPost, value: "ns3", expCode: http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest(tc.method, "http://localhost/-/blocked-tenants?value="+tc.value, strings.NewReader(tc.body)))
+		if resp := w.Result(); resp.StatusCode != tc.expCode {
+			t.Fatalf("%s %q: expected status code %d, got %d", tc.method, tc.value, tc.expCode, resp.StatusCode)
+		}
+	}
+
+	query(t, "namespace=ns1", http.StatusOK, string(okResponse))
+	query(t, "namespace=ns2", http.StatusForbidden, defaultDenialMessage)
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/-/blocked-tenants", nil))
+	var got map[string]Denial
+	if err := json.NewDecoder(w.Result().Body).Decode(&got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got["ns2"].StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected deny-list: %v", got)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of the enforcement in dry-run mode.
+const (
+	dryRunUnchanged = "unchanged"
+	dryRunRewritten = "rewritten"
+	dryRunDenied    = "denied"
+)
+
+// WithDryRun enables the dry-run mode: the proxy enforces the label on the
+// requests as usual, logs and counts the outcome (unchanged, rewritten or
+// denied) but forwards the original requests to the upstream and returns the
+// upstream responses as-is. It helps to roll out the enforcement in front of
+// an existing upstream.
+func WithDryRun() Option {
+	return optionFunc(func(o *options) {
+		o.dryRun = true
+	})
+}
+
+type dryRun struct {
+	// forward sends the original requests to the upstream.
+	forward  http.Handler
+	requests *prometheus.CounterVec
+}
+
+func newDryRun(forward http.Handler, reg prometheus.Registerer) *dryRun {
+	d := &dryRun{
+		forward: forward,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom_label_proxy_dry_run_requests_total",
+			Help: "Total number of requests evaluated in dry-run mode by outcome of the enforcement.",
+		}, []string{"handler", "outcome"}),
+	}
+	reg.MustRegister(d.requests)
+
+	return d
+}
+
+// dryRunRequest is the request which the enforced handler would have sent to
+// the upstream.
+type dryRunRequest struct {
+	url  *url.URL
+	form bool
+	body []byte
+}
+
+func newDryRunRequest(req *http.Request) (*dryRunRequest, error) {
+	dr := &dryRunRequest{url: req.URL, form: isFormRequest(req)}
+	if req.Body == nil {
+		return dr, nil
+	}
+
+	var err error
+	dr.body, err = io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(dr.body))
+
+	return dr, err
+}
+
+// params returns the query parameters and the form values of the request.
+func (dr *dryRunRequest) params() url.Values {
+	params := dr.url.Query()
+	if !dr.form {
+		return params
+	}
+
+	form, err := url.ParseQuery(string(dr.body))
+	if err != nil {
+		return params
+	}
+	for k, vs := range form {
+		params[k] = append(params[k], vs...)
+	}
+
+	return params
+}
+
+// rewrites returns true if the enforced request differs from the original
+// one. The parameters removed by the enforcement (e.g. the query parameter
+// holding the label value) don't count as a rewrite.
+func (dr *dryRunRequest) rewrites(orig *dryRunRequest) bool {
+	origParams := orig.params()
+	for k, vs := range dr.params() {
+		if !slices.Equal(origParams[k], vs) {
+			return true
+		}
+	}
+
+	if dr.form || bytes.Equal(dr.body, orig.body) {
+		return false
+	}
+
+	// The JSON bodies (e.g. silences) are re-encoded by the enforcement.
+	var a, b interface{}
+	if json.Unmarshal(dr.body, &a) != nil || json.Unmarshal(orig.body, &b) != nil {
+		return true
+	}
+
+	return !reflect.DeepEqual(a, b)
+}
+
+// capture records the requests sent by the enforced handlers instead of
+// forwarding them when the request is evaluated in dry-run mode.
+func (d *dryRun) capture() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		captured, ok := req.Context().Value(keyDryRun).(**dryRunRequest)
+		if !ok {
+			d.forward.ServeHTTP(w, req)
+			return
+		}
+
+		dr, err := newDryRunRequest(req)
+		if err != nil {
+			prometheusAPIError(w, "can't read the request body", http.StatusBadRequest)
+			return
+		}
+		*captured = dr
+	})
+}
+
+// dryRunHandler evaluates the enforcement of the route on a copy of the
+// request and forwards the original request to the upstream.
+func (r *routes) dryRunHandler(rt Route, next http.Handler) http.Handler {
+	if r.dryRun == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		orig, err := newDryRunRequest(req)
+		if err != nil {
+			prometheusAPIError(w, "can't read the request body", http.StatusBadRequest)
+			return
+		}
+
+		var captured *dryRunRequest
+		enforced := req.Clone(context.WithValue(req.Context(), keyDryRun, &captured))
+		enforced.Body = io.NopCloser(bytes.NewReader(orig.body))
+		resp := &bufferedResponse{header: http.Header{}}
+		next.ServeHTTP(resp, enforced)
+
+		outcome := dryRunUnchanged
+		switch {
+		case resp.code >= http.StatusBadRequest:
+			outcome = dryRunDenied
+		case captured == nil || captured.rewrites(orig):
+			// The requests answered by the proxy itself count as rewrites.
+			outcome = dryRunRewritten
+		}
+
+		r.dryRun.requests.WithLabelValues(rt.Path, outcome).Inc()
+		if outcome != dryRunUnchanged {
+			attrs := []any{"path", req.URL.Path, "outcome", outcome, "original", req.URL.RawQuery}
+			switch {
+			case outcome == dryRunDenied:
+				attrs = append(attrs, "status", resp.code, "error", resp.body.String())
+			case captured != nil:
+				attrs = append(attrs, "enforced", captured.url.RawQuery)
+				if len(captured.body) > 0 {
+					attrs = append(attrs, "enforced_body", string(captured.body))
+				}
+			}
+			r.logger.Info("Dry-run enforcement", attrs...)
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(orig.body))
+		r.dryRun.forward.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDryRun(t *testing.T) {
+	const rules = `{"status":"success","data":{"groups":[{"name":"g","file":"f","rules":[{"name":"r","labels":{"namespace":"other"},"type":"recording"}]}]}}`
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		params url.Values
+
+		expOutcome string
+		expHandler string
+		expBody    string
+	}{
+		{
+			name:       "rewritten query",
+			method:     http.MethodGet,
+			path:       "/api/v1/query",
+			params:     url.Values{"query": {"up"}, "namespace": {"ns1"}},
+			expOutcome: dryRunRewritten,
+			expHandler: "/api/v1/query",
+		},
+		{
+			name:       "rewritten POST query",
+			method:     http.MethodPost,
+			path:       "/api/v1/query",
+			params:     url.Values{"query": {"up"}, "namespace": {"ns1"}},
+			expOutcome: dryRunRewritten,
+			expHandler: "/api/v1/query",
+		},
+		{
+			name:       "unchanged query",
+			method:     http.MethodGet,
+			path:       "/api/v1/query",
+			params:     url.Values{"query": {`up{namespace="ns1"}`}, "namespace": {"ns1"}},
+			expOutcome: dryRunUnchanged,
+			expHandler: "/api/v1/query",
+		},
+		{
+			name:       "denied query",
+			method:     http.MethodGet,
+			path:       "/api/v1/query",
+			params:     url.Values{"query": {"up"}},
+			expOutcome: dryRunDenied,
+			expHandler: "/api/v1/query",
+		},
+		{
+			name:       "unfiltered response",
+			method:     http.MethodGet,
+			path:       "/api/v1/rules",
+			params:     url.Values{"namespace": {"ns1"}},
+			expOutcome: dryRunUnchanged,
+			expHandler: "/api/v1/rules",
+			expBody:    rules,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// The original request is forwarded.
+				if err := req.ParseForm(); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				for k, vs := range tc.params {
+					if got := req.Form[k]; fmt.Sprint(got) != fmt.Sprint(vs) {
+						prometheusAPIError(w, fmt.Sprintf("expected %s=%v, got %v", k, vs, got), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				if req.URL.Path == "/api/v1/rules" {
+					w.Write([]byte(rules))
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			reg := prometheus.NewRegistry()
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithDryRun(), WithPrometheusRegistry(reg))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.path, strings.NewReader(tc.params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" {
+				if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+					t.Fatalf("expected body %q, got %q", tc.expBody, got)
+				}
+			}
+
+			exp := fmt.Sprintf(`# HELP prom_label_proxy_dry_run_requests_total Total number of requests evaluated in dry-run mode by outcome of the enforcement.
+# TYPE prom_label_proxy_dry_run_requests_total counter
+prom_label_proxy_dry_run_requests_total{handler=%q,outcome=%q} 1
+`, tc.expHandler, tc.expOutcome)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(exp), "prom_label_proxy_dry_run_requests_total"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -16,6 +16,8 @@ package injectproxy
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"sort"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -23,8 +25,12 @@ import (
 
 // PromQLEnforcer can enforce label matchers in PromQL expressions.
 type PromQLEnforcer struct {
-	labelMatchers  map[string]*labels.Matcher
-	errorOnReplace bool
+	labelMatchers       map[string]*labels.Matcher
+	errorOnReplace      bool
+	errorOnUnselective  bool
+	errorOnLabelRewrite bool
+	embeddedQueries     bool
+	policy              *QueryPolicy
 }
 
 func NewPromQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *PromQLEnforcer {
@@ -49,6 +55,18 @@ var (
 
 	// ErrEnforceLabel is returned when the label matchers couldn't be enforced.
 	ErrEnforceLabel = errors.New("failed to enforce label")
+
+	// ErrUnselectiveSelector is returned when the input query contains a
+	// selector which matches all the series of the tenant.
+	ErrUnselectiveSelector = errors.New("unselective selector")
+
+	// ErrLabelRewrite is returned when the input query overwrites an
+	// enforced label with label_replace() or label_join().
+	ErrLabelRewrite = errors.New("enforced label rewrite")
+
+	// ErrIllegalSeriesLabel is returned when a series of a remote write
+	// request has a conflicting value for an enforced label.
+	ErrIllegalSeriesLabel = errors.New("conflicting series label")
 )
 
 // Enforce the label matchers in a PromQL expression.
@@ -58,8 +76,14 @@ func (ms *PromQLEnforcer) Enforce(q string) (string, error) {
 		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
 	}
 
+	if ms.policy != nil {
+		if err := ms.policy.check(expr); err != nil {
+			return "", err
+		}
+	}
+
 	if err := ms.EnforceNode(expr); err != nil {
-		if errors.Is(err, ErrIllegalLabelMatcher) {
+		if errors.Is(err, ErrIllegalLabelMatcher) || errors.Is(err, ErrUnselectiveSelector) || errors.Is(err, ErrLabelRewrite) || errors.Is(err, ErrQueryPolicy) {
 			return "", err
 		}
 
@@ -69,6 +93,68 @@ func (ms *PromQLEnforcer) Enforce(q string) (string, error) {
 	return expr.String(), nil
 }
 
+// EnforceQueryValues enforces the label matchers in the PromQL expression of
+// the "query" parameter like the proxy does for the query endpoints (e.g.
+// /api/v1/query). The values are modified in place. It returns false if the
+// parameter is missing or empty.
+func EnforceQueryValues(e *PromQLEnforcer, v url.Values) (bool, error) {
+	if v.Get(queryParam) == "" {
+		return false, nil
+	}
+
+	q, err := e.Enforce(v.Get(queryParam))
+	if err != nil {
+		return true, err
+	}
+
+	v.Set(queryParam, q)
+
+	return true, nil
+}
+
+// EnforceMatchValues enforces the label matchers in the "match[]" selectors
+// like the proxy does for the /federate, /api/v1/series and labels endpoints:
+// the label matchers are appended to each selector or, if no selector is
+// given, a selector made of the label matchers is added. The values are
+// modified in place.
+func EnforceMatchValues(e *PromQLEnforcer, v url.Values) error {
+	enforced := e.matchers()
+
+	selectors := v[matchersParam]
+	if len(selectors) == 0 {
+		v.Set(matchersParam, matchersToString(enforced...))
+		return nil
+	}
+
+	for i, s := range selectors {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return err
+		}
+
+		if e.errorOnUnselective {
+			if err := e.checkSelective(ms); err != nil {
+				return err
+			}
+		}
+
+		selectors[i] = matchersToString(append(ms, enforced...)...)
+	}
+
+	return nil
+}
+
+// matchers returns the enforced label matchers sorted by label name.
+func (ms *PromQLEnforcer) matchers() []*labels.Matcher {
+	res := make([]*labels.Matcher, 0, len(ms.labelMatchers))
+	for _, m := range ms.labelMatchers {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
 // EnforceNode walks the given node recursively
 // and enforces the given label enforcer on it.
 //
@@ -105,6 +191,12 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 		}
 
 	case *parser.Call:
+		if ms.errorOnLabelRewrite {
+			if err := ms.checkLabelRewrite(n); err != nil {
+				return err
+			}
+		}
+
 		if err := ms.EnforceNode(n.Args); err != nil {
 			return err
 		}
@@ -130,6 +222,12 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 	case *parser.MatrixSelector:
 		// inject labelselector
 		if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+			if ms.embeddedQueries {
+				if err := ms.enforceEmbeddedQueries(vs.LabelMatchers); err != nil {
+					return err
+				}
+			}
+
 			var err error
 			vs.LabelMatchers, err = ms.EnforceMatchers(vs.LabelMatchers)
 			if err != nil {
@@ -138,6 +236,12 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 		}
 
 	case *parser.VectorSelector:
+		if ms.embeddedQueries {
+			if err := ms.enforceEmbeddedQueries(n.LabelMatchers); err != nil {
+				return err
+			}
+		}
+
 		// inject labelselector
 		var err error
 		n.LabelMatchers, err = ms.EnforceMatchers(n.LabelMatchers)
@@ -152,6 +256,35 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 	return nil
 }
 
+// checkLabelRewrite returns an error if the function call sets an enforced
+// label on the result: label_replace() and label_join() can overwrite the
+// enforced label of the selected series with any value.
+func (ms PromQLEnforcer) checkLabelRewrite(n *parser.Call) error {
+	if n.Func == nil || (n.Func.Name != "label_replace" && n.Func.Name != "label_join") || len(n.Args) < 2 {
+		return nil
+	}
+
+	dst := n.Args[1]
+	for {
+		p, ok := dst.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		dst = p.Expr
+	}
+
+	sl, ok := dst.(*parser.StringLiteral)
+	if !ok {
+		return nil
+	}
+
+	if _, found := ms.labelMatchers[sl.Val]; found {
+		return fmt.Errorf("%w: %s() can't set the %q label", ErrLabelRewrite, n.Func.Name, sl.Val)
+	}
+
+	return nil
+}
+
 // EnforceMatchers appends the enforced label matcher(s) to the list of matchers
 // if not already present.
 //
@@ -164,10 +297,23 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 //
 // * if errorOnReplace is true
 //   - And the label matcher and the enforced matcher are disjoint, the function returns an error.
-//   - Otherwise the existing matcher is preserved.
+//   - Otherwise the existing matcher is preserved (unless the enforced
+//     matcher type is '='). For instance, when multiple label values are
+//     enforced with a '=~' matcher, the matchers selecting a subset of the
+//     values are preserved.
+//
+// If errorOnUnselective is true and the selector has no matcher (except for the
+// enforced labels) which excludes the empty string, the function returns an
+// error because the selector would match all the series of the tenant.
 func (ms PromQLEnforcer) EnforceMatchers(targets []*labels.Matcher) ([]*labels.Matcher, error) {
 	var res []*labels.Matcher
 
+	if ms.errorOnUnselective {
+		if err := ms.checkSelective(targets); err != nil {
+			return res, err
+		}
+	}
+
 	for _, target := range targets {
 		matcher, ok := ms.labelMatchers[target.Name]
 		if !ok {
@@ -299,9 +445,23 @@ func (ms PromQLEnforcer) EnforceMatchers(targets []*labels.Matcher) ([]*labels.M
 		res = append(res, target)
 	}
 
-	for _, enforcedMatcher := range ms.labelMatchers {
-		res = append(res, enforcedMatcher)
-	}
+	res = append(res, ms.matchers()...)
 
 	return res, nil
 }
+
+// checkSelective returns an error if the given matchers would select all the
+// series once the enforced label matchers are added.
+func (ms PromQLEnforcer) checkSelective(targets []*labels.Matcher) error {
+	for _, target := range targets {
+		if _, ok := ms.labelMatchers[target.Name]; ok {
+			continue
+		}
+
+		if !target.Matches("") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: selector %s must contain at least one non-empty matcher in addition to the enforced label", ErrUnselectiveSelector, matchersToString(targets...))
+}
@@ -16,6 +16,7 @@ package injectproxy
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"testing"
 
 	"github.com/prometheus/prometheus/model/labels"
@@ -994,3 +995,225 @@ func TestEnforceWithErrOnReplace(t *testing.T) {
 		})
 	}
 }
+
+func TestEnforceWithErrOnUnselective(t *testing.T) {
+	for _, tc := range []struct {
+		expression string
+		check      checkFunc
+	}{
+		{
+			expression: `up`,
+			check: checks(
+				noError(),
+				hasExpression(`up{namespace="NS"}`),
+			),
+		},
+		{
+			expression: `{job="prometheus"}`,
+			check: checks(
+				noError(),
+				hasExpression(`{job="prometheus",namespace="NS"}`),
+			),
+		},
+		{
+			expression: `sum(rate({job=~".+"}[5m]))`,
+			check: checks(
+				noError(),
+				hasExpression(`sum(rate({job=~".+",namespace="NS"}[5m]))`),
+			),
+		},
+		{
+			expression: `{namespace="NS"}`,
+			check:      errorIs(ErrUnselectiveSelector),
+		},
+		{
+			expression: `{namespace="NS",job=~".*"}`,
+			check:      errorIs(ErrUnselectiveSelector),
+		},
+		{
+			expression: `up + count({namespace!~"",job=""})`,
+			check:      errorIs(ErrUnselectiveSelector),
+		},
+	} {
+		t.Run(tc.expression, func(t *testing.T) {
+			e := NewPromQLEnforcer(false, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+			e.errorOnUnselective = true
+
+			got, err := e.Enforce(tc.expression)
+			if err := tc.check(got, err); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEnforceWithErrOnLabelRewrite(t *testing.T) {
+	for _, tc := range []struct {
+		expression string
+		check      checkFunc
+	}{
+		{
+			expression: `label_replace(up, "instance", "$1", "job", "(.*)")`,
+			check: checks(
+				noError(),
+				hasExpression(`label_replace(up{namespace="NS"}, "instance", "$1", "job", "(.*)")`),
+			),
+		},
+		{
+			expression: `label_join(up, "id", ",", "namespace", "job")`,
+			check: checks(
+				noError(),
+				hasExpression(`label_join(up{namespace="NS"}, "id", ",", "namespace", "job")`),
+			),
+		},
+		{
+			expression: `label_replace(up, "namespace", "other", "", "")`,
+			check:      errorIs(ErrLabelRewrite),
+		},
+		{
+			expression: `label_join(up, "namespace", ",", "job")`,
+			check:      errorIs(ErrLabelRewrite),
+		},
+		{
+			expression: `label_replace(up, ("namespace"), "other", "", "")`,
+			check:      errorIs(ErrLabelRewrite),
+		},
+		{
+			expression: `sum by (namespace) (label_replace(label_replace(up, "tmp", "$1", "job", "(.*)"), "namespace", "$1", "tmp", "(.*)"))`,
+			check:      errorIs(ErrLabelRewrite),
+		},
+	} {
+		t.Run(tc.expression, func(t *testing.T) {
+			e := NewPromQLEnforcer(false, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+			e.errorOnLabelRewrite = true
+
+			got, err := e.Enforce(tc.expression)
+			if err := tc.check(got, err); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// The label rewrites are allowed by default.
+	e := NewPromQLEnforcer(false, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+	got, err := e.Enforce(`label_replace(up, "namespace", "other", "", "")`)
+	if err := checks(noError(), hasExpression(`label_replace(up{namespace="NS"}, "namespace", "other", "", "")`))(got, err); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnforceQueryValues(t *testing.T) {
+	for _, tc := range []struct {
+		values string
+
+		exp      string
+		expFound bool
+		expErr   bool
+	}{
+		{
+			values:   "query=up&time=1",
+			exp:      "query=up%7Bnamespace%3D%22NS%22%7D&time=1",
+			expFound: true,
+		},
+		{
+			values: "time=1",
+			exp:    "time=1",
+		},
+		{
+			values:   "query=up{",
+			expFound: true,
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.values, func(t *testing.T) {
+			v, err := url.ParseQuery(tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found, err := EnforceQueryValues(NewPromQLEnforcer(false, mustNewMatcher(labels.MatchEqual, "namespace", "NS")), v)
+			if found != tc.expFound {
+				t.Fatalf("expected found to be %v, got %v", tc.expFound, found)
+			}
+			if tc.expErr {
+				if !errors.Is(err, ErrQueryParse) {
+					t.Fatalf("expected ErrQueryParse, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := v.Encode(); got != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestEnforceMatchValues(t *testing.T) {
+	for _, tc := range []struct {
+		values      string
+		matchers    []*labels.Matcher
+		unselective bool
+
+		exp    []string
+		expErr bool
+	}{
+		{
+			matchers: []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			exp:      []string{`{namespace="NS"}`},
+		},
+		{
+			values:   "match[]=up&match[]={job=\"a\"}",
+			matchers: []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			exp:      []string{`{__name__="up",namespace="NS"}`, `{job="a",namespace="NS"}`},
+		},
+		{
+			values: "match[]=up",
+			matchers: []*labels.Matcher{
+				mustNewMatcher(labels.MatchEqual, "tenant", "T"),
+				mustNewMatcher(labels.MatchRegexp, "namespace", "NS1|NS2"),
+			},
+			exp: []string{`{__name__="up",namespace=~"NS1|NS2",tenant="T"}`},
+		},
+		{
+			values:      "match[]={job=\"\"}",
+			matchers:    []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			unselective: true,
+			expErr:      true,
+		},
+		{
+			values:   "match[]=up{",
+			matchers: []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.values, func(t *testing.T) {
+			v, err := url.ParseQuery(tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := NewPromQLEnforcer(false, tc.matchers...)
+			e.errorOnUnselective = tc.unselective
+
+			err = EnforceMatchValues(e, v)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := v[matchersParam]
+			if fmt.Sprint(got) != fmt.Sprint(tc.exp) {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
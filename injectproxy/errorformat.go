@@ -0,0 +1,92 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// alertmanagerPathPrefix is the prefix of the Alertmanager API v2 paths.
+const alertmanagerPathPrefix = "/api/v2/"
+
+// ErrorFormat defines the format of the error responses returned by the
+// proxy.
+type ErrorFormat string
+
+const (
+	// ErrorFormatAuto returns Alertmanager errors for the paths of the
+	// Alertmanager API (/api/v2/) and Prometheus errors for the other paths.
+	ErrorFormatAuto ErrorFormat = "auto"
+	// ErrorFormatPrometheus returns errors in the format of the Prometheus
+	// API ({"status":"error","errorType":"...","error":"..."}).
+	ErrorFormatPrometheus ErrorFormat = "prometheus"
+	// ErrorFormatAlertmanager returns errors in the format of the
+	// Alertmanager API v2 (a JSON string) which is decoded by amtool.
+	ErrorFormatAlertmanager ErrorFormat = "alertmanager"
+)
+
+// WithErrorFormat configures the format of the error responses returned by
+// the proxy. The default is ErrorFormatAuto.
+func WithErrorFormat(f ErrorFormat) Option {
+	return optionFunc(func(o *options) {
+		o.errorFormat = f
+	})
+}
+
+// apiErrorWriter is a http.ResponseWriter which carries the format of the
+// errors written by prometheusAPIError and the logger of the routes.
+type apiErrorWriter struct {
+	http.ResponseWriter
+	format ErrorFormat
+	logger *slog.Logger
+}
+
+// Unwrap returns the underlying http.ResponseWriter (used by
+// http.ResponseController).
+func (w *apiErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAPIErrors wraps the response writer with the format of the errors of
+// the request and the logger of the routes.
+func (r *routes) withAPIErrors(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	f := r.errorFormat
+	if f == ErrorFormatAuto {
+		f = ErrorFormatPrometheus
+		if strings.HasPrefix(req.URL.Path, alertmanagerPathPrefix) {
+			f = ErrorFormatAlertmanager
+		}
+	}
+
+	return &apiErrorWriter{ResponseWriter: w, format: f, logger: r.logger}
+}
+
+// responseAPIErrors returns the format of the errors written to w and the
+// logger reporting the failures to write them. The response writers wrapped
+// by the handlers are unwrapped to find them. It defaults to the Prometheus
+// format and to the default logger when w isn't served by the routes.
+func responseAPIErrors(w http.ResponseWriter) (ErrorFormat, *slog.Logger) {
+	for {
+		switch v := w.(type) {
+		case *apiErrorWriter:
+			return v.format, v.logger
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return ErrorFormatPrometheus, slog.Default()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorFormat(t *testing.T) {
+	const (
+		prometheusError   = `{"error":"The \"namespace\" query parameter must be provided.","errorType":"prom-label-proxy","status":"error"}`
+		alertmanagerError = `"The \"namespace\" query parameter must be provided."`
+	)
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		opts []Option
+
+		expBody string
+	}{
+		{
+			name:    "Prometheus path",
+			url:     "/api/v1/query?query=up",
+			expBody: prometheusError,
+		},
+		{
+			name:    "Alertmanager path",
+			url:     "/api/v2/alerts/groups",
+			expBody: alertmanagerError,
+		},
+		{
+			name:    "Alertmanager path with response headers",
+			url:     "/api/v2/alerts/groups",
+			opts:    []Option{WithResponseHeaders(map[string]string{"X-Foo": "bar"})},
+			expBody: alertmanagerError,
+		},
+		{
+			name:    "Alertmanager path with Prometheus format",
+			url:     "/api/v2/alerts/groups",
+			opts:    []Option{WithErrorFormat(ErrorFormatPrometheus)},
+			expBody: prometheusError,
+		},
+		{
+			name:    "Prometheus path with Alertmanager format",
+			url:     "/api/v1/query?query=up",
+			opts:    []Option{WithErrorFormat(ErrorFormatAlertmanager)},
+			expBody: alertmanagerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "unexpected request", http.StatusTeapot)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Fatalf("expected JSON content type, got %q", got)
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body %s, got %s", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestInvalidErrorFormat(t *testing.T) {
+	_, err := NewRoutes(nil, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithErrorFormat("xml"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// failingWriter is a http.ResponseWriter whose writes fail.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestErrorLogger(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewRoutes(nil, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithLogger(newTestLogger(&buf)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := failingWriter{httptest.NewRecorder()}
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if exp := `msg="Failed to encode JSON" err="broken pipe"`; !strings.Contains(buf.String(), exp) {
+		t.Fatalf("expected log to contain %q, got %q", exp, buf.String())
+	}
+}
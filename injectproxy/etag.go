@@ -0,0 +1,79 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// setETag computes the ETag of a successful response to a GET request and
+// replaces the response with "304 Not Modified" if it matches the
+// If-None-Match header of the request.
+// The upstream APIs don't support conditional requests, the response is
+// always fetched from the upstream and only the bandwidth between the proxy
+// and the client is saved. The server-sent events are streamed without ETag.
+func setETag(resp *http.Response) error {
+	if resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "text/event-stream" {
+		return nil
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't read the response: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	h := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(h[:16]) + `"`
+	resp.Header.Set("ETag", etag)
+
+	if !etagMatch(resp.Request.Header.Get("If-None-Match"), etag) {
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		resp.Header["Content-Length"] = []string{fmt.Sprint(len(b))}
+		return nil
+	}
+
+	resp.StatusCode = http.StatusNotModified
+	resp.Status = fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-Type")
+
+	return nil
+}
+
+// etagMatch implements the weak comparison of the If-None-Match header
+// (RFC 9110, section 13.1.2).
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
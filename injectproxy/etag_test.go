@@ -0,0 +1,106 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETags(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithETags())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const u = "http://prometheus.example.com/api/v1/query?namespace=ns1&query=up"
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		ifNoneMatch string
+
+		expCode int
+	}{
+		{
+			name:        "matching ETag",
+			ifNoneMatch: etag,
+			expCode:     http.StatusNotModified,
+		},
+		{
+			name:        "matching weak ETag in a list",
+			ifNoneMatch: `"foo", W/` + etag,
+			expCode:     http.StatusNotModified,
+		},
+		{
+			name:        "wildcard",
+			ifNoneMatch: "*",
+			expCode:     http.StatusNotModified,
+		},
+		{
+			name:        "different ETag",
+			ifNoneMatch: `"foo"`,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        "POST request",
+			method:      http.MethodPost,
+			ifNoneMatch: etag,
+			expCode:     http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, u, nil)
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if tc.expCode == http.StatusNotModified && len(body) != 0 {
+				t.Fatalf("expected empty body, got %q", string(body))
+			}
+			if tc.expCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// extraLabel is an additional label enforced by the proxy.
+type extraLabel struct {
+	name string
+	el   ExtractLabeler
+}
+
+// WithExtraLabel enforces an additional label whose values are extracted
+// from the request by the given ExtractLabeler (e.g. HTTPHeaderEnforcer).
+// The label is enforced together with the proxy's label on the PromQL
+// queries, the match[] selectors, the rules, the alerts and the silences.
+// The regex match mode, the limits and the deny-list only apply to the
+// proxy's label.
+func WithExtraLabel(name string, el ExtractLabeler) Option {
+	return optionFunc(func(o *options) {
+		o.extraLabels = append(o.extraLabels, extraLabel{name: name, el: el})
+	})
+}
+
+// validateExtraLabels verifies that the label names are set and unique.
+func validateExtraLabels(label string, extra []extraLabel) error {
+	seen := map[string]struct{}{label: {}}
+	for _, e := range extra {
+		if e.name == "" {
+			return errors.New("the name of an extra label can't be empty")
+		}
+
+		if e.el == nil {
+			return fmt.Errorf("extra label %q: missing label extractor", e.name)
+		}
+
+		if _, found := seen[e.name]; found {
+			return fmt.Errorf("label %q is enforced more than once", e.name)
+		}
+		seen[e.name] = struct{}{}
+	}
+
+	return nil
+}
+
+// extractExtraLabels extracts the values of the additional labels once the
+// proxy's label values are known.
+func (r *routes) extractExtraLabels(next http.HandlerFunc) http.HandlerFunc {
+	for i := len(r.extraLabels) - 1; i >= 0; i-- {
+		next = r.extraLabels[i].extract(next)
+	}
+
+	return next
+}
+
+func (e extraLabel) extract(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// The label extractor overwrites the values of the proxy's label
+		// which are restored.
+		values := MustLabelValues(req.Context())
+
+		e.el.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+			ctx := withExtraLabelValues(req.Context(), e.name, MustLabelValues(req.Context()))
+			next(w, req.WithContext(WithLabelValues(ctx, values)))
+		}).ServeHTTP(w, req)
+	}
+}
+
+// extraLabelMatchers returns the PromQL matchers of the additional enforced
+// labels.
+func (r *routes) extraLabelMatchers(ctx context.Context) ([]*labels.Matcher, error) {
+	enforced := r.enforcedLabels(ctx)[1:]
+
+	ms := make([]*labels.Matcher, 0, len(enforced))
+	for _, el := range enforced {
+		typ, value := labels.MatchEqual, el.values[0]
+		if len(el.values) > 1 || r.matchType == labels.MatchRegexp {
+			typ, value = labels.MatchRegexp, labelValuesToRegexpString(el.values)
+		}
+
+		m, err := labels.NewMatcher(typ, el.name, value)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
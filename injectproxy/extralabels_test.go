@@ -0,0 +1,131 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtraLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		upstream http.Handler
+		path     string
+		header   http.Header
+
+		expCode int
+		expErr  bool
+	}{
+		{
+			name:     "query with header value",
+			opts:     []Option{WithExtraLabel("cluster", HTTPHeaderEnforcer{Name: "X-Cluster"})},
+			upstream: checkQueryHandler("", queryParam, `up{cluster="eu",namespace="ns1"}`),
+			path:     "/api/v1/query?query=up&namespace=ns1",
+			header:   http.Header{"X-Cluster": []string{"eu"}},
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query with multiple values",
+			opts:     []Option{WithExtraLabel("cluster", HTTPHeaderEnforcer{Name: "X-Cluster"})},
+			upstream: checkQueryHandler("", queryParam, `up{cluster=~"eu|us",namespace="ns1"}`),
+			path:     "/api/v1/query?query=up&namespace=ns1",
+			header:   http.Header{"X-Cluster": []string{"us", "eu"}},
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query overriding the extra label",
+			opts:     []Option{WithExtraLabel("cluster", StaticLabelEnforcer{"eu"})},
+			upstream: checkQueryHandler("", queryParam, `up{cluster="eu",namespace="ns1"}`),
+			path:     "/api/v1/query?query=up{cluster=\"us\"}&namespace=ns1",
+			expCode:  http.StatusOK,
+		},
+		{
+			name: "series with query parameter value",
+			opts: []Option{
+				WithExtraLabel("cluster", HTTPFormEnforcer{ParameterName: "cluster"}),
+				WithExtraLabel("region", StaticLabelEnforcer{"west"}),
+			},
+			upstream: checkParameterAbsent("cluster", checkQueryHandler("", matchersParam, `{__name__="up",cluster="eu",namespace="ns1",region="west"}`)),
+			path:     "/api/v1/series?match[]=up&namespace=ns1&cluster=eu",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "missing extra label value",
+			opts:     []Option{WithExtraLabel("cluster", HTTPHeaderEnforcer{Name: "X-Cluster"})},
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) }),
+			path:     "/api/v1/query?query=up&namespace=ns1",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "alerts",
+			opts:     []Option{WithExtraLabel("cluster", StaticLabelEnforcer{"eu"})},
+			upstream: checkQueryHandler("", "filter", `namespace="ns1"`, `cluster="eu"`, `alertname="foo"`),
+			path:     "/api/v2/alerts?filter=alertname%3D%22foo%22&filter=cluster%3D%22us%22&namespace=ns1",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:   "duplicate label",
+			opts:   []Option{WithExtraLabel(proxyLabel, StaticLabelEnforcer{"eu"})},
+			expErr: true,
+		},
+		{
+			name:   "empty label name",
+			opts:   []Option{WithExtraLabel("", StaticLabelEnforcer{"eu"})},
+			expErr: true,
+		},
+		{
+			name:   "missing label extractor",
+			opts:   []Option{WithExtraLabel("cluster", nil)},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := tc.upstream
+			if upstream == nil {
+				upstream = http.NotFoundHandler()
+			}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// federateFormat is the exposition format requested to the upstream when the
+// /federate responses are filtered.
+var federateFormat = expfmt.NewFormat(expfmt.TypeTextPlain)
+
+// WithFederateFiltering verifies the responses of the /federate endpoint for
+// upstreams which may not apply the "match[]" selectors as expected (e.g.
+// when they union the selectors). The upstream is requested to reply in the
+// text exposition format and the series which don't match the enforced
+// labels are removed from the response.
+func WithFederateFiltering() Option {
+	return optionFunc(func(o *options) {
+		o.federateFiltering = true
+	})
+}
+
+// filterFederation requests the text exposition format to the upstream and
+// filters the series of the response. It must be followed by a handler
+// enforcing the "match[]" selectors (e.g. matcher).
+func (r *routes) filterFederation(next http.HandlerFunc) http.HandlerFunc {
+	if !r.federateFiltering {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		req = req.Clone(context.WithValue(req.Context(), keyResponseModifier, r.filterFederateResponse))
+		req.Header.Set("Accept", string(federateFormat))
+
+		next(w, req)
+	}
+}
+
+// filterFederateResponse removes the series which don't match the enforced
+// labels from the /federate response. The metric families without series are
+// removed too.
+func (r *routes) filterFederateResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// Pass non-200 responses as-is.
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mt != "text/plain" {
+		return fmt.Errorf("unexpected content type %q for the federation response", resp.Header.Get("Content-Type"))
+	}
+
+	m, err := r.newLabelsMatcher(MustLabelValues(resp.Request.Context()), resp.Request)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't decode the federation response: %w", err)
+	}
+
+	names := make([]string, 0, len(families))
+	for name, mf := range families {
+		mf.Metric = slices.DeleteFunc(mf.Metric, func(metric *dto.Metric) bool {
+			return !m.matches(metricLabels(name, metric))
+		})
+		if len(mf.Metric) > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, federateFormat)
+	for _, name := range names {
+		if err := enc.Encode(families[name]); err != nil {
+			return fmt.Errorf("can't encode the federation response: %w", err)
+		}
+	}
+
+	resp.Header.Set("Content-Type", string(federateFormat))
+	replaceBody(resp, buf.Bytes())
+
+	return nil
+}
+
+func metricLabels(name string, metric *dto.Metric) labels.Labels {
+	b := labels.NewScratchBuilder(len(metric.Label) + 1)
+	b.Add(labels.MetricName, name)
+	for _, lp := range metric.Label {
+		b.Add(lp.GetName(), lp.GetValue())
+	}
+	b.Sort()
+
+	return b.Labels()
+}
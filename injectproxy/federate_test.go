@@ -0,0 +1,151 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const federateResponse = `# TYPE up untyped
+up{instance="a",job="prometheus",namespace="ns1"} 1 1714400000000
+up{instance="b",job="prometheus",namespace="ns2"} 1 1714400000000
+# TYPE other_tenant_metric untyped
+other_tenant_metric{namespace="ns2"} 42 1714400000000
+# TYPE unlabeled_metric untyped
+unlabeled_metric 3 1714400000000
+# TYPE requests_total counter
+requests_total{code="200",namespace="ns1"} 10 1714400000000
+requests_total{code="200",namespace="ns3"} 20 1714400000000
+`
+
+func TestFederateFiltering(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		labelv      string
+		opts        []Option
+		contentType string
+		encoding    string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "not filtered",
+			labelv:  "namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: federateResponse,
+		},
+		{
+			name:    "filtered",
+			labelv:  "namespace=ns1",
+			opts:    []Option{WithFederateFiltering()},
+			expCode: http.StatusOK,
+			expBody: `# TYPE requests_total counter
+requests_total{code="200",namespace="ns1"} 10 1714400000000
+# TYPE up untyped
+up{instance="a",job="prometheus",namespace="ns1"} 1 1714400000000
+`,
+		},
+		{
+			name:    "filtered with multiple label values",
+			labelv:  "namespace=ns2&namespace=ns3",
+			opts:    []Option{WithFederateFiltering()},
+			expCode: http.StatusOK,
+			expBody: `# TYPE other_tenant_metric untyped
+other_tenant_metric{namespace="ns2"} 42 1714400000000
+# TYPE requests_total counter
+requests_total{code="200",namespace="ns3"} 20 1714400000000
+# TYPE up untyped
+up{instance="b",job="prometheus",namespace="ns2"} 1 1714400000000
+`,
+		},
+		{
+			name:     "filtered compressed response",
+			labelv:   "namespace=ns1",
+			opts:     []Option{WithFederateFiltering()},
+			encoding: "gzip",
+			expCode:  http.StatusOK,
+			expBody: `# TYPE requests_total counter
+requests_total{code="200",namespace="ns1"} 10 1714400000000
+# TYPE up untyped
+up{instance="a",job="prometheus",namespace="ns1"} 1 1714400000000
+`,
+		},
+		{
+			name:        "unexpected content type",
+			labelv:      "namespace=ns1",
+			opts:        []Option{WithFederateFiltering()},
+			contentType: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+			expCode:     http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkFormParameterAbsent(proxyLabel, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				contentType := tc.contentType
+				if contentType == "" {
+					contentType = "text/plain; version=0.0.4; charset=utf-8"
+				}
+				w.Header().Set("Content-Type", contentType)
+
+				if accept := req.Header.Get("Accept"); len(tc.opts) > 0 && !strings.HasPrefix(accept, "text/plain") {
+					http.Error(w, "unexpected Accept header: "+accept, http.StatusNotAcceptable)
+					return
+				}
+
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+					w.Write(compress(t, tc.encoding, []byte(federateResponse)))
+					return
+				}
+				w.Write([]byte(federateResponse))
+			})))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/federate?match[]=up&"+tc.labelv, nil)
+			req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+			if tc.encoding != "" {
+				req.Header.Set("Accept-Encoding", tc.encoding)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			body := w.Body.Bytes()
+			if tc.encoding != "" {
+				body = decompress(t, tc.encoding, body)
+			}
+			if string(body) != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ResponseFilter describes how to filter the JSON responses of an endpoint
+// which isn't natively supported by the proxy. The items of the array which
+// don't match the enforced label values are removed from the response.
+type ResponseFilter struct {
+	// Path is the path of the endpoint.
+	Path string
+	// Array is the dot-separated path of the array in the JSON response
+	// (e.g. "data.targets"). If empty, the response itself is the array.
+	Array string
+	// Labels is the dot-separated path of the labels object in the array
+	// items (e.g. "labels"). If empty, the string fields of the items are
+	// the labels.
+	Labels string
+}
+
+// WithResponseFilters registers a route for each filter. The requests are
+// forwarded without modification (only GET is accepted) and the items of the
+// upstream response are filtered according to the enforced label values.
+func WithResponseFilters(filters ...ResponseFilter) Option {
+	return optionFunc(func(o *options) {
+		o.responseFilters = filters
+	})
+}
+
+// registerResponseFilters registers the routes of the response filters.
+func (r *routes) registerResponseFilters(mux *router, filters []ResponseFilter) error {
+	for _, f := range filters {
+		u, err := url.Parse("http://example.com" + f.Path)
+		if err != nil || u.Path != f.Path || f.Path == "" || f.Path == "/" {
+			return fmt.Errorf("response filter: path %q is not allowed", f.Path)
+		}
+
+		if err := r.handle(mux, Route{Path: f.Path, Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough); err != nil {
+			return fmt.Errorf("response filter: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// filterResponse returns a response modifier which removes the array items
+// not matching the enforced label values.
+func (r *routes) filterResponse(f ResponseFilter) func(*http.Response) error {
+	var (
+		arrayPath  = splitJSONPath(f.Array)
+		labelsPath = splitJSONPath(f.Labels)
+	)
+
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			// Pass non-200 responses as-is.
+			return nil
+		}
+
+		raw, err := readJSONBody(resp)
+		if err != nil {
+			return fmt.Errorf("can't decode the response: %w", err)
+		}
+
+		m, err := r.newLabelsMatcher(MustLabelValues(resp.Request.Context()), resp.Request)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+		}
+
+		b, err := filterJSONArray(raw, arrayPath, func(item *rawObject) bool {
+			return m.matches(labelsAt(item, labelsPath))
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+		}
+
+		replaceBody(resp, append(b, '\n'))
+
+		return nil
+	}
+}
+
+func splitJSONPath(p string) []string {
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, ".")
+}
+
+// filterJSONArray removes the items of the array located at the given path
+// for which keep returns false. The other values are left untouched.
+func filterJSONArray(raw json.RawMessage, path []string, keep func(*rawObject) bool) (json.RawMessage, error) {
+	if len(path) == 0 {
+		var items []*rawObject
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("can't decode array: %w", err)
+		}
+		if items == nil {
+			return raw, nil
+		}
+
+		filtered := []*rawObject{}
+		for _, item := range items {
+			if keep(item) {
+				filtered = append(filtered, item)
+			}
+		}
+
+		return marshalJSON(filtered)
+	}
+
+	var o *rawObject
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return nil, fmt.Errorf("can't decode %q: %w", path[0], err)
+	}
+	if o == nil {
+		return raw, nil
+	}
+
+	v, found := o.values[path[0]]
+	if !found {
+		// Nothing to filter.
+		return raw, nil
+	}
+
+	v, err := filterJSONArray(v, path[1:], keep)
+	if err != nil {
+		return nil, err
+	}
+	o.setRaw(path[0], v)
+
+	return marshalJSON(o)
+}
+
+// labelsAt returns the string fields of the object located at the given path.
+func labelsAt(o *rawObject, path []string) labels.Labels {
+	for _, k := range path {
+		var next *rawObject
+		if err := o.decode(k, &next); err != nil {
+			return labels.EmptyLabels()
+		}
+		o = next
+	}
+
+	if o == nil {
+		return labels.EmptyLabels()
+	}
+
+	b := labels.NewScratchBuilder(len(o.keys))
+	for _, k := range o.keys {
+		if s := o.str(k); s != "" {
+			b.Add(k, s)
+		}
+	}
+	b.Sort()
+
+	return b.Labels()
+}
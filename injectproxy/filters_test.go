@@ -0,0 +1,152 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseFilters(t *testing.T) {
+	const (
+		targets = `{"status":"success","data":{"targets":[` +
+			`{"labels":{"job":"a","namespace":"ns1"},"health":"up"},` +
+			`{"labels":{"job":"b","namespace":"ns2"},"health":"up"},` +
+			`{"labels":{"job":"c"},"health":"down"},` +
+			`null` +
+			`],"total":3}}`
+		receivers = `[{"name":"r1","namespace":"ns1"},{"name":"r2","namespace":"ns2","active":true},{"name":"r3"}]`
+	)
+
+	for _, tc := range []struct {
+		name     string
+		filters  []ResponseFilter
+		upstream string
+		method   string
+		url      string
+
+		expCode int
+		expBody string
+		expErr  bool
+	}{
+		{
+			name:     "nested array",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.targets", Labels: "labels"}},
+			upstream: targets,
+			url:      "/api/v1/custom?namespace=ns1",
+			expCode:  http.StatusOK,
+			expBody:  `{"status":"success","data":{"targets":[{"labels":{"job":"a","namespace":"ns1"},"health":"up"}],"total":3}}`,
+		},
+		{
+			name:     "multiple label values",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.targets", Labels: "labels"}},
+			upstream: targets,
+			url:      "/api/v1/custom?namespace=ns1&namespace=ns2",
+			expCode:  http.StatusOK,
+			expBody:  `{"status":"success","data":{"targets":[{"labels":{"job":"a","namespace":"ns1"},"health":"up"},{"labels":{"job":"b","namespace":"ns2"},"health":"up"}],"total":3}}`,
+		},
+		{
+			name:     "top-level array",
+			filters:  []ResponseFilter{{Path: "/api/v2/receivers"}},
+			upstream: receivers,
+			url:      "/api/v2/receivers?namespace=ns2",
+			expCode:  http.StatusOK,
+			expBody:  `[{"name":"r2","namespace":"ns2","active":true}]`,
+		},
+		{
+			name:     "missing array",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.items", Labels: "labels"}},
+			upstream: targets,
+			url:      "/api/v1/custom?namespace=ns1",
+			expCode:  http.StatusOK,
+			expBody:  targets,
+		},
+		{
+			name:     "not an array",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.total"}},
+			upstream: targets,
+			url:      "/api/v1/custom?namespace=ns1",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "missing label value",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.targets", Labels: "labels"}},
+			upstream: targets,
+			url:      "/api/v1/custom",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "sub-path",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.targets", Labels: "labels"}},
+			upstream: targets,
+			url:      "/api/v1/custom/foo?namespace=ns1",
+			expCode:  http.StatusNotFound,
+		},
+		{
+			name:     "unsupported method",
+			filters:  []ResponseFilter{{Path: "/api/v1/custom", Array: "data.targets", Labels: "labels"}},
+			upstream: targets,
+			method:   http.MethodPost,
+			url:      "/api/v1/custom?namespace=ns1",
+			expCode:  http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "built-in route",
+			filters: []ResponseFilter{{Path: "/api/v1/rules", Array: "data.groups"}},
+			expErr:  true,
+		},
+		{
+			name:    "invalid path",
+			filters: []ResponseFilter{{Path: "/"}},
+			expErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithResponseFilters(tc.filters...))
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// GRPCPassthrough forwards the gRPC services (e.g. "thanos.Store") to the
+// upstream without enforcement.
+type GRPCPassthrough struct {
+	// Services lists the fully-qualified names of the gRPC services.
+	Services []string
+	// Upstream is the URL of the gRPC server. The default upstream is used
+	// if nil. With the "http" scheme, the requests are sent with HTTP/2
+	// over cleartext (h2c).
+	Upstream *url.URL
+}
+
+// WithGRPCPassthrough forwards the gRPC requests for the given services
+// (e.g. /thanos.Store/Series) to the upstream without enforcement. The
+// clients must connect with HTTP/2: use NewH2CHandler for a cleartext
+// listener.
+func WithGRPCPassthrough(g GRPCPassthrough) Option {
+	return optionFunc(func(o *options) {
+		o.grpcPassthrough = &g
+	})
+}
+
+// NewH2CHandler returns a handler which serves the HTTP/2 requests over
+// cleartext connections (h2c) in addition to the HTTP/1 requests.
+func NewH2CHandler(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// newH2CTransport returns the transport sending the requests with HTTP/2
+// over cleartext connections.
+func newH2CTransport() http.RoundTripper {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// grpcProxy returns the reverse proxy of the gRPC requests. The responses
+// are streamed to the clients as-is, including the trailers.
+func (r *routes) grpcProxy(g *GRPCPassthrough, transport http.RoundTripper, tp trace.TracerProvider) http.Handler {
+	upstream := g.Upstream
+	if upstream == nil {
+		upstream = r.upstream
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.FlushInterval = -1
+	if upstream.Scheme == "http" {
+		transport = newH2CTransport()
+		if tp != nil {
+			transport = traceTransport(transport, tp)
+		}
+	}
+	if transport != nil {
+		proxy.Transport = transport
+	}
+
+	return proxy
+}
+
+// registerGRPCPassthrough registers the passthrough routes of the gRPC
+// services.
+func (r *routes) registerGRPCPassthrough(mux *router, g *GRPCPassthrough, transport http.RoundTripper, tp trace.TracerProvider) error {
+	if g.Upstream != nil && g.Upstream.Scheme != "http" && g.Upstream.Scheme != "https" {
+		return fmt.Errorf("invalid scheme for the gRPC upstream %q, only 'http' and 'https' are supported", g.Upstream.Redacted())
+	}
+
+	proxy := r.grpcProxy(g, transport, tp)
+	for _, s := range g.Services {
+		if s == "" || strings.ContainsAny(s, "/{}") {
+			return fmt.Errorf("invalid gRPC service name %q", s)
+		}
+
+		if err := r.handle(mux, Route{Path: "/" + s, Enforcement: EnforcementNone, Methods: []string{http.MethodPost}, Passthrough: true}, proxy.ServeHTTP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
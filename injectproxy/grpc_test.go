@@ -0,0 +1,154 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestGRPCPassthrough(t *testing.T) {
+	// The upstream only accepts HTTP/2 requests, like gRPC servers.
+	upstream := httptest.NewServer(NewH2CHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(req.URL.Path + ":" + string(body)))
+		w.Header().Set("Grpc-Status", "0")
+	})))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	r, err := NewRoutes(
+		&url.URL{},
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithGRPCPassthrough(GRPCPassthrough{Services: []string{"thanos.Store"}, Upstream: u}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	proxy := httptest.NewServer(NewH2CHandler(r))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+
+		expCode    int
+		expBody    string
+		expTrailer string
+	}{
+		{
+			name:       "gRPC method",
+			method:     http.MethodPost,
+			path:       "/thanos.Store/Series",
+			expCode:    http.StatusOK,
+			expBody:    "/thanos.Store/Series:payload",
+			expTrailer: "0",
+		},
+		{
+			name:    "GET method",
+			method:  http.MethodGet,
+			path:    "/thanos.Store/Series",
+			expCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "other service",
+			method:  http.MethodPost,
+			path:    "/thanos.Rules/Rules",
+			expCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, proxy.URL+tc.path, strings.NewReader("payload"))
+			req.Header.Set("Content-Type", "application/grpc")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, body)
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if string(body) != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, body)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != tc.expTrailer {
+				t.Fatalf("expected Grpc-Status trailer %q, got %q", tc.expTrailer, got)
+			}
+		})
+	}
+}
+
+func TestGRPCPassthroughInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		g    GRPCPassthrough
+	}{
+		{
+			name: "empty service",
+			g:    GRPCPassthrough{Services: []string{""}},
+		},
+		{
+			name: "service with slash",
+			g:    GRPCPassthrough{Services: []string{"thanos.Store/Series"}},
+		},
+		{
+			name: "invalid upstream scheme",
+			g:    GRPCPassthrough{Services: []string{"thanos.Store"}, Upstream: &url.URL{Scheme: "grpc", Host: "thanos:10901"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithGRPCPassthrough(tc.g))
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// HeaderMappingEnforcer enforces the label values mapped to the values of an
+// HTTP header holding the client's identity (e.g. the user or organization
+// set by an authenticating gateway). When the header has several values,
+// the union of the mapped label values is enforced.
+type HeaderMappingEnforcer struct {
+	Name            string
+	ParseListSyntax bool
+	// Mapping maps the header values to the label values.
+	Mapping map[string][]string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (hme HeaderMappingEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identities, err := HTTPHeaderEnforcer{Name: hme.Name, ParseListSyntax: hme.ParseListSyntax}.getLabelValues(r)
+		if err != nil {
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+			return
+		}
+
+		var labelValues []string
+		for _, id := range identities {
+			for _, v := range hme.Mapping[id] {
+				if v != "" && !slices.Contains(labelValues, v) {
+					labelValues = append(labelValues, v)
+				}
+			}
+		}
+
+		if len(labelValues) == 0 {
+			prometheusAPIError(w, fmt.Sprintf("no label value mapped to the HTTP header %q", hme.Name), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderMappingEnforcer(t *testing.T) {
+	mapping := map[string][]string{
+		"alice": {"ns1", "ns2"},
+		"bob":   {"ns2"},
+		"eve":   {},
+	}
+
+	for _, tc := range []struct {
+		name            string
+		headers         []string
+		parseListSyntax bool
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "single label value",
+			headers:  []string{"bob"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="ns2"}`,
+		},
+		{
+			name:     "multiple label values",
+			headers:  []string{"alice"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "multiple header values",
+			headers:  []string{"bob", "alice"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:            "list syntax",
+			headers:         []string{"bob, unknown"},
+			parseListSyntax: true,
+			expCode:         http.StatusOK,
+			expQuery:        `up{namespace="ns2"}`,
+		},
+		{
+			name:    "unknown identity",
+			headers: []string{"unknown"},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "identity without label values",
+			headers: []string{"eve"},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "missing header",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HeaderMappingEnforcer{Name: "X-Org-Id", ParseListSyntax: tc.parseListSyntax, Mapping: mapping})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			for _, h := range tc.headers {
+				req.Header.Add("X-Org-Id", h)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
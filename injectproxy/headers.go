@@ -0,0 +1,89 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// headerWriter is a http.ResponseWriter which sets fixed headers before
+// writing the response, replacing the values returned by the upstream.
+type headerWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for k, v := range w.headers {
+			w.Header().Set(k, v)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying http.ResponseWriter (used by
+// http.ResponseController).
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withResponseHeaders wraps the response writer to add the global response
+// headers. The writer is stored in the request's context so the route
+// handlers can override the headers with their own.
+func (r *routes) withResponseHeaders(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	if len(r.responseHeaders) == 0 && len(r.routeHeaders) == 0 {
+		return w, req
+	}
+
+	hw := &headerWriter{ResponseWriter: w, headers: r.responseHeaders}
+	return hw, req.WithContext(context.WithValue(req.Context(), keyHeaderWriter, hw))
+}
+
+// routeResponseHeaders replaces the response headers with the ones configured for the
+// route (merged with the global ones).
+func (r *routes) routeResponseHeaders(path string, next http.Handler) http.Handler {
+	routeHeaders, found := r.routeHeaders[path]
+	if !found {
+		return next
+	}
+
+	headers := make(map[string]string, len(r.responseHeaders)+len(routeHeaders))
+	for k, v := range r.responseHeaders {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range routeHeaders {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if hw, ok := req.Context().Value(keyHeaderWriter).(*headerWriter); ok {
+			hw.headers = headers
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
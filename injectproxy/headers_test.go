@@ -0,0 +1,87 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithRouteResponseHeaders(map[string]map[string]string{"/api/v1/unknown": {"Cache-Control": "no-store"}}),
+	)
+	if err == nil {
+		t.Fatal("expected error for unknown route")
+	}
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithResponseHeaders(map[string]string{"X-Content-Type-Options": "nosniff", "Cache-Control": "no-cache"}),
+		WithRouteResponseHeaders(map[string]map[string]string{"/api/v1/query": {"cache-control": "no-store"}}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url string
+
+		expCode    int
+		expHeaders map[string]string
+	}{
+		{
+			url:        "http://prometheus.example.com/api/v1/query?namespace=ns1&query=up",
+			expCode:    http.StatusOK,
+			expHeaders: map[string]string{"X-Content-Type-Options": "nosniff", "Cache-Control": "no-store"},
+		},
+		{
+			// Errors returned by the proxy get the headers too.
+			url:        "http://prometheus.example.com/api/v1/query?query=up",
+			expCode:    http.StatusBadRequest,
+			expHeaders: map[string]string{"X-Content-Type-Options": "nosniff", "Cache-Control": "no-store"},
+		},
+		{
+			url:        "http://prometheus.example.com/api/v1/series?namespace=ns1&match[]=up",
+			expCode:    http.StatusOK,
+			expHeaders: map[string]string{"X-Content-Type-Options": "nosniff", "Cache-Control": "no-cache"},
+		},
+		{
+			url:        "http://prometheus.example.com/unknown",
+			expCode:    http.StatusNotFound,
+			expHeaders: map[string]string{"X-Content-Type-Options": "nosniff", "Cache-Control": "no-cache"},
+		},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+			for k, v := range tc.expHeaders {
+				if got := resp.Header.Values(k); len(got) != 1 || got[0] != v {
+					t.Errorf("expected header %s: %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errBadRequestBody is returned when the request body can't be decoded.
+var errBadRequestBody = errors.New("invalid request body")
+
+// isJSONRequest returns true if the request body is JSON-encoded.
+func isJSONRequest(req *http.Request) bool {
+	ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return ct == "application/json"
+}
+
+// rewriteJSONBody decodes the JSON object from the request body, passes it to
+// f and replaces the request body with the re-encoded object. The objects
+// with duplicate keys are rejected because the decoders of the upstreams may
+// keep another value than the enforced one.
+func rewriteJSONBody(req *http.Request, f func(map[string]json.RawMessage) error) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("%w: can't decode JSON: %w", errBadRequestBody, err)
+	}
+	_ = req.Body.Close()
+
+	if err := checkDuplicateJSONKeys(raw); err != nil {
+		return err
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return fmt.Errorf("%w: can't decode JSON: %w", errBadRequestBody, err)
+	}
+
+	if err := f(body); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("can't encode JSON: %w", err)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+
+	return nil
+}
+
+// checkDuplicateJSONKeys returns an error if the JSON object has duplicate
+// keys.
+func checkDuplicateJSONKeys(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		// Not an object, json.Unmarshal reports the error.
+		return nil
+	}
+
+	keys := make(map[string]struct{})
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("%w: can't decode JSON: %w", errBadRequestBody, err)
+		}
+
+		k, _ := t.(string)
+		if _, found := keys[k]; found {
+			return fmt.Errorf("%w: duplicate %q field", errBadRequestBody, k)
+		}
+		keys[k] = struct{}{}
+
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("%w: can't decode JSON: %w", errBadRequestBody, err)
+		}
+	}
+
+	return nil
+}
+
+// jsonField returns the field of the JSON object. The objects with a field
+// whose name only differs by case are rejected because some decoders match
+// the field names case-insensitively.
+func jsonField(body map[string]json.RawMessage, name string) (json.RawMessage, bool, error) {
+	for k := range body {
+		if k != name && strings.EqualFold(k, name) {
+			return nil, false, fmt.Errorf("%w: unexpected %q field", errBadRequestBody, k)
+		}
+	}
+
+	raw, found := body[name]
+	return raw, found, nil
+}
+
+// enforceJSONQuery enforces the label matchers in the "query" field of the
+// JSON object. It returns false if the object has no query.
+func enforceJSONQuery(e *PromQLEnforcer, body map[string]json.RawMessage) (bool, error) {
+	raw, found, err := jsonField(body, queryParam)
+	if err != nil || !found {
+		return false, err
+	}
+
+	var q string
+	if err := json.Unmarshal(raw, &q); err != nil {
+		return false, fmt.Errorf("%w: the %q field must be a string", errBadRequestBody, queryParam)
+	}
+
+	if q == "" {
+		return false, nil
+	}
+
+	q, err = e.Enforce(q)
+	if err != nil {
+		return true, err
+	}
+
+	body[queryParam], err = json.Marshal(q)
+	if err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// clampJSONLimit ensures that the "limit" field of the JSON object, if
+// present, is lower or equal to max.
+func clampJSONLimit(body map[string]json.RawMessage, max uint64) error {
+	raw, found, err := jsonField(body, limitParam)
+	if err != nil || !found {
+		return err
+	}
+
+	// The limit can be encoded either as a string or as a number.
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+
+	limit, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid %q field: %w", errBadRequestBody, limitParam, err)
+	}
+
+	if limit == 0 || limit > max {
+		body[limitParam] = json.RawMessage(strconv.FormatUint(max, 10))
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONQueryBypass(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "query",
+			body:     `{"query":"up"}`,
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:    "capitalized query",
+			body:    `{"Query":"up"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "upper-case query",
+			body:    `{"QUERY":"up"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "query and case variant",
+			body:    `{"query":"up","qUery":"up"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "duplicate query",
+			body:    `{"query":"up","query":"up"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "escaped duplicate query",
+			body:    `{"query":"up","qu\u0065ry":"up"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "duplicate key in a nested object",
+			body:     `{"query":"up","opts":{"a":1,"a":2}}`,
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var got struct {
+					Query string `json:"query"`
+				}
+				if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if got.Query != tc.expQuery {
+					prometheusAPIError(w, fmt.Sprintf("expected query %q, got %q", tc.expQuery, got.Query), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestClampJSONLimit(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+
+		expLimit string
+		expErr   bool
+	}{
+		{body: `{"limit":"10"}`, expLimit: "5"},
+		{body: `{"limit":3}`, expLimit: "3"},
+		{body: `{"limit":0}`, expLimit: "5"},
+		{body: `{}`},
+		{body: `{"Limit":10}`, expErr: true},
+		{body: `{"limit":"abc"}`, expErr: true},
+	} {
+		t.Run(tc.body, func(t *testing.T) {
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err := clampJSONLimit(body, 5)
+			if tc.expErr {
+				if !errors.Is(err, errBadRequestBody) {
+					t.Fatalf("expected bad request error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got string
+			if raw, found := body[limitParam]; found {
+				if err := json.Unmarshal(raw, &got); err != nil {
+					got = string(raw)
+				}
+			}
+			if got != tc.expLimit {
+				t.Fatalf("expected limit %q, got %q", tc.expLimit, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// elementFilter returns the element of a JSON array to keep (possibly
+// modified) or nil to drop it.
+type elementFilter func(json.RawMessage) (json.RawMessage, error)
+
+// streamAPIResponse returns a response modifier which filters the elements of
+// the array under the given key of the "data" object (e.g. "alerts"). Unlike
+// modifyAPIResponse, the response is decoded while it's read: only one
+// element is held in memory at a time besides the kept elements, which
+// matters for the large rules and alerts responses.
+func streamAPIResponse(key string, newFilter func([]string, *http.Request) (elementFilter, error)) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			// Pass non-200 responses as-is.
+			return nil
+		}
+		defer resp.Body.Close()
+
+		f, err := newFilter(MustLabelValues(resp.Request.Context()), resp.Request)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+		}
+
+		var buf bytes.Buffer
+		if err := filterAPIResponse(json.NewDecoder(resp.Body), &buf, key, f); err != nil {
+			return err
+		}
+
+		replaceBody(resp, append(buf.Bytes(), '\n'))
+
+		return nil
+	}
+}
+
+// filterAPIResponse copies the Prometheus API response read by dec to buf,
+// passing the elements of the data[key] array to f.
+func filterAPIResponse(dec *json.Decoder, buf *bytes.Buffer, key string, f elementFilter) error {
+	var (
+		status  string
+		hasData bool
+	)
+	err := copyObject(dec, buf, func(k string) error {
+		switch k {
+		case "status":
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(raw, &status); err != nil {
+				return err
+			}
+			buf.Write(raw)
+		case "data":
+			hasData = true
+			found := false
+			return copyObject(dec, buf, func(k string) error {
+				if k != key {
+					return copyValue(dec, buf)
+				}
+				found = true
+				return filterArray(dec, buf, f)
+			}, func(n int) {
+				// A missing array is returned empty.
+				if found {
+					return
+				}
+				if n > 0 {
+					buf.WriteByte(',')
+				}
+				b, _ := marshalJSON(key)
+				buf.Write(b)
+				buf.WriteString(":[]")
+			})
+		default:
+			return copyValue(dec, buf)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		if errors.Is(err, errModifyResponseFailed) {
+			return err
+		}
+		return fmt.Errorf("can't decode the response: JSON decoding error: %w", err)
+	}
+
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("can't decode the response: unexpected data after the JSON object")
+	}
+
+	if status != "success" {
+		return fmt.Errorf("can't decode the response: unexpected response status: %q", status)
+	}
+
+	if !hasData {
+		return fmt.Errorf("%w: missing data", errModifyResponseFailed)
+	}
+
+	return nil
+}
+
+// copyObject copies the JSON object read by dec to buf. For each key, the key
+// is written and fn must copy the value. If not nil, end is called with the
+// number of keys before the object is closed.
+func copyObject(dec *json.Decoder, buf *bytes.Buffer, fn func(string) error, end func(int)) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	buf.WriteByte('{')
+
+	n := 0
+	for ; dec.More(); n++ {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		// Object keys are always strings.
+		k := t.(string)
+		b, err := marshalJSON(k)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+		buf.WriteByte(':')
+
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if end != nil {
+		end(n)
+	}
+	buf.WriteByte('}')
+
+	return nil
+}
+
+// filterArray copies the elements of the JSON array read by dec which are
+// kept by f.
+func filterArray(dec *json.Decoder, buf *bytes.Buffer, f elementFilter) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	buf.WriteByte('[')
+
+	n := 0
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		kept, err := f(raw)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+		}
+		if kept == nil {
+			continue
+		}
+
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(kept)
+		n++
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	buf.WriteByte(']')
+
+	return nil
+}
+
+func copyValue(dec *json.Decoder, buf *bytes.Buffer) error {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	buf.Write(raw)
+
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if got, ok := t.(json.Delim); !ok || got != d {
+		return fmt.Errorf("expected %q, got %v", d, t)
+	}
+
+	return nil
+}
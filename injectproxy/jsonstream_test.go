@@ -0,0 +1,282 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStreamAPIResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response string
+
+		expCode     int
+		expResponse string
+	}{
+		{
+			name:        "filtered alerts",
+			response:    `{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"},"value":1e+03},{"labels":{"namespace":"ns2"}},{"labels":{"namespace":"ns1"},"x":"<&>"}]},"warnings":["foo"]}`,
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"},"value":1e+03},{"labels":{"namespace":"ns1"},"x":"<&>"}]},"warnings":["foo"]}`,
+		},
+		{
+			name:        "status after data",
+			response:    `{"data":{"x":1,"alerts":[{"labels":{"namespace":"ns2"}}],"y":[]},"status":"success"}`,
+			expCode:     http.StatusOK,
+			expResponse: `{"data":{"x":1,"alerts":[],"y":[]},"status":"success"}`,
+		},
+		{
+			name:        "missing alerts",
+			response:    `{"status":"success","data":{}}`,
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"alerts":[]}}`,
+		},
+		{
+			name:        "missing alerts with other fields",
+			response:    `{"status":"success","data":{"x":1}}`,
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"x":1,"alerts":[]}}`,
+		},
+		{
+			name:     "missing data",
+			response: `{"status":"success"}`,
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "invalid alert",
+			response: `{"status":"success","data":{"alerts":[1]}}`,
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "error status",
+			response: `{"status":"error","data":{"alerts":[]}}`,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "invalid alerts",
+			response: `{"status":"success","data":{"alerts":{}}}`,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "truncated response",
+			response: `{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"}}`,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "trailing data",
+			response: `{"status":"success","data":{"alerts":[]}}{}`,
+			expCode:  http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.response))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/alerts?namespace=ns1", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := strings.TrimSuffix(w.Body.String(), "\n"); got != tc.expResponse {
+				t.Fatalf("expected response:\n%s\ngot:\n%s", tc.expResponse, got)
+			}
+		})
+	}
+}
+
+func TestMaxResponseRewriteBytes(t *testing.T) {
+	alerts := alertsResponse(100, 2)
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		encoding string
+		limit    int64
+
+		expCode int
+	}{
+		{
+			name:    "no limit",
+			path:    "/api/v1/alerts",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "below the limit",
+			path:    "/api/v1/alerts",
+			limit:   int64(len(alerts)),
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "above the limit",
+			path:    "/api/v1/alerts",
+			limit:   int64(len(alerts)) - 1,
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:     "decoded body above the limit",
+			path:     "/api/v1/alerts",
+			encoding: "gzip",
+			limit:    int64(len(alerts)) - 1,
+			expCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "decoded body below the limit",
+			path:     "/api/v1/alerts",
+			encoding: "gzip",
+			limit:    int64(len(alerts)),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:    "response which isn't rewritten",
+			path:    "/api/v1/query",
+			limit:   1,
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+					w.Write(compress(t, tc.encoding, alerts))
+					return
+				}
+				w.Write(alerts)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxResponseRewriteBytes(tc.limit))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?query=up&namespace=ns1", nil)
+			if tc.encoding != "" {
+				req.Header.Set("Accept-Encoding", tc.encoding)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// alertsResponse returns the /api/v1/alerts response with n alerts for each
+// of the given number of namespaces.
+func alertsResponse(n, namespaces int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"status":"success","data":{"alerts":[`)
+	for i := 0; i < n*namespaces; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"labels":{"alertname":"alert%d","namespace":"ns%d","severity":"critical"},"annotations":{"summary":"Alert %d is firing"},"state":"firing","activeAt":"2024-04-29T14:23:52.403557247+02:00","value":"1e+00"}`, i, i%namespaces, i)
+	}
+	b.WriteString(`]}}`)
+
+	return b.Bytes()
+}
+
+// rulesResponse returns the /api/v1/rules response with n groups of 10
+// alerting rules for each of the given number of namespaces.
+func rulesResponse(n, namespaces int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"status":"success","data":{"groups":[`)
+	for i := 0; i < n*namespaces; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"name":"group%d","file":"rules.yml","rules":[`, i)
+		for j := 0; j < 10; j++ {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `{"state":"firing","name":"alert%d","query":"up{namespace=\"ns%d\"} == 0","duration":300,"labels":{"namespace":"ns%d"},"annotations":{},"alerts":[{"labels":{"alertname":"alert%d","namespace":"ns%d"},"annotations":{},"state":"firing","activeAt":"2024-04-29T14:23:52.403557247+02:00","value":"0e+00"}],"health":"ok","type":"alerting"}`, j, i%namespaces, i%namespaces, j, i%namespaces)
+		}
+		b.WriteString(`],"interval":30}`)
+	}
+	b.WriteString(`]}}`)
+
+	return b.Bytes()
+}
+
+func benchmarkModifier(b *testing.B, path string, body []byte) {
+	r, err := NewRoutes(&url.URL{Scheme: "http", Host: "prometheus.example.com"}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+path+"?namespace=ns1", nil)
+	req = req.WithContext(WithLabelValues(req.Context(), []string{"ns1"}))
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+
+		if err := r.ModifyResponse(resp); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkFilterAlerts(b *testing.B) {
+	for _, namespaces := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("namespaces=%d", namespaces), func(b *testing.B) {
+			benchmarkModifier(b, "/api/v1/alerts", alertsResponse(10000/namespaces, namespaces))
+		})
+	}
+}
+
+func BenchmarkFilterRules(b *testing.B) {
+	for _, namespaces := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("namespaces=%d", namespaces), func(b *testing.B) {
+			benchmarkModifier(b, "/api/v1/rules", rulesResponse(1000/namespaces, namespaces))
+		})
+	}
+}
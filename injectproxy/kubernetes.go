@@ -0,0 +1,376 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	tokenReviewPath          = "/apis/authentication.k8s.io/v1/tokenreviews"
+	subjectAccessReviewPath  = "/apis/authorization.k8s.io/v1/subjectaccessreviews"
+	maxKubernetesCacheLength = 10000
+)
+
+// KubernetesReviewer authenticates the bearer tokens and authorizes the users
+// with the TokenReview and SubjectAccessReview APIs of a Kubernetes API
+// server. The service account of the proxy must be allowed to create both
+// resources (e.g. with the "system:auth-delegator" cluster role).
+type KubernetesReviewer struct {
+	// URL is the URL of the API server.
+	URL *url.URL
+	// Client sends the requests to the API server. http.DefaultClient is
+	// used if nil.
+	Client *http.Client
+	// TokenFile is the file holding the token which authenticates the
+	// proxy. It is read for every review since the projected service
+	// account tokens are rotated.
+	TokenFile string
+}
+
+// NewInClusterKubernetesReviewer returns the reviewer for the API server of
+// the cluster where the proxy runs, using the service account of its pod.
+func NewInClusterKubernetesReviewer() (*KubernetesReviewer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
+	}
+
+	b, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in the CA file %q", inClusterCAFile)
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &KubernetesReviewer{
+		URL:       &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)},
+		Client:    &http.Client{Transport: t, Timeout: 10 * time.Second},
+		TokenFile: inClusterTokenFile,
+	}, nil
+}
+
+// kubernetesUser is the user information returned by the TokenReview API.
+type kubernetesUser struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+// reviewToken returns the user authenticated by the token or nil if the token
+// isn't valid.
+func (kr *KubernetesReviewer) reviewToken(ctx context.Context, token string) (*kubernetesUser, error) {
+	var review struct {
+		Status struct {
+			Authenticated bool           `json:"authenticated"`
+			User          kubernetesUser `json:"user"`
+		} `json:"status"`
+	}
+
+	err := kr.create(ctx, tokenReviewPath, map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec":       map[string]string{"token": token},
+	}, &review)
+	if err != nil {
+		return nil, err
+	}
+
+	if !review.Status.Authenticated {
+		return nil, nil
+	}
+
+	return &review.Status.User, nil
+}
+
+// reviewAccess returns true if the user is allowed to access the resource in
+// the namespace.
+func (kr *KubernetesReviewer) reviewAccess(ctx context.Context, user *kubernetesUser, access KubernetesAccess, namespace string) (bool, error) {
+	var review struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}
+
+	err := kr.create(ctx, subjectAccessReviewPath, map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SubjectAccessReview",
+		"spec": map[string]interface{}{
+			"resourceAttributes": map[string]string{
+				"namespace": namespace,
+				"verb":      access.Verb,
+				"group":     access.Group,
+				"resource":  access.Resource,
+			},
+			"user":   user.Username,
+			"uid":    user.UID,
+			"groups": user.Groups,
+			"extra":  user.Extra,
+		},
+	}, &review)
+	if err != nil {
+		return false, err
+	}
+
+	return review.Status.Allowed, nil
+}
+
+// create sends the review to the API server and decodes the response.
+func (kr *KubernetesReviewer) create(ctx context.Context, path string, review interface{}, v interface{}) error {
+	b, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kr.URL.JoinPath(path).String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if kr.TokenFile != "" {
+		token, err := os.ReadFile(kr.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the token file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	client := kr.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from the Kubernetes API", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("can't decode the Kubernetes API response: %w", err)
+	}
+
+	return nil
+}
+
+// KubernetesAccess is the access to a namespaced resource which the users
+// must have in the enforced namespaces (e.g. "get pods").
+type KubernetesAccess struct {
+	Verb     string
+	Group    string
+	Resource string
+}
+
+// KubernetesEnforcer authorizes the label values (the namespaces) extracted
+// by another enforcer for the Kubernetes user authenticated by the bearer
+// token of the request. The requests without a valid token are rejected with
+// 401 and the requests for namespaces where the user doesn't have the access
+// are rejected with 403. The reviews are cached for the given TTL.
+//
+// The enforcer doesn't derive the namespaces which the user can access: the
+// namespaces must be requested explicitly and the requests without namespace
+// are rejected by the other enforcer.
+type KubernetesEnforcer struct {
+	// ForwardToken keeps the Authorization header of the requests forwarded
+	// to the upstream (e.g. when the upstream authenticates the users with
+	// the same tokens). By default, the header is removed once the token is
+	// reviewed so that the user's credentials don't reach the upstream.
+	ForwardToken bool
+
+	reviewer *KubernetesReviewer
+	enforcer ExtractLabeler
+	access   KubernetesAccess
+	ttl      time.Duration
+	now      func() time.Time
+
+	mtx   sync.Mutex
+	cache map[string]kubernetesReview
+}
+
+type kubernetesReview struct {
+	user    *kubernetesUser
+	allowed bool
+	expires time.Time
+}
+
+// NewKubernetesEnforcer returns the enforcer authorizing the label values
+// extracted by enforcer (e.g. HTTPFormEnforcer).
+func NewKubernetesEnforcer(reviewer *KubernetesReviewer, enforcer ExtractLabeler, access KubernetesAccess, ttl time.Duration) *KubernetesEnforcer {
+	return &KubernetesEnforcer{
+		reviewer: reviewer,
+		enforcer: enforcer,
+		access:   access,
+		ttl:      ttl,
+		now:      time.Now,
+		cache:    make(map[string]kubernetesReview),
+	}
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ke *KubernetesEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return ke.enforcer.ExtractLabel(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		if prefix, rest, found := strings.Cut(token, " "); found && strings.EqualFold(prefix, "Bearer") {
+			token = strings.TrimSpace(rest)
+		} else {
+			token = ""
+		}
+		if token == "" {
+			prometheusAPIError(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := ke.authenticate(r.Context(), token)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("can't review the token: %v", err), http.StatusBadGateway)
+			return
+		}
+		if user == nil {
+			prometheusAPIError(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		for _, ns := range MustLabelValues(r.Context()) {
+			allowed, err := ke.authorize(r.Context(), token, user, ns)
+			if err != nil {
+				prometheusAPIError(w, fmt.Sprintf("can't review the access: %v", err), http.StatusBadGateway)
+				return
+			}
+			if !allowed {
+				prometheusAPIError(w, fmt.Sprintf("user %q can't %s %s in namespace %q", user.Username, ke.access.Verb, ke.resource(), ns), http.StatusForbidden)
+				return
+			}
+		}
+
+		if !ke.ForwardToken {
+			r.Header.Del("Authorization")
+		}
+
+		next(w, r)
+	})
+}
+
+func (ke *KubernetesEnforcer) resource() string {
+	if ke.access.Group == "" {
+		return ke.access.Resource
+	}
+
+	return ke.access.Resource + "." + ke.access.Group
+}
+
+func (ke *KubernetesEnforcer) authenticate(ctx context.Context, token string) (*kubernetesUser, error) {
+	key := cacheKey(token, "")
+	if review, found := ke.cached(key); found {
+		return review.user, nil
+	}
+
+	user, err := ke.reviewer.reviewToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	ke.store(key, kubernetesReview{user: user})
+
+	return user, nil
+}
+
+func (ke *KubernetesEnforcer) authorize(ctx context.Context, token string, user *kubernetesUser, namespace string) (bool, error) {
+	key := cacheKey(token, namespace)
+	if review, found := ke.cached(key); found {
+		return review.allowed, nil
+	}
+
+	allowed, err := ke.reviewer.reviewAccess(ctx, user, ke.access, namespace)
+	if err != nil {
+		return false, err
+	}
+	ke.store(key, kubernetesReview{allowed: allowed})
+
+	return allowed, nil
+}
+
+// cacheKey doesn't keep the token in memory.
+func cacheKey(token, namespace string) string {
+	h := sha256.Sum256([]byte(token))
+	return string(h[:]) + namespace
+}
+
+func (ke *KubernetesEnforcer) cached(key string) (kubernetesReview, bool) {
+	if ke.ttl <= 0 {
+		return kubernetesReview{}, false
+	}
+
+	ke.mtx.Lock()
+	defer ke.mtx.Unlock()
+
+	review, found := ke.cache[key]
+	if !found || !ke.now().Before(review.expires) {
+		return kubernetesReview{}, false
+	}
+
+	return review, true
+}
+
+func (ke *KubernetesEnforcer) store(key string, review kubernetesReview) {
+	if ke.ttl <= 0 {
+		return
+	}
+
+	ke.mtx.Lock()
+	defer ke.mtx.Unlock()
+
+	now := ke.now()
+	if len(ke.cache) >= maxKubernetesCacheLength {
+		for k, r := range ke.cache {
+			if !now.Before(r.expires) {
+				delete(ke.cache, k)
+			}
+		}
+		if len(ke.cache) >= maxKubernetesCacheLength {
+			// All the entries are still valid, start afresh.
+			clear(ke.cache)
+		}
+	}
+
+	review.expires = now.Add(ke.ttl)
+	ke.cache[key] = review
+}
@@ -0,0 +1,308 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeKubernetesAPI implements the TokenReview and SubjectAccessReview APIs.
+type fakeKubernetesAPI struct {
+	// users maps the tokens to the user names.
+	users map[string]string
+	// namespaces maps the user names to their namespaces.
+	namespaces map[string][]string
+
+	reviews atomic.Int64
+}
+
+func (f *fakeKubernetesAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.reviews.Add(1)
+
+	if req.Header.Get("Authorization") != "Bearer proxy-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var review struct {
+		Spec struct {
+			Token              string `json:"token"`
+			User               string `json:"user"`
+			ResourceAttributes struct {
+				Namespace string `json:"namespace"`
+				Verb      string `json:"verb"`
+				Resource  string `json:"resource"`
+			} `json:"resourceAttributes"`
+		} `json:"spec"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	switch req.URL.Path {
+	case tokenReviewPath:
+		user, found := f.users[review.Spec.Token]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": map[string]interface{}{
+				"authenticated": found,
+				"user":          map[string]interface{}{"username": user},
+			},
+		})
+	case subjectAccessReviewPath:
+		attrs := review.Spec.ResourceAttributes
+		allowed := attrs.Verb == "get" && attrs.Resource == "pods" && slices.Contains(f.namespaces[review.Spec.User], attrs.Namespace)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": map[string]interface{}{"allowed": allowed},
+		})
+	}
+}
+
+func TestKubernetesEnforcer(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("proxy-token\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		url       string
+		token     string
+		tokenFile string
+
+		expCode int
+	}{
+		{
+			name:    "allowed namespace",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			token:   "alice-token",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "allowed namespaces",
+			url:     "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			token:   "alice-token",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "forbidden namespace",
+			url:     "/api/v1/query?query=up&namespace=ns1&namespace=ns3",
+			token:   "alice-token",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "invalid token",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			token:   "eve-token",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing token",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing namespace",
+			url:     "/api/v1/query?query=up",
+			token:   "alice-token",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:      "API server error",
+			url:       "/api/v1/query?query=up&namespace=ns1",
+			token:     "alice-token",
+			tokenFile: "/nonexistent",
+			expCode:   http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := httptest.NewServer(&fakeKubernetesAPI{
+				users:      map[string]string{"alice-token": "alice"},
+				namespaces: map[string][]string{"alice": {"ns1", "ns2"}},
+			})
+			defer api.Close()
+
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			u, _ := url.Parse(api.URL)
+			if tc.tokenFile == "" {
+				tc.tokenFile = tokenFile
+			}
+			e := NewKubernetesEnforcer(
+				&KubernetesReviewer{URL: u, TokenFile: tc.tokenFile},
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				KubernetesAccess{Verb: "get", Resource: "pods"},
+				time.Minute,
+			)
+
+			r, err := NewRoutes(m.url, proxyLabel, e)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestKubernetesEnforcerForwardToken(t *testing.T) {
+	api := httptest.NewServer(&fakeKubernetesAPI{
+		users:      map[string]string{"alice-token": "alice"},
+		namespaces: map[string][]string{"alice": {"ns1"}},
+	})
+	defer api.Close()
+	u, _ := url.Parse(api.URL)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("proxy-token"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		forwardToken bool
+
+		expAuthorization string
+	}{
+		{
+			forwardToken: false,
+		},
+		{
+			forwardToken:     true,
+			expAuthorization: "Bearer alice-token",
+		},
+	} {
+		t.Run(fmt.Sprintf("forward=%t", tc.forwardToken), func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Authorization"); got != tc.expAuthorization {
+					prometheusAPIError(w, fmt.Sprintf("expected Authorization header %q, got %q", tc.expAuthorization, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			e := NewKubernetesEnforcer(
+				&KubernetesReviewer{URL: u, TokenFile: tokenFile},
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				KubernetesAccess{Verb: "get", Resource: "pods"},
+				0,
+			)
+			e.ForwardToken = tc.forwardToken
+
+			r, err := NewRoutes(m.url, proxyLabel, e)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+			req.Header.Set("Authorization", "Bearer alice-token")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestKubernetesEnforcerCache(t *testing.T) {
+	api := &fakeKubernetesAPI{
+		users:      map[string]string{"alice-token": "alice"},
+		namespaces: map[string][]string{"alice": {"ns1"}},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("proxy-token"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u, _ := url.Parse(srv.URL)
+	e := NewKubernetesEnforcer(
+		&KubernetesReviewer{URL: u, TokenFile: tokenFile},
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		KubernetesAccess{Verb: "get", Resource: "pods"},
+		time.Minute,
+	)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	r, err := NewRoutes(m.url, proxyLabel, e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := func(expCode int) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+		req.Header.Set("Authorization", "Bearer alice-token")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != expCode {
+			t.Fatalf("expected status code %d, got %d: %s", expCode, w.Code, w.Body.String())
+		}
+	}
+
+	// 1 token review and 1 access review.
+	query(http.StatusOK)
+	if got := api.reviews.Load(); got != 2 {
+		t.Fatalf("expected 2 reviews, got %d", got)
+	}
+
+	// The reviews are cached.
+	api.namespaces["alice"] = nil
+	query(http.StatusOK)
+	if got := api.reviews.Load(); got != 2 {
+		t.Fatalf("expected 2 reviews, got %d", got)
+	}
+
+	// The reviews are done again once expired.
+	now = now.Add(time.Minute)
+	query(http.StatusForbidden)
+	if got := api.reviews.Load(); got != 4 {
+		t.Fatalf("expected 4 reviews, got %d", got)
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	startParam = "start"
+	endParam   = "end"
+	stepParam  = "step"
+)
+
+// ErrQueryRangeLimit is returned when the time range or the step of a range
+// query exceeds the limits of the tenant.
+var ErrQueryRangeLimit = errors.New("query range limit exceeded")
+
+// Limits defines the limits applied to the requests of a tenant.
+type Limits struct {
+	// QueryResultLimit is the maximum number of series returned by the
+	// /api/v1/query and /api/v1/query_range endpoints. Zero means no limit.
+	// NOTE: the "limit" parameter requires Prometheus >= v3.2.0.
+	QueryResultLimit uint64
+	// MaxQueryRange is the maximum duration between the start and the end
+	// of the /api/v1/query_range requests. Zero means no limit.
+	MaxQueryRange time.Duration
+	// MinQueryStep is the minimum step of the /api/v1/query_range
+	// requests. Zero means no limit.
+	MinQueryStep time.Duration
+	// MaxQueryLookback is the maximum duration between the start of the
+	// /api/v1/query_range requests and the current time. Zero means no
+	// limit.
+	MaxQueryLookback time.Duration
+	// ClampQueryRange causes the out-of-bounds range queries to be
+	// clamped to the limits instead of being rejected.
+	ClampQueryRange bool
+}
+
+// hasQueryRangeLimits returns true if the range queries are limited.
+func (l Limits) hasQueryRangeLimits() bool {
+	return l.MaxQueryRange > 0 || l.MinQueryStep > 0 || l.MaxQueryLookback > 0
+}
+
+type tenantLimits struct {
+	defaults  Limits
+	overrides map[string]Limits
+}
+
+// get returns the limits applying to the given label values.
+func (tl *tenantLimits) get(lvalues []string) Limits {
+	if tl == nil {
+		return Limits{}
+	}
+
+	var res Limits
+	for i, lv := range lvalues {
+		l := tl.defaults
+		if o, found := tl.overrides[lv]; found {
+			if o.QueryResultLimit > 0 {
+				l.QueryResultLimit = o.QueryResultLimit
+			}
+			if o.MaxQueryRange > 0 {
+				l.MaxQueryRange = o.MaxQueryRange
+			}
+			if o.MinQueryStep > 0 {
+				l.MinQueryStep = o.MinQueryStep
+			}
+			if o.MaxQueryLookback > 0 {
+				l.MaxQueryLookback = o.MaxQueryLookback
+			}
+			l.ClampQueryRange = l.ClampQueryRange || o.ClampQueryRange
+		}
+
+		if i == 0 {
+			res = l
+			continue
+		}
+
+		res.QueryResultLimit = minLimit(res.QueryResultLimit, l.QueryResultLimit)
+		res.MaxQueryRange = time.Duration(minLimit(uint64(res.MaxQueryRange), uint64(l.MaxQueryRange)))
+		res.MinQueryStep = max(res.MinQueryStep, l.MinQueryStep)
+		res.MaxQueryLookback = time.Duration(minLimit(uint64(res.MaxQueryLookback), uint64(l.MaxQueryLookback)))
+		// The queries are clamped only if all the label values allow it.
+		res.ClampQueryRange = res.ClampQueryRange && l.ClampQueryRange
+	}
+
+	return res
+}
+
+// minLimit returns the lowest limit, zero meaning no limit.
+func minLimit(a, b uint64) uint64 {
+	switch {
+	case a == 0:
+		return b
+	case b == 0:
+		return a
+	case a < b:
+		return a
+	default:
+		return b
+	}
+}
+
+// queryLimit enforces the "limit" parameter on the query endpoints if
+// configured for the tenant.
+// It must be followed by a handler which re-encodes the POST body from
+// req.PostForm (e.g. query).
+func (r *routes) queryLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		limit := r.limits.get(MustLabelValues(req.Context())).QueryResultLimit
+		if err := enforceLimit(req, limit); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// queryRangeLimits enforces the time range and step limits of the tenant on
+// the range queries.
+// It must be followed by a handler which re-encodes the POST body from
+// req.PostForm (e.g. query).
+func (r *routes) queryRangeLimits(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		l := r.limits.get(MustLabelValues(req.Context()))
+		if !l.hasQueryRangeLimits() {
+			next(w, req)
+			return
+		}
+
+		var (
+			q   = req.URL.Query()
+			now = time.Now()
+			err error
+		)
+		switch {
+		case req.Method == http.MethodPost && isJSONRequest(req):
+			err = rewriteJSONBody(req, func(body map[string]json.RawMessage) error {
+				return l.enforceQueryRangeParams(now, q, jsonParams(body))
+			})
+		case req.Method == http.MethodPost:
+			if err = req.ParseForm(); err == nil {
+				err = l.enforceQueryRangeParams(now, q, req.PostForm)
+			}
+		default:
+			err = l.enforceQueryRangeParams(now, q)
+		}
+		if err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrQueryRangeLimit) {
+				code = http.StatusUnprocessableEntity
+			}
+			prometheusAPIError(w, err.Error(), code)
+			return
+		}
+		req.URL.RawQuery = q.Encode()
+
+		next(w, req)
+	}
+}
+
+// params abstracts away the locations of the request parameters (URL query
+// string, POST form or JSON body).
+type params interface {
+	Has(string) bool
+	Get(string) string
+	Set(string, string)
+}
+
+// jsonParams are the parameters of a JSON body.
+type jsonParams map[string]json.RawMessage
+
+func (p jsonParams) Has(k string) bool {
+	_, found := p[k]
+	return found
+}
+
+func (p jsonParams) Get(k string) string {
+	// The values can be encoded either as strings or as numbers.
+	var s string
+	if err := json.Unmarshal(p[k], &s); err != nil {
+		s = string(p[k])
+	}
+
+	return s
+}
+
+func (p jsonParams) Set(k, v string) {
+	p[k], _ = marshalJSON(v)
+}
+
+// enforceQueryRangeParams enforces the limits on the parameters found in the
+// given locations, the last ones taking precedence (like the POST form over
+// the URL query string for the upstream). The clamped values are written back
+// to all the locations holding the parameter.
+func (l Limits) enforceQueryRangeParams(now time.Time, locations ...params) error {
+	keys := []string{startParam, endParam, stepParam}
+
+	v := url.Values{}
+	for _, loc := range locations {
+		for _, k := range keys {
+			if loc.Has(k) {
+				v.Set(k, loc.Get(k))
+			}
+		}
+	}
+
+	orig := maps.Clone(v)
+	if err := l.enforceQueryRange(v, now); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if v.Get(k) == orig.Get(k) {
+			continue
+		}
+
+		for _, loc := range locations {
+			if loc.Has(k) {
+				loc.Set(k, v.Get(k))
+			}
+		}
+	}
+
+	return nil
+}
+
+// enforceQueryRange checks the start, end and step parameters against the
+// limits. With ClampQueryRange, the out-of-bounds values are replaced
+// instead. The missing parameters aren't checked, the upstream rejects the
+// request anyway.
+func (l Limits) enforceQueryRange(v url.Values, now time.Time) error {
+	var (
+		start, end time.Time
+		err        error
+	)
+	if v.Has(startParam) {
+		if start, err = parseTime(v.Get(startParam)); err != nil {
+			return fmt.Errorf("invalid %q parameter: %w", startParam, err)
+		}
+	}
+	if v.Has(endParam) {
+		if end, err = parseTime(v.Get(endParam)); err != nil {
+			return fmt.Errorf("invalid %q parameter: %w", endParam, err)
+		}
+	}
+
+	if l.MaxQueryLookback > 0 && !start.IsZero() {
+		oldest := now.Add(-l.MaxQueryLookback)
+		switch {
+		case !end.IsZero() && end.Before(oldest):
+			return fmt.Errorf("%w: the query ends more than %s ago", ErrQueryRangeLimit, model.Duration(l.MaxQueryLookback))
+		case start.Before(oldest) && l.ClampQueryRange:
+			start = oldest
+			v.Set(startParam, formatTime(start))
+		case start.Before(oldest):
+			return fmt.Errorf("%w: the query starts more than %s ago", ErrQueryRangeLimit, model.Duration(l.MaxQueryLookback))
+		}
+	}
+
+	if l.MaxQueryRange > 0 && !start.IsZero() && !end.IsZero() && end.Sub(start) > l.MaxQueryRange {
+		if !l.ClampQueryRange {
+			return fmt.Errorf("%w: the query range can't exceed %s", ErrQueryRangeLimit, model.Duration(l.MaxQueryRange))
+		}
+		v.Set(startParam, formatTime(end.Add(-l.MaxQueryRange)))
+	}
+
+	if l.MinQueryStep > 0 && v.Has(stepParam) {
+		step, err := parseDuration(v.Get(stepParam))
+		if err != nil {
+			return fmt.Errorf("invalid %q parameter: %w", stepParam, err)
+		}
+
+		if step < l.MinQueryStep {
+			if !l.ClampQueryRange {
+				return fmt.Errorf("%w: the query step can't be lower than %s", ErrQueryRangeLimit, model.Duration(l.MinQueryStep))
+			}
+			v.Set(stepParam, strconv.FormatFloat(l.MinQueryStep.Seconds(), 'f', -1, 64))
+		}
+	}
+
+	return nil
+}
+
+// parseTime parses the timestamps like the Prometheus API: either a Unix
+// timestamp in seconds or a RFC 3339 date.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(sec), int64(ns*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses the durations like the Prometheus API: either a
+// number of seconds or a Prometheus duration (e.g. "5m").
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration: it overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// formatTime formats the timestamp as a Unix timestamp in seconds.
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
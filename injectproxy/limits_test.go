@@ -0,0 +1,419 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryResultLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		method string
+		limit  string
+		opts   []Option
+
+		expLimit []string
+	}{
+		{
+			name:   "no limit configured",
+			labelv: []string{"default"},
+			limit:  "1000",
+
+			expLimit: []string{"1000"},
+		},
+		{
+			name:   "default limit is injected",
+			labelv: []string{"default"},
+			opts:   []Option{WithLimits(Limits{QueryResultLimit: 100}, nil)},
+
+			expLimit: []string{"100"},
+		},
+		{
+			name:   "lower limit is preserved",
+			labelv: []string{"default"},
+			limit:  "10",
+			opts:   []Option{WithLimits(Limits{QueryResultLimit: 100}, nil)},
+
+			expLimit: []string{"10"},
+		},
+		{
+			name:   "higher limit is replaced by the override",
+			labelv: []string{"ns1"},
+			limit:  "1000",
+			opts:   []Option{WithLimits(Limits{QueryResultLimit: 100}, map[string]Limits{"ns1": {QueryResultLimit: 500}})},
+
+			expLimit: []string{"500"},
+		},
+		{
+			name:   "override without default",
+			labelv: []string{"ns1"},
+			opts:   []Option{WithLimits(Limits{}, map[string]Limits{"ns1": {QueryResultLimit: 500}})},
+
+			expLimit: []string{"500"},
+		},
+		{
+			name:   "lowest limit applies to multiple values",
+			labelv: []string{"ns1", "ns2"},
+			opts:   []Option{WithLimits(Limits{QueryResultLimit: 100}, map[string]Limits{"ns1": {QueryResultLimit: 500}})},
+
+			expLimit: []string{"100"},
+		},
+		{
+			name:   "higher limit is replaced for POSTs",
+			labelv: []string{"ns1"},
+			method: http.MethodPost,
+			limit:  "1000",
+			opts:   []Option{WithLimits(Limits{QueryResultLimit: 100}, map[string]Limits{"ns1": {QueryResultLimit: 500}})},
+
+			expLimit: []string{"500"},
+		},
+	} {
+		for _, endpoint := range []string{"query", "query_range"} {
+			t.Run(endpoint+"/"+tc.name, func(t *testing.T) {
+				var h http.Handler
+				if tc.method == http.MethodPost {
+					h = checkFormHandler(limitParam, tc.expLimit...)
+				} else {
+					h = checkQueryHandler("", limitParam, tc.expLimit...)
+				}
+				m := newMockUpstream(h)
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				v := url.Values{queryParam: []string{"up"}, proxyLabel: tc.labelv}
+				if tc.limit != "" {
+					v.Set(limitParam, tc.limit)
+				}
+
+				var req *http.Request
+				if tc.method == http.MethodPost {
+					req = httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/"+endpoint, strings.NewReader(v.Encode()))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				} else {
+					req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/"+endpoint+"?"+v.Encode(), nil)
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(resp.Body)
+					t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestEnforceQueryRange(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	limits := Limits{MaxQueryRange: 24 * time.Hour, MinQueryStep: 30 * time.Second, MaxQueryLookback: 7 * 24 * time.Hour}
+	clamped := limits
+	clamped.ClampQueryRange = true
+
+	for _, tc := range []struct {
+		name   string
+		limits Limits
+		params url.Values
+
+		expErr    bool
+		expParams url.Values
+	}{
+		{
+			name:      "within the limits",
+			limits:    limits,
+			params:    url.Values{"start": []string{"996400"}, "end": []string{"1000000"}, "step": []string{"1m"}},
+			expParams: url.Values{"start": []string{"996400"}, "end": []string{"1000000"}, "step": []string{"1m"}},
+		},
+		{
+			name:      "RFC 3339 timestamps",
+			limits:    limits,
+			params:    url.Values{"start": []string{"1970-01-12T12:00:00Z"}, "end": []string{"1970-01-12T13:46:40Z"}},
+			expParams: url.Values{"start": []string{"1970-01-12T12:00:00Z"}, "end": []string{"1970-01-12T13:46:40Z"}},
+		},
+		{
+			name:   "range too long",
+			limits: limits,
+			params: url.Values{"start": []string{"900000"}, "end": []string{"1000000"}},
+			expErr: true,
+		},
+		{
+			name:      "clamped range",
+			limits:    clamped,
+			params:    url.Values{"start": []string{"900000"}, "end": []string{"1000000"}},
+			expParams: url.Values{"start": []string{"913600"}, "end": []string{"1000000"}},
+		},
+		{
+			name:   "step too low",
+			limits: limits,
+			params: url.Values{"step": []string{"15"}},
+			expErr: true,
+		},
+		{
+			name:      "clamped step",
+			limits:    clamped,
+			params:    url.Values{"step": []string{"15s"}},
+			expParams: url.Values{"step": []string{"30"}},
+		},
+		{
+			name:   "start too old",
+			limits: limits,
+			params: url.Values{"start": []string{"390000"}, "end": []string{"396400"}},
+			expErr: true,
+		},
+		{
+			name:      "clamped start",
+			limits:    clamped,
+			params:    url.Values{"start": []string{"390000"}, "end": []string{"396800"}},
+			expParams: url.Values{"start": []string{"395200"}, "end": []string{"396800"}},
+		},
+		{
+			name:   "end too old",
+			limits: clamped,
+			params: url.Values{"start": []string{"300000"}, "end": []string{"301000"}},
+			expErr: true,
+		},
+		{
+			name:   "invalid start",
+			limits: limits,
+			params: url.Values{"start": []string{"yesterday"}},
+			expErr: true,
+		},
+		{
+			name:      "missing parameters",
+			limits:    limits,
+			params:    url.Values{},
+			expParams: url.Values{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.enforceQueryRange(tc.params, now)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.params.Encode() != tc.expParams.Encode() {
+				t.Fatalf("expected parameters %q, got %q", tc.expParams.Encode(), tc.params.Encode())
+			}
+		})
+	}
+}
+
+func TestQueryRangeLimits(t *testing.T) {
+	opt := WithLimits(
+		Limits{MinQueryStep: time.Minute, ClampQueryRange: true},
+		map[string]Limits{"ns2": {MinQueryStep: 5 * time.Minute}},
+	)
+
+	for _, tc := range []struct {
+		name        string
+		labelv      []string
+		contentType string
+		opts        []Option
+
+		expCode int
+		expStep string
+	}{
+		{
+			name:    "no limit",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusOK,
+			expStep: "15",
+		},
+		{
+			name:    "clamped step",
+			labelv:  []string{"ns1"},
+			opts:    []Option{opt},
+			expCode: http.StatusOK,
+			expStep: "60",
+		},
+		{
+			name:        "clamped step in the form",
+			labelv:      []string{"ns1"},
+			contentType: "application/x-www-form-urlencoded",
+			opts:        []Option{opt},
+			expCode:     http.StatusOK,
+			expStep:     "60",
+		},
+		{
+			name:        "clamped step in the JSON body",
+			labelv:      []string{"ns1"},
+			contentType: "application/json",
+			opts:        []Option{opt},
+			expCode:     http.StatusOK,
+			expStep:     "60",
+		},
+		{
+			name:    "highest minimum step of the label values",
+			labelv:  []string{"ns1", "ns2"},
+			opts:    []Option{opt},
+			expCode: http.StatusOK,
+			expStep: "300",
+		},
+		{
+			name:    "rejected request",
+			labelv:  []string{"ns1"},
+			opts:    []Option{WithLimits(Limits{MinQueryStep: time.Minute}, nil)},
+			expCode: http.StatusUnprocessableEntity,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var step string
+				switch tc.contentType {
+				case "application/json":
+					var body map[string]string
+					if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+						prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					step = body[stepParam]
+				default:
+					step = req.FormValue(stepParam)
+				}
+
+				if step != tc.expStep {
+					prometheusAPIError(w, "unexpected step: "+step, http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.labelv}
+			params := url.Values{queryParam: []string{"up"}, startParam: []string{"0"}, endParam: []string{"3600"}, stepParam: []string{"15"}}
+
+			var req *http.Request
+			switch tc.contentType {
+			case "application/json":
+				body, _ := json.Marshal(map[string]string{queryParam: "up", startParam: "0", endParam: "3600", stepParam: "15"})
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range?"+q.Encode(), strings.NewReader(string(body)))
+				req.Header.Set("Content-Type", tc.contentType)
+			case "application/x-www-form-urlencoded":
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query_range?"+q.Encode(), strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", tc.contentType)
+			default:
+				for k, v := range q {
+					params[k] = v
+				}
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query_range?"+params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		query         string
+		limit         int64
+		contentLength int64
+
+		expCode int
+	}{
+		{
+			name:    "no limit",
+			query:   strings.Repeat("up or ", 100) + "up",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "under the limit",
+			query:   "up",
+			limit:   1024,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "over the limit",
+			query:   strings.Repeat("up or ", 100) + "up",
+			limit:   100,
+			expCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "over the limit with unknown content length",
+			query:         strings.Repeat("up or ", 100) + "up",
+			limit:         100,
+			contentLength: -1,
+			expCode:       http.StatusRequestEntityTooLarge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if got := req.PostForm.Get(queryParam); got == "" {
+					prometheusAPIError(w, "missing query", http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var opts []Option
+			if tc.limit > 0 {
+				opts = append(opts, WithMaxRequestBodyBytes(tc.limit))
+			}
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body := url.Values{queryParam: []string{tc.query}}.Encode()
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=ns1", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.contentLength != 0 {
+				req.ContentLength = tc.contentLength
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
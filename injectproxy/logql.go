@@ -0,0 +1,213 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// EnforceLogQL enforces the label matchers in the stream selectors of a LogQL
+// expression (e.g. `sum(rate({app="foo"} |= "error" [5m]))`).
+//
+// The stream selectors have the same syntax as the PromQL selectors, they are
+// located by skipping the string literals and the comments of the expression
+// and enforced like the PromQL selectors. The rest of the expression (line
+// filters, parsers, ...) is left unchanged and validated by the upstream.
+func (ms *PromQLEnforcer) EnforceLogQL(q string) (string, error) {
+	var sb strings.Builder
+
+	for i := 0; i < len(q); {
+		var (
+			end int
+			err error
+		)
+
+		switch q[i] {
+		case '"', '`':
+			end, err = skipLogQLString(q, i)
+		case '#':
+			end = strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i
+			}
+		case '{':
+			end, err = skipLogQLSelector(q, i)
+			if err != nil {
+				break
+			}
+
+			var s string
+			s, err = ms.enforceStreamSelector(q[i:end])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(s)
+			i = end
+			continue
+		case '}':
+			err = fmt.Errorf("unexpected '}' at position %d", i)
+		default:
+			end = i + 1
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+		}
+
+		sb.WriteString(q[i:end])
+		i = end
+	}
+
+	return sb.String(), nil
+}
+
+// enforceStreamSelector enforces the label matchers in a stream selector.
+func (ms *PromQLEnforcer) enforceStreamSelector(s string) (string, error) {
+	targets, err := parser.ParseMetricSelector(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+	}
+
+	res, err := ms.EnforceMatchers(targets)
+	if err != nil {
+		if errors.Is(err, ErrIllegalLabelMatcher) || errors.Is(err, ErrUnselectiveSelector) {
+			return "", err
+		}
+
+		return "", fmt.Errorf("%w: %w", ErrEnforceLabel, err)
+	}
+
+	return matchersToString(res...), nil
+}
+
+// skipLogQLString returns the position following the string literal starting
+// at position i.
+func skipLogQLString(q string, i int) (int, error) {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		switch q[j] {
+		case '\\':
+			if quote == '"' {
+				// Skip the escaped character.
+				j++
+			}
+		case quote:
+			return j + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unterminated string at position %d", i)
+}
+
+// skipLogQLSelector returns the position following the stream selector
+// starting at position i.
+func skipLogQLSelector(q string, i int) (int, error) {
+	for j := i + 1; j < len(q); {
+		switch q[j] {
+		case '"', '`':
+			var err error
+			j, err = skipLogQLString(q, j)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		case '{':
+			return 0, fmt.Errorf("unexpected '{' at position %d", j)
+		case '}':
+			return j + 1, nil
+		}
+		j++
+	}
+
+	return 0, fmt.Errorf("unterminated stream selector at position %d", i)
+}
+
+// EnforceLogQLValues enforces the label matchers in the LogQL expression of
+// the "query" parameter like the proxy does for the Loki query endpoints. The
+// values are modified in place. If the parameter is missing and inject is
+// true, a stream selector made of the label matchers is added.
+func EnforceLogQLValues(e *PromQLEnforcer, v url.Values, inject bool) error {
+	if v.Get(queryParam) == "" {
+		if inject {
+			v.Set(queryParam, matchersToString(e.matchers()...))
+		}
+		return nil
+	}
+
+	q, err := e.EnforceLogQL(v.Get(queryParam))
+	if err != nil {
+		return err
+	}
+
+	v.Set(queryParam, q)
+
+	return nil
+}
+
+// logQL enforces the label matchers in the LogQL expression of the request.
+// If inject is true, the requests without expression get a stream selector
+// made of the label matchers (e.g. for the labels endpoints which would
+// otherwise return the labels of all the streams).
+func (r *routes) logQL(inject bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		e, err := r.newQueryEnforcer(req)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		inject := inject
+		if req.Method == http.MethodPost {
+			if err := req.ParseForm(); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if req.PostForm.Has(queryParam) {
+				if err := EnforceLogQLValues(e, req.PostForm, false); err != nil {
+					enforceError(w, err)
+					return
+				}
+
+				// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
+				_ = req.Body.Close()
+				newBody := req.PostForm.Encode()
+				req.Body = io.NopCloser(strings.NewReader(newBody))
+				req.ContentLength = int64(len(newBody))
+
+				// The expression of the body takes precedence over the
+				// URL query string.
+				inject = false
+			}
+		}
+
+		q := req.URL.Query()
+		if err := EnforceLogQLValues(e, q, inject); err != nil {
+			enforceError(w, err)
+			return
+		}
+		req.URL.RawQuery = q.Encode()
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestEnforceLogQL(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		query          string
+		errorOnReplace bool
+
+		exp    string
+		expErr error
+	}{
+		{
+			name:  "stream selector",
+			query: `{app="foo"}`,
+			exp:   `{app="foo",namespace="ns1"}`,
+		},
+		{
+			name:  "line filters and parser",
+			query: `{app="foo"} |= "error" != "{timeout}" | json | line_format "{{.msg}}"`,
+			exp:   `{app="foo",namespace="ns1"} |= "error" != "{timeout}" | json | line_format "{{.msg}}"`,
+		},
+		{
+			name:  "escaped quote",
+			query: `{app="foo"} |= "\"{" | logfmt`,
+			exp:   `{app="foo",namespace="ns1"} |= "\"{" | logfmt`,
+		},
+		{
+			name:  "raw string",
+			query: "{app=\"foo\"} |~ `a{2}\\`",
+			exp:   "{app=\"foo\",namespace=\"ns1\"} |~ `a{2}\\`",
+		},
+		{
+			name:  "metric query with several selectors",
+			query: `sum by (app) (rate({app="foo"}[5m])) / sum by (app) (count_over_time({app=~"b.+", namespace="ns2"} |= "x" [5m]))`,
+			exp:   `sum by (app) (rate({app="foo",namespace="ns1"}[5m])) / sum by (app) (count_over_time({app=~"b.+",namespace="ns1"} |= "x" [5m]))`,
+		},
+		{
+			name:  "comment",
+			query: "{app=\"foo\"} # {foo\n|= \"x\"",
+			exp:   "{app=\"foo\",namespace=\"ns1\"} # {foo\n|= \"x\"",
+		},
+		{
+			name:           "conflicting matcher",
+			query:          `{app="foo", namespace="ns2"}`,
+			errorOnReplace: true,
+			expErr:         ErrIllegalLabelMatcher,
+		},
+		{
+			name:   "unterminated selector",
+			query:  `{app="foo"`,
+			expErr: ErrQueryParse,
+		},
+		{
+			name:   "unterminated string",
+			query:  `{app="foo"} |= "foo`,
+			expErr: ErrQueryParse,
+		},
+		{
+			name:   "nested braces",
+			query:  `{app={"foo"}}`,
+			expErr: ErrQueryParse,
+		},
+		{
+			name:   "invalid selector",
+			query:  `{app}`,
+			expErr: ErrQueryParse,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewPromQLEnforcer(tc.errorOnReplace, &labels.Matcher{Name: proxyLabel, Type: labels.MatchEqual, Value: "ns1"})
+
+			got, err := e.EnforceLogQL(tc.query)
+			if tc.expErr != nil {
+				if !errors.Is(err, tc.expErr) {
+					t.Fatalf("expected error %v, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.exp {
+				t.Fatalf("expected query:\n%s\ngot:\n%s", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestLokiRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		body     url.Values
+		upstream http.Handler
+
+		expCode int
+	}{
+		{
+			name:     "query",
+			path:     "/loki/api/v1/query?query=" + url.QueryEscape(`count_over_time({app="foo"}[5m])`) + "&namespace=ns1",
+			upstream: checkQueryHandler("", queryParam, `count_over_time({app="foo",namespace="ns1"}[5m])`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query_range with POST",
+			method:   http.MethodPost,
+			path:     "/loki/api/v1/query_range?namespace=ns1",
+			body:     url.Values{queryParam: []string{`{app="foo"} |= "error"`}},
+			upstream: checkFormHandler(queryParam, `{app="foo",namespace="ns1"} |= "error"`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "tail",
+			path:     "/loki/api/v1/tail?query=" + url.QueryEscape(`{app="foo"}`) + "&namespace=ns1",
+			upstream: checkQueryHandler("", queryParam, `{app="foo",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "labels without query",
+			path:     "/loki/api/v1/labels?namespace=ns1",
+			upstream: checkQueryHandler("", queryParam, `{namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "label values",
+			path:     "/loki/api/v1/label/app/values?query=" + url.QueryEscape(`{app=~"f.+"}`) + "&namespace=ns1",
+			upstream: checkQueryHandler("", queryParam, `{app=~"f.+",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "series",
+			path:     "/loki/api/v1/series?match[]=" + url.QueryEscape(`{app="foo"}`) + "&namespace=ns1",
+			upstream: checkQueryHandler("", matchersParam, `{app="foo",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "invalid query",
+			path:     "/loki/api/v1/query?query=" + url.QueryEscape(`{app="foo"`) + "&namespace=ns1",
+			upstream: http.NotFoundHandler(),
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "missing label value",
+			path:     "/loki/api/v1/query?query=" + url.QueryEscape(`{app="foo"}`),
+			upstream: http.NotFoundHandler(),
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithBackend(BackendLoki))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			var body io.Reader
+			if tc.body != nil {
+				body = strings.NewReader(tc.body.Encode())
+			}
+			req := httptest.NewRequest(method, "http://loki.example.com"+tc.path, body)
+			if tc.body != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
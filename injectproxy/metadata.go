@@ -0,0 +1,183 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// matchTargetParam is the label selector of the targets of the
+	// /api/v1/targets/metadata endpoint.
+	matchTargetParam = "match_target"
+	// limitPerMetricParam is the maximum number of metadata entries per
+	// metric of the /api/v1/metadata endpoint.
+	limitPerMetricParam = "limit_per_metric"
+)
+
+// EnforceMatchTargetValue enforces the label matchers in the "match_target"
+// selector of the /api/v1/targets/metadata endpoint: the label matchers are
+// appended to the selector or, if no selector is given, a selector made of
+// the label matchers is set. The values are modified in place.
+func EnforceMatchTargetValue(e *PromQLEnforcer, v url.Values) error {
+	var ms []*labels.Matcher
+	if s := v.Get(matchTargetParam); s != "" {
+		var err error
+		ms, err = parser.ParseMetricSelector(s)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrQueryParse, err)
+		}
+	}
+
+	v.Set(matchTargetParam, matchersToString(append(ms, e.matchers()...)...))
+
+	return nil
+}
+
+// targetsMetadata enforces the label matchers in the "match_target" selector.
+func (r *routes) targetsMetadata(w http.ResponseWriter, req *http.Request) {
+	e, err := r.newQueryEnforcer(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := req.URL.Query()
+	if err := EnforceMatchTargetValue(e, q); err != nil {
+		enforceError(w, err)
+		return
+	}
+	req.URL.RawQuery = q.Encode()
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// filterTargetsMetadata removes the metadata entries of the targets which
+// don't match the enforced labels.
+func (r *routes) filterTargetsMetadata(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterJSONArray(resp.Data, nil, func(entry *rawObject) bool {
+		return m.matches(labelsAt(entry, []string{"target"}))
+	})
+}
+
+// metadata answers the requests of the /api/v1/metadata endpoint from the
+// /api/v1/targets/metadata endpoint since the metric metadata isn't
+// associated with labels: only the metadata of the metrics scraped from the
+// matching targets is returned.
+func (r *routes) metadata(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	var limits [2]int
+	for i, param := range []string{limitParam, limitPerMetricParam} {
+		if s := q.Get(param); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				prometheusAPIError(w, fmt.Sprintf("invalid %q parameter: %v", param, err), http.StatusBadRequest)
+				return
+			}
+			limits[i] = n
+		}
+		// The limits apply to the metrics, not to the targets.
+		q.Del(param)
+	}
+
+	e, err := r.newQueryEnforcer(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := EnforceMatchTargetValue(e, q); err != nil {
+		enforceError(w, err)
+		return
+	}
+
+	m := modifyAPIResponse(func(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+		return r.metadataFromTargets(lvalues, req, resp, limits[0], limits[1])
+	})
+
+	// The request is cloned since its URL is shared with the caller.
+	req = req.Clone(context.WithValue(req.Context(), keyResponseModifier, m))
+	req.URL.Path = "/api/v1/targets/metadata"
+	req.URL.RawPath = ""
+	req.URL.RawQuery = q.Encode()
+
+	r.handler.ServeHTTP(w, req)
+}
+
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// metadataFromTargets converts the metadata of the matching targets into the
+// format of the /api/v1/metadata endpoint. The limits are ignored if not
+// positive.
+func (r *routes) metadataFromTargets(lvalues []string, req *http.Request, resp *apiResponse, limit, limitPerMetric int) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Target labels.Labels `json:"target"`
+		Metric string        `json:"metric"`
+		metricMetadata
+	}
+	if err := json.Unmarshal(resp.Data, &entries); err != nil {
+		return nil, fmt.Errorf("can't decode targets metadata: %w", err)
+	}
+
+	res := map[string][]metricMetadata{}
+	for _, e := range entries {
+		if !m.matches(e.Target) || slices.Contains(res[e.Metric], e.metricMetadata) {
+			continue
+		}
+
+		if limitPerMetric > 0 && len(res[e.Metric]) >= limitPerMetric {
+			continue
+		}
+
+		res[e.Metric] = append(res[e.Metric], e.metricMetadata)
+	}
+
+	if limit > 0 && len(res) > limit {
+		// Keep the first metrics in alphabetical order for stable results.
+		metrics := make([]string, 0, len(res))
+		for k := range res {
+			metrics = append(metrics, k)
+		}
+		slices.Sort(metrics)
+
+		for _, k := range metrics[limit:] {
+			delete(res, k)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const targetsMetadataResponse = `{"status":"success","data":[
+  {"target":{"instance":"a:9090","namespace":"ns1"},"metric":"up","type":"gauge","help":"Up.","unit":""},
+  {"target":{"instance":"b:9090","namespace":"ns1"},"metric":"up","type":"gauge","help":"Up.","unit":""},
+  {"target":{"instance":"a:9090","namespace":"ns1"},"metric":"http_requests_total","type":"counter","help":"Requests.","unit":""},
+  {"target":{"instance":"c:9090","namespace":"ns1"},"metric":"http_requests_total","type":"counter","help":"Total requests.","unit":""},
+  {"target":{"instance":"d:9090","namespace":"ns2"},"metric":"secret_total","type":"counter","help":"Secret.","unit":""}
+]}`
+
+func TestTargetsMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		matchTarget string
+		labelv      []string
+
+		expCode        int
+		expMatchTarget string
+		expInstances   []string
+	}{
+		{
+			name:           "no selector",
+			labelv:         []string{"ns1"},
+			expCode:        http.StatusOK,
+			expMatchTarget: `{namespace="ns1"}`,
+			expInstances:   []string{"a:9090", "b:9090", "a:9090", "c:9090"},
+		},
+		{
+			name:           "with selector",
+			matchTarget:    `{instance="a:9090"}`,
+			labelv:         []string{"ns1"},
+			expCode:        http.StatusOK,
+			expMatchTarget: `{instance="a:9090",namespace="ns1"}`,
+			expInstances:   []string{"a:9090", "b:9090", "a:9090", "c:9090"},
+		},
+		{
+			name:           "multiple values",
+			labelv:         []string{"ns1", "ns2"},
+			expCode:        http.StatusOK,
+			expMatchTarget: `{namespace=~"ns1|ns2"}`,
+			expInstances:   []string{"a:9090", "b:9090", "a:9090", "c:9090", "d:9090"},
+		},
+		{
+			name:        "invalid selector",
+			matchTarget: `{instance=}`,
+			labelv:      []string{"ns1"},
+			expCode:     http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.URL.Query().Get(matchTargetParam); got != tc.expMatchTarget {
+					prometheusAPIError(w, "unexpected match_target: "+got, http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte(targetsMetadataResponse))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.labelv}
+			if tc.matchTarget != "" {
+				q.Set(matchTargetParam, tc.matchTarget)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/targets/metadata?"+q.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data []struct {
+					Target map[string]string `json:"target"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var instances []string
+			for _, e := range resp.Data {
+				instances = append(instances, e.Target["instance"])
+			}
+			if !reflect.DeepEqual(instances, tc.expInstances) {
+				t.Fatalf("expected instances %v, got %v", tc.expInstances, instances)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		query url.Values
+
+		expCode  int
+		expQuery url.Values
+		expData  map[string][]metricMetadata
+	}{
+		{
+			name:     "all metrics",
+			query:    url.Values{proxyLabel: {"ns1"}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchTargetParam: {`{namespace="ns1"}`}},
+			expData: map[string][]metricMetadata{
+				"up":                  {{Type: "gauge", Help: "Up."}},
+				"http_requests_total": {{Type: "counter", Help: "Requests."}, {Type: "counter", Help: "Total requests."}},
+			},
+		},
+		{
+			name:     "metric",
+			query:    url.Values{proxyLabel: {"ns1"}, "metric": {"up"}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchTargetParam: {`{namespace="ns1"}`}, "metric": {"up"}},
+			expData: map[string][]metricMetadata{
+				"up":                  {{Type: "gauge", Help: "Up."}},
+				"http_requests_total": {{Type: "counter", Help: "Requests."}, {Type: "counter", Help: "Total requests."}},
+			},
+		},
+		{
+			name:     "limits",
+			query:    url.Values{proxyLabel: {"ns1"}, "limit": {"1"}, "limit_per_metric": {"1"}},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{matchTargetParam: {`{namespace="ns1"}`}},
+			expData: map[string][]metricMetadata{
+				"http_requests_total": {{Type: "counter", Help: "Requests."}},
+			},
+		},
+		{
+			name:    "invalid limit",
+			query:   url.Values{proxyLabel: {"ns1"}, "limit": {"foo"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/api/v1/targets/metadata" {
+					prometheusAPIError(w, "unexpected path: "+req.URL.Path, http.StatusInternalServerError)
+					return
+				}
+				if got := req.URL.Query(); !reflect.DeepEqual(got, tc.expQuery) {
+					prometheusAPIError(w, "unexpected query: "+got.Encode(), http.StatusInternalServerError)
+					return
+				}
+				// The metric parameter is ignored by the mock.
+				w.Write([]byte(targetsMetadataResponse))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/metadata?"+tc.query.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data map[string][]metricMetadata `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Data, tc.expData) {
+				t.Fatalf("expected data %v, got %v", tc.expData, resp.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// LabelValueNormalizer transforms a label value extracted from the request
+// (e.g. to fix the casing of the values returned by an identity provider).
+type LabelValueNormalizer func(string) string
+
+var (
+	// LowercaseLabelValues converts the label values to lower case.
+	LowercaseLabelValues LabelValueNormalizer = strings.ToLower
+	// TrimLabelValues removes the leading and trailing white spaces of the
+	// label values.
+	TrimLabelValues LabelValueNormalizer = strings.TrimSpace
+)
+
+// MapLabelValues returns a normalizer replacing the label values found in
+// the mapping. The other values are returned unchanged.
+func MapLabelValues(mapping map[string]string) LabelValueNormalizer {
+	return func(v string) string {
+		if mapped, found := mapping[v]; found {
+			return mapped
+		}
+
+		return v
+	}
+}
+
+// WithLabelValueNormalizers applies the normalizers (in order) to the label
+// values extracted from the requests before they are enforced. The values
+// which are empty once normalized are removed and the duplicates are merged.
+// The ACL, blocked and read-only checks see the normalized values. It
+// doesn't apply to the additional enforced labels.
+func WithLabelValueNormalizers(normalizers ...LabelValueNormalizer) Option {
+	return optionFunc(func(o *options) {
+		o.normalizers = append(o.normalizers, normalizers...)
+	})
+}
+
+// normalizeLabelValues replaces the label values in the request's context
+// with the normalized ones.
+func (r *routes) normalizeLabelValues(next http.HandlerFunc) http.HandlerFunc {
+	if len(r.normalizers) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		values := MustLabelValues(req.Context())
+
+		normalized := make([]string, 0, len(values))
+		for _, v := range values {
+			for _, n := range r.normalizers {
+				v = n(v)
+			}
+
+			if v != "" && !slices.Contains(normalized, v) {
+				normalized = append(normalized, v)
+			}
+		}
+
+		if len(normalized) == 0 {
+			prometheusAPIError(w, fmt.Sprintf("empty %q label value after normalization", r.label), http.StatusBadRequest)
+			return
+		}
+
+		next(w, req.WithContext(WithLabelValues(req.Context(), normalized)))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLabelValueNormalizers(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		labelv      []string
+		normalizers []LabelValueNormalizer
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "no normalizer",
+			labelv:   []string{"NS1"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="NS1"}`,
+		},
+		{
+			name:        "lowercase and trim",
+			labelv:      []string{" NS1 "},
+			normalizers: []LabelValueNormalizer{LowercaseLabelValues, TrimLabelValues},
+			expCode:     http.StatusOK,
+			expQuery:    `up{namespace="ns1"}`,
+		},
+		{
+			name:        "duplicated values once normalized",
+			labelv:      []string{"NS1", "ns1", "Ns2"},
+			normalizers: []LabelValueNormalizer{LowercaseLabelValues},
+			expCode:     http.StatusOK,
+			expQuery:    `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:        "mapping after lowercase",
+			labelv:      []string{"Team-A"},
+			normalizers: []LabelValueNormalizer{LowercaseLabelValues, MapLabelValues(map[string]string{"team-a": "ns1"})},
+			expCode:     http.StatusOK,
+			expQuery:    `up{namespace="ns1"}`,
+		},
+		{
+			name:        "empty value once normalized",
+			labelv:      []string{" "},
+			normalizers: []LabelValueNormalizer{TrimLabelValues},
+			expCode:     http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithLabelValueNormalizers(tc.normalizers...))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: []string{"up"}}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const orgIDHeader = "X-Scope-OrgID"
+
+// OrgIDConfig configures the X-Scope-OrgID header of the upstream requests
+// for the backends with native multi-tenancy (e.g. Cortex, Mimir or Loki).
+type OrgIDConfig struct {
+	// Separator joins the label values in the header. The default is "|"
+	// which Mimir uses for the tenant federation.
+	Separator string
+	// SkipInjection forwards the requests without enforcing the label
+	// matchers: the upstream restricts the data to the tenants of the
+	// header.
+	SkipInjection bool
+}
+
+// WithOrgIDHeader sets the X-Scope-OrgID header of the upstream requests to
+// the enforced label values. The header sent by the clients is always
+// removed.
+func WithOrgIDHeader(cfg OrgIDConfig) Option {
+	return optionFunc(func(o *options) {
+		if cfg.Separator == "" {
+			cfg.Separator = "|"
+		}
+		o.orgID = &cfg
+	})
+}
+
+// labelFilteredPaths lists the paths of the responses filtered by label
+// values, which isn't needed when the upstream enforces the tenancy.
+var labelFilteredPaths = []string{
+	"/api/v1/rules",
+	"/api/v1/alerts",
+	"/api/v1/targets",
+	"/api/v1/stores",
+	"/api/v1/targets/metadata",
+	"/api/v1/series",
+	"/api/v2/alerts/groups",
+	"/api/v2/receivers",
+}
+
+// skipsInjection returns true if the requests of the route are forwarded
+// without enforcement because the upstream enforces the tenancy.
+func (r *routes) skipsInjection(rt Route) bool {
+	if r.orgID == nil || !r.orgID.SkipInjection {
+		return false
+	}
+
+	switch rt.Enforcement {
+	case EnforcementPromQL, EnforcementLogQL, EnforcementMatchers, EnforcementResponse, EnforcementSilences, EnforcementFilter, EnforcementSeries:
+		return true
+	}
+
+	return false
+}
+
+// setOrgID sets the enforced label values into the X-Scope-OrgID header.
+func (r *routes) setOrgID(next http.HandlerFunc) http.HandlerFunc {
+	if r.orgID == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Set(orgIDHeader, strings.Join(MustLabelValues(req.Context()), r.orgID.Separator))
+
+		next(w, req)
+	}
+}
+
+// removeOrgID removes the X-Scope-OrgID header sent by the client so that the
+// requests to the routes without enforcement can't select a tenant.
+func (r *routes) removeOrgID(req *http.Request) {
+	if r.orgID != nil {
+		req.Header.Del(orgIDHeader)
+	}
+}
+
+// WithForwardEnforcedHeader sets the given header of the upstream requests to
+// the enforced label values joined with "," (e.g. "X-Prom-Label-Proxy-Values:
+// ns1,ns2") so that the upstream middlewares can correlate the requests with
+// the tenants. The header sent by the clients is always removed.
+func WithForwardEnforcedHeader(name string) Option {
+	return optionFunc(func(o *options) {
+		o.enforcedHeader = http.CanonicalHeaderKey(name)
+	})
+}
+
+// setEnforcedHeader sets the enforced label values into the configured
+// header.
+func (r *routes) setEnforcedHeader(next http.HandlerFunc) http.HandlerFunc {
+	if r.enforcedHeader == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Set(r.enforcedHeader, strings.Join(MustLabelValues(req.Context()), ","))
+
+		next(w, req)
+	}
+}
+
+// removeEnforcedHeader removes the header of the enforced label values sent
+// by the client so that it can't be spoofed.
+func (r *routes) removeEnforcedHeader(req *http.Request) {
+	if r.enforcedHeader != "" {
+		req.Header.Del(r.enforcedHeader)
+	}
+}
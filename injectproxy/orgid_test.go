@@ -0,0 +1,186 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOrgIDHeader(t *testing.T) {
+	const rules = `{"status":"success","data":{"groups":[{"name":"g","file":"f","rules":[{"name":"r","labels":{},"type":"recording"}]}]}}`
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		cfg  OrgIDConfig
+
+		expCode  int
+		expOrgID string
+		expQuery string
+		expBody  string
+	}{
+		{
+			name:     "single label value",
+			url:      "/api/v1/query?query=up&namespace=ns1",
+			expCode:  http.StatusOK,
+			expOrgID: "ns1",
+			expQuery: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "multiple label values",
+			url:      "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			expCode:  http.StatusOK,
+			expOrgID: "ns1|ns2",
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "custom separator",
+			url:      "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			cfg:      OrgIDConfig{Separator: ","},
+			expCode:  http.StatusOK,
+			expOrgID: "ns1,ns2",
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "skip injection",
+			url:      "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			cfg:      OrgIDConfig{SkipInjection: true},
+			expCode:  http.StatusOK,
+			expOrgID: "ns1|ns2",
+			expQuery: `up`,
+		},
+		{
+			name:     "skip response filtering",
+			url:      "/api/v1/rules?namespace=ns1",
+			cfg:      OrgIDConfig{SkipInjection: true},
+			expCode:  http.StatusOK,
+			expOrgID: "ns1",
+			expBody:  rules,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v1/query?query=up",
+			cfg:     OrgIDConfig{SkipInjection: true},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "passthrough path",
+			url:     "/api/v1/status/buildinfo",
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get(orgIDHeader); got != tc.expOrgID {
+					prometheusAPIError(w, fmt.Sprintf("expected org ID %q, got %q", tc.expOrgID, got), http.StatusInternalServerError)
+					return
+				}
+				if got := req.URL.Query().Get(queryParam); got != tc.expQuery {
+					prometheusAPIError(w, fmt.Sprintf("expected query %q, got %q", tc.expQuery, got), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if req.URL.Path == "/api/v1/rules" {
+					w.Write([]byte(rules))
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithOrgIDHeader(tc.cfg),
+				WithPassthroughPaths([]string{"/api/v1/status/buildinfo"}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			// The header sent by the client is never forwarded.
+			req.Header.Set(orgIDHeader, "other")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" {
+				if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+					t.Fatalf("expected body %q, got %q", tc.expBody, got)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardEnforcedHeader(t *testing.T) {
+	const header = "X-Prom-Label-Proxy-Values"
+
+	for _, tc := range []struct {
+		name string
+		url  string
+
+		expValues string
+	}{
+		{
+			name:      "single label value",
+			url:       "/api/v1/query?query=up&namespace=ns1",
+			expValues: "ns1",
+		},
+		{
+			name:      "multiple label values",
+			url:       "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			expValues: "ns1,ns2",
+		},
+		{
+			name: "passthrough path",
+			url:  "/api/v1/status/buildinfo",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get(header); got != tc.expValues {
+					prometheusAPIError(w, fmt.Sprintf("expected header value %q, got %q", tc.expValues, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithForwardEnforcedHeader(strings.ToLower(header)),
+				WithPassthroughPaths([]string{"/api/v1/status/buildinfo"}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			// The header sent by the client is never forwarded.
+			req.Header.Set(header, "other")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		})
+	}
+}
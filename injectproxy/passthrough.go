@@ -0,0 +1,149 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PassthroughRule forwards the requests whose path matches a pattern and
+// whose method is accepted to the upstream without enforcement. Contrary to
+// WithPassthroughPaths, the rules only apply to the requests which don't
+// match any route of the proxy: they can't override a registered route,
+// whether it is enforced, filtered or forbidden (e.g. "/api/v1/status/tsdb"
+// isn't forwarded by a rule matching "/api/v1/status/*").
+type PassthroughRule struct {
+	// Path is a glob pattern matched against the request path (see
+	// path.Match, e.g. "/api/v1/status/*").
+	Path string
+	// Regexp is a regular expression matched against the whole request
+	// path (e.g. "/api/v1/(notifications|features)(/live)?"). Exactly one
+	// of Path and Regexp must be set.
+	Regexp string
+	// Methods lists the accepted HTTP methods, all methods are accepted if
+	// empty.
+	Methods []string
+}
+
+// pattern returns the configured path pattern.
+func (pr PassthroughRule) pattern() string {
+	if pr.Regexp != "" {
+		return pr.Regexp
+	}
+
+	return pr.Path
+}
+
+// WithPassthroughRules forwards the requests matching one of the rules to the
+// upstream without enforcement. The requests which match no rule are handled
+// by the unmatched path policy. Use with care.
+func WithPassthroughRules(rules []PassthroughRule) Option {
+	return optionFunc(func(o *options) {
+		o.passthroughRules = append(o.passthroughRules, rules...)
+	})
+}
+
+// passthroughRule is the compiled form of a PassthroughRule.
+type passthroughRule struct {
+	glob    string
+	re      *regexp.Regexp
+	methods []string
+}
+
+func newPassthroughRule(pr PassthroughRule) (passthroughRule, error) {
+	var rule passthroughRule
+
+	switch {
+	case pr.Path != "" && pr.Regexp != "":
+		return rule, errors.New("path and regexp can't be both set")
+	case pr.Path != "":
+		if !strings.HasPrefix(pr.Path, "/") {
+			return rule, errors.New("the path must start with '/'")
+		}
+		if _, err := path.Match(pr.Path, ""); err != nil {
+			return rule, err
+		}
+		rule.glob = pr.Path
+	case pr.Regexp != "":
+		re, err := regexp.Compile("^(?:" + pr.Regexp + ")$")
+		if err != nil {
+			return rule, err
+		}
+		rule.re = re
+	default:
+		return rule, errors.New("either path or regexp must be set")
+	}
+
+	// Like for WithPassthroughPaths, the rules can't forward all the paths.
+	if rule.matchesPath("/") {
+		return rule, errors.New("the root path can't be matched")
+	}
+
+	for _, m := range pr.Methods {
+		rule.methods = append(rule.methods, strings.ToUpper(m))
+	}
+
+	return rule, nil
+}
+
+func (pr passthroughRule) matchesPath(p string) bool {
+	if pr.re != nil {
+		return pr.re.MatchString(p)
+	}
+
+	matched, _ := path.Match(pr.glob, p)
+	return matched
+}
+
+func (pr passthroughRule) matches(req *http.Request) bool {
+	if len(pr.methods) > 0 && !slices.Contains(pr.methods, req.Method) {
+		return false
+	}
+
+	return pr.matchesPath(req.URL.Path)
+}
+
+// passthroughRules forwards the requests matching one of the rules to the
+// upstream. The other requests are handled by next.
+func (r *routes) passthroughRules(mux *router, rules []PassthroughRule, next http.Handler) (http.Handler, error) {
+	compiled := make([]passthroughRule, 0, len(rules))
+	handlers := make([]http.Handler, 0, len(rules))
+	for _, pr := range rules {
+		rule, err := newPassthroughRule(pr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid passthrough rule %q: %w", pr.pattern(), err)
+		}
+
+		compiled = append(compiled, rule)
+		handlers = append(handlers, mux.instrument(pr.pattern(), http.HandlerFunc(r.passthrough)))
+		r.table = append(r.table, Route{Path: pr.pattern(), Enforcement: EnforcementNone, Methods: rule.methods, Passthrough: true})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i, rule := range compiled {
+			if rule.matches(req) {
+				handlers[i].ServeHTTP(w, req)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	}), nil
+}
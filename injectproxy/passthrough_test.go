@@ -0,0 +1,147 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPassthroughRules(t *testing.T) {
+	rules := []PassthroughRule{
+		{Path: "/api/v1/status/*", Methods: []string{"get"}},
+		{Regexp: "/api/v1/(notifications|features)(/live)?"},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		opts   []Option
+
+		expCode int
+	}{
+		{
+			name:    "glob with accepted method",
+			method:  http.MethodGet,
+			url:     "/api/v1/status/runtimeinfo",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "glob with rejected method",
+			method:  http.MethodPost,
+			url:     "/api/v1/status/runtimeinfo",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "glob doesn't match sub-paths",
+			method:  http.MethodGet,
+			url:     "/api/v1/status/runtimeinfo/extra",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "regexp",
+			method:  http.MethodPost,
+			url:     "/api/v1/notifications/live",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "regexp is anchored",
+			method:  http.MethodGet,
+			url:     "/api/v1/notifications/other",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "enforced route",
+			method:  http.MethodGet,
+			url:     "/api/v1/status/config",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "forbidden route",
+			method:  http.MethodGet,
+			url:     "/api/v1/status/tsdb",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "unmatched path policy",
+			method:  http.MethodPost,
+			url:     "/api/v1/status/runtimeinfo",
+			opts:    []Option{WithUnmatchedPathPolicy(UnmatchedPathForbidden)},
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkParameterAbsent(proxyLabel, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+			})))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithPassthroughRules(rules))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInvalidPassthroughRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule PassthroughRule
+	}{
+		{
+			name: "empty rule",
+		},
+		{
+			name: "path and regexp",
+			rule: PassthroughRule{Path: "/foo", Regexp: "/foo"},
+		},
+		{
+			name: "relative path",
+			rule: PassthroughRule{Path: "foo/*"},
+		},
+		{
+			name: "invalid glob",
+			rule: PassthroughRule{Path: "/foo/["},
+		},
+		{
+			name: "invalid regexp",
+			rule: PassthroughRule{Regexp: "/foo/("},
+		},
+		{
+			name: "all paths glob",
+			rule: PassthroughRule{Path: "/*"},
+		},
+		{
+			name: "all paths regexp",
+			rule: PassthroughRule{Regexp: ".*"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughRules([]PassthroughRule{tc.rule}))
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// PolicyInput describes the request submitted to the policy evaluator.
+type PolicyInput struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// PolicyDecision is the result of the policy evaluation.
+type PolicyDecision struct {
+	// Allow is false if the request is forbidden.
+	Allow bool `json:"allow"`
+	// Labels maps the label names to the values to enforce. The proxy's
+	// label is required, the other labels are enforced like the labels
+	// configured with WithExtraLabel(). The labels without values are
+	// ignored.
+	Labels map[string][]string `json:"labels"`
+}
+
+// PolicyEvaluator decides which label values are enforced for a request.
+type PolicyEvaluator interface {
+	Evaluate(ctx context.Context, input PolicyInput) (PolicyDecision, error)
+}
+
+// PolicyEvaluatorFunc is an adapter to use a function (e.g. evaluating an
+// embedded Rego policy) as a PolicyEvaluator.
+type PolicyEvaluatorFunc func(ctx context.Context, input PolicyInput) (PolicyDecision, error)
+
+// Evaluate implements the PolicyEvaluator interface.
+func (f PolicyEvaluatorFunc) Evaluate(ctx context.Context, input PolicyInput) (PolicyDecision, error) {
+	return f(ctx, input)
+}
+
+// OPAEvaluator evaluates the policy with the Data API of Open Policy Agent
+// (https://www.openpolicyagent.org/docs/latest/rest-api/#data-api).
+// The request metadata is sent as the input document and the decision is
+// read from the result document, an undefined result forbids the request.
+type OPAEvaluator struct {
+	// URL is the URL of the decision document (e.g.
+	// "http://opa:8181/v1/data/prom_label_proxy/decision").
+	URL *url.URL
+	// Client is the HTTP client used to query OPA, http.DefaultClient is
+	// used if nil.
+	Client *http.Client
+}
+
+// Evaluate implements the PolicyEvaluator interface.
+func (o *OPAEvaluator) Evaluate(ctx context.Context, input PolicyInput) (PolicyDecision, error) {
+	b, err := json.Marshal(struct {
+		Input PolicyInput `json:"input"`
+	}{Input: input})
+	if err != nil {
+		return PolicyDecision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL.String(), bytes.NewReader(b))
+	if err != nil {
+		return PolicyDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return PolicyDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return PolicyDecision{}, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Result *PolicyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return PolicyDecision{}, fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	if res.Result == nil {
+		return PolicyDecision{}, nil
+	}
+
+	return *res.Result, nil
+}
+
+// WithPolicyEvaluator causes the proxy to get the label values to enforce
+// from the policy evaluator instead of the ExtractLabeler. The evaluator is
+// called for every request requiring the label values.
+func WithPolicyEvaluator(pe PolicyEvaluator) Option {
+	return optionFunc(func(o *options) {
+		o.policy = pe
+	})
+}
+
+// extractLabels stores the enforced label values in the request's context.
+func (r *routes) extractLabels(next http.HandlerFunc) http.Handler {
+	if r.policy == nil {
+		return r.el.ExtractLabel(r.extractExtraLabels(next))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		decision, err := r.policy.Evaluate(req.Context(), PolicyInput{
+			Method:  req.Method,
+			Path:    req.URL.Path,
+			Headers: req.Header.Clone(),
+		})
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("policy evaluation failed: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		values := removeEmptyValues(decision.Labels[r.label])
+		if !decision.Allow || len(values) == 0 {
+			prometheusAPIError(w, "forbidden by policy", http.StatusForbidden)
+			return
+		}
+
+		ctx := WithLabelValues(req.Context(), values)
+
+		names := make([]string, 0, len(decision.Labels))
+		for name := range decision.Labels {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			if name == r.label {
+				continue
+			}
+
+			if vals := removeEmptyValues(decision.Labels[name]); len(vals) > 0 {
+				ctx = withExtraLabelValues(ctx, name, vals)
+			}
+		}
+
+		next(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPolicyEvaluator(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   PolicyEvaluator
+		upstream http.Handler
+
+		expCode int
+	}{
+		{
+			name: "allowed",
+			policy: PolicyEvaluatorFunc(func(_ context.Context, in PolicyInput) (PolicyDecision, error) {
+				if in.Method != http.MethodGet || in.Path != "/api/v1/query" || in.Headers["X-User"][0] != "alice" {
+					return PolicyDecision{}, errors.New("unexpected input")
+				}
+				return PolicyDecision{Allow: true, Labels: map[string][]string{proxyLabel: {"ns1", "ns2"}}}, nil
+			}),
+			upstream: checkQueryHandler("", queryParam, `up{namespace=~"ns1|ns2"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name: "additional labels",
+			policy: PolicyEvaluatorFunc(func(context.Context, PolicyInput) (PolicyDecision, error) {
+				return PolicyDecision{Allow: true, Labels: map[string][]string{proxyLabel: {"ns1"}, "cluster": {"eu"}, "region": {}}}, nil
+			}),
+			upstream: checkQueryHandler("", queryParam, `up{cluster="eu",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name: "denied",
+			policy: PolicyEvaluatorFunc(func(context.Context, PolicyInput) (PolicyDecision, error) {
+				return PolicyDecision{Allow: false, Labels: map[string][]string{proxyLabel: {"ns1"}}}, nil
+			}),
+			expCode: http.StatusForbidden,
+		},
+		{
+			name: "missing label values",
+			policy: PolicyEvaluatorFunc(func(context.Context, PolicyInput) (PolicyDecision, error) {
+				return PolicyDecision{Allow: true, Labels: map[string][]string{"cluster": {"eu"}}}, nil
+			}),
+			expCode: http.StatusForbidden,
+		},
+		{
+			name: "evaluation error",
+			policy: PolicyEvaluatorFunc(func(context.Context, PolicyInput) (PolicyDecision, error) {
+				return PolicyDecision{}, errors.New("timeout")
+			}),
+			expCode: http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := tc.upstream
+			if upstream == nil {
+				upstream = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) })
+			}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPolicyEvaluator(tc.policy))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.Header.Set("X-User", "alice")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestOPAEvaluator(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response string
+		code     int
+
+		exp    PolicyDecision
+		expErr bool
+	}{
+		{
+			name:     "decision",
+			response: `{"result":{"allow":true,"labels":{"namespace":["ns1"]}}}`,
+			code:     http.StatusOK,
+			exp:      PolicyDecision{Allow: true, Labels: map[string][]string{"namespace": {"ns1"}}},
+		},
+		{
+			name:     "undefined decision",
+			response: `{}`,
+			code:     http.StatusOK,
+			exp:      PolicyDecision{},
+		},
+		{
+			name:     "error",
+			response: `{"code":"internal_error"}`,
+			code:     http.StatusInternalServerError,
+			expErr:   true,
+		},
+		{
+			name:     "invalid response",
+			response: `{"result":`,
+			code:     http.StatusOK,
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var body struct {
+					Input PolicyInput `json:"input"`
+				}
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil || req.Method != http.MethodPost || body.Input.Path != "/api/v1/query" {
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					return
+				}
+
+				w.WriteHeader(tc.code)
+				w.Write([]byte(tc.response))
+			}))
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL + "/v1/data/prom_label_proxy/decision")
+			o := &OPAEvaluator{URL: u}
+
+			got, err := o.Evaluate(context.Background(), PolicyInput{Method: http.MethodGet, Path: "/api/v1/query"})
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Allow != tc.exp.Allow || len(got.Labels) != len(tc.exp.Labels) {
+				t.Fatalf("expected decision %+v, got %+v", tc.exp, got)
+			}
+			for k, v := range tc.exp.Labels {
+				if len(got.Labels[k]) != len(v) || got.Labels[k][0] != v[0] {
+					t.Fatalf("expected decision %+v, got %+v", tc.exp, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// embeddedQueriesMetricName is the metric name of the selectors in
+	// which the Mimir query-frontend embeds the sharded sub-queries.
+	embeddedQueriesMetricName = "__embedded_queries__"
+	// embeddedQueriesLabelName is the label holding the JSON-encoded
+	// sub-queries.
+	embeddedQueriesLabelName = "__queries__"
+
+	// shardingControlHeader sets the number of shards of a query.
+	shardingControlHeader = "Sharding-Control"
+	// queryShardingHeader selects the shard of an instant query.
+	queryShardingHeader = "X-Query-Sharding"
+)
+
+// shardRe matches the shard selectors (e.g. "1_of_16").
+var shardRe = regexp.MustCompile(`^([0-9]+)_of_([0-9]+)$`)
+
+// WithQueryFrontendCompat enables the compatibility mode for the query
+// frontends (Mimir or Thanos) which shard the queries:
+//   - the sub-queries embedded in the __embedded_queries__ selectors are
+//     enforced like the top-level expression,
+//   - the sharding headers (Sharding-Control and X-Query-Sharding) of the
+//     query requests are validated before being forwarded.
+func WithQueryFrontendCompat() Option {
+	return optionFunc(func(o *options) {
+		o.queryFrontendCompat = true
+	})
+}
+
+// embeddedQueries is the JSON value of the __queries__ label. The
+// sub-queries are either PromQL expressions or objects with an "Expr" field
+// depending on the Mimir version.
+type embeddedQueries struct {
+	Concat []json.RawMessage `json:"Concat"`
+}
+
+// enforceEmbeddedQueries enforces the sub-queries of an
+// __embedded_queries__ selector. The matchers of other selectors are left
+// untouched.
+func (ms PromQLEnforcer) enforceEmbeddedQueries(matchers []*labels.Matcher) error {
+	embedded := false
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && m.Value == embeddedQueriesMetricName {
+			embedded = true
+			break
+		}
+	}
+	if !embedded {
+		return nil
+	}
+
+	for i, m := range matchers {
+		if m.Name != embeddedQueriesLabelName {
+			continue
+		}
+
+		if m.Type != labels.MatchEqual {
+			return fmt.Errorf("%w: unexpected %s%s matcher in embedded queries", ErrIllegalLabelMatcher, m.Name, m.Type)
+		}
+
+		var eq embeddedQueries
+		if err := json.Unmarshal([]byte(m.Value), &eq); err != nil {
+			return fmt.Errorf("%w: invalid embedded queries: %w", ErrQueryParse, err)
+		}
+
+		for j, raw := range eq.Concat {
+			q, err := ms.enforceEmbeddedQuery(raw)
+			if err != nil {
+				return err
+			}
+			eq.Concat[j] = q
+		}
+
+		b, err := marshalJSON(eq)
+		if err != nil {
+			return err
+		}
+
+		nm, err := labels.NewMatcher(labels.MatchEqual, m.Name, string(b))
+		if err != nil {
+			return err
+		}
+		matchers[i] = nm
+	}
+
+	return nil
+}
+
+// enforceEmbeddedQuery enforces a single embedded sub-query.
+func (ms PromQLEnforcer) enforceEmbeddedQuery(raw json.RawMessage) (json.RawMessage, error) {
+	var expr string
+	if err := json.Unmarshal(raw, &expr); err == nil {
+		q, err := ms.Enforce(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		return marshalJSON(q)
+	}
+
+	var obj *rawObject
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+		return nil, fmt.Errorf("%w: invalid embedded query", ErrQueryParse)
+	}
+
+	if err := obj.decode("Expr", &expr); err != nil {
+		return nil, fmt.Errorf("%w: invalid embedded query: %w", ErrQueryParse, err)
+	}
+
+	q, err := ms.Enforce(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := obj.set("Expr", q); err != nil {
+		return nil, err
+	}
+
+	return marshalJSON(obj)
+}
+
+// errInvalidShardingHeader is returned when a sharding header has an invalid
+// value.
+var errInvalidShardingHeader = errors.New("invalid sharding header")
+
+// checkShardingHeaders validates the sharding headers of the query requests.
+func checkShardingHeaders(h http.Header) error {
+	for _, v := range h.Values(shardingControlHeader) {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("%w: %s: %q isn't a number of shards", errInvalidShardingHeader, shardingControlHeader, v)
+		}
+	}
+
+	for _, v := range h.Values(queryShardingHeader) {
+		m := shardRe.FindStringSubmatch(v)
+		if m == nil {
+			return fmt.Errorf("%w: %s: %q doesn't match <index>_of_<total>", errInvalidShardingHeader, queryShardingHeader, v)
+		}
+
+		// The regexp guarantees that the numbers are valid.
+		index, _ := strconv.Atoi(m[1])
+		total, _ := strconv.Atoi(m[2])
+		if index < 1 || index > total {
+			return fmt.Errorf("%w: %s: shard %d out of range", errInvalidShardingHeader, queryShardingHeader, index)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// embeddedQuery returns the __embedded_queries__ selector of the given
+// JSON-encoded sub-queries.
+func embeddedQuery(queries string) string {
+	return `__embedded_queries__{__queries__=` + strconv.Quote(queries) + `}`
+}
+
+func TestEnforceEmbeddedQueries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		disabled bool
+
+		expQuery string
+		expErr   error
+	}{
+		{
+			name:     "string sub-queries",
+			query:    `sum(` + embeddedQuery(`{"Concat":["sum(up{__query_shard__=\"1_of_2\"})","sum(up{__query_shard__=\"2_of_2\"})"]}`) + `)`,
+			expQuery: `sum(__embedded_queries__{__queries__="{\"Concat\":[\"sum(up{__query_shard__=\\\"1_of_2\\\",namespace=\\\"ns1\\\"})\",\"sum(up{__query_shard__=\\\"2_of_2\\\",namespace=\\\"ns1\\\"})\"]}",namespace="ns1"})`,
+		},
+		{
+			name:     "object sub-queries",
+			query:    embeddedQuery(`{"Concat":[{"Expr":"rate(http_requests_total[5m]) > 1","Params":{}}]}`) + `[5m]`,
+			expQuery: `__embedded_queries__{__queries__="{\"Concat\":[{\"Expr\":\"rate(http_requests_total{namespace=\\\"ns1\\\"}[5m]) > 1\",\"Params\":{}}]}",namespace="ns1"}[5m]`,
+		},
+		{
+			name:     "other selector",
+			query:    `up{__queries__="foo"}`,
+			expQuery: `up{__queries__="foo",namespace="ns1"}`,
+		},
+		{
+			name:     "compatibility mode disabled",
+			query:    embeddedQuery(`{"Concat":["up"]}`),
+			disabled: true,
+			expQuery: `__embedded_queries__{__queries__="{\"Concat\":[\"up\"]}",namespace="ns1"}`,
+		},
+		{
+			name:   "conflicting label in sub-query",
+			query:  embeddedQuery(`{"Concat":["up{namespace=\"ns2\"}"]}`),
+			expErr: ErrIllegalLabelMatcher,
+		},
+		{
+			name:   "invalid sub-query",
+			query:  embeddedQuery(`{"Concat":["up{"]}`),
+			expErr: ErrQueryParse,
+		},
+		{
+			name:   "invalid JSON",
+			query:  embeddedQuery(`{"Concat":`),
+			expErr: ErrQueryParse,
+		},
+		{
+			name:   "regexp matcher",
+			query:  `__embedded_queries__{__queries__=~".+"}`,
+			expErr: ErrIllegalLabelMatcher,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewPromQLEnforcer(true, &labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "ns1"})
+			e.embeddedQueries = !tc.disabled
+
+			got, err := e.Enforce(tc.query)
+			if tc.expErr != nil {
+				if !errors.Is(err, tc.expErr) {
+					t.Fatalf("expected error %v, got %v", tc.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.expQuery {
+				t.Fatalf("expected query:\n%s\ngot:\n%s", tc.expQuery, got)
+			}
+		})
+	}
+}
+
+func TestShardingHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+
+		expCode int
+	}{
+		{
+			name:    "no header",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "shard count",
+			headers: map[string]string{shardingControlHeader: "16"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid shard count",
+			headers: map[string]string{shardingControlHeader: "all"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "shard selector",
+			headers: map[string]string{queryShardingHeader: "3_of_16"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "out of range shard selector",
+			headers: map[string]string{queryShardingHeader: "17_of_16"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid shard selector",
+			headers: map[string]string{queryShardingHeader: "3/16"},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				for k, v := range tc.headers {
+					if got := req.Header.Get(k); got != v {
+						prometheusAPIError(w, "unexpected "+k+" header: "+got, http.StatusInternalServerError)
+						return
+					}
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryFrontendCompat())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: []string{"up"}, proxyLabel: []string{"ns1"}}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
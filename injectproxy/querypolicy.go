@@ -0,0 +1,177 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ErrQueryPolicy is returned when the input query is denied by the query
+// policy of the tenant.
+var ErrQueryPolicy = errors.New("query denied by policy")
+
+// QueryPolicy restricts the PromQL expressions which a tenant can run.
+type QueryPolicy struct {
+	// DeniedFunctions lists the PromQL functions which can't be called
+	// (e.g. "absent" or "scalar").
+	DeniedFunctions []string
+	// MaxTopK is the maximum value of the k parameter of the topk,
+	// bottomk and limitk aggregations. Zero means no limit.
+	MaxTopK int64
+	// DenyUnnamedSelectors rejects the selectors which don't select a
+	// metric name (e.g. `{job="api"}` or `{__name__=~".*"}`).
+	DenyUnnamedSelectors bool
+}
+
+type tenantQueryPolicies struct {
+	defaults  QueryPolicy
+	overrides map[string]QueryPolicy
+}
+
+// WithQueryPolicy configures the policy applied to the PromQL expressions of
+// the query endpoints. The overrides map label values to their specific
+// policy which replaces the default one. When a request carries several label
+// values, the restrictions of all their policies apply. The denied queries
+// get a "422 Unprocessable Entity" response.
+func WithQueryPolicy(defaults QueryPolicy, overrides map[string]QueryPolicy) Option {
+	return optionFunc(func(o *options) {
+		o.queryPolicies = &tenantQueryPolicies{defaults: defaults, overrides: overrides}
+	})
+}
+
+// validate returns an error if a policy refers to an unknown function.
+func (tp *tenantQueryPolicies) validate() error {
+	if tp == nil {
+		return nil
+	}
+
+	check := func(p QueryPolicy) error {
+		for _, f := range p.DeniedFunctions {
+			if _, found := parser.Functions[f]; !found {
+				return fmt.Errorf("unknown function %q", f)
+			}
+		}
+		if p.MaxTopK < 0 {
+			return errors.New("the maximum k parameter can't be negative")
+		}
+
+		return nil
+	}
+
+	if err := check(tp.defaults); err != nil {
+		return fmt.Errorf("invalid query policy: %w", err)
+	}
+	for lv, p := range tp.overrides {
+		if err := check(p); err != nil {
+			return fmt.Errorf("invalid query policy for %q: %w", lv, err)
+		}
+	}
+
+	return nil
+}
+
+// get returns the policy applying to the given label values.
+func (tp *tenantQueryPolicies) get(lvalues []string) *QueryPolicy {
+	if tp == nil {
+		return nil
+	}
+
+	var res QueryPolicy
+	for _, lv := range lvalues {
+		p := tp.defaults
+		if o, found := tp.overrides[lv]; found {
+			p = o
+		}
+
+		for _, f := range p.DeniedFunctions {
+			if !slices.Contains(res.DeniedFunctions, f) {
+				res.DeniedFunctions = append(res.DeniedFunctions, f)
+			}
+		}
+		res.MaxTopK = int64(minLimit(uint64(res.MaxTopK), uint64(p.MaxTopK)))
+		res.DenyUnnamedSelectors = res.DenyUnnamedSelectors || p.DenyUnnamedSelectors
+	}
+
+	return &res
+}
+
+// check returns an error if the expression isn't allowed by the policy.
+func (p *QueryPolicy) check(expr parser.Expr) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.Call:
+			if n.Func != nil && slices.Contains(p.DeniedFunctions, n.Func.Name) {
+				err = fmt.Errorf("%w: function %s() isn't allowed", ErrQueryPolicy, n.Func.Name)
+			}
+
+		case *parser.AggregateExpr:
+			switch n.Op {
+			case parser.TOPK, parser.BOTTOMK, parser.LIMITK:
+				err = p.checkTopK(n)
+			}
+
+		case *parser.VectorSelector:
+			if p.DenyUnnamedSelectors && !hasMetricName(n.LabelMatchers) {
+				err = fmt.Errorf("%w: selector %s doesn't select a metric name", ErrQueryPolicy, n.String())
+			}
+		}
+
+		return err
+	})
+
+	return err
+}
+
+func (p *QueryPolicy) checkTopK(n *parser.AggregateExpr) error {
+	if p.MaxTopK <= 0 {
+		return nil
+	}
+
+	param := n.Param
+	for {
+		pe, ok := param.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		param = pe.Expr
+	}
+
+	k, ok := param.(*parser.NumberLiteral)
+	if !ok {
+		return fmt.Errorf("%w: the k parameter of %s must be a number", ErrQueryPolicy, n.Op)
+	}
+
+	if k.Val > float64(p.MaxTopK) {
+		return fmt.Errorf("%w: the k parameter of %s can't exceed %d", ErrQueryPolicy, n.Op, p.MaxTopK)
+	}
+
+	return nil
+}
+
+// hasMetricName returns true if the matchers select a non-empty metric name.
+func hasMetricName(ms []*labels.Matcher) bool {
+	for _, m := range ms {
+		if m.Name == labels.MetricName && !m.Matches("") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestEnforceWithQueryPolicy(t *testing.T) {
+	policy := QueryPolicy{
+		DeniedFunctions:      []string{"absent", "vector"},
+		MaxTopK:              10,
+		DenyUnnamedSelectors: true,
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query string
+
+		expErr bool
+	}{
+		{
+			name:  "allowed query",
+			query: `sum by (job) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			name:   "denied function",
+			query:  `absent(up{job="api"})`,
+			expErr: true,
+		},
+		{
+			name:   "nested denied function",
+			query:  `up > on() group_left vector(1)`,
+			expErr: true,
+		},
+		{
+			name:  "topk below the limit",
+			query: `topk(10, up)`,
+		},
+		{
+			name:   "topk above the limit",
+			query:  `topk(11, up)`,
+			expErr: true,
+		},
+		{
+			name:  "bottomk with parenthesized parameter",
+			query: `bottomk((5), up)`,
+		},
+		{
+			name:   "topk with expression parameter",
+			query:  `topk(scalar(count(up)), up)`,
+			expErr: true,
+		},
+		{
+			name:   "unnamed selector",
+			query:  `count({job="api"})`,
+			expErr: true,
+		},
+		{
+			name:   "unnamed selector in range vector",
+			query:  `rate({job="api"}[5m])`,
+			expErr: true,
+		},
+		{
+			name:   "selector matching all the metric names",
+			query:  `{__name__=~".*",job="api"}`,
+			expErr: true,
+		},
+		{
+			name:  "selector with metric name regexp",
+			query: `{__name__=~"http_.+",job="api"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewPromQLEnforcer(false, &labels.Matcher{Name: "namespace", Type: labels.MatchEqual, Value: "ns1"})
+			e.policy = &policy
+
+			_, err := e.Enforce(tc.query)
+			if tc.expErr {
+				if !errors.Is(err, ErrQueryPolicy) {
+					t.Fatalf("expected error %v, got %v", ErrQueryPolicy, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryPolicy(t *testing.T) {
+	opt := WithQueryPolicy(
+		QueryPolicy{DeniedFunctions: []string{"absent"}},
+		map[string]QueryPolicy{
+			"ns2": {},
+			"ns3": {MaxTopK: 5},
+		},
+	)
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		labelv []string
+
+		expCode int
+	}{
+		{
+			name:    "default policy",
+			query:   `absent(up)`,
+			labelv:  []string{"ns1"},
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "override replaces the default policy",
+			query:   `absent(up)`,
+			labelv:  []string{"ns2"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "restrictions of all the label values",
+			query:   `topk(10, up)`,
+			labelv:  []string{"ns2", "ns3"},
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "allowed query",
+			query:   `topk(5, up)`,
+			labelv:  []string{"ns2", "ns3"},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: []string{tc.query}, proxyLabel: tc.labelv}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInvalidQueryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		defaults  QueryPolicy
+		overrides map[string]QueryPolicy
+	}{
+		{
+			name:     "unknown function",
+			defaults: QueryPolicy{DeniedFunctions: []string{"foo"}},
+		},
+		{
+			name:      "negative topk in override",
+			overrides: map[string]QueryPolicy{"ns1": {MaxTopK: -1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryPolicy(tc.defaults, tc.overrides))
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// rawObject is a JSON object whose values are kept undecoded. When encoded
+// back, the fields keep their original order and the values which haven't
+// been modified by the proxy are copied byte-for-byte.
+type rawObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *rawObject) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expected JSON object, got %v", t)
+	}
+
+	o.keys = o.keys[:0]
+	o.values = make(map[string]json.RawMessage)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		// Object keys are always strings.
+		key := t.(string)
+
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		o.setRaw(key, v)
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+func (o rawObject) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, k := range o.keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		key, err := marshalJSON(k)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, o.values[k]...)
+	}
+
+	return append(buf, '}'), nil
+}
+
+// decode unmarshals the value of the given key (if present) into v.
+func (o *rawObject) decode(key string, v interface{}) error {
+	if o == nil {
+		return nil
+	}
+
+	raw, found := o.values[key]
+	if !found {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("can't decode %q: %w", key, err)
+	}
+
+	return nil
+}
+
+// set replaces the value of the given key. New keys are added at the end of
+// the object.
+func (o *rawObject) set(key string, v interface{}) error {
+	b, err := marshalJSON(v)
+	if err != nil {
+		return fmt.Errorf("can't encode %q: %w", key, err)
+	}
+
+	o.setRaw(key, b)
+
+	return nil
+}
+
+func (o *rawObject) setRaw(key string, v json.RawMessage) {
+	if o.values == nil {
+		o.values = make(map[string]json.RawMessage)
+	}
+
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+// del removes the given key.
+func (o *rawObject) del(key string) {
+	if _, found := o.values[key]; !found {
+		return
+	}
+
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// rename renames the given key in place. An existing value for the new key is
+// replaced.
+func (o *rawObject) rename(key, to string) {
+	v, found := o.values[key]
+	if !found || key == to {
+		return
+	}
+
+	o.del(to)
+	delete(o.values, key)
+	o.values[to] = v
+	for i, k := range o.keys {
+		if k == key {
+			o.keys[i] = to
+			break
+		}
+	}
+}
+
+// labels returns the value of the "labels" key.
+func (o *rawObject) labels() (labels.Labels, error) {
+	var ls labels.Labels
+	if err := o.decode("labels", &ls); err != nil {
+		return labels.EmptyLabels(), err
+	}
+
+	return ls, nil
+}
+
+// str returns the value of the given key if it is a string.
+func (o *rawObject) str(key string) string {
+	var s string
+	_ = o.decode(key, &s)
+	return s
+}
+
+// marshalJSON works like json.Marshal except that it doesn't escape HTML
+// characters and that it doesn't reformat the raw objects, both would modify
+// the bytes returned by the upstream.
+func marshalJSON(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case *rawObject:
+		if v == nil {
+			return []byte("null"), nil
+		}
+		return v.MarshalJSON()
+	case []*rawObject:
+		buf := []byte{'['}
+		for i, o := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+
+			b, err := marshalJSON(o)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, b...)
+		}
+		return append(buf, ']'), nil
+	case []json.RawMessage:
+		buf := []byte{'['}
+		for i, b := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, b...)
+		}
+		return append(buf, ']'), nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRawObject(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		in     string
+		modify func(*rawObject) error
+
+		exp string
+		err bool
+	}{
+		{
+			name: "unmodified",
+			in:   `{"z": 1.0, "a": [1e3, "<&>"], "m": {"y": null, "x": true}}`,
+			exp:  `{"z":1.0,"a":[1e3, "<&>"],"m":{"y": null, "x": true}}`,
+		},
+		{
+			name: "set existing key",
+			in:   `{"z":1,"a":2}`,
+			modify: func(o *rawObject) error {
+				return o.set("z", "<3>")
+			},
+			exp: `{"z":"<3>","a":2}`,
+		},
+		{
+			name: "set new key",
+			in:   `{"z":1,"a":2}`,
+			modify: func(o *rawObject) error {
+				return o.set("b", []*rawObject{nil, {}})
+			},
+			exp: `{"z":1,"a":2,"b":[null,{}]}`,
+		},
+		{
+			name: "delete key",
+			in:   `{"z":1,"a":2,"b":3}`,
+			modify: func(o *rawObject) error {
+				o.del("a")
+				o.del("c")
+				return nil
+			},
+			exp: `{"z":1,"b":3}`,
+		},
+		{
+			name: "duplicate keys",
+			in:   `{"z":1,"a":2,"z":3}`,
+			exp:  `{"z":3,"a":2}`,
+		},
+		{
+			name: "not an object",
+			in:   `[1,2]`,
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var o rawObject
+			err := json.Unmarshal([]byte(tc.in), &o)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.modify != nil {
+				if err := tc.modify(&o); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			got, err := marshalJSON(&o)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(got) != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// WithReceivers enables the /api/v2/receivers endpoint of Alertmanager. The
+// map's keys are the receiver names and the values are the label values
+// allowed to see the receiver. The receivers which aren't listed are hidden
+// from all the clients.
+func WithReceivers(receivers map[string][]string) Option {
+	return optionFunc(func(o *options) {
+		o.receivers = receivers
+	})
+}
+
+// filterReceivers removes the receivers which aren't assigned to the enforced
+// label values from the Alertmanager response.
+func (r *routes) filterReceivers(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// Pass non-200 responses as-is.
+		return nil
+	}
+
+	raw, err := readJSONBody(resp)
+	if err != nil {
+		return fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	m, err := r.newLabelMatcher(MustLabelValues(resp.Request.Context())...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+
+	b, err := filterJSONArray(raw, nil, func(item *rawObject) bool {
+		var name string
+		if err := item.decode("name", &name); err != nil {
+			return false
+		}
+
+		return slices.ContainsFunc(r.receivers[name], m.Matches)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+
+	replaceBody(resp, append(b, '\n'))
+
+	return nil
+}
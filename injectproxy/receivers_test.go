@@ -0,0 +1,134 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReceivers(t *testing.T) {
+	const receivers = `[{"name":"team-a"},{"name":"team-b"},{"name":"shared"},{"name":"ops"}]`
+	mapping := map[string][]string{
+		"team-a": {"ns1"},
+		"team-b": {"ns2"},
+		"shared": {"ns1", "ns2"},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		opts     []Option
+		upstream string
+		code     int
+
+		expCode     int
+		expResponse string
+	}{
+		{
+			name:    "no mapping",
+			url:     "/api/v2/receivers?namespace=ns1",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:        "single value",
+			url:         "/api/v2/receivers?namespace=ns1",
+			opts:        []Option{WithReceivers(mapping)},
+			expCode:     http.StatusOK,
+			expResponse: `[{"name":"team-a"},{"name":"shared"}]`,
+		},
+		{
+			name:        "multiple values",
+			url:         "/api/v2/receivers?namespace=ns1&namespace=ns2",
+			opts:        []Option{WithReceivers(mapping)},
+			expCode:     http.StatusOK,
+			expResponse: `[{"name":"team-a"},{"name":"team-b"},{"name":"shared"}]`,
+		},
+		{
+			name:        "regex match",
+			url:         "/api/v2/receivers?namespace=ns.*",
+			opts:        []Option{WithReceivers(mapping), WithRegexMatch()},
+			expCode:     http.StatusOK,
+			expResponse: `[{"name":"team-a"},{"name":"team-b"},{"name":"shared"}]`,
+		},
+		{
+			name:        "no receiver",
+			url:         "/api/v2/receivers?namespace=ns3",
+			opts:        []Option{WithReceivers(mapping)},
+			expCode:     http.StatusOK,
+			expResponse: `[]`,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v2/receivers",
+			opts:    []Option{WithReceivers(mapping)},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "upstream error",
+			url:      "/api/v2/receivers?namespace=ns1",
+			opts:     []Option{WithReceivers(mapping)},
+			upstream: `internal error`,
+			code:     http.StatusInternalServerError,
+			expCode:  http.StatusInternalServerError,
+		},
+		{
+			name:     "invalid response",
+			url:      "/api/v2/receivers?namespace=ns1",
+			opts:     []Option{WithReceivers(mapping)},
+			upstream: `{}`,
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				body, code := tc.upstream, tc.code
+				if body == "" {
+					body = receivers
+				}
+				if code == 0 {
+					code = http.StatusOK
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(code)
+				w.Write([]byte(body))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com"+tc.url, nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expResponse == "" {
+				return
+			}
+
+			if got := strings.TrimSpace(string(body)); got != tc.expResponse {
+				t.Fatalf("expected response %s, got %s", tc.expResponse, got)
+			}
+		})
+	}
+}
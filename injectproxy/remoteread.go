@@ -0,0 +1,143 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteRead enforces the label matchers in the queries of the
+// snappy-compressed protobuf body of a remote read request.
+func (r *routes) remoteRead(w http.ResponseWriter, req *http.Request) {
+	e, err := r.newQueryEnforcer(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't read the request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	_ = req.Body.Close()
+
+	b, err := EnforceRemoteRead(e, compressed)
+	if err != nil {
+		enforceError(w, err)
+		return
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+
+	// The responses aren't coalesced since they may be streamed.
+	r.handler.ServeHTTP(w, req)
+}
+
+// EnforceRemoteRead enforces the label matchers in every query of the
+// snappy-compressed remote read request and returns the re-encoded request.
+func EnforceRemoteRead(e *PromQLEnforcer, compressed []byte) ([]byte, error) {
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decompress: %w", errBadRequestBody, err)
+	}
+
+	var rr prompb.ReadRequest
+	if err := rr.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("%w: can't decode protobuf: %w", errBadRequestBody, err)
+	}
+
+	for _, q := range rr.Queries {
+		ms, err := fromRemoteReadMatchers(q.Matchers)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadRequestBody, err)
+		}
+
+		ms, err = e.EnforceMatchers(ms)
+		if err != nil {
+			if errors.Is(err, ErrIllegalLabelMatcher) || errors.Is(err, ErrUnselectiveSelector) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("%w: %w", ErrEnforceLabel, err)
+		}
+
+		q.Matchers = toRemoteReadMatchers(ms)
+	}
+
+	b, err = rr.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("can't encode protobuf: %w", err)
+	}
+
+	return snappy.Encode(nil, b), nil
+}
+
+func fromRemoteReadMatchers(ms []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	res := make([]*labels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type %d", m.Type)
+		}
+
+		lm, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, lm)
+	}
+
+	return res, nil
+}
+
+func toRemoteReadMatchers(ms []*labels.Matcher) []*prompb.LabelMatcher {
+	res := make([]*prompb.LabelMatcher, 0, len(ms))
+	for _, m := range ms {
+		var t prompb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			t = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			t = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			t = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			t = prompb.LabelMatcher_NRE
+		}
+		res = append(res, &prompb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value})
+	}
+
+	return res
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func encodeReadRequest(t *testing.T, queries ...[]*prompb.LabelMatcher) []byte {
+	t.Helper()
+
+	rr := prompb.ReadRequest{}
+	for _, ms := range queries {
+		rr.Queries = append(rr.Queries, &prompb.Query{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: ms})
+	}
+
+	b, err := rr.Marshal()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return snappy.Encode(nil, b)
+}
+
+// checkReadRequestHandler verifies that the queries of the remote read
+// request have the expected matchers.
+func checkReadRequestHandler(exp ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, _ := io.ReadAll(req.Body)
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var rr prompb.ReadRequest
+		if err := rr.Unmarshal(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.ContentLength != int64(len(compressed)) {
+			http.Error(w, fmt.Sprintf("expected content length %d, got %d", len(compressed), req.ContentLength), http.StatusBadRequest)
+			return
+		}
+
+		if len(rr.Queries) != len(exp) {
+			http.Error(w, fmt.Sprintf("expected %d queries, got %d", len(exp), len(rr.Queries)), http.StatusBadRequest)
+			return
+		}
+
+		for i, q := range rr.Queries {
+			ms, err := fromRemoteReadMatchers(q.Matchers)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if got := matchersToString(ms...); got != exp[i] {
+				http.Error(w, fmt.Sprintf("expected query %d to be %s, got %s", i, exp[i], got), http.StatusBadRequest)
+				return
+			}
+
+			if q.StartTimestampMs != 1 || q.EndTimestampMs != 2 {
+				http.Error(w, "unexpected time range", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Write(okResponse)
+	})
+}
+
+func TestRemoteRead(t *testing.T) {
+	var (
+		up      = &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}
+		ns2     = &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: proxyLabel, Value: "ns2"}
+		job     = &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "a|b"}
+		badJob  = &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "("}
+		badType = &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(42), Name: "job", Value: "a"}
+	)
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		method   string
+		body     []byte
+		opts     []Option
+		upstream http.Handler
+
+		expCode int
+	}{
+		{
+			name:     "single query",
+			url:      "/api/v1/read?namespace=ns1",
+			body:     encodeReadRequest(t, []*prompb.LabelMatcher{up}),
+			upstream: checkReadRequestHandler(`{__name__="up",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "multiple queries",
+			url:      "/api/v1/read?namespace=ns1",
+			body:     encodeReadRequest(t, []*prompb.LabelMatcher{up}, []*prompb.LabelMatcher{job, ns2}),
+			upstream: checkReadRequestHandler(`{__name__="up",namespace="ns1"}`, `{job=~"a|b",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "multiple label values",
+			url:      "/api/v1/read?namespace=ns1&namespace=ns2",
+			body:     encodeReadRequest(t, []*prompb.LabelMatcher{up}),
+			upstream: checkReadRequestHandler(`{__name__="up",namespace=~"ns1|ns2"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:    "conflicting matcher with error on replace",
+			url:     "/api/v1/read?namespace=ns1",
+			body:    encodeReadRequest(t, []*prompb.LabelMatcher{up, ns2}),
+			opts:    []Option{WithErrorOnReplace()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid regex",
+			url:     "/api/v1/read?namespace=ns1",
+			body:    encodeReadRequest(t, []*prompb.LabelMatcher{badJob}),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid matcher type",
+			url:     "/api/v1/read?namespace=ns1",
+			body:    encodeReadRequest(t, []*prompb.LabelMatcher{badType}),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid compression",
+			url:     "/api/v1/read?namespace=ns1",
+			body:    []byte("foo"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid protobuf",
+			url:     "/api/v1/read?namespace=ns1",
+			body:    snappy.Encode(nil, []byte("foo")),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v1/read",
+			body:    encodeReadRequest(t, []*prompb.LabelMatcher{up}),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "GET method",
+			url:     "/api/v1/read?namespace=ns1",
+			method:  http.MethodGet,
+			expCode: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := tc.upstream
+			if upstream == nil {
+				upstream = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					http.Error(w, "unexpected request", http.StatusTeapot)
+				})
+			}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set("Content-Encoding", "snappy")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, strings.TrimSpace(string(body)))
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	remoteWritePath = "/api/v1/write"
+
+	// remoteWriteProto is the only protobuf message of the remote write
+	// protocol supported by the proxy (remote write 1.0).
+	remoteWriteProto = "prometheus.WriteRequest"
+)
+
+// WithRemoteWrite enables the /api/v1/write endpoint. The enforced labels are
+// verified on every series of the remote write requests: the series without
+// the label get it injected (if a single value is enforced) and the requests
+// with series of other label values are rejected. If not set, the endpoint
+// isn't exposed.
+func WithRemoteWrite() Option {
+	return optionFunc(func(o *options) {
+		o.remoteWrite = true
+	})
+}
+
+// seriesLabel is a label enforced on the series of a remote write request.
+type seriesLabel struct {
+	matcher *labels.Matcher
+	// value is injected into the series without the label. It is empty when
+	// the label can't be injected (multiple values or regex match).
+	value string
+}
+
+// remoteWrite enforces the labels on the series of the snappy-compressed
+// protobuf body of a remote write request.
+func (r *routes) remoteWrite(w http.ResponseWriter, req *http.Request) {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		_, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("invalid Content-Type header: %v", err), http.StatusUnsupportedMediaType)
+			return
+		}
+		if proto, found := params["proto"]; found && proto != remoteWriteProto {
+			prometheusAPIError(w, fmt.Sprintf("unsupported remote write protobuf message %q", proto), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	sls, err := r.seriesLabels(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't read the request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	_ = req.Body.Close()
+
+	b, err := enforceRemoteWrite(sls, compressed)
+	if err != nil {
+		enforceError(w, err)
+		return
+	}
+
+	// The request was possibly chunked: it is forwarded with its new length.
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// seriesLabels returns the labels enforced on the series of the request.
+func (r *routes) seriesLabels(req *http.Request) ([]seriesLabel, error) {
+	enforced := r.enforcedLabels(req.Context())
+
+	lm, err := r.newLabelMatcher(enforced[0].values...)
+	if err != nil {
+		return nil, err
+	}
+
+	extra, err := r.extraLabelMatchers(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	sls := make([]seriesLabel, 0, len(enforced))
+	for i, m := range append([]*labels.Matcher{lm}, extra...) {
+		sl := seriesLabel{matcher: m}
+		if len(enforced[i].values) == 1 && (i > 0 || !r.regexMatch) {
+			sl.value = enforced[i].values[0]
+		}
+		sls = append(sls, sl)
+	}
+
+	return sls, nil
+}
+
+// enforceRemoteWrite enforces the labels on every series of the
+// snappy-compressed remote write request and returns the re-encoded request.
+func enforceRemoteWrite(sls []seriesLabel, compressed []byte) ([]byte, error) {
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decompress: %w", errBadRequestBody, err)
+	}
+
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("%w: can't decode protobuf: %w", errBadRequestBody, err)
+	}
+
+	for i := range wr.Timeseries {
+		ts := &wr.Timeseries[i]
+		for _, sl := range sls {
+			ts.Labels, err = enforceSeriesLabel(ts.Labels, sl)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b, err = wr.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("can't encode protobuf: %w", err)
+	}
+
+	return snappy.Encode(nil, b), nil
+}
+
+// enforceSeriesLabel verifies the value of the enforced label in the labels
+// of a series or injects it when missing. The labels aren't assumed to be
+// sorted nor unique so that a malformed series can't bypass the check.
+func enforceSeriesLabel(ls []prompb.Label, sl seriesLabel) ([]prompb.Label, error) {
+	name := sl.matcher.Name
+
+	found := false
+	for _, l := range ls {
+		if l.Name != name || l.Value == "" {
+			continue
+		}
+		if !sl.matcher.Matches(l.Value) {
+			return nil, fmt.Errorf("%w: series %s doesn't match %s", ErrIllegalSeriesLabel, seriesString(ls), sl.matcher)
+		}
+		found = true
+	}
+	if found {
+		return ls, nil
+	}
+
+	if sl.value == "" {
+		return nil, fmt.Errorf("%w: series %s has no %q label and it can't be injected for %s", ErrIllegalSeriesLabel, seriesString(ls), name, sl.matcher)
+	}
+
+	// A label with an empty value is the same as a missing label.
+	ls = slices.DeleteFunc(ls, func(l prompb.Label) bool { return l.Name == name })
+
+	i := slices.IndexFunc(ls, func(l prompb.Label) bool { return l.Name > name })
+	if i < 0 {
+		i = len(ls)
+	}
+
+	return slices.Insert(ls, i, prompb.Label{Name: name, Value: sl.value}), nil
+}
+
+func seriesString(ls []prompb.Label) string {
+	b := labels.NewScratchBuilder(len(ls))
+	for _, l := range ls {
+		b.Add(l.Name, l.Value)
+	}
+
+	return b.Labels().String()
+}
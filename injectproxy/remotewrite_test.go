@@ -0,0 +1,289 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func encodeWriteRequest(t *testing.T, series ...[]prompb.Label) []byte {
+	t.Helper()
+
+	wr := prompb.WriteRequest{}
+	for _, ls := range series {
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{Labels: ls, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}})
+	}
+
+	b, err := wr.Marshal()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return snappy.Encode(nil, b)
+}
+
+// checkWriteRequestHandler verifies that the series of the remote write
+// request have the expected labels.
+func checkWriteRequestHandler(exp ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, _ := io.ReadAll(req.Body)
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.ContentLength != int64(len(compressed)) {
+			http.Error(w, fmt.Sprintf("expected content length %d, got %d", len(compressed), req.ContentLength), http.StatusBadRequest)
+			return
+		}
+
+		if len(wr.Timeseries) != len(exp) {
+			http.Error(w, fmt.Sprintf("expected %d series, got %d", len(exp), len(wr.Timeseries)), http.StatusBadRequest)
+			return
+		}
+
+		for i, ts := range wr.Timeseries {
+			if got := seriesString(ts.Labels); got != exp[i] {
+				http.Error(w, fmt.Sprintf("expected series %d to be %s, got %s", i, exp[i], got), http.StatusBadRequest)
+				return
+			}
+
+			if len(ts.Samples) != 1 {
+				http.Error(w, "unexpected samples", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var (
+		up   = prompb.Label{Name: "__name__", Value: "up"}
+		job  = prompb.Label{Name: "job", Value: "a"}
+		ns1  = prompb.Label{Name: proxyLabel, Value: "ns1"}
+		ns2  = prompb.Label{Name: proxyLabel, Value: "ns2"}
+		ns3  = prompb.Label{Name: proxyLabel, Value: "ns3"}
+		zone = prompb.Label{Name: "zone", Value: "z1"}
+	)
+
+	for _, tc := range []struct {
+		name        string
+		url         string
+		method      string
+		contentType string
+		body        []byte
+		chunked     bool
+		opts        []Option
+		upstream    http.Handler
+
+		expCode int
+	}{
+		{
+			name:     "injected label",
+			url:      "/api/v1/write?namespace=ns1",
+			body:     encodeWriteRequest(t, []prompb.Label{up, job, zone}),
+			opts:     []Option{WithRemoteWrite()},
+			upstream: checkWriteRequestHandler(`{__name__="up", job="a", namespace="ns1", zone="z1"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:     "matching label",
+			url:      "/api/v1/write?namespace=ns1",
+			body:     encodeWriteRequest(t, []prompb.Label{up, ns1}, []prompb.Label{up, job}),
+			opts:     []Option{WithRemoteWrite()},
+			upstream: checkWriteRequestHandler(`{__name__="up", namespace="ns1"}`, `{__name__="up", job="a", namespace="ns1"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:     "empty label value",
+			url:      "/api/v1/write?namespace=ns1",
+			body:     encodeWriteRequest(t, []prompb.Label{up, {Name: proxyLabel}}),
+			opts:     []Option{WithRemoteWrite()},
+			upstream: checkWriteRequestHandler(`{__name__="up", namespace="ns1"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:     "chunked request",
+			url:      "/api/v1/write?namespace=ns1",
+			body:     encodeWriteRequest(t, []prompb.Label{up}),
+			chunked:  true,
+			opts:     []Option{WithRemoteWrite()},
+			upstream: checkWriteRequestHandler(`{__name__="up", namespace="ns1"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:    "conflicting label",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    encodeWriteRequest(t, []prompb.Label{up, ns1}, []prompb.Label{up, ns2}),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "duplicate label",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    encodeWriteRequest(t, []prompb.Label{ns1, up, ns2}),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "multiple label values",
+			url:      "/api/v1/write?namespace=ns1&namespace=ns2",
+			body:     encodeWriteRequest(t, []prompb.Label{up, ns1}, []prompb.Label{up, ns2}),
+			opts:     []Option{WithRemoteWrite()},
+			upstream: checkWriteRequestHandler(`{__name__="up", namespace="ns1"}`, `{__name__="up", namespace="ns2"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:    "multiple label values with missing label",
+			url:     "/api/v1/write?namespace=ns1&namespace=ns2",
+			body:    encodeWriteRequest(t, []prompb.Label{up}),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "regex match",
+			url:      "/api/v1/write?namespace=ns[12]",
+			body:     encodeWriteRequest(t, []prompb.Label{up, ns2}),
+			opts:     []Option{WithRemoteWrite(), WithRegexMatch()},
+			upstream: checkWriteRequestHandler(`{__name__="up", namespace="ns2"}`),
+			expCode:  http.StatusNoContent,
+		},
+		{
+			name:    "regex match with conflicting label",
+			url:     "/api/v1/write?namespace=ns[12]",
+			body:    encodeWriteRequest(t, []prompb.Label{up, ns3}),
+			opts:    []Option{WithRemoteWrite(), WithRegexMatch()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "regex match with missing label",
+			url:     "/api/v1/write?namespace=ns[12]",
+			body:    encodeWriteRequest(t, []prompb.Label{up}),
+			opts:    []Option{WithRemoteWrite(), WithRegexMatch()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:        "remote write 2.0",
+			url:         "/api/v1/write?namespace=ns1",
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request",
+			body:        encodeWriteRequest(t, []prompb.Label{up}),
+			opts:        []Option{WithRemoteWrite()},
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "invalid compression",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    []byte("foo"),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid protobuf",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    snappy.Encode(nil, []byte("foo")),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v1/write",
+			body:    encodeWriteRequest(t, []prompb.Label{up}),
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "read-only label value",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    encodeWriteRequest(t, []prompb.Label{up}),
+			opts:    []Option{WithRemoteWrite(), WithReadOnlyTenants("ns1")},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "GET method",
+			url:     "/api/v1/write?namespace=ns1",
+			method:  http.MethodGet,
+			opts:    []Option{WithRemoteWrite()},
+			expCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "not enabled",
+			url:     "/api/v1/write?namespace=ns1",
+			body:    encodeWriteRequest(t, []prompb.Label{up}),
+			expCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := tc.upstream
+			if upstream == nil {
+				upstream = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					http.Error(w, "unexpected request", http.StatusTeapot)
+				})
+			}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			var body io.Reader = bytes.NewReader(tc.body)
+			if tc.chunked {
+				// Hide the length of the body.
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, body)
+			if tc.chunked {
+				req.TransferEncoding = []string{"chunked"}
+			}
+			contentType := tc.contentType
+			if contentType == "" {
+				contentType = "application/x-protobuf"
+			}
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Content-Encoding", "snappy")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, strings.TrimSpace(string(body)))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const maxResolverCacheLength = 10000
+
+// LabelValueResolver returns the label values which a tenant is authorized
+// to access.
+type LabelValueResolver interface {
+	Resolve(ctx context.Context, tenant string) ([]string, error)
+}
+
+// HTTPLabelValueResolver gets the label values of the tenants from an HTTP
+// endpoint. The tenant is sent in the "tenant" query parameter and the
+// endpoint replies with the label values as a JSON document:
+//
+//	{"values": ["ns1", "ns2"]}
+//
+// The "404 Not Found" responses mean that the tenant has no label value.
+type HTTPLabelValueResolver struct {
+	// URL is the URL of the endpoint.
+	URL *url.URL
+	// Client is the HTTP client used to query the endpoint,
+	// http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// Resolve implements the LabelValueResolver interface.
+func (hr *HTTPLabelValueResolver) Resolve(ctx context.Context, tenant string) ([]string, error) {
+	u := *hr.URL
+	q := u.Query()
+	q.Set("tenant", tenant)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := hr.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var res struct {
+		Values []string `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("can't decode the response: %w", err)
+	}
+
+	return res.Values, nil
+}
+
+// ResolvingEnforcer enforces the label values resolved from the tenants
+// extracted by another enforcer (e.g. the value of an HTTP header). When
+// several tenants are extracted, the union of their label values is
+// enforced. The requests of the tenants without label values are rejected
+// with 403. The resolved values are cached for the given TTL.
+type ResolvingEnforcer struct {
+	resolver LabelValueResolver
+	enforcer ExtractLabeler
+	ttl      time.Duration
+	now      func() time.Time
+
+	mtx   sync.Mutex
+	cache map[string]resolvedValues
+}
+
+type resolvedValues struct {
+	values  []string
+	expires time.Time
+}
+
+// NewResolvingEnforcer returns the enforcer resolving the tenants extracted
+// by enforcer (e.g. HTTPHeaderEnforcer) with resolver.
+func NewResolvingEnforcer(resolver LabelValueResolver, enforcer ExtractLabeler, ttl time.Duration) *ResolvingEnforcer {
+	return &ResolvingEnforcer{
+		resolver: resolver,
+		enforcer: enforcer,
+		ttl:      ttl,
+		now:      time.Now,
+		cache:    make(map[string]resolvedValues),
+	}
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (re *ResolvingEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return re.enforcer.ExtractLabel(func(w http.ResponseWriter, r *http.Request) {
+		var labelValues []string
+		for _, tenant := range MustLabelValues(r.Context()) {
+			values, err := re.resolve(r.Context(), tenant)
+			if err != nil {
+				prometheusAPIError(w, fmt.Sprintf("can't resolve the label values of %q: %v", tenant, err), http.StatusBadGateway)
+				return
+			}
+
+			for _, v := range values {
+				if v != "" && !slices.Contains(labelValues, v) {
+					labelValues = append(labelValues, v)
+				}
+			}
+		}
+
+		if len(labelValues) == 0 {
+			prometheusAPIError(w, "no label value resolved for the tenant", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+func (re *ResolvingEnforcer) resolve(ctx context.Context, tenant string) ([]string, error) {
+	if values, found := re.cached(tenant); found {
+		return values, nil
+	}
+
+	values, err := re.resolver.Resolve(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	re.store(tenant, values)
+
+	return values, nil
+}
+
+func (re *ResolvingEnforcer) cached(tenant string) ([]string, bool) {
+	if re.ttl <= 0 {
+		return nil, false
+	}
+
+	re.mtx.Lock()
+	defer re.mtx.Unlock()
+
+	rv, found := re.cache[tenant]
+	if !found || !re.now().Before(rv.expires) {
+		return nil, false
+	}
+
+	return rv.values, true
+}
+
+func (re *ResolvingEnforcer) store(tenant string, values []string) {
+	if re.ttl <= 0 {
+		return
+	}
+
+	re.mtx.Lock()
+	defer re.mtx.Unlock()
+
+	now := re.now()
+	if len(re.cache) >= maxResolverCacheLength {
+		for k, rv := range re.cache {
+			if !now.Before(rv.expires) {
+				delete(re.cache, k)
+			}
+		}
+		if len(re.cache) >= maxResolverCacheLength {
+			// All the entries are still valid, start afresh.
+			clear(re.cache)
+		}
+	}
+
+	re.cache[tenant] = resolvedValues{values: values, expires: now.Add(re.ttl)}
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver implements the endpoint queried by HTTPLabelValueResolver.
+type fakeResolver struct {
+	// values maps the tenants to their label values.
+	values map[string][]string
+
+	requests atomic.Int64
+}
+
+func (f *fakeResolver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.requests.Add(1)
+
+	tenant := req.URL.Query().Get("tenant")
+	if tenant == "broken" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	values, found := f.values[tenant]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string][]string{"values": values})
+}
+
+func TestResolvingEnforcer(t *testing.T) {
+	const tenantHeader = "X-Tenant"
+
+	for _, tc := range []struct {
+		name    string
+		tenants []string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "single tenant",
+			tenants:  []string{"team-a"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "multiple tenants",
+			tenants:  []string{"team-a", "team-b"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"ns1|ns2|ns3"}`,
+		},
+		{
+			name:    "unknown tenant",
+			tenants: []string{"team-c"},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "tenant without label values",
+			tenants: []string{"team-d"},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "resolver failure",
+			tenants: []string{"team-a", "broken"},
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:    "missing tenant",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := httptest.NewServer(&fakeResolver{values: map[string][]string{
+				"team-a": {"ns1", "ns2"},
+				"team-b": {"ns2", "ns3"},
+				"team-d": {},
+			}})
+			defer resolver.Close()
+			u, _ := url.Parse(resolver.URL)
+
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expQuery))
+			defer m.Close()
+
+			e := NewResolvingEnforcer(&HTTPLabelValueResolver{URL: u}, HTTPHeaderEnforcer{Name: tenantHeader}, 0)
+			r, err := NewRoutes(m.url, proxyLabel, e)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			for _, tenant := range tc.tenants {
+				req.Header.Add(tenantHeader, tenant)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestResolvingEnforcerCache(t *testing.T) {
+	f := &fakeResolver{values: map[string][]string{"team-a": {"ns1"}}}
+	resolver := httptest.NewServer(f)
+	defer resolver.Close()
+	u, _ := url.Parse(resolver.URL)
+
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="ns1"}`))
+	defer m.Close()
+
+	e := NewResolvingEnforcer(&HTTPLabelValueResolver{URL: u}, HTTPHeaderEnforcer{Name: "X-Tenant"}, time.Minute)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	r, err := NewRoutes(m.url, proxyLabel, e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := func() {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+		req.Header.Set("X-Tenant", "team-a")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	query()
+	query()
+	if got := f.requests.Load(); got != 1 {
+		t.Fatalf("expected 1 resolver request, got %d", got)
+	}
+
+	// The cached values expire.
+	now = now.Add(time.Minute)
+	query()
+	if got := f.requests.Load(); got != 2 {
+		t.Fatalf("expected 2 resolver requests, got %d", got)
+	}
+}
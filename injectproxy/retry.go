@@ -0,0 +1,224 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryConfig configures the retries of the idempotent requests (GET and
+// HEAD requests without body) sent to the upstream.
+type RetryConfig struct {
+	// Retries is the maximum number of retries after the first attempt
+	// when the upstream returns a 5xx status code or the request fails
+	// (e.g. connection refused).
+	Retries int
+	// Backoff is the delay before the first retry. It is doubled for each
+	// following retry.
+	Backoff time.Duration
+	// HedgeDelay enables the hedging of the requests: when the upstream
+	// doesn't respond within the delay, a second identical request is sent
+	// and the first response is used. Zero disables the hedging.
+	HedgeDelay time.Duration
+}
+
+// WithUpstreamRetries configures the retries (and the hedging) of the
+// idempotent requests sent to the upstream.
+func WithUpstreamRetries(cfg RetryConfig) Option {
+	return optionFunc(func(o *options) {
+		o.retries = cfg
+	})
+}
+
+type retryTransport struct {
+	next http.RoundTripper
+	cfg  RetryConfig
+
+	retries prometheus.Counter
+	hedged  prometheus.Counter
+}
+
+// newRetryTransport returns the transport retrying the idempotent requests
+// sent with rt according to cfg.
+func newRetryTransport(rt http.RoundTripper, cfg RetryConfig, reg prometheus.Registerer) *retryTransport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	t := &retryTransport{
+		next: rt,
+		cfg:  cfg,
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_label_proxy_upstream_retries_total",
+			Help: "Total number of upstream requests retried after a failure.",
+		}),
+		hedged: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_label_proxy_upstream_hedged_requests_total",
+			Help: "Total number of hedged upstream requests sent because the upstream didn't respond in time.",
+		}),
+	}
+	reg.MustRegister(t.retries, t.hedged)
+
+	return t
+}
+
+// idempotent returns true if the request can be sent more than once.
+func idempotent(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	// Protocol upgrades (e.g. WebSocket) hijack the connection.
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// retryable returns true if the attempt failed and should be retried.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// The client went away.
+		return req.Context().Err() == nil
+	}
+
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	backoff := t.cfg.Backoff
+	for i := 0; ; i++ {
+		resp, err := t.attempt(req)
+		if i >= t.cfg.Retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		discardResponse(resp)
+		t.retries.Inc()
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// attempt sends the request to the upstream, hedged if configured.
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.cfg.HedgeDelay <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	type result struct {
+		i    int
+		resp *http.Response
+		err  error
+	}
+
+	var (
+		// The channel is buffered so that the losing request doesn't
+		// block.
+		results = make(chan result, 2)
+		cancels []context.CancelFunc
+	)
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.next.RoundTrip(req.Clone(ctx))
+			results <- result{i: i, resp: resp, err: err}
+		}()
+	}
+
+	send()
+	hedge := time.NewTimer(t.cfg.HedgeDelay)
+	defer hedge.Stop()
+
+	pending := 1
+	for {
+		select {
+		case <-hedge.C:
+			t.hedged.Inc()
+			send()
+			pending++
+		case res := <-results:
+			pending--
+			if pending > 0 && retryable(req, res.resp, res.err) {
+				// Wait for the other request.
+				discardResponse(res.resp)
+				cancels[res.i]()
+				continue
+			}
+
+			// Cancel the other requests and release their responses.
+			for i, cancel := range cancels {
+				if i != res.i {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					discardResponse((<-results).resp)
+				}
+			}(pending)
+
+			if res.err != nil {
+				cancels[res.i]()
+				return nil, res.err
+			}
+			// The request's context is canceled once the body is read.
+			res.resp.Body = &cancelReadCloser{ReadCloser: res.resp.Body, cancel: cancels[res.i]}
+
+			return res.resp, nil
+		}
+	}
+}
+
+// discardResponse drains and closes the body of a response which isn't used.
+func discardResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+}
+
+// cancelReadCloser cancels the context of the request when the response body
+// is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+
+	return err
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		failures int64
+		cfg      RetryConfig
+
+		expCode     int
+		expAttempts int64
+		expRetries  int
+	}{
+		{
+			name:        "success after retries",
+			method:      http.MethodGet,
+			failures:    2,
+			cfg:         RetryConfig{Retries: 2, Backoff: time.Millisecond},
+			expCode:     http.StatusOK,
+			expAttempts: 3,
+			expRetries:  2,
+		},
+		{
+			name:        "retries exhausted",
+			method:      http.MethodGet,
+			failures:    3,
+			cfg:         RetryConfig{Retries: 1, Backoff: time.Millisecond},
+			expCode:     http.StatusServiceUnavailable,
+			expAttempts: 2,
+			expRetries:  1,
+		},
+		{
+			name:        "POST request",
+			method:      http.MethodPost,
+			failures:    1,
+			cfg:         RetryConfig{Retries: 2, Backoff: time.Millisecond},
+			expCode:     http.StatusServiceUnavailable,
+			expAttempts: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int64
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if attempts.Add(1) <= tc.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			reg := prometheus.NewRegistry()
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamRetries(tc.cfg), WithPrometheusRegistry(reg))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?namespace=ns1", strings.NewReader("query=up"))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := attempts.Load(); got != tc.expAttempts {
+				t.Fatalf("expected %d attempts, got %d", tc.expAttempts, got)
+			}
+
+			exp := fmt.Sprintf(`
+# HELP prom_label_proxy_upstream_retries_total Total number of upstream requests retried after a failure.
+# TYPE prom_label_proxy_upstream_retries_total counter
+prom_label_proxy_upstream_retries_total %d
+`, tc.expRetries)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(exp), "prom_label_proxy_upstream_retries_total"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetriesConnectionError(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(okResponse)
+	}))
+	u := *m.url
+	m.Close()
+
+	r, err := NewRoutes(&u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamRetries(RetryConfig{Retries: 2, Backoff: time.Millisecond}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusBadGateway, w.Code, w.Body.String())
+	}
+}
+
+func TestUpstreamHedging(t *testing.T) {
+	var (
+		attempts atomic.Int64
+		release  = make(chan struct{})
+	)
+	defer close(release)
+
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if attempts.Add(1) == 1 {
+			// The first request is stuck until the client cancels it.
+			select {
+			case <-req.Context().Done():
+			case <-release:
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamRetries(RetryConfig{HedgeDelay: 10 * time.Millisecond}), WithPrometheusRegistry(reg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Body.String() != string(okResponse) {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	exp := `
+# HELP prom_label_proxy_upstream_hedged_requests_total Total number of hedged upstream requests sent because the upstream didn't respond in time.
+# TYPE prom_label_proxy_upstream_hedged_requests_total counter
+prom_label_proxy_upstream_hedged_requests_total 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(exp), "prom_label_proxy_upstream_hedged_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidRetryConfig(t *testing.T) {
+	for _, cfg := range []RetryConfig{
+		{Retries: -1},
+		{Retries: 1, Backoff: -time.Second},
+		{HedgeDelay: -time.Second},
+	} {
+		_, err := NewRoutes(&url.URL{Scheme: "http", Host: "prometheus.example.com"}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamRetries(cfg))
+		if err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
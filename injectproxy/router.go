@@ -0,0 +1,151 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/metalmatze/signal/server/signalhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// router dispatches the requests to the routes of the proxy. It relies on the
+// patterns of http.ServeMux which support path parameters (e.g.
+// "/api/v2/silence/{id}").
+//
+// The router doesn't allow registering a pattern which shares the static
+// prefix of a previously registered pattern. For example, if "/federate" is
+// registered, "/federate/" or "/federate/some" can't be registered. This
+// prevents a user-provided pattern from shadowing an enforced route.
+type router struct {
+	mux          *http.ServeMux
+	instrumenter signalhttp.HandlerInstrumenter
+	prefixes     map[string]struct{}
+}
+
+func newRouter(reg prometheus.Registerer) *router {
+	return &router{
+		mux:          http.NewServeMux(),
+		instrumenter: signalhttp.NewHandlerInstrumenter(reg, []string{"handler"}),
+		prefixes:     map[string]struct{}{},
+	}
+}
+
+// staticPrefix returns the part of the pattern before the first wildcard
+// without the trailing slashes.
+func staticPrefix(pattern string) string {
+	if i := strings.IndexByte(pattern, '{'); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	return strings.TrimRight(pattern, "/")
+}
+
+// Handle registers the handler for the pattern.
+// If subtree is true, the handler also serves the requests to the sub-paths
+// of the pattern (which can't have wildcards). Otherwise the requests to the
+// sub-paths get a "404 Not Found" response, except for the pattern with a
+// trailing slash (e.g. "/api/v2/silences/") which is served by the handler.
+func (rt *router) Handle(pattern string, subtree bool, handler http.Handler) error {
+	prefix := staticPrefix(pattern)
+	if subtree && prefix != strings.TrimRight(pattern, "/") {
+		return fmt.Errorf("pattern %q: wildcards aren't allowed", pattern)
+	}
+
+	if _, ok := rt.prefixes[prefix]; ok {
+		return fmt.Errorf("pattern %q was already registered", prefix)
+	}
+
+	for p := range rt.prefixes {
+		if strings.HasPrefix(prefix+"/", p+"/") {
+			return fmt.Errorf("pattern %q is registered, cannot register path %q that shares it", p, prefix)
+		}
+	}
+
+	var patterns []string
+	switch {
+	case subtree:
+		patterns = []string{prefix, prefix + "/"}
+	case prefix == pattern:
+		patterns = []string{pattern, pattern + "/{$}"}
+	default:
+		patterns = []string{pattern}
+	}
+
+	h := rt.instrument(pattern, handler)
+	for _, p := range patterns {
+		if err := rt.register(p, h); err != nil {
+			return err
+		}
+	}
+
+	if !subtree {
+		// The sub-paths would otherwise be handled by the catch-all
+		// route (if any).
+		if err := rt.register(prefix+"/", http.HandlerFunc(http.NotFound)); err != nil {
+			return err
+		}
+	}
+
+	rt.prefixes[prefix] = struct{}{}
+
+	return nil
+}
+
+// HandleFallback registers the handler for the requests which don't match any
+// route.
+func (rt *router) HandleFallback(handler http.Handler) {
+	rt.mux.Handle("/", handler)
+}
+
+// register converts the panics of http.ServeMux (e.g. for invalid patterns)
+// into errors.
+func (rt *router) register(pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid pattern %q: %v", pattern, r)
+		}
+	}()
+
+	rt.mux.Handle(pattern, handler)
+
+	return nil
+}
+
+func (rt *router) instrument(pattern string, handler http.Handler) http.Handler {
+	return rt.instrumenter.NewHandler(prometheus.Labels{"handler": pattern}, handler)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt.mux.ServeHTTP(w, req)
+}
+
+// enforceMethods replies with "405 Method Not Allowed" to the requests whose
+// method isn't accepted.
+func enforceMethods(h http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !slices.Contains(methods, req.Method) {
+			w.Header().Set("Allow", allow)
+			prometheusAPIError(w, fmt.Sprintf("method %s isn't allowed", req.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
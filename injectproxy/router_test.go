@@ -0,0 +1,187 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRouter(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+		path   string
+
+		expCode  int
+		expAllow string
+	}{
+		{
+			name:    "exact path",
+			path:    "/api/v1/series?match[]=up&namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "trailing slash",
+			path:    "/api/v1/series/?match[]=up&namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "sub-path",
+			path:    "/api/v1/series/foo?match[]=up&namespace=ns1",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "path parameter",
+			opts:    []Option{WithEnabledLabelsAPI()},
+			path:    "/api/v1/label/job/values?namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "path parameter without value",
+			opts:    []Option{WithEnabledLabelsAPI()},
+			path:    "/api/v1/label/job?namespace=ns1",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:     "method not allowed",
+			method:   http.MethodDelete,
+			path:     "/api/v1/query?query=up&namespace=ns1",
+			expCode:  http.StatusMethodNotAllowed,
+			expAllow: "GET, POST",
+		},
+		{
+			// The method is checked before the label value.
+			name:     "method not allowed without label",
+			method:   http.MethodPost,
+			path:     "/federate?match[]=up",
+			expCode:  http.StatusMethodNotAllowed,
+			expAllow: "GET",
+		},
+		{
+			name:    "passthrough sub-path",
+			opts:    []Option{WithPassthroughPaths([]string{"/graph"})},
+			path:    "/graph/foo",
+			expCode: http.StatusOK,
+		},
+		{
+			// The sub-paths of the enforced routes aren't forwarded by the
+			// catch-all route.
+			name:    "sub-path with passthrough by default",
+			opts:    []Option{WithPassthroughByDefault([]string{"/api/v1/series"})},
+			path:    "/api/v1/series/foo",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "other path with passthrough by default",
+			opts:    []Option{WithPassthroughByDefault([]string{"/api/v1/series"})},
+			path:    "/api/v1/foo",
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, "http://prometheus.example.com"+tc.path, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("Allow"); got != tc.expAllow {
+				t.Fatalf("expected Allow header %q, got %q", tc.expAllow, got)
+			}
+		})
+	}
+}
+
+func TestRouterHandle(t *testing.T) {
+	h := http.NotFoundHandler()
+
+	for _, tc := range []struct {
+		name     string
+		patterns []string
+		subtree  bool
+
+		expErr bool
+	}{
+		{
+			name:     "distinct patterns",
+			patterns: []string{"/api/v1/query", "/api/v1/label/{name}/values", "/api/v1/labels"},
+		},
+		{
+			name:     "duplicate pattern",
+			patterns: []string{"/api/v1/query", "/api/v1/query/"},
+			expErr:   true,
+		},
+		{
+			name:     "shared prefix",
+			patterns: []string{"/federate", "/federate/some"},
+			expErr:   true,
+		},
+		{
+			name:     "shared prefix with wildcard",
+			patterns: []string{"/api/v2/silence/{id}", "/api/v2/silence/foo"},
+			expErr:   true,
+		},
+		{
+			name:     "subtree with wildcard",
+			patterns: []string{"/api/{version}"},
+			subtree:  true,
+			expErr:   true,
+		},
+		{
+			name:     "invalid pattern",
+			patterns: []string{"/api/{"},
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := newRouter(prometheus.NewRegistry())
+
+			var err error
+			for _, p := range tc.patterns {
+				if err = rt.Handle(p, tc.subtree, h); err != nil {
+					break
+				}
+			}
+
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -14,53 +14,176 @@
 package injectproxy
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/efficientgo/core/merrors"
-	"github.com/metalmatze/signal/server/signalhttp"
+	amlabels "github.com/prometheus/alertmanager/pkg/labels"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	queryParam    = "query"
 	matchersParam = "match[]"
+	statsParam    = "stats"
+	limitParam    = "limit"
 )
 
 type routes struct {
-	upstream *url.URL
-	handler  http.Handler
-	label    string
-	el       ExtractLabeler
+	upstream             *url.URL
+	alertmanagerUpstream *url.URL
+	upstreamShards       []*url.URL
+	handler              http.Handler
+	label                string
+	el                   ExtractLabeler
 
 	mux                   http.Handler
+	router                *router
 	modifiers             map[string]func(*http.Response) error
 	errorOnReplace        bool
 	regexMatch            bool
+	matchType             labels.MatchType
+	errorFormat           ErrorFormat
 	rulesWithActiveAlerts bool
-
-	logger *log.Logger
+	stripStats            bool
+	stripLabel            bool
+	deepFiltering         bool
+	federateFiltering     bool
+	metadataLimit         uint64
+	limits                *tenantLimits
+	queryPolicies         *tenantQueryPolicies
+	errorOnUnselective    bool
+	errorOnLabelRewrite   bool
+	queryFrontendCompat   bool
+	table                 []Route
+	methods               map[string][]string
+	getBodyPolicy         GETBodyPolicy
+	responseHeaders       map[string]string
+	routeHeaders          map[string]map[string]string
+	etags                 bool
+	denyList              *DenyList
+	readOnly              map[string]struct{}
+	silenceMatchers       map[string][]*amlabels.Matcher
+	silenceOwner          Identifier
+	orgID                 *OrgIDConfig
+	enforcedHeader        string
+	dryRun                *dryRun
+	receivers             map[string][]string
+	distinctValues        *distinctCounter
+	labelsMatchMode       LabelsMatchMode
+	enforcedPaths         map[string]struct{}
+	disabledRoutes        map[string]struct{}
+	enabledRoutes         map[string]struct{}
+	accessLog             *accessLogger
+	auditLogger           *AuditLogger
+	adminBypass           *AdminBypass
+	tenantBaggage         bool
+	maxRewriteBytes       int64
+	maxRequestBodyBytes   int64
+	normalizers           []LabelValueNormalizer
+	coalescer             *coalescer
+	silenceCache          *silenceCache
+	extraLabels           []extraLabel
+	policy                PolicyEvaluator
+	transport             http.RoundTripper
+	aclIdentifier         Identifier
+	acl                   LabelACL
+
+	logger *slog.Logger
+	tracer trace.Tracer
 }
 
 type options struct {
 	enableLabelAPIs       bool
 	passthroughPaths      []string
+	passthroughRules      []PassthroughRule
 	errorOnReplace        bool
 	registerer            prometheus.Registerer
 	regexMatch            bool
+	matchType             labels.MatchType
 	rulesWithActiveAlerts bool
+	redactedConfigAPI     bool
+	statusEndpoints       []string
+	filteredTSDBStatus    bool
+	remoteWrite           bool
+	federateFiltering     bool
+	adminAPIs             bool
+	stripStats            bool
+	stripLabel            bool
+	deepFiltering         bool
+	metadataLimit         uint64
+	limits                *tenantLimits
+	queryPolicies         *tenantQueryPolicies
+	errorOnUnselective    bool
+	errorOnLabelRewrite   bool
+	queryFrontendCompat   bool
+	methods               map[string][]string
+	getBodyPolicy         GETBodyPolicy
+	responseHeaders       map[string]string
+	routeHeaders          map[string]map[string]string
+	etags                 bool
+	denyList              *DenyList
+	readOnly              []string
+	silenceMatchers       map[string][]string
+	silenceOwner          Identifier
+	dryRun                bool
+	orgID                 *OrgIDConfig
+	enforcedHeader        string
+	receivers             map[string][]string
+	distinctValuesWindow  time.Duration
+	labelsMatchMode       LabelsMatchMode
+	backend               Backend
+	disabledFamilies      []routeFamily
+	unmatchedPathPolicy   UnmatchedPathPolicy
+	errorFormat           ErrorFormat
+	unmatchedPathRedirect string
+	passthroughByDefault  bool
+	enforcedPaths         []string
+	disabledRoutes        []string
+	enabledRoutes         []string
+	accessLog             *AccessLogConfig
+	auditLogger           *AuditLogger
+	adminBypass           *AdminBypass
+	tenantBaggage         bool
+	responseFilters       []ResponseFilter
+	responseTransforms    map[string][]ResponseTransform
+	queryCoalescing       bool
+	extraLabels           []extraLabel
+	policy                PolicyEvaluator
+	upstreamTransport     http.RoundTripper
+	retries               RetryConfig
+	alertmanagerUpstream  *url.URL
+	rulesUpstream         *url.URL
+	upstreamShards        []*url.URL
+	grpcPassthrough       *GRPCPassthrough
+	flushInterval         time.Duration
+	maxRewriteBytes       int64
+	maxRequestBodyBytes   int64
+	normalizers           []LabelValueNormalizer
+	aclIdentifier         Identifier
+	acl                   LabelACL
+	logger                *slog.Logger
+	tracerProvider        trace.TracerProvider
+	silenceCacheTTL       time.Duration
+	silenceCacheSize      int
 }
 
 type Option interface {
@@ -80,6 +203,14 @@ func WithPrometheusRegistry(reg prometheus.Registerer) Option {
 	})
 }
 
+// WithLogger configures the logger of the proxy. By default, slog.Default()
+// is used.
+func WithLogger(logger *slog.Logger) Option {
+	return optionFunc(func(o *options) {
+		o.logger = logger
+	})
+}
+
 // WithEnabledLabelsAPI enables proxying to labels API. If false, "501 Not implemented" will be return for those.
 func WithEnabledLabelsAPI() Option {
 	return optionFunc(func(o *options) {
@@ -104,6 +235,26 @@ func WithErrorOnReplace() Option {
 	})
 }
 
+// WithErrorOnUnselectiveQuery causes the proxy to return 400 if the PromQL
+// expression or the match[] parameters contain a selector that has no matcher
+// in addition to the enforced label (e.g. `{job=""}` or `{}`), since it would
+// select all the series of the tenant.
+func WithErrorOnUnselectiveQuery() Option {
+	return optionFunc(func(o *options) {
+		o.errorOnUnselective = true
+	})
+}
+
+// WithErrorOnLabelRewrite causes the proxy to return 400 if the PromQL
+// expression calls label_replace() or label_join() with an enforced label as
+// the destination label (e.g. `label_replace(up, "namespace", "b", "", "")`),
+// since the results would carry label values which weren't enforced.
+func WithErrorOnLabelRewrite() Option {
+	return optionFunc(func(o *options) {
+		o.errorOnLabelRewrite = true
+	})
+}
+
 // WithActiveAlerts causes the proxy to return rules with active alerts.
 func WithActiveAlerts() Option {
 	return optionFunc(func(o *options) {
@@ -118,70 +269,269 @@ func WithRegexMatch() Option {
 	})
 }
 
-// mux abstracts away the behavior we expect from the http.ServeMux type in this package.
-type mux interface {
-	http.Handler
-	Handle(string, http.Handler)
+// WithMatchType configures the type of the matcher enforcing a single label
+// value: labels.MatchEqual (default) or labels.MatchRegexp. Multiple label
+// values are always enforced with a regexp matcher, hence with
+// labels.MatchRegexp the injected matchers have the same form whatever the
+// number of values (e.g. namespace=~"a" and namespace=~"a|b").
+// It doesn't apply to the Alertmanager matchers.
+func WithMatchType(t labels.MatchType) Option {
+	return optionFunc(func(o *options) {
+		o.matchType = t
+	})
 }
 
-// strictMux is a mux that wraps standard HTTP handler with safer handler that allows safe user provided handler registrations.
-type strictMux struct {
-	mux
-	seen map[string]struct{}
+// WithRedactedConfigAPI enables proxying to the /api/v1/status/config
+// endpoint. The secrets (passwords, bearer tokens, ...) are redacted from the
+// configuration before returning it to the client. If not set, "403 Forbidden"
+// will be returned for this endpoint.
+func WithRedactedConfigAPI() Option {
+	return optionFunc(func(o *options) {
+		o.redactedConfigAPI = true
+	})
 }
 
-func newStrictMux(m mux) *strictMux {
-	return &strictMux{
-		m,
-		map[string]struct{}{},
-	}
+// WithStatusEndpoints enables proxying to the given /api/v1/status/<name>
+// endpoints (without enforcement since they aren't scoped to a tenant).
+// Supported names are "buildinfo", "flags", "runtimeinfo" and "walreplay".
+// The other status endpoints aren't exposed.
+func WithStatusEndpoints(names ...string) Option {
+	return optionFunc(func(o *options) {
+		o.statusEndpoints = names
+	})
+}
 
+// WithFilteredTSDBStatus enables proxying to the /api/v1/status/tsdb endpoint.
+// The cardinality statistics are filtered to the series count of the enforced
+// label values: the other statistics and the head stats, which aren't scoped
+// to the tenant, are removed from the response. If not set, "403 Forbidden"
+// will be returned for this endpoint.
+func WithFilteredTSDBStatus() Option {
+	return optionFunc(func(o *options) {
+		o.filteredTSDBStatus = true
+	})
 }
 
-// Handle is like HTTP mux handle but it does not allow to register paths that are shared with previously registered paths.
-// It also makes sure the trailing / is registered too.
-// For example if /api/v1/federate was registered consequent registrations like /api/v1/federate/ or /api/v1/federate/some will
-// return error. In the mean time request with both /api/v1/federate and /api/v1/federate/ will point to the handled passed by /api/v1/federate
-// registration.
-// This allows to de-risk ability for user to mis-configure and leak inject isolation.
-func (s *strictMux) Handle(pattern string, handler http.Handler) error {
-	sanitized := pattern
-	for next := strings.TrimSuffix(sanitized, "/"); next != sanitized; sanitized = next {
-	}
+// WithoutQueryStats causes the proxy to remove the execution statistics from
+// the /api/v1/query and /api/v1/query_range responses. The "stats" parameter
+// is dropped from the upstream request and the "stats" section is removed
+// from the response since it can reveal information about the load generated
+// by other tenants.
+func WithoutQueryStats() Option {
+	return optionFunc(func(o *options) {
+		o.stripStats = true
+	})
+}
 
-	if _, ok := s.seen[sanitized]; ok {
-		return fmt.Errorf("pattern %q was already registered", sanitized)
-	}
+// WithoutEnforcedLabel causes the proxy to remove the enforced label from the
+// series of the /api/v1/query and /api/v1/query_range responses so that the
+// clients don't see the label used for the tenancy. The series which only
+// differ by the enforced label (when multiple values are enforced) can't be
+// told apart anymore.
+func WithoutEnforcedLabel() Option {
+	return optionFunc(func(o *options) {
+		o.stripLabel = true
+	})
+}
 
-	for p := range s.seen {
-		if strings.HasPrefix(sanitized+"/", p+"/") {
-			return fmt.Errorf("pattern %q is registered, cannot register path %q that shares it", p, sanitized)
-		}
-	}
+// WithMetadataLimit sets the maximum number of items returned by the
+// /api/v1/series, /api/v1/labels and /api/v1/label/<name>/values endpoints.
+// The "limit" parameter is injected into the upstream request if absent and
+// values greater than the given limit (or 0 which means no limit) are
+// replaced.
+func WithMetadataLimit(limit uint64) Option {
+	return optionFunc(func(o *options) {
+		o.metadataLimit = limit
+	})
+}
 
-	s.mux.Handle(sanitized, handler)
-	s.mux.Handle(sanitized+"/", handler)
-	s.seen[sanitized] = struct{}{}
+// WithLimits configures the limits enforced by the proxy. The overrides map
+// label values to their specific limits, the zero fields of an override fall
+// back to the default limits.
+// When a request carries several label values, the lowest limit applies.
+func WithLimits(defaults Limits, overrides map[string]Limits) Option {
+	return optionFunc(func(o *options) {
+		o.limits = &tenantLimits{defaults: defaults, overrides: overrides}
+	})
+}
 
-	return nil
+// WithRouteMethods overrides the HTTP methods accepted by the given routes
+// (e.g. "/api/v1/query" to []string{"GET"}). The methods can only be
+// restricted: a method which isn't supported by the route by default is an
+// error.
+func WithRouteMethods(methods map[string][]string) Option {
+	return optionFunc(func(o *options) {
+		o.methods = methods
+	})
+}
+
+// GETBodyPolicy defines how the proxy handles GET requests with a body on the
+// query and matcher endpoints.
+type GETBodyPolicy string
+
+const (
+	// GETBodyIgnore forwards the request, the body is ignored by the
+	// upstream.
+	GETBodyIgnore GETBodyPolicy = "ignore"
+	// GETBodyReject rejects the request with "400 Bad Request".
+	GETBodyReject GETBodyPolicy = "reject"
+	// GETBodyEnforce moves the form-encoded parameters of the body into the
+	// URL query string so they are enforced and honored by the upstream.
+	GETBodyEnforce GETBodyPolicy = "enforce"
+)
+
+// WithGETBodyPolicy configures how GET requests with a body are handled on
+// the query and matcher endpoints. The default is GETBodyIgnore.
+func WithGETBodyPolicy(p GETBodyPolicy) Option {
+	return optionFunc(func(o *options) {
+		o.getBodyPolicy = p
+	})
 }
 
-// instrumentedMux wraps a mux and instruments it.
-type instrumentedMux struct {
-	mux
-	i signalhttp.HandlerInstrumenter
+// UnmatchedPathPolicy defines how the proxy replies to the requests which
+// don't match any route.
+type UnmatchedPathPolicy string
+
+const (
+	// UnmatchedPathNotFound replies with "404 Not Found".
+	UnmatchedPathNotFound UnmatchedPathPolicy = "not-found"
+	// UnmatchedPathForbidden replies with "403 Forbidden" and a body
+	// explaining that the path isn't handled by the proxy.
+	UnmatchedPathForbidden UnmatchedPathPolicy = "forbidden"
+	// UnmatchedPathRedirect redirects the client to a URL (e.g. the
+	// documentation of the proxy's deployment).
+	UnmatchedPathRedirect UnmatchedPathPolicy = "redirect"
+)
+
+// WithUnmatchedPathPolicy configures how the requests which don't match any
+// route are handled. The default is UnmatchedPathNotFound.
+// UnmatchedPathRedirect requires WithUnmatchedPathRedirect instead.
+func WithUnmatchedPathPolicy(p UnmatchedPathPolicy) Option {
+	return optionFunc(func(o *options) {
+		o.unmatchedPathPolicy = p
+	})
 }
 
-func newInstrumentedMux(m mux, r prometheus.Registerer) *instrumentedMux {
-	return &instrumentedMux{
-		m,
-		signalhttp.NewHandlerInstrumenter(r, []string{"handler"}),
-	}
+// WithUnmatchedPathRedirect redirects the requests which don't match any
+// route to the given URL.
+func WithUnmatchedPathRedirect(u string) Option {
+	return optionFunc(func(o *options) {
+		o.unmatchedPathPolicy = UnmatchedPathRedirect
+		o.unmatchedPathRedirect = u
+	})
 }
 
-// Handle implements the mux interface.
-func (i *instrumentedMux) Handle(pattern string, handler http.Handler) {
-	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, handler))
+// WithPassthroughByDefault inverts the operating mode of the proxy: only the
+// given built-in routes are enforced and the requests for all the other paths
+// are forwarded to the upstream without enforcement. The routes which are
+// always forbidden (e.g. /api/v1/status/config) remain forbidden.
+// Use with care: the upstream API is exposed to all the clients.
+func WithPassthroughByDefault(enforcedPaths []string) Option {
+	return optionFunc(func(o *options) {
+		o.passthroughByDefault = true
+		o.enforcedPaths = enforcedPaths
+	})
+}
+
+// WithDisabledRoutes disables the given built-in routes: the proxy replies
+// with "404 Not Found" instead of enforcing the requests.
+func WithDisabledRoutes(paths ...string) Option {
+	return optionFunc(func(o *options) {
+		o.disabledRoutes = append(o.disabledRoutes, paths...)
+	})
+}
+
+// WithEnabledRoutes enables only the given built-in enforced routes: the proxy
+// replies with "404 Not Found" to the requests of the other enforced routes.
+// The routes without enforcement, the forbidden routes and the passthrough
+// routes aren't affected.
+func WithEnabledRoutes(paths ...string) Option {
+	return optionFunc(func(o *options) {
+		o.enabledRoutes = append(o.enabledRoutes, paths...)
+	})
+}
+
+// WithResponseHeaders sets fixed headers (e.g. "X-Content-Type-Options") on
+// all the responses returned by the proxy. The values replace the ones
+// returned by the upstream.
+func WithResponseHeaders(headers map[string]string) Option {
+	return optionFunc(func(o *options) {
+		o.responseHeaders = headers
+	})
+}
+
+// WithRouteResponseHeaders sets fixed headers on the responses of the given
+// routes (e.g. "/api/v1/query" to {"Cache-Control": "no-store"}). They take
+// precedence over the headers configured by WithResponseHeaders.
+func WithRouteResponseHeaders(headers map[string]map[string]string) Option {
+	return optionFunc(func(o *options) {
+		o.routeHeaders = headers
+	})
+}
+
+// WithETags causes the proxy to set the ETag header on the successful
+// responses to GET requests and to reply with "304 Not Modified" when the
+// If-None-Match header of the request matches.
+func WithETags() Option {
+	return optionFunc(func(o *options) {
+		o.etags = true
+	})
+}
+
+// WithDenyList causes the proxy to reject the requests carrying a label value
+// which is blocked by the deny-list. The deny-list can be updated while the
+// proxy is running.
+func WithDenyList(d *DenyList) Option {
+	return optionFunc(func(o *options) {
+		o.denyList = d
+	})
+}
+
+// WithReadOnlyTenants causes the proxy to reject the mutating requests (e.g.
+// creating or deleting silences) for the given label values with "403
+// Forbidden". Read requests are still allowed.
+func WithReadOnlyTenants(values ...string) Option {
+	return optionFunc(func(o *options) {
+		o.readOnly = values
+	})
+}
+
+// WithSilenceMatchers configures additional matchers (e.g. `cluster="prod"`)
+// which are added to the silences created by the given label values. The
+// matchers of the silence with the same label names are replaced.
+func WithSilenceMatchers(matchers map[string][]string) Option {
+	return optionFunc(func(o *options) {
+		o.silenceMatchers = matchers
+	})
+}
+
+// WithDistinctLabelValuesWindow enables the
+// prom_label_proxy_distinct_label_values metric which estimates the number of
+// distinct label values seen over the given sliding window.
+func WithDistinctLabelValuesWindow(window time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.distinctValuesWindow = window
+	})
+}
+
+// LabelsMatchMode defines how the rules and alerts responses are filtered
+// when several labels are enforced.
+type LabelsMatchMode string
+
+const (
+	// MatchAllLabels keeps the items matching all the enforced labels.
+	MatchAllLabels LabelsMatchMode = "all"
+	// MatchAnyLabel keeps the items matching at least one enforced label.
+	MatchAnyLabel LabelsMatchMode = "any"
+)
+
+// WithLabelsMatchMode configures how the /api/v1/rules and /api/v1/alerts
+// responses are filtered when several labels are enforced. The default is
+// MatchAllLabels. The Alertmanager endpoints always require all the labels.
+func WithLabelsMatchMode(mode LabelsMatchMode) Option {
+	return optionFunc(func(o *options) {
+		o.labelsMatchMode = mode
+	})
 }
 
 // ExtractLabeler is an HTTP handler that extract the label value to be
@@ -206,31 +556,41 @@ func (hff HTTPFormEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
 			return
 		}
 
-		// Remove the proxy label from the query parameters.
-		q := r.URL.Query()
-		q.Del(hff.ParameterName)
-		r.URL.RawQuery = q.Encode()
-
-		// Remove the param from the PostForm.
-		if r.Method == http.MethodPost {
-			if err := r.ParseForm(); err != nil {
-				prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusInternalServerError)
-				return
-			}
-			if r.PostForm.Get(hff.ParameterName) != "" {
-				r.PostForm.Del(hff.ParameterName)
-				newBody := r.PostForm.Encode()
-				// We are replacing request body, close previous one (r.FormValue ensures it is read fully and not nil).
-				_ = r.Body.Close()
-				r.Body = io.NopCloser(strings.NewReader(newBody))
-				r.ContentLength = int64(len(newBody))
-			}
+		if err := hff.removeParameter(r); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
 	})
 }
 
+// removeParameter removes the proxy label from the query parameters and the
+// POST form.
+func (hff HTTPFormEnforcer) removeParameter(r *http.Request) error {
+	q := r.URL.Query()
+	q.Del(hff.ParameterName)
+	r.URL.RawQuery = q.Encode()
+
+	if r.Method != http.MethodPost {
+		return nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("Failed to parse the PostForm: %v", err)
+	}
+	if r.PostForm.Get(hff.ParameterName) != "" {
+		r.PostForm.Del(hff.ParameterName)
+		newBody := r.PostForm.Encode()
+		// We are replacing request body, close previous one (r.FormValue ensures it is read fully and not nil).
+		_ = r.Body.Close()
+		r.Body = io.NopCloser(strings.NewReader(newBody))
+		r.ContentLength = int64(len(newBody))
+	}
+
+	return nil
+}
+
 func (hff HTTPFormEnforcer) getLabelValues(r *http.Request) ([]string, error) {
 	err := r.ParseForm()
 	if err != nil {
@@ -290,76 +650,397 @@ func (sle StaticLabelEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler
 	})
 }
 
+func (sle StaticLabelEnforcer) getLabelValues(*http.Request) ([]string, error) {
+	return sle, nil
+}
+
 func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, opts ...Option) (*routes, error) {
-	opt := options{}
+	opt := options{getBodyPolicy: GETBodyIgnore, labelsMatchMode: MatchAllLabels, unmatchedPathPolicy: UnmatchedPathNotFound, errorFormat: ErrorFormatAuto}
 	for _, o := range opts {
 		o.apply(&opt)
 	}
 
+	switch opt.getBodyPolicy {
+	case GETBodyIgnore, GETBodyReject, GETBodyEnforce:
+	default:
+		return nil, fmt.Errorf("invalid GET body policy %q", opt.getBodyPolicy)
+	}
+
+	switch opt.unmatchedPathPolicy {
+	case UnmatchedPathNotFound, UnmatchedPathForbidden:
+	case UnmatchedPathRedirect:
+		u, err := url.Parse(opt.unmatchedPathRedirect)
+		if err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid redirect URL %q for unmatched paths", opt.unmatchedPathRedirect)
+		}
+	default:
+		return nil, fmt.Errorf("invalid unmatched path policy %q", opt.unmatchedPathPolicy)
+	}
+
+	if opt.retries.Retries < 0 || opt.retries.Backoff < 0 || opt.retries.HedgeDelay < 0 {
+		return nil, fmt.Errorf("invalid upstream retry configuration %+v", opt.retries)
+	}
+
+	switch opt.errorFormat {
+	case ErrorFormatAuto, ErrorFormatPrometheus, ErrorFormatAlertmanager:
+	default:
+		return nil, fmt.Errorf("invalid error format %q", opt.errorFormat)
+	}
+
+	for _, u := range opt.upstreamShards {
+		if u == nil {
+			return nil, errors.New("invalid nil upstream shard")
+		}
+	}
+
+	if opt.adminBypass != nil && (opt.adminBypass.Identifier == nil || len(opt.adminBypass.Admins) == 0) {
+		return nil, errors.New("admin bypass requires an identifier and at least one admin")
+	}
+	if opt.adminBypass != nil {
+		switch id := opt.adminBypass.Identifier.(type) {
+		case JWTClaimIdentifier:
+			if len(id.Key) == 0 {
+				return nil, errors.New("admin bypass requires a key to verify the signature of the tokens")
+			}
+		case JWTSubjectIdentifier, HeaderIdentifier:
+			return nil, fmt.Errorf("admin bypass can't use the unverified identities of %T", id)
+		}
+	}
+
+	if opt.passthroughByDefault {
+		if len(opt.enforcedPaths) == 0 {
+			return nil, errors.New("passthrough by default requires at least one enforced path")
+		}
+		if opt.unmatchedPathPolicy != UnmatchedPathNotFound {
+			return nil, fmt.Errorf("unmatched path policy %q isn't compatible with passthrough by default", opt.unmatchedPathPolicy)
+		}
+	}
+
+	if err := validateExtraLabels(label, opt.extraLabels); err != nil {
+		return nil, err
+	}
+
+	if err := opt.queryPolicies.validate(); err != nil {
+		return nil, err
+	}
+
+	if opt.policy != nil && len(opt.extraLabels) > 0 {
+		return nil, errors.New("the extra labels can't be used with a policy evaluator")
+	}
+
+	switch opt.matchType {
+	case labels.MatchEqual, labels.MatchRegexp:
+	default:
+		return nil, fmt.Errorf("invalid match type %q", opt.matchType)
+	}
+
+	switch opt.labelsMatchMode {
+	case MatchAllLabels, MatchAnyLabel:
+	default:
+		return nil, fmt.Errorf("invalid labels match mode %q", opt.labelsMatchMode)
+	}
+
+	families := []routeFamily{familyPrometheus, familyAlertmanager}
+	if opt.backend != "" {
+		preset, found := backendPresets[opt.backend]
+		if !found {
+			return nil, fmt.Errorf("unsupported backend %q", opt.backend)
+		}
+
+		families = preset.families
+		opt.enableLabelAPIs = opt.enableLabelAPIs || preset.enableLabelAPIs
+		opt.passthroughPaths = slices.Clone(opt.passthroughPaths)
+		for _, p := range preset.passthroughPaths {
+			if !slices.Contains(opt.passthroughPaths, p) {
+				opt.passthroughPaths = append(opt.passthroughPaths, p)
+			}
+		}
+	}
+
+	if opt.alertmanagerUpstream != nil && !slices.Contains(families, familyAlertmanager) {
+		families = append(slices.Clone(families), familyAlertmanager)
+	}
+
+	families = slices.DeleteFunc(slices.Clone(families), func(f routeFamily) bool {
+		return slices.Contains(opt.disabledFamilies, f)
+	})
+	if len(families) == 0 {
+		return nil, errors.New("all the routes of the backend are disabled")
+	}
+
 	if opt.registerer == nil {
 		opt.registerer = prometheus.NewRegistry()
 	}
 
+	if opt.logger == nil {
+		opt.logger = slog.Default()
+	}
+
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	if opt.tracerProvider != nil {
+		opt.upstreamTransport = traceTransport(opt.upstreamTransport, opt.tracerProvider)
+	}
+	if opt.retries.Retries > 0 || opt.retries.HedgeDelay > 0 {
+		// Each attempt gets its own span.
+		opt.upstreamTransport = newRetryTransport(opt.upstreamTransport, opt.retries, opt.registerer)
+	}
+	if opt.upstreamTransport != nil {
+		proxy.Transport = opt.upstreamTransport
+	}
+	proxy.FlushInterval = opt.flushInterval
+	if opt.alertmanagerUpstream != nil || opt.rulesUpstream != nil || len(opt.upstreamShards) > 0 {
+		proxy.Director = upstreamDirector(upstream, opt.alertmanagerUpstream, opt.rulesUpstream, opt.upstreamShards)
+	}
+
+	var handler http.Handler = proxy
+	if opt.tracerProvider != nil {
+		handler = endStage(proxy)
+	}
 
 	r := &routes{
 		upstream:              upstream,
-		handler:               proxy,
+		alertmanagerUpstream:  upstream,
+		upstreamShards:        opt.upstreamShards,
+		handler:               handler,
+		transport:             opt.upstreamTransport,
+		aclIdentifier:         opt.aclIdentifier,
+		acl:                   opt.acl,
+		receivers:             opt.receivers,
 		label:                 label,
 		el:                    extractLabeler,
 		errorOnReplace:        opt.errorOnReplace,
 		regexMatch:            opt.regexMatch,
+		errorFormat:           opt.errorFormat,
 		rulesWithActiveAlerts: opt.rulesWithActiveAlerts,
-		logger:                log.Default(),
-	}
-	mux := newStrictMux(newInstrumentedMux(http.NewServeMux(), opt.registerer))
-
-	errs := merrors.New(
-		mux.Handle("/federate", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
-		mux.Handle("/api/v1/query", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
-		mux.Handle("/api/v1/query_range", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
-		mux.Handle("/api/v1/alerts", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/rules", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/series", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
-		mux.Handle("/api/v1/query_exemplars", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
-	)
+		stripStats:            opt.stripStats,
+		stripLabel:            opt.stripLabel,
+		deepFiltering:         opt.deepFiltering,
+		federateFiltering:     opt.federateFiltering,
+		metadataLimit:         opt.metadataLimit,
+		limits:                opt.limits,
+		queryPolicies:         opt.queryPolicies,
+		errorOnUnselective:    opt.errorOnUnselective,
+		errorOnLabelRewrite:   opt.errorOnLabelRewrite,
+		queryFrontendCompat:   opt.queryFrontendCompat,
+		methods:               opt.methods,
+		getBodyPolicy:         opt.getBodyPolicy,
+		labelsMatchMode:       opt.labelsMatchMode,
+		matchType:             opt.matchType,
+		responseHeaders:       opt.responseHeaders,
+		routeHeaders:          opt.routeHeaders,
+		etags:                 opt.etags,
+		tenantBaggage:         opt.tenantBaggage,
+		extraLabels:           opt.extraLabels,
+		policy:                opt.policy,
+		denyList:              opt.denyList,
+		readOnly:              make(map[string]struct{}, len(opt.readOnly)),
+		disabledRoutes:        make(map[string]struct{}, len(opt.disabledRoutes)),
+		logger:                opt.logger,
+		maxRewriteBytes:       opt.maxRewriteBytes,
+		maxRequestBodyBytes:   opt.maxRequestBodyBytes,
+		normalizers:           opt.normalizers,
+		silenceOwner:          opt.silenceOwner,
+		orgID:                 opt.orgID,
+		enforcedHeader:        opt.enforcedHeader,
+	}
+	if opt.tracerProvider != nil {
+		r.tracer = opt.tracerProvider.Tracer(tracerName)
+	}
+	if opt.alertmanagerUpstream != nil {
+		r.alertmanagerUpstream = opt.alertmanagerUpstream
+	}
+	for _, v := range opt.readOnly {
+		r.readOnly[v] = struct{}{}
+	}
+	for _, p := range opt.disabledRoutes {
+		r.disabledRoutes[p] = struct{}{}
+	}
+	if len(opt.enabledRoutes) > 0 {
+		r.enabledRoutes = make(map[string]struct{}, len(opt.enabledRoutes))
+		for _, p := range opt.enabledRoutes {
+			r.enabledRoutes[p] = struct{}{}
+		}
+	}
+	r.auditLogger = opt.auditLogger
+	r.adminBypass = opt.adminBypass
+	if opt.accessLog != nil {
+		r.accessLog = newAccessLogger(opt.accessLog, r.logger)
+	}
+	if opt.passthroughByDefault {
+		r.enforcedPaths = make(map[string]struct{}, len(opt.enforcedPaths))
+		for _, p := range opt.enforcedPaths {
+			r.enforcedPaths[p] = struct{}{}
+		}
+	}
+
+	if opt.distinctValuesWindow > 0 {
+		r.distinctValues = newDistinctCounter(opt.distinctValuesWindow)
+		opt.registerer.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "prom_label_proxy_distinct_label_values",
+				Help:        "Estimated number of distinct label values seen over the sliding window.",
+				ConstLabels: prometheus.Labels{"window": model.Duration(opt.distinctValuesWindow).String()},
+			},
+			r.distinctValues.estimate,
+		))
+	}
+
+	if opt.dryRun {
+		r.dryRun = newDryRun(r.handler, opt.registerer)
+		r.handler = r.dryRun.capture()
+	}
+
+	// In dry-run mode, the enforced requests aren't forwarded.
+	if opt.queryCoalescing && !opt.dryRun {
+		r.coalescer = newCoalescer(opt.registerer)
+	}
+
+	if opt.silenceCacheTTL > 0 {
+		r.silenceCache = newSilenceCache(opt.silenceCacheTTL, opt.silenceCacheSize, opt.registerer)
+	}
+
+	var err error
+	r.silenceMatchers, err = parseSilenceMatchers(label, opt.silenceMatchers)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := newRouter(opt.registerer)
+
+	errs := merrors.New()
+
+	if slices.Contains(families, familyPrometheus) {
+		errs.Add(
+			r.handle(mux, Route{Path: "/federate", Enforcement: EnforcementMatchers, Methods: []string{"GET"}}, r.filterFederation(r.matcher)),
+			r.handle(mux, Route{Path: "/api/v1/query", Enforcement: EnforcementPromQL, Methods: []string{"GET", "POST"}}, r.queryLimit(r.query)),
+			r.handle(mux, Route{Path: "/api/v1/query_range", Enforcement: EnforcementPromQL, Methods: []string{"GET", "POST"}}, r.queryLimit(r.queryRangeLimits(r.query))),
+			r.handle(mux, Route{Path: "/api/v1/alerts", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			r.handle(mux, Route{Path: "/api/v1/rules", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			// The router rejects the sub-paths of the registered patterns,
+			// the targets metadata must be registered before the targets.
+			r.handle(mux, Route{Path: "/api/v1/targets/metadata", Enforcement: EnforcementMatchers, Methods: []string{"GET"}}, r.targetsMetadata),
+			r.handle(mux, Route{Path: "/api/v1/targets", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			r.handle(mux, Route{Path: "/api/v1/series", Enforcement: EnforcementMatchers, Methods: []string{"GET", "POST"}}, r.limit(r.matcher)),
+			r.handle(mux, Route{Path: "/api/v1/metadata", Enforcement: EnforcementMatchers, Methods: []string{"GET"}}, r.metadata),
+			r.handle(mux, Route{Path: "/api/v1/query_exemplars", Enforcement: EnforcementPromQL, Methods: []string{"GET", "POST"}}, r.query),
+			r.handle(mux, Route{Path: "/api/v1/read", Enforcement: EnforcementMatchers, Methods: []string{"POST"}}, r.remoteRead),
+		)
+
+		if opt.remoteWrite {
+			errs.Add(
+				r.handle(mux, Route{Path: remoteWritePath, Enforcement: EnforcementSeries, Methods: []string{"POST"}, Mutating: true}, r.remoteWrite),
+			)
+		}
+
+		if opt.enableLabelAPIs {
+			errs.Add(
+				r.handle(mux, Route{Path: "/api/v1/labels", Enforcement: EnforcementMatchers, Methods: []string{"GET", "POST"}}, r.limit(r.deepFilterLabels(r.matcher))),
+				r.handle(mux, Route{Path: "/api/v1/label/{name}/values", Enforcement: EnforcementMatchers, Methods: []string{"GET"}}, r.limit(r.deepFilterLabels(r.matcher))),
+			)
+		}
+
+		if opt.redactedConfigAPI {
+			errs.Add(
+				r.handle(mux, Route{Path: "/api/v1/status/config", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			)
+		} else {
+			// The configuration may contain secrets and it isn't scoped to the
+			// tenant: block it unless explicitly requested.
+			errs.Add(
+				r.handle(mux, Route{Path: "/api/v1/status/config", Enforcement: EnforcementForbidden}, forbidden),
+			)
+		}
+
+		switch {
+		case opt.filteredTSDBStatus:
+			errs.Add(
+				r.handle(mux, Route{Path: tsdbStatusPath, Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			)
+		case !slices.Contains(opt.passthroughPaths, tsdbStatusPath):
+			// The cardinality statistics reveal the metric names and label
+			// values of all the tenants: block them unless explicitly
+			// requested.
+			errs.Add(
+				r.handle(mux, Route{Path: tsdbStatusPath, Enforcement: EnforcementForbidden}, forbidden),
+			)
+		}
 
-	if opt.enableLabelAPIs {
 		errs.Add(
-			mux.Handle("/api/v1/labels", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
-			// Full path is /api/v1/label/<label_name>/values but http mux does not support patterns.
-			// This is fine though as we don't care about name for matcher injector.
-			mux.Handle("/api/v1/label/", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
+			r.handle(mux, Route{Path: deleteSeriesPath, Enforcement: EnforcementMatchers, Methods: []string{"POST"}, Mutating: true}, r.deleteSeries),
 		)
+		for _, p := range adminEndpoints {
+			if opt.adminAPIs {
+				errs.Add(
+					r.handle(mux, Route{Path: p, Enforcement: EnforcementLabel, Methods: []string{"POST"}, Mutating: true}, r.passthrough),
+				)
+				continue
+			}
+			// The endpoints act on the data of all the tenants: block them
+			// unless explicitly requested.
+			errs.Add(
+				r.handle(mux, Route{Path: p, Enforcement: EnforcementForbidden}, forbidden),
+			)
+		}
+
+		for _, name := range opt.statusEndpoints {
+			if _, found := statusEndpoints[name]; !found {
+				return nil, fmt.Errorf("unsupported status endpoint %q", name)
+			}
+			errs.Add(
+				r.handle(mux, Route{Path: "/api/v1/status/" + name, Enforcement: EnforcementLabel, Methods: []string{"GET"}}, r.passthrough),
+			)
+		}
 	}
 
-	errs.Add(
-		// Reject multi label values with assertSingleLabelValue() because the
-		// semantics of the Silences API don't support multi-label matchers.
-		mux.Handle("/api/v2/silences", r.el.ExtractLabel(
-			r.errorIfRegexpMatch(
-				enforceMethods(
-					assertSingleLabelValue(r.silences),
-					"GET", "POST",
-				),
+	if slices.Contains(families, familyAlertmanager) {
+		errs.Add(
+			// Reject multi label values with r.assertSingleLabelValue() because the
+			// semantics of the Silences API don't support multi-label matchers.
+			r.handle(mux, Route{Path: "/api/v2/silences", Enforcement: EnforcementSilences, Methods: []string{"GET", "POST"}, Mutating: true},
+				r.assertSingleLabelValue(r.silences),
 			),
-		)),
-		mux.Handle("/api/v2/silence/", r.el.ExtractLabel(
-			r.errorIfRegexpMatch(
-				enforceMethods(
-					assertSingleLabelValue(r.deleteSilence),
-					"DELETE",
-				),
+			r.handle(mux, Route{Path: "/api/v2/silence/{id}", Enforcement: EnforcementSilences, Methods: []string{"DELETE"}, Mutating: true},
+				r.assertSingleLabelValue(r.deleteSilence),
 			),
-		)),
-		mux.Handle("/api/v2/alerts/groups", r.el.ExtractLabel(enforceMethods(r.enforceFilterParameter, "GET"))),
-		mux.Handle("/api/v2/alerts", r.el.ExtractLabel(enforceMethods(r.alerts, "GET"))),
-	)
+			r.handle(mux, Route{Path: "/api/v2/alerts/groups", Enforcement: EnforcementFilter, Methods: []string{"GET"}}, r.enforceFilterParameter),
+			r.handle(mux, Route{Path: "/api/v2/alerts", Enforcement: EnforcementFilter, Methods: []string{"GET", "POST"}, Mutating: true}, r.alerts),
+		)
+		if opt.receivers != nil {
+			errs.Add(
+				r.handle(mux, Route{Path: "/api/v2/receivers", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+			)
+		}
+	}
+
+	if slices.Contains(families, familyThanos) {
+		errs.Add(
+			r.handle(mux, Route{Path: "/api/v1/stores", Enforcement: EnforcementResponse, Methods: []string{"GET"}}, r.passthrough),
+		)
+	}
+
+	if slices.Contains(families, familyLoki) {
+		errs.Add(
+			r.handle(mux, Route{Path: "/loki/api/v1/query", Enforcement: EnforcementLogQL, Methods: []string{"GET", "POST"}}, r.logQL(false, r.forward)),
+			r.handle(mux, Route{Path: "/loki/api/v1/query_range", Enforcement: EnforcementLogQL, Methods: []string{"GET", "POST"}}, r.logQL(false, r.forward)),
+			// The websocket connections aren't coalesced.
+			r.handle(mux, Route{Path: "/loki/api/v1/tail", Enforcement: EnforcementLogQL, Methods: []string{"GET"}}, r.logQL(false, r.handler.ServeHTTP)),
+			// The stream selectors of the series endpoint have the same
+			// syntax as the PromQL selectors.
+			r.handle(mux, Route{Path: "/loki/api/v1/series", Enforcement: EnforcementMatchers, Methods: []string{"GET", "POST"}}, r.matcher),
+		)
+
+		if opt.enableLabelAPIs {
+			errs.Add(
+				r.handle(mux, Route{Path: "/loki/api/v1/labels", Enforcement: EnforcementLogQL, Methods: []string{"GET", "POST"}}, r.logQL(true, r.passthrough)),
+				r.handle(mux, Route{Path: "/loki/api/v1/label/{name}/values", Enforcement: EnforcementLogQL, Methods: []string{"GET"}}, r.logQL(true, r.passthrough)),
+			)
+		}
+	}
 
 	errs.Add(
-		mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.handle(mux, Route{Path: "/healthz", Enforcement: EnforcementNone}, func(w http.ResponseWriter, r *http.Request) {
 			_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
-		})),
+		}),
 	)
 
 	if err := errs.Err(); err != nil {
@@ -382,39 +1063,343 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 
 	// Register optional passthrough paths.
 	for _, path := range opt.passthroughPaths {
-		if err := mux.Handle(path, http.HandlerFunc(r.passthrough)); err != nil {
+		if err := r.handle(mux, Route{Path: path, Enforcement: EnforcementNone, Passthrough: true}, r.passthrough); err != nil {
 			return nil, err
 		}
 	}
 
-	r.mux = mux
+	if opt.grpcPassthrough != nil {
+		if err := r.registerGRPCPassthrough(mux, opt.grpcPassthrough, opt.upstreamTransport, opt.tracerProvider); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.registerResponseFilters(mux, opt.responseFilters); err != nil {
+		return nil, err
+	}
+
+	for path := range opt.methods {
+		if !r.hasRoute(path) {
+			return nil, fmt.Errorf("can't override the methods of %q: unknown route", path)
+		}
+	}
+
+	for path := range opt.routeHeaders {
+		if !r.hasRoute(path) {
+			return nil, fmt.Errorf("can't set the response headers of %q: unknown route", path)
+		}
+	}
+
+	for _, path := range opt.disabledRoutes {
+		if rt, found := r.route(path); !found || rt.Enforcement != EnforcementDisabled {
+			return nil, fmt.Errorf("can't disable %q: unknown route", path)
+		}
+	}
+
+	for _, path := range opt.enabledRoutes {
+		if rt, found := r.route(path); !found || rt.Enforcement == EnforcementDisabled {
+			return nil, fmt.Errorf("can't enable %q: unknown or disabled route", path)
+		}
+	}
+
+	for _, path := range opt.enforcedPaths {
+		if !r.hasRoute(path) {
+			return nil, fmt.Errorf("can't enforce %q: unknown route", path)
+		}
+	}
+
+	var fallback http.Handler
+	switch {
+	case opt.passthroughByDefault:
+		fallback = http.HandlerFunc(r.passthrough)
+	case opt.unmatchedPathPolicy == UnmatchedPathForbidden:
+		fallback = http.HandlerFunc(unmatchedPathForbidden)
+	case opt.unmatchedPathPolicy == UnmatchedPathRedirect:
+		fallback = http.RedirectHandler(opt.unmatchedPathRedirect, http.StatusFound)
+	}
+	if len(opt.passthroughRules) > 0 {
+		if fallback == nil {
+			fallback = http.NotFoundHandler()
+		}
+
+		var err error
+		fallback, err = r.passthroughRules(mux, opt.passthroughRules, fallback)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.passthroughByDefault {
+		r.table = append(r.table, Route{Path: "/", Enforcement: EnforcementNone, Passthrough: true})
+	}
+	if fallback != nil {
+		mux.HandleFallback(fallback)
+	}
+
+	r.router = mux
+	r.mux = r.bypassAdmins(mux)
+	if r.auditLogger != nil {
+		r.mux = r.auditHandler(r.mux)
+	}
+	if r.accessLog != nil {
+		r.mux = r.accessLog.handler(r.mux)
+	}
+	if opt.tracerProvider != nil {
+		r.mux = r.traceHandler(r.mux, opt.tracerProvider)
+	}
 	r.modifiers = map[string]func(*http.Response) error{
-		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
-		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
+		"/api/v1/rules":   streamAPIResponse("groups", r.rulesFilter),
+		"/api/v1/alerts":  streamAPIResponse("alerts", r.alertsFilter),
+		"/api/v1/targets": modifyAPIResponse(r.filterTargets),
+		"/api/v1/stores":  modifyAPIResponse(r.filterStores),
+
+		"/api/v1/targets/metadata": modifyAPIResponse(r.filterTargetsMetadata),
+
+		"/api/v2/alerts/groups": r.filterAlertGroups,
+	}
+	if opt.redactedConfigAPI {
+		r.modifiers["/api/v1/status/config"] = modifyAPIResponse(r.filterConfig)
+	}
+	if opt.filteredTSDBStatus {
+		r.modifiers[tsdbStatusPath] = modifyAPIResponse(r.filterTSDBStatus)
+	}
+	if opt.receivers != nil {
+		r.modifiers["/api/v2/receivers"] = r.filterReceivers
+	}
+	if opt.deepFiltering {
+		r.modifiers["/api/v1/series"] = modifyAPIResponse(r.filterSeries)
+	}
+	if opt.stripStats {
+		r.modifiers["/api/v1/query"] = modifyAPIResponse(removeStats)
+		r.modifiers["/api/v1/query_range"] = modifyAPIResponse(removeStats)
+	}
+	if opt.stripLabel {
+		for _, path := range []string{"/api/v1/query", "/api/v1/query_range"} {
+			r.modifiers[path] = chainModifiers(r.modifiers[path], modifyAPIResponse(r.removeEnforcedLabel))
+		}
+	}
+	if r.orgID != nil && r.orgID.SkipInjection {
+		for _, path := range labelFilteredPaths {
+			delete(r.modifiers, path)
+		}
+	}
+	for _, f := range opt.responseFilters {
+		r.modifiers[f.Path] = r.filterResponse(f)
+	}
+	// Only the responses of the enforced routes are modified.
+	maps.DeleteFunc(r.modifiers, func(path string, _ func(*http.Response) error) bool {
+		rt, found := r.route(path)
+		return !found || rt.Passthrough || rt.Enforcement == EnforcementDisabled
+	})
+	for path, ts := range opt.responseTransforms {
+		if rt, found := r.route(path); !found || rt.Enforcement == EnforcementDisabled {
+			return nil, fmt.Errorf("can't transform the responses of %q: unknown route", path)
+		}
+
+		trs := make([]*transformer, 0, len(ts))
+		for _, t := range ts {
+			tr, err := newTransformer(t)
+			if err != nil {
+				return nil, fmt.Errorf("can't transform the responses of %q: %w", path, err)
+			}
+			trs = append(trs, tr)
+		}
+		r.modifiers[path] = chainModifiers(r.modifiers[path], transformResponse(trs))
+	}
+	if opt.dryRun {
+		// The upstream responses are returned as-is.
+		clear(r.modifiers)
 	}
 	proxy.ModifyResponse = r.ModifyResponse
 	proxy.ErrorHandler = r.errorHandler
-	proxy.ErrorLog = log.Default()
+	proxy.ErrorLog = slog.NewLogLogger(r.logger.Handler(), slog.LevelError)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if r.modifiesResponse(req) {
+			restrictAcceptEncoding(req.Header)
+		}
+		if r.recordsRequests() {
+			logUpstreamRequest(req)
+		}
+	}
 
 	return r, nil
 }
 
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.mux.ServeHTTP(w, req)
+	r.removeOrgID(req)
+	r.removeEnforcedHeader(req)
+	w, req = r.withResponseHeaders(w, req)
+	r.mux.ServeHTTP(r.withAPIErrors(w, req), req)
+}
+
+// modifiesResponse returns true if the response to the upstream request is
+// modified by the proxy.
+func (r *routes) modifiesResponse(req *http.Request) bool {
+	if bypassed(req) {
+		return false
+	}
+	if _, found := req.Context().Value(keyResponseModifier).(func(*http.Response) error); found {
+		return true
+	}
+	_, found := r.modifiers[req.URL.Path]
+
+	return found
 }
 
 func (r *routes) ModifyResponse(resp *http.Response) error {
-	m, found := r.modifiers[resp.Request.URL.Path]
-	if !found {
-		// Return the server's response unmodified.
+	if r.recordsRequests() {
+		logUpstreamResponse(resp)
+	}
+
+	m, found := resp.Request.Context().Value(keyResponseModifier).(func(*http.Response) error)
+	if !found && !bypassed(resp.Request) {
+		m, found = r.modifiers[resp.Request.URL.Path]
+	}
+	if found && r.tracer != nil {
+		_, span := r.tracer.Start(resp.Request.Context(), spanModifyResponse)
+		defer span.End()
+	}
+	if found {
+		if err := withDecodedBody(r.limitBody(m))(resp); err != nil {
+			return err
+		}
+	}
+
+	if r.etags {
+		return setETag(resp)
+	}
+
+	return nil
+}
+
+// WithMaxResponseRewriteBytes limits the size of the (decoded) upstream
+// responses which the proxy rewrites (e.g. the /api/v1/rules responses). The
+// proxy replies with "502 Bad Gateway" when the limit is exceeded. There is
+// no limit by default.
+func WithMaxResponseRewriteBytes(n int64) Option {
+	return optionFunc(func(o *options) {
+		o.maxRewriteBytes = n
+	})
+}
+
+// WithMaxRequestBodyBytes limits the size of the request bodies of the
+// enforced routes (e.g. the queries sent with POST). The body is read up to
+// the limit before the enforcement and the proxy replies with "413 Request
+// Entity Too Large" when the limit is exceeded. There is no limit by default.
+func WithMaxRequestBodyBytes(n int64) Option {
+	return optionFunc(func(o *options) {
+		o.maxRequestBodyBytes = n
+	})
+}
+
+// limitRequestBody reads the request body up to the configured limit so that
+// the enforcement (e.g. the parsing of the form) never buffers more than the
+// limit.
+func (r *routes) limitRequestBody(next http.Handler) http.Handler {
+	if r.maxRequestBodyBytes <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.ContentLength > r.maxRequestBodyBytes {
+			prometheusAPIError(w, fmt.Sprintf("request body larger than %d bytes", r.maxRequestBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		b, err := io.ReadAll(http.MaxBytesReader(w, req.Body, r.maxRequestBodyBytes))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				prometheusAPIError(w, fmt.Sprintf("request body larger than %d bytes", r.maxRequestBodyBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			prometheusAPIError(w, fmt.Sprintf("can't read the request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.ContentLength = int64(len(b))
+		req.TransferEncoding = nil
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// errResponseTooLarge is returned when the upstream response exceeds the
+// size limit of the rewritten responses.
+var errResponseTooLarge = errors.New("response too large to be rewritten")
+
+// limitBody returns a response modifier which fails with errResponseTooLarge
+// when m reads more than the configured limit from the body.
+func (r *routes) limitBody(m func(*http.Response) error) func(*http.Response) error {
+	if r.maxRewriteBytes <= 0 {
+		return m
+	}
+
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			// The modifiers pass the other responses as-is.
+			return m(resp)
+		}
+
+		if resp.ContentLength > r.maxRewriteBytes {
+			resp.Body.Close()
+			return fmt.Errorf("%w: %d bytes", errResponseTooLarge, resp.ContentLength)
+		}
+
+		lb := &limitedBody{ReadCloser: resp.Body, n: r.maxRewriteBytes}
+		resp.Body = lb
+		if err := m(resp); err != nil {
+			return err
+		}
+
+		// The body wasn't rewritten, it's forwarded without limit.
+		if resp.Body == io.ReadCloser(lb) {
+			resp.Body = lb.ReadCloser
+		}
+
 		return nil
 	}
+}
 
-	return m(resp)
+// limitedBody works like io.LimitedReader except that it returns an error
+// when the underlying reader has more data than the limit.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, errResponseTooLarge
+	}
+
+	// Read one more byte to detect that the limit is exceeded.
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.n {
+		b.n -= int64(n)
+		return n, err
+	}
+
+	n = int(b.n)
+	b.n = -1
+
+	return n, errResponseTooLarge
 }
 
 func (r *routes) errorHandler(rw http.ResponseWriter, _ *http.Request, err error) {
-	r.logger.Printf("http: proxy error: %v", err)
+	r.logger.Error("Proxy error", "err", err)
 	if errors.Is(err, errModifyResponseFailed) {
 		rw.WriteHeader(http.StatusBadRequest)
 	}
@@ -422,24 +1407,47 @@ func (r *routes) errorHandler(rw http.ResponseWriter, _ *http.Request, err error
 	rw.WriteHeader(http.StatusBadGateway)
 }
 
-func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+// getBody applies the GET body policy to the request.
+func (r *routes) getBody(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		for _, m := range methods {
-			if m == req.Method {
-				h(w, req)
-				return
-			}
+		if req.Method != http.MethodGet || req.ContentLength == 0 || r.getBodyPolicy == GETBodyIgnore {
+			next(w, req)
+			return
 		}
-		http.NotFound(w, req)
-	}
-}
 
-func (r *routes) errorIfRegexpMatch(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, req *http.Request) {
-		if r.regexMatch {
-			prometheusAPIError(w, "support for regex match not implemented", http.StatusNotImplemented)
+		if r.getBodyPolicy == GETBodyReject {
+			prometheusAPIError(w, "GET requests with a body aren't supported, use POST instead", http.StatusBadRequest)
+			return
+		}
+
+		if isJSONRequest(req) {
+			prometheusAPIError(w, "GET requests with a JSON body aren't supported, use POST instead", http.StatusBadRequest)
+			return
+		}
+
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to read the body: %v", err), http.StatusBadRequest)
 			return
 		}
+		_ = req.Body.Close()
+
+		bodyValues, err := url.ParseQuery(string(b))
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to parse the body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		q := req.URL.Query()
+		for k, vs := range bodyValues {
+			q[k] = append(q[k], vs...)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		req.Header.Del("Content-Length")
+		req.Header.Del("Content-Type")
 
 		next(w, req)
 	}
@@ -447,7 +1455,38 @@ func (r *routes) errorIfRegexpMatch(next http.HandlerFunc) http.HandlerFunc {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyLabel ctxKey = iota
+	keyHeaderWriter
+	keyExtraLabels
+	keyAccessLogEntry
+	keyResponseModifier
+	keyStage
+	keyDryRun
+	keyAdminBypass
+	keyShard
+)
+
+// enforcedLabel is a label enforced by the proxy with its values.
+type enforcedLabel struct {
+	name   string
+	values []string
+}
+
+// withExtraLabelValues stores the values of an additional enforced label in
+// the given context.
+func withExtraLabelValues(ctx context.Context, name string, values []string) context.Context {
+	extra, _ := ctx.Value(keyExtraLabels).([]enforcedLabel)
+	extra = append(slices.Clone(extra), enforcedLabel{name: name, values: values})
+	return context.WithValue(ctx, keyExtraLabels, extra)
+}
+
+// enforcedLabels returns the labels enforced for the request, the first one
+// being the proxy's label.
+func (r *routes) enforcedLabels(ctx context.Context) []enforcedLabel {
+	extra, _ := ctx.Value(keyExtraLabels).([]enforcedLabel)
+	return append([]enforcedLabel{{name: r.label, values: MustLabelValues(ctx)}}, extra...)
+}
 
 // MustLabelValues returns labels (previously stored using WithLabelValue())
 // from the given context.
@@ -494,88 +1533,83 @@ func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
-	var matcher *labels.Matcher
+	e, err := r.newQueryEnforcer(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if len(MustLabelValues(req.Context())) > 1 {
-		if r.regexMatch {
-			prometheusAPIError(w, "Only one label value allowed with regex match", http.StatusBadRequest)
+	if r.queryFrontendCompat {
+		if err := checkShardingHeaders(req.Header); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		matcher = &labels.Matcher{
-			Name:  r.label,
-			Type:  labels.MatchRegexp,
-			Value: labelValuesToRegexpString(MustLabelValues(req.Context())),
-		}
-	} else {
-		matcherType := labels.MatchEqual
-		matcherValue := MustLabelValue(req.Context())
-		if r.regexMatch {
-			compiledRegex, err := regexp.Compile(matcherValue)
-			if err != nil {
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if compiledRegex.MatchString("") {
-				prometheusAPIError(w, "Regex should not match empty string", http.StatusBadRequest)
-				return
-			}
-			matcherType = labels.MatchRegexp
-		}
-
-		matcher = &labels.Matcher{
-			Name:  r.label,
-			Type:  matcherType,
-			Value: matcherValue,
-		}
 	}
 
-	e := NewPromQLEnforcer(r.errorOnReplace, matcher)
+	if r.stripStats {
+		q := req.URL.Query()
+		q.Del(statsParam)
+		req.URL.RawQuery = q.Encode()
+	}
 
 	// The `query` can come in the URL query string and/or the POST body.
 	// For this reason, we need to try to enforcing in both places.
 	// Note: a POST request may include some values in the URL query string
 	// and others in the body. If both locations include a `query`, then
 	// enforce in both places.
-	q, found1, err := enforceQueryValues(e, req.URL.Query())
+	q := req.URL.Query()
+	found1, err := EnforceQueryValues(e, q)
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrIllegalLabelMatcher):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, ErrQueryParse):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, ErrEnforceLabel):
-			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
-		}
-
+		enforceError(w, err)
+		return
+	}
+	if err := EnforceStoreMatchValues(e, q); err != nil {
+		enforceError(w, err)
 		return
 	}
-	req.URL.RawQuery = q
+	req.URL.RawQuery = q.Encode()
 
 	var found2 bool
 	// Enforce the query in the POST body if needed.
-	if req.Method == http.MethodPost {
+	switch {
+	case req.Method == http.MethodPost && isJSONRequest(req):
+		err = rewriteJSONBody(req, func(body map[string]json.RawMessage) error {
+			if r.stripStats {
+				delete(body, statsParam)
+			}
+
+			var err error
+			found2, err = enforceJSONQuery(e, body)
+			return err
+		})
+		if err != nil {
+			enforceError(w, err)
+			return
+		}
+
+	case req.Method == http.MethodPost:
 		if err := req.ParseForm(); err != nil {
 			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		q, found2, err = enforceQueryValues(e, req.PostForm)
+		if r.stripStats {
+			req.PostForm.Del(statsParam)
+		}
+		found2, err = EnforceQueryValues(e, req.PostForm)
 		if err != nil {
-			switch {
-			case errors.Is(err, ErrIllegalLabelMatcher):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-			case errors.Is(err, ErrQueryParse):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-			case errors.Is(err, ErrEnforceLabel):
-				prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
-			}
-
+			enforceError(w, err)
+			return
+		}
+		if err := EnforceStoreMatchValues(e, req.PostForm); err != nil {
+			enforceError(w, err)
 			return
 		}
 
 		// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
 		_ = req.Body.Close()
-		req.Body = io.NopCloser(strings.NewReader(q))
-		req.ContentLength = int64(len(q))
+		newBody := req.PostForm.Encode()
+		req.Body = io.NopCloser(strings.NewReader(newBody))
+		req.ContentLength = int64(len(newBody))
 	}
 
 	// If no query was found, return early.
@@ -583,25 +1617,46 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r.handler.ServeHTTP(w, req)
+	r.forward(w, req)
 }
 
-func enforceQueryValues(e *PromQLEnforcer, v url.Values) (values string, noQuery bool, err error) {
-	// If no values were given or no query is present,
-	// e.g. because the query came in the POST body
-	// but the URL query string was passed, then finish early.
-	if v.Get(queryParam) == "" {
-		return v.Encode(), false, nil
+// newQueryEnforcer returns the enforcer of the PromQL (or LogQL) expressions
+// for the enforced labels of the request.
+func (r *routes) newQueryEnforcer(req *http.Request) (*PromQLEnforcer, error) {
+	// The matcher must be compiled since the enforcer evaluates it against
+	// the matchers of the expression when errorOnReplace is true.
+	matcher, err := r.newLabelMatcher(MustLabelValues(req.Context())...)
+	if err != nil {
+		return nil, err
 	}
 
-	q, err := e.Enforce(v.Get(queryParam))
+	extra, err := r.extraLabelMatchers(req.Context())
 	if err != nil {
-		return "", true, err
+		return nil, err
 	}
 
-	v.Set(queryParam, q)
+	e := NewPromQLEnforcer(r.errorOnReplace, append([]*labels.Matcher{matcher}, extra...)...)
+	e.errorOnUnselective = r.errorOnUnselective
+	e.errorOnLabelRewrite = r.errorOnLabelRewrite
+	e.embeddedQueries = r.queryFrontendCompat
+	e.policy = r.queryPolicies.get(MustLabelValues(req.Context()))
 
-	return v.Encode(), true, nil
+	return e, nil
+}
+
+// enforceError replies to the request with the HTTP status code matching the
+// enforcement error.
+func enforceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrIllegalLabelMatcher), errors.Is(err, ErrUnselectiveSelector), errors.Is(err, ErrLabelRewrite), errors.Is(err, ErrIllegalSeriesLabel):
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrQueryParse), errors.Is(err, errBadRequestBody):
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrQueryPolicy):
+		prometheusAPIError(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (r *routes) newLabelMatcher(vals ...string) (*labels.Matcher, error) {
@@ -628,7 +1683,7 @@ func (r *routes) newLabelMatcher(vals ...string) (*labels.Matcher, error) {
 		return m, nil
 	}
 
-	if len(vals) == 1 {
+	if len(vals) == 1 && r.matchType == labels.MatchEqual {
 		return &labels.Matcher{
 			Name:  r.label,
 			Type:  labels.MatchEqual,
@@ -657,8 +1712,21 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	extra, err := r.extraLabelMatchers(req.Context())
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e := NewPromQLEnforcer(false, append([]*labels.Matcher{matcher}, extra...)...)
+	e.errorOnUnselective = r.errorOnUnselective
+
 	q := req.URL.Query()
-	if err := injectMatcher(q, matcher); err != nil {
+	if err := EnforceMatchValues(e, q); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := EnforceStoreMatchValues(e, q); err != nil {
 		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -666,11 +1734,17 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 	req.URL.RawQuery = q.Encode()
 	if req.Method == http.MethodPost {
 		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		q = req.PostForm
-		if err := injectMatcher(q, matcher); err != nil {
+		if err := EnforceMatchValues(e, q); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := EnforceStoreMatchValues(e, q); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -684,23 +1758,73 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
-func injectMatcher(q url.Values, matcher *labels.Matcher) error {
-	matchers := q[matchersParam]
-	if len(matchers) == 0 {
-		q.Set(matchersParam, matchersToString(matcher))
+// limit enforces the "limit" parameter on the metadata endpoints if
+// configured.
+// It must be followed by a handler which re-encodes the POST body from
+// req.PostForm (e.g. matcher).
+func (r *routes) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := enforceLimit(req, r.metadataLimit); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// enforceLimit ensures that the "limit" parameter of the request is lower or
+// equal to max. It is a no-op if max is zero.
+// For POST requests, only req.PostForm is modified and the body needs to be
+// re-encoded by the caller.
+func enforceLimit(req *http.Request, max uint64) error {
+	if max == 0 {
 		return nil
 	}
 
-	// Inject label into existing matchers.
-	for i, m := range matchers {
-		ms, err := parser.ParseMetricSelector(m)
-		if err != nil {
-			return err
+	q := req.URL.Query()
+	if err := clampLimit(q, max, true); err != nil {
+		return err
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if req.Method != http.MethodPost {
+		return nil
+	}
+
+	if isJSONRequest(req) {
+		return rewriteJSONBody(req, func(body map[string]json.RawMessage) error {
+			return clampJSONLimit(body, max)
+		})
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+
+	// The form values take precedence over the URL query values.
+	return clampLimit(req.PostForm, max, false)
+}
+
+// clampLimit ensures that the "limit" parameter is set and lower or equal to
+// max. If inject is false, the parameter isn't added when absent.
+func clampLimit(v url.Values, max uint64, inject bool) error {
+	s := v.Get(limitParam)
+	if s == "" {
+		if inject {
+			v.Set(limitParam, strconv.FormatUint(max, 10))
 		}
+		return nil
+	}
+
+	limit, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %q parameter: %w", limitParam, err)
+	}
 
-		matchers[i] = matchersToString(append(ms, matcher)...)
+	if limit == 0 || limit > max {
+		v.Set(limitParam, strconv.FormatUint(max, 10))
 	}
-	q[matchersParam] = matchers
 
 	return nil
 }
@@ -14,15 +14,19 @@
 package injectproxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
 )
 
 var okResponse = []byte(`ok`)
@@ -236,7 +240,7 @@ func TestWithPassthroughPaths(t *testing.T) {
 			expCode: http.StatusNotFound,
 		},
 		{
-			url: "http://prometheus.example.com/api/v2/silence", method: http.MethodGet,
+			url: "http://prometheus.example.com/api/v2/silence/foo", method: http.MethodDelete,
 			expCode: http.StatusBadRequest, // Missing label to inject.
 		},
 		{
@@ -1052,6 +1056,75 @@ func TestQuery(t *testing.T) {
 			expCode:        http.StatusBadRequest,
 			expResponse:    nil,
 		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a equal matcher selecting an allowed value`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace="second"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{namespace="second",namespace=~"default|second"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a equal matcher selecting another value`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace="other"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+			expResponse:    nil,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a not-equal matcher`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace!="second"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{namespace!="second",namespace=~"default|second"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a not-equal matcher excluding the empty value`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace!=""}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{namespace!="",namespace=~"default|second"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a regexp matcher selecting a subset of the allowed values`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace=~"sec.*"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{namespace=~"default|second",namespace=~"sec.*"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a regexp matcher selecting other values`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace=~"other|third"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+			expResponse:    nil,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a not-regexp matcher`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace!~"default"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{namespace!~"default",namespace=~"default|second"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Query with multiple label values, errorOnReplace and a not-regexp matcher excluding all the allowed values`,
+			labelv:         []string{"default", "second"},
+			promQuery:      `up{namespace!~"default|second"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+			expResponse:    nil,
+		},
 		{
 			name:         `Query with a scalar`,
 			labelv:       []string{"default"},
@@ -1334,3 +1407,1129 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryStats(t *testing.T) {
+	const (
+		// The sample's timestamp and value can't be represented exactly
+		// as float64 numbers.
+		queryResult   = `"result":[{"metric":{},"value":[1714393432.40355724712,"1.00000000000000000001e-7"]}]`
+		queryResponse = `{"status":"success","data":{"resultType":"vector",` + queryResult + `,"stats":{"timings":{"evalTotalTime":0.001}}}}`
+	)
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expStats bool
+	}{
+		{
+			name:     "stats are passed through by default",
+			expStats: true,
+		},
+		{
+			name: "stats are removed",
+			opts: []Option{WithoutQueryStats()},
+		},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			t.Run(tc.name+"/"+method, func(t *testing.T) {
+				m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					if err := req.ParseForm(); err != nil {
+						prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					if got := req.Form.Get(statsParam) != ""; got != tc.expStats {
+						prometheusAPIError(w, fmt.Sprintf("expected stats parameter: %v, got %v", tc.expStats, got), http.StatusInternalServerError)
+						return
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(queryResponse))
+				}))
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				v := url.Values{queryParam: []string{"up"}, statsParam: []string{"all"}, proxyLabel: []string{"default"}}
+				var req *http.Request
+				if method == http.MethodGet {
+					req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query?"+v.Encode(), nil)
+				} else {
+					req = httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query", strings.NewReader(v.Encode()))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, string(body))
+				}
+
+				if got := strings.Contains(string(body), `"stats"`); got != tc.expStats {
+					t.Fatalf("expected stats in the response: %v, got %s", tc.expStats, string(body))
+				}
+
+				if !strings.Contains(string(body), queryResult) {
+					t.Fatalf("expected the result to be unmodified, got %s", string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestQueryStatsNullData(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":null}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithoutQueryStats())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Body.String(); !strings.Contains(got, `"data":null`) {
+		t.Fatalf("expected null data, got %s", got)
+	}
+}
+
+func TestUnmatchedPathPolicy(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		path string
+
+		expCode     int
+		expBody     string
+		expLocation string
+		expErr      bool
+	}{
+		{
+			name:    "default",
+			path:    "/graph",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "not found",
+			opts:    []Option{WithUnmatchedPathPolicy(UnmatchedPathNotFound)},
+			path:    "/graph",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "forbidden",
+			opts:    []Option{WithUnmatchedPathPolicy(UnmatchedPathForbidden)},
+			path:    "/graph",
+			expCode: http.StatusForbidden,
+			expBody: "the /graph path isn't handled by the proxy",
+		},
+		{
+			name:    "forbidden doesn't apply to enforced routes",
+			opts:    []Option{WithUnmatchedPathPolicy(UnmatchedPathForbidden)},
+			path:    "/api/v1/query?query=up",
+			expCode: http.StatusOK,
+		},
+		{
+			name:        "redirect",
+			opts:        []Option{WithUnmatchedPathRedirect("https://docs.example.com/proxy")},
+			path:        "/api/v1/format_query",
+			expCode:     http.StatusFound,
+			expLocation: "https://docs.example.com/proxy",
+		},
+		{
+			name:   "redirect without URL",
+			opts:   []Option{WithUnmatchedPathPolicy(UnmatchedPathRedirect)},
+			expErr: true,
+		},
+		{
+			name:   "redirect with relative URL",
+			opts:   []Option{WithUnmatchedPathRedirect("/docs")},
+			expErr: true,
+		},
+		{
+			name:   "invalid policy",
+			opts:   []Option{WithUnmatchedPathPolicy("foo")},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			sep := "?"
+			if strings.Contains(tc.path, "?") {
+				sep = "&"
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+sep+proxyLabel+"=default", nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, body)
+			}
+
+			if !strings.Contains(string(body), tc.expBody) {
+				t.Fatalf("expected body to contain %q, got %q", tc.expBody, body)
+			}
+
+			if got := resp.Header.Get("Location"); got != tc.expLocation {
+				t.Fatalf("expected location %q, got %q", tc.expLocation, got)
+			}
+		})
+	}
+}
+
+func TestPassthroughByDefault(t *testing.T) {
+	// The upstream echoes the request's path and query string.
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"path":%q,"query":%q}}`, req.URL.Path, req.URL.RawQuery)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughByDefault([]string{"/api/v1/query"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+
+		expCode int
+		expBody string
+	}{
+		{
+			// Enforced route.
+			path:    "/api/v1/query?query=up&namespace=default",
+			expCode: http.StatusOK,
+			expBody: url.QueryEscape(`up{namespace="default"}`),
+		},
+		{
+			// Enforced route without label value.
+			path:    "/api/v1/query?query=up",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Built-in route which isn't enforced.
+			path:    "/api/v1/series?match[]=up",
+			expCode: http.StatusOK,
+			expBody: `"query":"match[]=up"`,
+		},
+		{
+			// The response isn't filtered.
+			path:    "/api/v1/rules",
+			expCode: http.StatusOK,
+			expBody: `"path":"/api/v1/rules"`,
+		},
+		{
+			path:    "/api/v1/targets",
+			expCode: http.StatusOK,
+			expBody: `"path":"/api/v1/targets"`,
+		},
+		{
+			path:    "/api/v1/status/config",
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path, nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, body)
+			}
+
+			if !strings.Contains(string(body), tc.expBody) {
+				t.Fatalf("expected body to contain %q, got %q", tc.expBody, body)
+			}
+		})
+	}
+
+	if !r.hasRoute("/") {
+		t.Fatal("expected the catch-all route to be listed")
+	}
+
+	for _, opts := range [][]Option{
+		{WithPassthroughByDefault(nil)},
+		{WithPassthroughByDefault([]string{"/api/v1/foo"})},
+		{WithPassthroughByDefault([]string{"/api/v1/query"}), WithUnmatchedPathPolicy(UnmatchedPathForbidden)},
+	} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...); err == nil {
+			t.Fatal("expected error, got none")
+		}
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithDisabledRoutes("/federate", "/api/v1/query_exemplars"),
+		// Disabled routes return 404 even when the unmatched paths don't.
+		WithUnmatchedPathPolicy(UnmatchedPathForbidden),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path    string
+		expCode int
+	}{
+		{path: "/federate?match[]=up", expCode: http.StatusNotFound},
+		{path: "/api/v1/query_exemplars?query=up", expCode: http.StatusNotFound},
+		{path: "/api/v1/query?query=up", expCode: http.StatusOK},
+		{path: "/api/v1/format_query?query=up", expCode: http.StatusForbidden},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"&"+proxyLabel+"=default", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if rt, _ := r.route("/federate"); rt.Enforcement != EnforcementDisabled {
+		t.Fatalf("expected %q enforcement, got %q", EnforcementDisabled, rt.Enforcement)
+	}
+
+	_, err = NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithDisabledRoutes("/api/v1/foo"))
+	if err == nil {
+		t.Fatal("expected error for unknown route")
+	}
+}
+
+func TestEnabledRoutes(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEnabledRoutes("/api/v1/query", "/api/v1/query_range"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path    string
+		expCode int
+	}{
+		{path: "/api/v1/query?query=up", expCode: http.StatusOK},
+		{path: "/federate?match[]=up", expCode: http.StatusNotFound},
+		{path: "/api/v1/series?match[]=up", expCode: http.StatusNotFound},
+		{path: "/api/v1/status/config?query=up", expCode: http.StatusForbidden},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"&"+proxyLabel+"=default", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if rt, _ := r.route("/federate"); rt.Enforcement != EnforcementDisabled {
+		t.Fatalf("expected %q enforcement, got %q", EnforcementDisabled, rt.Enforcement)
+	}
+
+	for _, opts := range [][]Option{
+		{WithEnabledRoutes("/api/v1/foo")},
+		{WithEnabledRoutes("/federate"), WithDisabledRoutes("/federate")},
+	} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestMetadataLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		path   string
+		method string
+		limit  string
+
+		expCode  int
+		expLimit string
+	}{
+		{
+			name:     "limit is injected",
+			path:     "/api/v1/series",
+			expCode:  http.StatusOK,
+			expLimit: "100",
+		},
+		{
+			name:     "lower limit is preserved",
+			path:     "/api/v1/series",
+			limit:    "10",
+			expCode:  http.StatusOK,
+			expLimit: "10",
+		},
+		{
+			name:     "higher limit is replaced",
+			path:     "/api/v1/labels",
+			limit:    "1000",
+			expCode:  http.StatusOK,
+			expLimit: "100",
+		},
+		{
+			name:     "unlimited is replaced",
+			path:     "/api/v1/label/job/values",
+			limit:    "0",
+			expCode:  http.StatusOK,
+			expLimit: "100",
+		},
+		{
+			name:    "invalid limit",
+			path:    "/api/v1/series",
+			limit:   "-1",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "lower limit is preserved for POSTs",
+			path:     "/api/v1/series",
+			method:   http.MethodPost,
+			limit:    "10",
+			expCode:  http.StatusOK,
+			expLimit: "10",
+		},
+		{
+			name:     "higher limit is replaced for POSTs",
+			path:     "/api/v1/labels",
+			method:   http.MethodPost,
+			limit:    "1000",
+			expCode:  http.StatusOK,
+			expLimit: "100",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var h http.Handler
+			if tc.method == http.MethodPost {
+				h = checkFormHandler(limitParam, tc.expLimit)
+			} else {
+				h = checkQueryHandler("", limitParam, tc.expLimit)
+			}
+			m := newMockUpstream(h)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithEnabledLabelsAPI(), WithMetadataLimit(100))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			v := url.Values{proxyLabel: []string{"default"}}
+			if tc.limit != "" {
+				v.Set(limitParam, tc.limit)
+			}
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.path, strings.NewReader(v.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+v.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestErrorOnUnselectiveQuery(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithErrorOnUnselectiveQuery())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+
+		expCode int
+	}{
+		{
+			path:    "/api/v1/query",
+			params:  url.Values{queryParam: []string{`up`}},
+			expCode: http.StatusOK,
+		},
+		{
+			path:    "/api/v1/query",
+			params:  url.Values{queryParam: []string{`{namespace=~".+"}`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			path:    "/api/v1/series",
+			params:  url.Values{matchersParam: []string{`{job="prometheus"}`}},
+			expCode: http.StatusOK,
+		},
+		{
+			path:    "/api/v1/series",
+			params:  url.Values{matchersParam: []string{`{job="prometheus"}`, `{namespace="default"}`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			path:    "/federate",
+			params:  url.Values{matchersParam: []string{`{job=~".*",namespace!=""}`}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.path+"?"+tc.params.Encode(), func(t *testing.T) {
+			tc.params.Set(proxyLabel, "default")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestErrorOnLabelRewrite(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithErrorOnLabelRewrite())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+
+		expCode int
+	}{
+		{
+			path:    "/api/v1/query",
+			params:  url.Values{queryParam: []string{`label_replace(up, "instance", "$1", "job", "(.*)")`}},
+			expCode: http.StatusOK,
+		},
+		{
+			path:    "/api/v1/query",
+			params:  url.Values{queryParam: []string{`label_replace(up, "namespace", "other", "", "")`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			path:    "/api/v1/query_range",
+			params:  url.Values{queryParam: []string{`label_join(up, "namespace", ",", "job")`}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.path+"?"+tc.params.Encode(), func(t *testing.T) {
+			tc.params.Set(proxyLabel, "default")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+tc.params.Encode(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestStripEnforcedLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		response string
+		opts     []Option
+
+		expCode     int
+		expResponse string
+	}{
+		{
+			name:        "label is kept by default",
+			path:        "/api/v1/query",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]}]}}`,
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]}]}}`,
+		},
+		{
+			name:        "vector",
+			path:        "/api/v1/query",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]},{"metric":{"job":"api"},"value":[1,"0"]}]}}`,
+			opts:        []Option{WithoutEnforcedLabel()},
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]},{"metric":{"job":"api"},"value":[1,"0"]}]}}`,
+		},
+		{
+			name:        "matrix",
+			path:        "/api/v1/query_range",
+			response:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"namespace":"default","job":"api"},"values":[[1,"1"],[2,"1"]]}]}}`,
+			opts:        []Option{WithoutEnforcedLabel()},
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"api"},"values":[[1,"1"],[2,"1"]]}]}}`,
+		},
+		{
+			name:        "scalar",
+			path:        "/api/v1/query",
+			response:    `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			opts:        []Option{WithoutEnforcedLabel()},
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+		},
+		{
+			name:        "with stats removed",
+			path:        "/api/v1/query",
+			response:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"default"},"value":[1,"1"]}],"stats":{"timings":{}}}}`,
+			opts:        []Option{WithoutEnforcedLabel(), WithoutQueryStats()},
+			expCode:     http.StatusOK,
+			expResponse: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]}]}}`,
+		},
+		{
+			name:     "invalid response",
+			path:     "/api/v1/query",
+			response: `{"status":"success","data":{"resultType":"vector","result":{}}}`,
+			opts:     []Option{WithoutEnforcedLabel()},
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tc.response))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?query=up&namespace=default", nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := strings.TrimSpace(string(body)); got != tc.expResponse {
+				t.Fatalf("expected response body %q, got %q", tc.expResponse, got)
+			}
+		})
+	}
+}
+
+func TestMatchType(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		path   string
+		labelv []string
+		opts   []Option
+
+		expCode  int
+		expKey   string
+		expValue string
+	}{
+		{
+			name:     "equal matcher by default",
+			path:     "/api/v1/query?query=up",
+			labelv:   []string{"ns1"},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{namespace="ns1"}`,
+		},
+		{
+			name:     "regexp matcher for a single value",
+			path:     "/api/v1/query?query=up",
+			labelv:   []string{"ns1"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp)},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{namespace=~"ns1"}`,
+		},
+		{
+			name:     "regexp matcher for multiple values",
+			path:     "/api/v1/query?query=up",
+			labelv:   []string{"ns1", "ns2"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp)},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "regexp matcher with escaped value",
+			path:     "/api/v1/query?query=up",
+			labelv:   []string{"ns.1"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp)},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{namespace=~"ns\\.1"}`,
+		},
+		{
+			name:     "regexp matcher for match[] selectors",
+			path:     "/api/v1/series?match[]=up",
+			labelv:   []string{"ns1"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp)},
+			expCode:  http.StatusOK,
+			expKey:   matchersParam,
+			expValue: `{__name__="up",namespace=~"ns1"}`,
+		},
+		{
+			name:     "regexp matcher for extra labels",
+			path:     "/api/v1/query?query=up&cluster=c1",
+			labelv:   []string{"ns1"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp), WithExtraLabel("cluster", HTTPFormEnforcer{ParameterName: "cluster"})},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{cluster=~"c1",namespace=~"ns1"}`,
+		},
+		{
+			name:     "regexp matcher with error on replace and the same value",
+			path:     `/api/v1/query?query=up{namespace="ns1"}`,
+			labelv:   []string{"ns1"},
+			opts:     []Option{WithMatchType(labels.MatchRegexp), WithErrorOnReplace()},
+			expCode:  http.StatusOK,
+			expKey:   queryParam,
+			expValue: `up{namespace="ns1",namespace=~"ns1"}`,
+		},
+		{
+			name:    "regexp matcher with error on replace and another value",
+			path:    `/api/v1/query?query=up{namespace="ns2"}`,
+			labelv:  []string{"ns1"},
+			opts:    []Option{WithMatchType(labels.MatchRegexp), WithErrorOnReplace()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", tc.expKey, tc.expValue))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com" + tc.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			for _, v := range tc.labelv {
+				q.Add(proxyLabel, v)
+			}
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("invalid match type", func(t *testing.T) {
+		_, err := NewRoutes(&url.URL{}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMatchType(labels.MatchNotEqual))
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestQueryWithJSONBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		opts []Option
+
+		expCode int
+		expBody map[string]interface{}
+	}{
+		{
+			name:    "query is enforced",
+			body:    `{"query":"up","time":"1700000000"}`,
+			expCode: http.StatusOK,
+			expBody: map[string]interface{}{"query": `up{namespace="default"}`, "time": "1700000000"},
+		},
+		{
+			name:    "stats are removed",
+			body:    `{"query":"up","stats":"all"}`,
+			opts:    []Option{WithoutQueryStats()},
+			expCode: http.StatusOK,
+			expBody: map[string]interface{}{"query": `up{namespace="default"}`},
+		},
+		{
+			name:    "limit is clamped",
+			body:    `{"query":"up","limit":1000}`,
+			opts:    []Option{WithLimits(Limits{QueryResultLimit: 100}, nil)},
+			expCode: http.StatusOK,
+			expBody: map[string]interface{}{"query": `up{namespace="default"}`, "limit": float64(100)},
+		},
+		{
+			name:    "invalid JSON",
+			body:    `{"query":`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid query type",
+			body:    `{"query":1}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid PromQL",
+			body:    `{"query":"up{"}`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var got map[string]interface{}
+				if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if !reflect.DeepEqual(got, tc.expBody) {
+					prometheusAPIError(w, fmt.Sprintf("expected body %v, got %v", tc.expBody, got), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query?namespace=default", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	r, err := NewRoutes(
+		&url.URL{Scheme: "http", Host: "prometheus.example.com"},
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithPassthroughPaths([]string{"/api/v1/status/buildinfo"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.RoutesHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/-/routes", nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+
+	var got []Route
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	routes := make(map[string]Route, len(got))
+	for _, rt := range got {
+		routes[rt.Path] = rt
+	}
+
+	for _, exp := range []Route{
+		{Path: "/api/v1/query", Enforcement: EnforcementPromQL, Methods: []string{"GET", "POST"}},
+		{Path: "/federate", Enforcement: EnforcementMatchers, Methods: []string{"GET"}},
+		{Path: "/api/v1/status/config", Enforcement: EnforcementForbidden},
+		{Path: "/api/v2/silence/{id}", Enforcement: EnforcementSilences, Methods: []string{"DELETE"}, Mutating: true},
+		{Path: "/api/v1/status/buildinfo", Enforcement: EnforcementNone, Passthrough: true},
+	} {
+		if !reflect.DeepEqual(routes[exp.Path], exp) {
+			t.Errorf("expected route %+v, got %+v", exp, routes[exp.Path])
+		}
+	}
+
+	if _, found := routes["/api/v1/labels"]; found {
+		t.Errorf("expected /api/v1/labels to be absent when the labels API is disabled")
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	upstream := &url.URL{Scheme: "http", Host: "prometheus.example.com"}
+
+	for _, tc := range []struct {
+		name    string
+		methods map[string][]string
+
+		expErr bool
+	}{
+		{
+			name:    "unknown route",
+			methods: map[string][]string{"/api/v1/unknown": {"GET"}},
+			expErr:  true,
+		},
+		{
+			name:    "unsupported method",
+			methods: map[string][]string{"/federate": {"POST"}},
+			expErr:  true,
+		},
+		{
+			name:    "no method",
+			methods: map[string][]string{"/api/v1/query": {}},
+			expErr:  true,
+		},
+		{
+			name:    "restricted methods",
+			methods: map[string][]string{"/api/v1/query": {"get"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(upstream, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRouteMethods(tc.methods))
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	m := newMockUpstream(checkQueryHandler("", queryParam, `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRouteMethods(map[string][]string{"/api/v1/query": {"GET"}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		method  string
+		expCode int
+	}{
+		{method: http.MethodGet, expCode: http.StatusOK},
+		{method: http.MethodPost, expCode: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?namespace=default&query=up", nil))
+
+			if resp := w.Result(); resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGETBodyPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy GETBodyPolicy
+		path   string
+		body   string
+
+		expCode int
+	}{
+		{
+			name:    "ignore",
+			path:    "/api/v1/query?query=up",
+			body:    "query=down",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "reject",
+			policy:  GETBodyReject,
+			path:    "/api/v1/query?query=up",
+			body:    "query=down",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "reject without body",
+			policy:  GETBodyReject,
+			path:    "/api/v1/query?query=up",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "enforce",
+			policy:  GETBodyEnforce,
+			path:    "/api/v1/query",
+			body:    "query=up",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "enforce matchers",
+			policy:  GETBodyEnforce,
+			path:    "/api/v1/series",
+			body:    "match[]=up",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "invalid policy",
+			policy:  GETBodyPolicy("foo"),
+			path:    "/api/v1/query?query=up",
+			expCode: -1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				q := req.URL.Query()
+				for _, param := range []string{queryParam, matchersParam} {
+					if v := q.Get(param); v != "" && !strings.Contains(v, `namespace="default"`) {
+						prometheusAPIError(w, fmt.Sprintf("unexpected %s parameter: %q", param, v), http.StatusInternalServerError)
+						return
+					}
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var opts []Option
+			if tc.policy != "" {
+				opts = append(opts, WithGETBodyPolicy(tc.policy))
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, opts...)
+			if tc.expCode < 0 {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path, strings.NewReader(tc.body))
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestHandleCustomRoute(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", "tenant", "ns1"))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = r.Handle("/api/v1/custom", func(w http.ResponseWriter, req *http.Request, upstream http.Handler) {
+		q := req.URL.Query()
+		q.Set("tenant", MustLabelValue(req.Context()))
+		req.URL.RawQuery = q.Encode()
+		upstream.ServeHTTP(w, req)
+	}, http.MethodGet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.Handle("/api/v1/query/custom", func(http.ResponseWriter, *http.Request, http.Handler) {}); err == nil {
+		t.Fatal("expected error for a path conflicting with a built-in route, got none")
+	}
+
+	for _, tc := range []struct {
+		method  string
+		url     string
+		expCode int
+	}{
+		{
+			method:  http.MethodGet,
+			url:     "/api/v1/custom?namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			method:  http.MethodGet,
+			url:     "/api/v1/custom",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			method:  http.MethodPost,
+			url:     "/api/v1/custom?namespace=ns1",
+			expCode: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(tc.method+" "+tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	rt, found := r.route("/api/v1/custom")
+	if !found {
+		t.Fatal("expected the custom route in the route table")
+	}
+	if exp := (Route{Path: "/api/v1/custom", Enforcement: EnforcementCustom, Methods: []string{"GET"}, Mutating: true}); !reflect.DeepEqual(rt, exp) {
+		t.Fatalf("expected route %+v, got %+v", exp, rt)
+	}
+}
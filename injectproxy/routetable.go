@@ -0,0 +1,288 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Enforcement describes how the label value is enforced on a route.
+type Enforcement string
+
+const (
+	// EnforcementPromQL injects the label matcher into the PromQL expression.
+	EnforcementPromQL Enforcement = "promql"
+	// EnforcementLogQL injects the label matcher into the stream selectors
+	// of the LogQL expression.
+	EnforcementLogQL Enforcement = "logql"
+	// EnforcementMatchers injects the label matcher into the match[] selectors.
+	EnforcementMatchers Enforcement = "matchers"
+	// EnforcementResponse filters the upstream response.
+	EnforcementResponse Enforcement = "response"
+	// EnforcementSilences enforces the label matcher on the silences.
+	EnforcementSilences Enforcement = "silences"
+	// EnforcementFilter injects the label matcher into the Alertmanager
+	// filter parameter.
+	EnforcementFilter Enforcement = "filter"
+	// EnforcementSeries enforces the label on the series of the remote
+	// write requests.
+	EnforcementSeries Enforcement = "series"
+	// EnforcementLabel requires the label value but the request is forwarded
+	// without modification.
+	EnforcementLabel Enforcement = "label"
+	// EnforcementNone doesn't require nor enforce the label value.
+	EnforcementNone Enforcement = "none"
+	// EnforcementForbidden rejects all the requests.
+	EnforcementForbidden Enforcement = "forbidden"
+	// EnforcementCustom delegates the enforcement to the EnforcementFunc of
+	// a route registered with Handle.
+	EnforcementCustom Enforcement = "custom"
+	// EnforcementDisabled replies with "404 Not Found" to all the requests
+	// of a built-in route disabled by the configuration.
+	EnforcementDisabled Enforcement = "disabled"
+)
+
+// Route describes a path handled by the proxy.
+type Route struct {
+	// Path is the registered pattern which may contain path parameters
+	// (e.g. "/api/v2/silence/{id}"). The requests to the sub-paths are
+	// rejected except for the passthrough routes which handle them.
+	Path string `json:"path"`
+	// Enforcement is the enforcement mode of the route.
+	Enforcement Enforcement `json:"enforcement"`
+	// Methods lists the accepted HTTP methods, all methods are accepted if
+	// empty.
+	Methods []string `json:"methods,omitempty"`
+	// Passthrough is true if the requests are forwarded to the upstream
+	// without enforcement.
+	Passthrough bool `json:"passthrough"`
+	// Mutating is true if the requests other than GET and HEAD modify the
+	// upstream state (e.g. creating silences). These requests are rejected
+	// for the read-only label values.
+	Mutating bool `json:"mutating,omitempty"`
+}
+
+// middleware wraps the handler of an enforced route.
+type middleware func(next http.HandlerFunc) http.HandlerFunc
+
+// handle registers the handler for the route and records the route.
+// The handler is wrapped to reject the HTTP methods which aren't accepted and
+// to extract the label value when the route requires it.
+func (r *routes) handle(mux *router, rt Route, h http.HandlerFunc) error {
+	if r.disabledRoute(rt) {
+		// The route is registered so the requests don't fall through to
+		// the catch-all route (if any).
+		rt = Route{Path: rt.Path, Enforcement: EnforcementDisabled}
+		h = http.NotFound
+	}
+
+	if r.enforcedPaths != nil && !rt.Passthrough && rt.Enforcement != EnforcementNone && rt.Enforcement != EnforcementForbidden && rt.Enforcement != EnforcementDisabled && rt.Enforcement != EnforcementCustom {
+		// In passthrough-by-default mode, the built-in routes which aren't
+		// listed are handled by the catch-all passthrough route.
+		if _, found := r.enforcedPaths[rt.Path]; !found {
+			return nil
+		}
+	}
+
+	if methods, found := r.methods[rt.Path]; found {
+		var err error
+		rt.Methods, err = restrictMethods(rt, methods)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.skipsInjection(rt) {
+		// The upstream enforces the tenancy.
+		rt.Enforcement = EnforcementLabel
+		h = r.passthrough
+	}
+
+	switch rt.Enforcement {
+	case EnforcementPromQL, EnforcementLogQL, EnforcementMatchers:
+		h = r.getBody(h)
+	}
+
+	var handler http.Handler = h
+	switch rt.Enforcement {
+	case EnforcementNone, EnforcementForbidden, EnforcementDisabled:
+	default:
+		// The middlewares run in order once the label values are
+		// extracted.
+		middlewares := []middleware{
+			r.normalizeLabelValues,
+			r.logLabelValues,
+			r.traceLabelValues,
+			r.observeLabelValues,
+			r.enforceACL,
+			r.denyBlocked,
+			r.propagateBaggage,
+			r.setOrgID,
+			r.setEnforcedHeader,
+			r.selectShard,
+			func(next http.HandlerFunc) http.HandlerFunc { return r.denyReadOnly(rt, next) },
+		}
+		next := r.traceStage(spanRewrite, h)
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+
+		enforced := r.limitRequestBody(r.extractLabels(next))
+		handler = r.traceStage(spanEnforce, r.auditEnforced(enforced.ServeHTTP))
+		handler = r.dryRunHandler(rt, handler)
+	}
+
+	if len(rt.Methods) > 0 {
+		handler = enforceMethods(handler, rt.Methods...)
+	}
+
+	handler = r.routeResponseHeaders(rt.Path, handler)
+
+	if err := mux.Handle(rt.Path, rt.Passthrough, handler); err != nil {
+		return err
+	}
+
+	r.table = append(r.table, rt)
+
+	return nil
+}
+
+// disabledRoute returns true if the built-in route is disabled by the
+// configuration.
+func (r *routes) disabledRoute(rt Route) bool {
+	if rt.Passthrough {
+		return false
+	}
+
+	if _, found := r.disabledRoutes[rt.Path]; found {
+		return true
+	}
+
+	if r.enabledRoutes == nil {
+		return false
+	}
+
+	switch rt.Enforcement {
+	case EnforcementNone, EnforcementForbidden, EnforcementDisabled, EnforcementCustom:
+		return false
+	}
+	_, found := r.enabledRoutes[rt.Path]
+
+	return !found
+}
+
+// EnforcementFunc handles the requests of a custom route. It is called once
+// the label values are extracted from the request, they are available with
+// MustLabelValues. The function enforces the label values on the request
+// before passing it to upstream which forwards it to the upstream server.
+type EnforcementFunc func(w http.ResponseWriter, req *http.Request, upstream http.Handler)
+
+// Handle registers a custom enforced route for the given path which accepts
+// the given HTTP methods (all methods if empty). The route benefits from the
+// same processing as the built-in routes (label extraction, ACL, blocked
+// tenants, access log, metrics...). The responses of custom routes aren't
+// modified. The custom routes are considered mutating: the requests other
+// than GET and HEAD are rejected for the read-only label values. Handle must
+// be called before the routes serve requests and it returns an error if the
+// path conflicts with a registered route.
+func (r *routes) Handle(path string, f EnforcementFunc, methods ...string) error {
+	rt := Route{Path: path, Enforcement: EnforcementCustom, Methods: methods, Mutating: true}
+
+	return r.handle(r.router, rt, func(w http.ResponseWriter, req *http.Request) {
+		f(w, req, r.handler)
+	})
+}
+
+// isMutating returns true if the request method modifies the upstream state
+// for the route.
+func isMutating(rt Route, method string) bool {
+	return rt.Mutating && method != http.MethodGet && method != http.MethodHead
+}
+
+// denyReadOnly rejects the mutating requests of read-only label values.
+func (r *routes) denyReadOnly(rt Route, next http.HandlerFunc) http.HandlerFunc {
+	if len(r.readOnly) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if isMutating(rt, req.Method) {
+			for _, v := range MustLabelValues(req.Context()) {
+				if _, found := r.readOnly[v]; found {
+					prometheusAPIError(w, fmt.Sprintf("label value %q is read-only", v), http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+// restrictMethods returns the methods accepted by the route after applying
+// the configured override. The override can only restrict the default methods
+// of the route.
+func restrictMethods(rt Route, methods []string) ([]string, error) {
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("route %q: at least one HTTP method is required", rt.Path)
+	}
+
+	allowed := make([]string, 0, len(methods))
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if len(rt.Methods) > 0 && !slices.Contains(rt.Methods, m) {
+			return nil, fmt.Errorf("route %q: method %q isn't supported, expected one of %v", rt.Path, m, rt.Methods)
+		}
+		allowed = append(allowed, m)
+	}
+
+	return allowed, nil
+}
+
+func (r *routes) hasRoute(path string) bool {
+	_, found := r.route(path)
+	return found
+}
+
+// route returns the registered route for the given path.
+func (r *routes) route(path string) (Route, bool) {
+	for _, rt := range r.table {
+		if rt.Path == path {
+			return rt, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// Routes returns the routes handled by the proxy in registration order.
+func (r *routes) Routes() []Route {
+	table := make([]Route, len(r.table))
+	copy(table, r.table)
+
+	return table
+}
+
+// RoutesHandler returns an HTTP handler which lists the routes handled by the
+// proxy as JSON.
+func (r *routes) RoutesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.Routes())
+	}
+}
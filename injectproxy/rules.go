@@ -15,13 +15,13 @@ package injectproxy
 
 import (
 	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
+	"net/url"
+	"strings"
 
 	"github.com/prometheus/prometheus/model/labels"
 )
@@ -32,139 +32,56 @@ type apiResponse struct {
 	ErrorType string          `json:"errorType,omitempty"`
 	Error     string          `json:"error,omitempty"`
 	Warnings  []string        `json:"warnings,omitempty"`
+
+	// raw is the original response, it is used to encode the modified
+	// response without altering the other fields.
+	raw *rawObject
 }
 
-func getAPIResponse(resp *http.Response) (*apiResponse, error) {
+// readJSONBody reads the JSON body of the response. The compressed bodies are
+// decoded by withDecodedBody before the response modifiers run.
+func readJSONBody(resp *http.Response) (json.RawMessage, error) {
 	defer resp.Body.Close()
-	reader := resp.Body
-
-	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
-		var err error
-		reader, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("gzip decoding error: %w", err)
-		}
-		defer reader.Close()
-
-		// TODO: recompress the modified response?
-		resp.Header.Del("Content-Encoding")
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
 
-	var apir apiResponse
-	if err := json.NewDecoder(reader).Decode(&apir); err != nil {
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
 		return nil, fmt.Errorf("JSON decoding error: %w", err)
 	}
 
-	if apir.Status != "success" {
-		return nil, fmt.Errorf("unexpected response status: %q", apir.Status)
-	}
-
-	return &apir, nil
-}
-
-type rulesData struct {
-	RuleGroups []*ruleGroup `json:"groups"`
-}
-
-type ruleGroup struct {
-	Name     string  `json:"name"`
-	File     string  `json:"file"`
-	Rules    []rule  `json:"rules"`
-	Interval float64 `json:"interval"`
+	return raw, nil
 }
 
-type rule struct {
-	*alertingRule
-	*recordingRule
+// replaceBody replaces the body of the response.
+func replaceBody(resp *http.Response, b []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.Header["Content-Length"] = []string{fmt.Sprint(len(b))}
 }
 
-func (r *rule) Labels() labels.Labels {
-	if r.alertingRule != nil {
-		return r.alertingRule.Labels
+func getAPIResponse(resp *http.Response) (*apiResponse, error) {
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
-	return r.recordingRule.Labels
-}
 
-// MarshalJSON implements the json.Marshaler interface for rule.
-func (r *rule) MarshalJSON() ([]byte, error) {
-	if r.alertingRule != nil {
-		return json.Marshal(r.alertingRule)
+	raw, err := readJSONBody(resp)
+	if err != nil {
+		return nil, err
 	}
-	return json.Marshal(r.recordingRule)
-}
 
-// UnmarshalJSON implements the json.Unmarshaler interface for rule.
-func (r *rule) UnmarshalJSON(b []byte) error {
-	var ruleType struct {
-		Type string `json:"type"`
-	}
-	if err := json.Unmarshal(b, &ruleType); err != nil {
-		return err
-	}
-	switch ruleType.Type {
-	case "alerting":
-		var alertingr alertingRule
-		if err := json.Unmarshal(b, &alertingr); err != nil {
-			return err
-		}
-		r.alertingRule = &alertingr
-	case "recording":
-		var recordingr recordingRule
-		if err := json.Unmarshal(b, &recordingr); err != nil {
-			return err
-		}
-		r.recordingRule = &recordingr
-	default:
-		return fmt.Errorf("failed to unmarshal rule: unknown type %q", ruleType.Type)
+	var apir apiResponse
+	if err := json.Unmarshal(raw, &apir); err != nil {
+		return nil, fmt.Errorf("JSON decoding error: %w", err)
 	}
 
-	return nil
-}
-
-type alertingRule struct {
-	State          string        `json:"state"`
-	Name           string        `json:"name"`
-	Query          string        `json:"query"`
-	Duration       float64       `json:"duration"`
-	KeepFiringFor  float64       `json:"keepFiringFor"`
-	Labels         labels.Labels `json:"labels"`
-	Annotations    labels.Labels `json:"annotations"`
-	Alerts         []*alert      `json:"alerts"`
-	Health         string        `json:"health"`
-	LastError      string        `json:"lastError,omitempty"`
-	EvaluationTime float64       `json:"evaluationTime"`
-	LastEvaluation time.Time     `json:"lastEvaluation"`
-	// Type of an alertingRule is always "alerting".
-	Type string `json:"type"`
-}
-
-type recordingRule struct {
-	Name           string        `json:"name"`
-	Query          string        `json:"query"`
-	Labels         labels.Labels `json:"labels,omitempty"`
-	Health         string        `json:"health"`
-	LastError      string        `json:"lastError,omitempty"`
-	EvaluationTime float64       `json:"evaluationTime"`
-	LastEvaluation time.Time     `json:"lastEvaluation"`
-	// Type of a recordingRule is always "recording".
-	Type string `json:"type"`
-}
+	if err := json.Unmarshal(raw, &apir.raw); err != nil {
+		return nil, fmt.Errorf("JSON decoding error: %w", err)
+	}
 
-type alertsData struct {
-	Alerts []*alert `json:"alerts"`
-}
+	if apir.Status != "success" {
+		return nil, fmt.Errorf("unexpected response status: %q", apir.Status)
+	}
 
-type alert struct {
-	Labels          labels.Labels `json:"labels"`
-	Annotations     labels.Labels `json:"annotations"`
-	State           string        `json:"state"`
-	ActiveAt        *time.Time    `json:"activeAt,omitempty"`
-	KeepFiringSince *time.Time    `json:"keepFiringSince,omitempty"`
-	Value           string        `json:"value"`
+	return &apir, nil
 }
 
 // errModifyResponseFailed is returned when the proxy failed to modify the
@@ -191,112 +108,297 @@ func modifyAPIResponse(f func([]string, *http.Request, *apiResponse) (interface{
 			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
 		}
 
-		b, err := json.Marshal(v)
-		if err != nil {
+		if err := apir.raw.set("data", v); err != nil {
 			return fmt.Errorf("can't encode the data: %w", err)
 		}
 
-		apir.Data = json.RawMessage(b)
-
-		var buf bytes.Buffer
-		if err = json.NewEncoder(&buf).Encode(apir); err != nil {
+		b, err := marshalJSON(apir.raw)
+		if err != nil {
 			return fmt.Errorf("can't encode the response: %w", err)
 		}
-		resp.Body = io.NopCloser(&buf)
-		resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+		replaceBody(resp, append(b, '\n'))
 
 		return nil
 	}
 }
 
-func (r *routes) filterRules(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
-	var rgs rulesData
-	if err := json.Unmarshal(resp.Data, &rgs); err != nil {
-		return nil, fmt.Errorf("can't decode rules data: %w", err)
+// removeStats removes the execution statistics from the query results.
+func removeStats(_ []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var data *rawObject
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode query data: %w", err)
+	}
+	if data == nil {
+		// "data": null
+		return resp.Data, nil
+	}
+
+	data.del(statsParam)
+
+	return data, nil
+}
+
+// removeEnforcedLabel removes the enforced label from the series of the
+// vector and matrix query results.
+func (r *routes) removeEnforcedLabel(_ []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var data struct {
+		ResultType string `json:"resultType"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode query data: %w", err)
 	}
 
+	if data.ResultType != "vector" && data.ResultType != "matrix" {
+		return resp.Data, nil
+	}
+
+	return transformJSON(
+		resp.Data,
+		[]jsonPathSegment{{key: "result", each: true}, {key: "metric"}, {key: r.label}},
+		func(o *rawObject, key string) error {
+			o.del(key)
+			return nil
+		},
+	)
+}
+
+// labelsMatcher matches label sets against the enforced labels.
+type labelsMatcher struct {
+	matchers []*labels.Matcher
+	any      bool
+}
+
+// newLabelsMatcher returns the matcher for the enforced labels of the
+// request.
+func (r *routes) newLabelsMatcher(lvalues []string, req *http.Request) (*labelsMatcher, error) {
 	m, err := r.newLabelMatcher(lvalues...)
 	if err != nil {
 		return nil, err
 	}
 
-	filtered := []*ruleGroup{}
-	for _, rg := range rgs.RuleGroups {
-		var rules []rule
-		for _, rgr := range rg.Rules {
-			if lval := rgr.Labels().Get(r.label); lval != "" && m.Matches(lval) {
-				rules = append(rules, rgr)
-				continue
-			}
+	extra, err := r.extraLabelMatchers(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	return &labelsMatcher{
+		matchers: append([]*labels.Matcher{m}, extra...),
+		any:      r.labelsMatchMode == MatchAnyLabel,
+	}, nil
+}
+
+// matches returns true if the label set matches all the enforced labels (or
+// any of them when configured with MatchAnyLabel).
+func (lm *labelsMatcher) matches(ls labels.Labels) bool {
+	for _, m := range lm.matchers {
+		lval := ls.Get(m.Name)
+		ok := lval != "" && m.Matches(lval)
+		if ok == lm.any {
+			return ok
+		}
+	}
+
+	return !lm.any
+}
+
+// ruleFilters are the filters of the /api/v1/rules endpoint implemented by
+// Prometheus. The proxy applies them to the response as well since other
+// upstreams (or older versions of Prometheus) ignore them.
+type ruleFilters struct {
+	ruleNames  map[string]struct{}
+	groupNames map[string]struct{}
+	files      map[string]struct{}
+	// typ is the type of the rules ("alerting" or "recording"), empty if
+	// not filtered.
+	typ string
+}
+
+func newRuleFilters(q url.Values) ruleFilters {
+	set := func(vals []string) map[string]struct{} {
+		if len(vals) == 0 {
+			return nil
+		}
+
+		m := make(map[string]struct{}, len(vals))
+		for _, v := range vals {
+			m[v] = struct{}{}
+		}
+		return m
+	}
+
+	f := ruleFilters{
+		ruleNames:  set(q["rule_name[]"]),
+		groupNames: set(q["rule_group[]"]),
+		files:      set(q["file[]"]),
+	}
+
+	switch strings.ToLower(q.Get("type")) {
+	case "alert":
+		f.typ = "alerting"
+	case "record":
+		f.typ = "recording"
+	}
+
+	return f
+}
+
+func inFilter(set map[string]struct{}, v string) bool {
+	if set == nil {
+		return true
+	}
+
+	_, found := set[v]
+	return found
+}
+
+func (f ruleFilters) keepGroup(rg *rawObject) bool {
+	return inFilter(f.groupNames, rg.str("name")) && inFilter(f.files, rg.str("file"))
+}
+
+func (f ruleFilters) keepRule(rgr *rawObject) bool {
+	return inFilter(f.ruleNames, rgr.str("name")) && (f.typ == "" || rgr.str("type") == f.typ)
+}
+
+// rulesFilter returns the filter of the rule groups.
+func (r *routes) rulesFilter(lvalues []string, req *http.Request) (elementFilter, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := newRuleFilters(req.URL.Query())
+
+	return func(b json.RawMessage) (json.RawMessage, error) {
+		var rg *rawObject
+		if err := json.Unmarshal(b, &rg); err != nil {
+			return nil, fmt.Errorf("can't decode rule group: %w", err)
+		}
+
+		if !rf.keepGroup(rg) {
+			return nil, nil
+		}
+
+		var rules []*rawObject
+		if err := rg.decode("rules", &rules); err != nil {
+			return nil, err
+		}
 
-			if !r.rulesWithActiveAlerts || rgr.alertingRule == nil {
+		var kept []*rawObject
+		for _, rgr := range rules {
+			if !rf.keepRule(rgr) {
 				continue
 			}
 
-			var ar *alertingRule
-			for i := range rgr.alertingRule.Alerts {
-				if lval := rgr.alertingRule.Alerts[i].Labels.Get(r.label); lval == "" || !m.Matches(lval) {
-					continue
-				}
+			ls, err := rgr.labels()
+			if err != nil {
+				return nil, err
+			}
 
-				if ar == nil {
-					ar = &alertingRule{
-						Name:           rgr.alertingRule.Name,
-						Query:          rgr.alertingRule.Query,
-						Duration:       rgr.alertingRule.Duration,
-						KeepFiringFor:  rgr.alertingRule.KeepFiringFor,
-						Labels:         rgr.alertingRule.Labels.Copy(),
-						Annotations:    rgr.alertingRule.Annotations.Copy(),
-						Health:         rgr.alertingRule.Health,
-						LastError:      rgr.alertingRule.LastError,
-						EvaluationTime: rgr.alertingRule.EvaluationTime,
-						LastEvaluation: rgr.alertingRule.LastEvaluation,
-						Type:           rgr.alertingRule.Type,
+			isAlerting := rgr.str("type") == "alerting"
+			if m.matches(ls) {
+				if isAlerting {
+					if _, err := filterRuleAlerts(rgr, m); err != nil {
+						return nil, err
 					}
 				}
+				kept = append(kept, rgr)
+				continue
+			}
 
-				ar.Alerts = append(ar.Alerts, rgr.alertingRule.Alerts[i])
-				switch ar.State {
-				case "pending":
-					if rgr.alertingRule.Alerts[i].State == "firing" {
-						ar.State = rgr.alertingRule.Alerts[i].State
-					}
-				case "":
-					ar.State = rgr.alertingRule.Alerts[i].State
-				}
+			if !r.rulesWithActiveAlerts || !isAlerting {
+				continue
 			}
 
-			if ar != nil {
-				rules = append(rules, rule{alertingRule: ar})
+			n, err := filterRuleAlerts(rgr, m)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				kept = append(kept, rgr)
 			}
 		}
 
-		if len(rules) > 0 {
-			rg.Rules = rules
-			filtered = append(filtered, rg)
+		if len(kept) == 0 {
+			return nil, nil
+		}
+
+		if err := rg.set("rules", kept); err != nil {
+			return nil, err
 		}
-	}
 
-	return &rulesData{RuleGroups: filtered}, nil
+		return marshalJSON(rg)
+	}, nil
 }
 
-func (r *routes) filterAlerts(lvalues []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
-	var data alertsData
-	if err := json.Unmarshal(resp.Data, &data); err != nil {
-		return nil, fmt.Errorf("can't decode alerts data: %w", err)
+// filterRuleAlerts removes the alerts of the alerting rule which don't match
+// the enforced labels and updates the state of the rule accordingly. It
+// returns the number of remaining alerts.
+func filterRuleAlerts(ar *rawObject, m *labelsMatcher) (int, error) {
+	var alerts []*rawObject
+	if err := ar.decode("alerts", &alerts); err != nil {
+		return 0, err
 	}
 
-	m, err := r.newLabelMatcher(lvalues...)
+	var (
+		kept  = make([]*rawObject, 0, len(alerts))
+		state = "inactive"
+	)
+	for _, a := range alerts {
+		ls, err := a.labels()
+		if err != nil {
+			return 0, err
+		}
+		if !m.matches(ls) {
+			continue
+		}
+
+		kept = append(kept, a)
+		switch s := a.str("state"); s {
+		case "firing":
+			state = s
+		case "pending":
+			if state != "firing" {
+				state = s
+			}
+		}
+	}
+
+	if len(kept) == len(alerts) {
+		return len(kept), nil
+	}
+
+	if err := ar.set("alerts", kept); err != nil {
+		return 0, err
+	}
+	if err := ar.set("state", state); err != nil {
+		return 0, err
+	}
+
+	return len(kept), nil
+}
+
+// alertsFilter returns the filter of the alerts.
+func (r *routes) alertsFilter(lvalues []string, req *http.Request) (elementFilter, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
 	if err != nil {
 		return nil, err
 	}
 
-	filtered := []*alert{}
-	for _, alert := range data.Alerts {
-		if lval := alert.Labels.Get(r.label); lval != "" && m.Matches(lval) {
-			filtered = append(filtered, alert)
+	return func(b json.RawMessage) (json.RawMessage, error) {
+		var a *rawObject
+		if err := json.Unmarshal(b, &a); err != nil {
+			return nil, fmt.Errorf("can't decode alert: %w", err)
+		}
+
+		ls, err := a.labels()
+		if err != nil {
+			return nil, err
+		}
+		if !m.matches(ls) {
+			return nil, nil
 		}
-	}
 
-	return &alertsData{Alerts: filtered}, nil
+		return b, nil
+	}, nil
 }
@@ -21,8 +21,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
 
+	"github.com/prometheus/prometheus/model/labels"
 	"gotest.tools/v3/golden"
 )
 
@@ -382,6 +384,131 @@ func validRules() http.Handler {
 	})
 }
 
+// rulesWithMixedAlerts returns an alerting rule for ns1 whose alerts belong
+// to different namespaces.
+func rulesWithMixedAlerts() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "rules": [
+          {
+            "state": "firing",
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "labels": {
+              "namespace": "ns1"
+            },
+            "annotations": {},
+            "alerts": [
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns2"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2024-04-29T12:23:52.403557247Z",
+                "value": "0e+00"
+              },
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns1"
+                },
+                "annotations": {},
+                "state": "pending",
+                "activeAt": "2024-04-29T12:23:52.403557247Z",
+                "value": "0e+00"
+              }
+            ],
+            "health": "ok",
+            "type": "alerting",
+            "evaluationTime": 0.000214303,
+            "lastEvaluation": "2024-04-29T14:23:52.403557247+02:00"
+          }
+        ],
+        "interval": 10
+      }
+    ]
+  }
+}`))
+	})
+}
+
+// rulesWithUnknownFields returns rules with fields which aren't known by the
+// proxy.
+func rulesWithUnknownFields() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "group1",
+        "file": "testdata/rules1.yml",
+        "partialResponseStrategy": "ABORT",
+        "limit": 10,
+        "rules": [
+          {
+            "state": "firing",
+            "name": "Alert1",
+            "query": "metric1 == 0",
+            "duration": 0,
+            "keepFiringFor": 300,
+            "labels": {
+              "namespace": "ns1"
+            },
+            "annotations": {},
+            "alerts": [
+              {
+                "labels": {
+                  "alertname": "Alert1",
+                  "namespace": "ns1"
+                },
+                "annotations": {},
+                "state": "firing",
+                "activeAt": "2024-04-29T12:23:52.403557247Z",
+                "keepFiringSince": "2024-04-29T12:33:52.403557247Z",
+                "value": "0e+00",
+                "partialResponseStrategy": "ABORT"
+              }
+            ],
+            "health": "ok",
+            "type": "alerting",
+            "evaluationTime": 0.000214303,
+            "lastEvaluation": "2024-04-29T14:23:52.403557247+02:00"
+          },
+          {
+            "state": "inactive",
+            "name": "Alert2",
+            "query": "metric2 == 0",
+            "duration": 0,
+            "labels": {
+              "namespace": "ns2"
+            },
+            "annotations": {},
+            "alerts": [],
+            "health": "ok",
+            "type": "alerting"
+          }
+        ],
+        "interval": 10
+      }
+    ],
+    "groupNextToken": "abc"
+  }
+}`))
+	})
+}
+
 func validAlerts() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -492,7 +619,7 @@ func TestRules(t *testing.T) {
 			golden:  "rules_no_match.golden",
 		},
 		{
-			// Gzipped response should be handled when explictly asked by the original client.
+			// Gzipped response should be handled (and compressed again) when explictly asked by the original client.
 			labelv:   []string{"not_present_gzip_requested"},
 			upstream: gzipHandler(validRules()),
 			reqHeaders: map[string][]string{
@@ -541,6 +668,31 @@ func TestRules(t *testing.T) {
 			expCode: http.StatusOK,
 			golden:  "rules_match_namespaces_ns1_and_ns2.golden",
 		},
+		{
+			// The regex is anchored.
+			labelv:   []string{"ns[12]"},
+			upstream: validRules(),
+			opts:     []Option{WithRegexMatch()},
+
+			expCode: http.StatusOK,
+			golden:  "rules_match_namespaces_ns1_and_ns2.golden",
+		},
+		{
+			labelv:   []string{"s1"},
+			upstream: validRules(),
+			opts:     []Option{WithRegexMatch()},
+
+			expCode: http.StatusOK,
+			golden:  "rules_no_match.golden",
+		},
+		{
+			labelv:   []string{"ns[3]"},
+			upstream: validRules(),
+			opts:     []Option{WithRegexMatch(), WithActiveAlerts()},
+
+			expCode: http.StatusOK,
+			golden:  "rules_with_active_alerts.golden",
+		},
 		{
 			labelv:   []string{"ns1|ns2", "ns3"},
 			upstream: validRules(),
@@ -557,6 +709,22 @@ func TestRules(t *testing.T) {
 			expCode: http.StatusOK,
 			golden:  "rules_with_active_alerts.golden",
 		},
+		{
+			// Alerts of other namespaces are removed from the rule.
+			labelv:   []string{"ns1"},
+			upstream: rulesWithMixedAlerts(),
+
+			expCode: http.StatusOK,
+			golden:  "rules_filter_alerts.golden",
+		},
+		{
+			// Fields unknown to the proxy are returned unmodified.
+			labelv:   []string{"ns1"},
+			upstream: rulesWithUnknownFields(),
+
+			expCode: http.StatusOK,
+			golden:  "rules_unknown_fields.golden",
+		},
 	} {
 		t.Run(fmt.Sprintf("%s=%s", proxyLabel, tc.labelv), func(t *testing.T) {
 			m := newMockUpstream(tc.upstream)
@@ -598,7 +766,20 @@ func TestRules(t *testing.T) {
 				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
 			}
 
-			body, err := io.ReadAll(resp.Body)
+			var rd io.Reader = resp.Body
+			if tc.reqHeaders["Accept-Encoding"] != nil {
+				// The modified response is compressed again.
+				if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+					t.Fatalf("expected gzip content encoding, got %q", enc)
+				}
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("expected no error, got %s", err)
+				}
+				rd = gz
+			}
+
+			body, err := io.ReadAll(rd)
 			if err != nil {
 				t.Fatalf("expected no error, got %s", err)
 			}
@@ -696,6 +877,23 @@ func TestAlerts(t *testing.T) {
 			expCode: http.StatusOK,
 			golden:  "alerts_match_namespaces_ns1_and_ns2.golden",
 		},
+		{
+			// The regex is anchored.
+			labelv:   []string{"ns[12]"},
+			upstream: validAlerts(),
+			opts:     []Option{WithRegexMatch()},
+
+			expCode: http.StatusOK,
+			golden:  "alerts_match_namespaces_ns1_and_ns2.golden",
+		},
+		{
+			labelv:   []string{"s1"},
+			upstream: validAlerts(),
+			opts:     []Option{WithRegexMatch()},
+
+			expCode: http.StatusOK,
+			golden:  "alerts_no_match.golden",
+		},
 		{
 			labelv:   []string{"ns1", "ns2"},
 			upstream: validAlerts(),
@@ -754,6 +952,164 @@ func TestAlerts(t *testing.T) {
 	}
 }
 
+// TestRulesPreserveBytes verifies that the parts of the response which aren't
+// filtered (including numbers which can't be represented as float64 values)
+// are returned as-is.
+func TestRulesFilterParameters(t *testing.T) {
+	const rulesResponse = `{"status":"success","data":{"groups":[` +
+		`{"name":"g1","file":"a.yml","rules":[` +
+		`{"name":"A1","type":"alerting","labels":{"namespace":"ns1","cluster":"eu"},"alerts":[]},` +
+		`{"name":"R1","type":"recording","labels":{"namespace":"ns1","cluster":"eu"}},` +
+		`{"name":"A2","type":"alerting","labels":{"namespace":"ns1","cluster":"us"},"alerts":[]},` +
+		`{"name":"A3","type":"alerting","labels":{"namespace":"ns2","cluster":"eu"},"alerts":[]}` +
+		`]},` +
+		`{"name":"g2","file":"b.yml","rules":[` +
+		`{"name":"R2","type":"recording","labels":{"namespace":"ns1","cluster":"eu"}}` +
+		`]}` +
+		`]}}`
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		opts  []Option
+
+		exp map[string][]string
+	}{
+		{
+			name: "no filter",
+			exp:  map[string][]string{"g1": {"A1", "R1", "A2"}, "g2": {"R2"}},
+		},
+		{
+			name:  "rule names",
+			query: "rule_name[]=A1&rule_name[]=R2",
+			exp:   map[string][]string{"g1": {"A1"}, "g2": {"R2"}},
+		},
+		{
+			name:  "rule groups",
+			query: "rule_group[]=g2",
+			exp:   map[string][]string{"g2": {"R2"}},
+		},
+		{
+			name:  "files",
+			query: "file[]=a.yml",
+			exp:   map[string][]string{"g1": {"A1", "R1", "A2"}},
+		},
+		{
+			name:  "alerting rules",
+			query: "type=alert",
+			exp:   map[string][]string{"g1": {"A1", "A2"}},
+		},
+		{
+			name:  "recording rules",
+			query: "type=record",
+			exp:   map[string][]string{"g1": {"R1"}, "g2": {"R2"}},
+		},
+		{
+			name:  "combined filters",
+			query: "type=record&file[]=a.yml&file[]=b.yml&rule_group[]=g2",
+			exp:   map[string][]string{"g2": {"R2"}},
+		},
+		{
+			name: "multiple enforced labels",
+			opts: []Option{WithExtraLabel("cluster", StaticLabelEnforcer{"eu"})},
+			exp:  map[string][]string{"g1": {"A1", "R1"}, "g2": {"R2"}},
+		},
+		{
+			name:  "multiple enforced labels and filters",
+			query: "type=alert",
+			opts:  []Option{WithExtraLabel("cluster", StaticLabelEnforcer{"eu"})},
+			exp:   map[string][]string{"g1": {"A1"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// The filter parameters are forwarded to the upstream.
+				q, _ := url.ParseQuery(tc.query)
+				for k, v := range q {
+					if got := req.URL.Query()[k]; !reflect.DeepEqual(got, v) {
+						prometheusAPIError(w, fmt.Sprintf("expected parameter %q with values %v, got %v", k, v, got), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(rulesResponse))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u := "http://prometheus.example.com/api/v1/rules?namespace=ns1"
+			if tc.query != "" {
+				u += "&" + tc.query
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			var resp struct {
+				Data struct {
+					Groups []struct {
+						Name  string `json:"name"`
+						Rules []struct {
+							Name string `json:"name"`
+						} `json:"rules"`
+					} `json:"groups"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := map[string][]string{}
+			for _, g := range resp.Data.Groups {
+				for _, r := range g.Rules {
+					got[g.Name] = append(got[g.Name], r.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Fatalf("expected rules %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestRulesPreserveBytes(t *testing.T) {
+	rule := func(ns string) string {
+		return `{"name":"Alert1","query":"metric1{namespace=\"` + ns + `\"} < 1.50","duration":1e+03,"labels":{"namespace":"` + ns + `"},"annotations":{"summary":"<b>&</b>"},"alerts":[],"health":"ok","type":"alerting","evaluationTime":0.00021430300000000000017,"lastEvaluation":"2024-04-29T14:23:52.403557247+02:00","x-vendor":{"b":2,"a":1,"c":12345678901234567891,"d":1e-07}}`
+	}
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"groups":[{"name":"group1","rules":[` + rule("ns1") + `,` + rule("ns2") + `],"interval":10.0}]},"infos":["foo"]}`))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/rules?namespace=ns1", nil))
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	exp := `{"status":"success","data":{"groups":[{"name":"group1","rules":[` + rule("ns1") + `],"interval":10.0}]},"infos":["foo"]}` + "\n"
+	if string(body) != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, body)
+	}
+}
+
 func normalizeAPIResponse(t *testing.T, b []byte) string {
 	t.Helper()
 	var apir apiResponse
@@ -767,3 +1123,84 @@ func normalizeAPIResponse(t *testing.T, b []byte) string {
 
 	return string(out)
 }
+
+func TestAlertsMultipleLabels(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "status": "success",
+  "data": {
+    "alerts": [
+      {"labels": {"alertname": "a", "namespace": "ns1", "cluster": "prod"}, "annotations": {}, "state": "firing", "value": "1e+00"},
+      {"labels": {"alertname": "b", "namespace": "ns1", "cluster": "dev"}, "annotations": {}, "state": "firing", "value": "1e+00"},
+      {"labels": {"alertname": "c", "namespace": "ns2", "cluster": "prod"}, "annotations": {}, "state": "firing", "value": "1e+00"},
+      {"labels": {"alertname": "d", "namespace": "ns3", "cluster": "dev"}, "annotations": {}, "state": "firing", "value": "1e+00"},
+      {"labels": {"alertname": "e", "namespace": "ns1"}, "annotations": {}, "state": "firing", "value": "1e+00"}
+    ]
+  }
+}`))
+	})
+
+	el := extraLabelEnforcer{
+		ExtractLabeler: HTTPFormEnforcer{ParameterName: proxyLabel},
+		name:           "cluster",
+		values:         []string{"prod"},
+	}
+
+	for _, tc := range []struct {
+		mode LabelsMatchMode
+
+		expAlerts []string
+	}{
+		{
+			mode:      MatchAllLabels,
+			expAlerts: []string{"a"},
+		},
+		{
+			mode:      MatchAnyLabel,
+			expAlerts: []string{"a", "b", "c", "e"},
+		},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, el, WithLabelsMatchMode(tc.mode))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/alerts?namespace=ns1", nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+			}
+
+			var apir struct {
+				Data struct {
+					Alerts []struct {
+						Labels labels.Labels `json:"labels"`
+					} `json:"alerts"`
+				} `json:"data"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []string{}
+			for _, a := range apir.Data.Alerts {
+				got = append(got, a.Labels.Get("alertname"))
+			}
+			if !reflect.DeepEqual(got, tc.expAlerts) {
+				t.Fatalf("expected alerts %v, got %v", tc.expAlerts, got)
+			}
+		})
+	}
+
+	_, err := NewRoutes(&url.URL{Scheme: "http", Host: "prometheus.example.com"}, proxyLabel, el, WithLabelsMatchMode("foo"))
+	if err == nil {
+		t.Fatal("expected error for invalid mode")
+	}
+}
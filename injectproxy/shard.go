@@ -0,0 +1,93 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// WithUpstreamShards spreads the tenants over several upstreams (e.g. one
+// Prometheus server per group of tenants): the requests of the enforced
+// routes are forwarded to the shard selected by a consistent hash of the
+// label value. The requests with several label values are rejected with 400
+// unless all the values belong to the same shard. The requests without label
+// value (e.g. the passthrough paths) and the requests for the Alertmanager
+// and rules upstreams (if configured) aren't sharded.
+func WithUpstreamShards(shards []*url.URL) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamShards = shards
+	})
+}
+
+// shardOf returns the index of the shard of the label value. The shards are
+// selected with rendezvous hashing: adding or removing a shard only moves the
+// label values from or to this shard.
+func shardOf(shards []*url.URL, value string) int {
+	var (
+		shard int
+		best  uint64
+	)
+	for i, u := range shards {
+		if score := hash64(u.String() + "\x00" + value); i == 0 || score > best {
+			shard, best = i, score
+		}
+	}
+
+	return shard
+}
+
+// selectShard stores the shard of the enforced label values in the request's
+// context.
+func (r *routes) selectShard(next http.HandlerFunc) http.HandlerFunc {
+	if len(r.upstreamShards) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		values := MustLabelValues(req.Context())
+
+		shard := shardOf(r.upstreamShards, values[0])
+		for _, v := range values[1:] {
+			if shardOf(r.upstreamShards, v) != shard {
+				prometheusAPIError(w, fmt.Sprintf("the label values %q belong to different shards", values), http.StatusBadRequest)
+				return
+			}
+		}
+
+		next(w, req.WithContext(context.WithValue(req.Context(), keyShard, shard)))
+	}
+}
+
+// shardDirector returns the director of the reverse proxy which forwards the
+// requests to their shard. The requests without shard are handled by
+// fallback.
+func shardDirector(fallback func(*http.Request), shards []*url.URL) func(*http.Request) {
+	directors := make([]func(*http.Request), len(shards))
+	for i, u := range shards {
+		directors[i] = httputil.NewSingleHostReverseProxy(u).Director
+	}
+
+	return func(req *http.Request) {
+		if shard, ok := req.Context().Value(keyShard).(int); ok {
+			directors[shard](req)
+			return
+		}
+
+		fallback(req)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithSilenceCache caches the silences fetched from Alertmanager to verify
+// the ownership of the silences updated and deleted by the clients. The
+// silences are cached for the given TTL and at most size silences are kept
+// (the least recently used are evicted first). The cached silence is
+// invalidated when a write to it succeeds.
+func WithSilenceCache(ttl time.Duration, size int) Option {
+	return optionFunc(func(o *options) {
+		o.silenceCacheTTL = ttl
+		o.silenceCacheSize = size
+	})
+}
+
+type silenceCacheEntry struct {
+	id      string
+	silence *models.GettableSilence
+	expires time.Time
+}
+
+// silenceCache is a TTL cache of silences bounded in size.
+type silenceCache struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entries at the front.
+	lru *list.List
+
+	requests *prometheus.CounterVec
+}
+
+func newSilenceCache(ttl time.Duration, size int, reg prometheus.Registerer) *silenceCache {
+	c := &silenceCache{
+		ttl:     ttl,
+		size:    max(size, 1),
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom_label_proxy_silence_cache_requests_total",
+			Help: "Total number of silence lookups by result of the cache (hit or miss).",
+		}, []string{"result"}),
+	}
+	reg.MustRegister(c.requests)
+
+	return c
+}
+
+// get returns the cached silence if it hasn't expired.
+func (c *silenceCache) get(id string) (*models.GettableSilence, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, found := c.entries[id]
+	if !found || c.now().After(e.Value.(*silenceCacheEntry).expires) {
+		c.requests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	c.requests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(e)
+
+	return e.Value.(*silenceCacheEntry).silence, true
+}
+
+// add caches the silence and evicts the least recently used silence if the
+// cache is full.
+func (c *silenceCache) add(id string, sil *models.GettableSilence) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	entry := &silenceCacheEntry{id: id, silence: sil, expires: c.now().Add(c.ttl)}
+	if e, found := c.entries[id]; found {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*silenceCacheEntry).id)
+	}
+}
+
+// invalidate removes the silence from the cache.
+func (c *silenceCache) invalidate(id string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, found := c.entries[id]; found {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+	}
+}
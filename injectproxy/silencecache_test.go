@@ -0,0 +1,120 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSilenceCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newSilenceCache(time.Minute, 2, prometheus.NewRegistry())
+	c.now = func() time.Time { return now }
+
+	id := func(s string) *models.GettableSilence { return &models.GettableSilence{ID: &s} }
+
+	c.add("a", id("a"))
+	c.add("b", id("b"))
+	if _, found := c.get("a"); !found {
+		t.Fatal("expected a to be cached")
+	}
+
+	// b is the least recently used silence.
+	c.add("c", id("c"))
+	if _, found := c.get("b"); found {
+		t.Fatal("expected b to be evicted")
+	}
+	for _, s := range []string{"a", "c"} {
+		if sil, found := c.get(s); !found || *sil.ID != s {
+			t.Fatalf("expected %s to be cached", s)
+		}
+	}
+
+	c.invalidate("a")
+	if _, found := c.get("a"); found {
+		t.Fatal("expected a to be invalidated")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, found := c.get("c"); found {
+		t.Fatal("expected c to be expired")
+	}
+}
+
+func TestDeleteSilenceWithCache(t *testing.T) {
+	var (
+		lookups    atomic.Int32
+		deleteCode atomic.Int32
+	)
+	deleteCode.Store(http.StatusInternalServerError)
+
+	get := getSilenceWithLabel("default")
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			w.WriteHeader(int(deleteCode.Load()))
+			return
+		}
+
+		lookups.Add(1)
+		get.ServeHTTP(w, req)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithSilenceCache(time.Minute, 10),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deleteSilence := func(expCode int) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "http://alertmanager.example.com/api/v2/silence/"+silID+"?"+proxyLabel+"=default", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != expCode {
+			t.Fatalf("expected status code %d, got %d: %s", expCode, w.Code, w.Body.String())
+		}
+	}
+
+	// The failed deletions don't invalidate the cache.
+	deleteSilence(http.StatusInternalServerError)
+	deleteSilence(http.StatusInternalServerError)
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+
+	deleteCode.Store(http.StatusOK)
+	deleteSilence(http.StatusOK)
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+
+	// The successful deletion invalidates the cache.
+	deleteSilence(http.StatusOK)
+	if n := lookups.Load(); n != 2 {
+		t.Fatalf("expected 2 lookups, got %d", n)
+	}
+}
@@ -17,14 +17,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/go-openapi/runtime"
 	runtimeclient "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
 	"github.com/prometheus/alertmanager/api/v2/client"
@@ -46,77 +49,130 @@ func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
 }
 
 // assertSingleLabelValue verifies that the proxy is configured to match only
-// one label value. If not, it will reply with "422 Unprocessable Content".
-func assertSingleLabelValue(next http.HandlerFunc) http.HandlerFunc {
+// one value for each enforced label. If not, it will reply with "422
+// Unprocessable Content".
+func (r *routes) assertSingleLabelValue(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		labelValues := MustLabelValues(req.Context())
-		if len(labelValues) > 1 {
-			http.Error(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
-			return
+		for _, el := range r.enforcedLabels(req.Context()) {
+			if len(el.values) > 1 {
+				prometheusAPIError(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
+				return
+			}
 		}
 
 		next(w, req)
 	}
 }
 
-// enforceFilterParameter injects a label matcher parameter into the
+// enforceFilterParameter injects the label matcher parameters into the
 // Alertmanager API's query.
 func (r *routes) enforceFilterParameter(w http.ResponseWriter, req *http.Request) {
 	var (
-		q               = req.URL.Query()
-		proxyLabelMatch labels.Matcher
+		q        = req.URL.Query()
+		enforced = r.enforcedLabels(req.Context())
+		matchers = make([]*labels.Matcher, 0, len(enforced))
 	)
 
-	if len(MustLabelValues(req.Context())) > 1 {
-		proxyLabelMatch = labels.Matcher{
-			Type:  labels.MatchRegexp,
-			Name:  r.label,
-			Value: labelValuesToRegexpString(MustLabelValues(req.Context())),
-		}
-	} else {
-		matcherType := labels.MatchEqual
-		matcherValue := MustLabelValue(req.Context())
-		if r.regexMatch {
-			compiledRegex, err := regexp.Compile(matcherValue)
-			if err != nil {
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if compiledRegex.MatchString("") {
-				prometheusAPIError(w, "Regex should not match empty string", http.StatusBadRequest)
-				return
-			}
-			matcherType = labels.MatchRegexp
-		}
-		proxyLabelMatch = labels.Matcher{
-			Type:  matcherType,
-			Name:  r.label,
-			Value: matcherValue,
+	for i, el := range enforced {
+		// Only the proxy's label is subject to regex matching.
+		m, err := alertmanagerMatcher(el, i == 0 && r.regexMatch)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		matchers = append(matchers, m)
+	}
+
+	modified, err := EnforceAlertmanagerFilters(q["filter"], matchers...)
+	if err != nil {
+		prometheusAPIError(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q["filter"] = modified
+	q.Del(r.label)
+	req.URL.RawQuery = q.Encode()
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// EnforceAlertmanagerFilters returns the values of the "filter" parameter of
+// the Alertmanager API enforcing the given matchers like the proxy does for
+// the /api/v2/alerts, /api/v2/alerts/groups and /api/v2/silences endpoints.
+// The enforced matchers come first and the filters on the enforced labels are
+// dropped, except when the enforced matcher is a regexp (e.g. for multiple
+// label values) since the filter might select a specific value.
+func EnforceAlertmanagerFilters(filters []string, matchers ...*labels.Matcher) ([]string, error) {
+	modified := make([]string, 0, len(matchers)+len(filters))
+	for _, m := range matchers {
+		modified = append(modified, m.String())
 	}
 
-	modified := []string{proxyLabelMatch.String()}
-	for _, filter := range q["filter"] {
+	for _, filter := range filters {
 		m, err := labels.ParseMatcher(filter)
 		if err != nil {
-			prometheusAPIError(w, fmt.Sprintf("bad request: can't parse filter %q: %v", filter, err), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("can't parse filter %q: %w", filter, err)
 		}
 
-		// Keep the original matcher in case of multi label values because
-		// the user might want to filter on a specific value.
-		if m.Name == r.label && proxyLabelMatch.Type != labels.MatchRegexp {
+		if i := slices.IndexFunc(matchers, func(em *labels.Matcher) bool { return em.Name == m.Name }); i >= 0 && matchers[i].Type != labels.MatchRegexp {
 			continue
 		}
 
 		modified = append(modified, filter)
 	}
 
-	q["filter"] = modified
-	q.Del(r.label)
-	req.URL.RawQuery = q.Encode()
+	return modified, nil
+}
 
-	r.handler.ServeHTTP(w, req)
+// alertmanagerMatcher returns the Alertmanager matcher enforcing the label.
+func alertmanagerMatcher(el enforcedLabel, regexMatch bool) (*labels.Matcher, error) {
+	if len(el.values) > 1 {
+		return labels.NewMatcher(labels.MatchRegexp, el.name, labelValuesToRegexpString(el.values))
+	}
+
+	matcherType := labels.MatchEqual
+	if regexMatch {
+		compiledRegex, err := regexp.Compile(el.values[0])
+		if err != nil {
+			return nil, err
+		}
+		if compiledRegex.MatchString("") {
+			return nil, errors.New("Regex should not match empty string")
+		}
+		matcherType = labels.MatchRegexp
+	}
+
+	return labels.NewMatcher(matcherType, el.name, el.values[0])
+}
+
+// WithSilenceOwnership records the identity of the requester as the creator
+// ("createdBy") of the silences which it creates or updates. The updates and
+// deletions are then restricted to the silences created by the same identity,
+// in addition to the enforced label check.
+func WithSilenceOwnership(id Identifier) Option {
+	return optionFunc(func(o *options) {
+		o.silenceOwner = id
+	})
+}
+
+// silenceCreator returns the identity of the requester when the silence
+// ownership is enabled.
+func (r *routes) silenceCreator(req *http.Request) (string, error) {
+	if r.silenceOwner == nil {
+		return "", nil
+	}
+
+	return r.silenceOwner.Identify(req)
+}
+
+// createdBy returns true if the silence ownership is disabled or if the
+// silence has been created by the given identity.
+func (r *routes) createdBy(sil *models.GettableSilence, creator string) bool {
+	if r.silenceOwner == nil {
+		return true
+	}
+
+	return sil.CreatedBy != nil && *sil.CreatedBy == creator
 }
 
 func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
@@ -125,6 +181,18 @@ func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
 		lvalue = MustLabelValue(req.Context())
 	)
 
+	enforced, err := r.enforcedSilenceMatchers(req.Context())
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	creator, err := r.silenceCreator(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
 		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
 		return
@@ -138,29 +206,20 @@ func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if !hasMatcherForLabel(existing.Matchers, r.label, lvalue) {
+		if !SilenceOwnedBy(existing, enforced) || !r.createdBy(existing, creator) {
 			prometheusAPIError(w, "forbidden", http.StatusForbidden)
 			return
 		}
 	}
 
-	var falsy bool
-	modified := models.Matchers{
-		&models.Matcher{Name: &(r.label), Value: &lvalue, IsRegex: &falsy},
-	}
-	for _, m := range sil.Matchers {
-		if m.Name != nil && *m.Name == r.label {
-			continue
-		}
-		modified = append(modified, m)
-	}
-	// At least one matcher in addition to the enforced label is required,
-	// otherwise all alerts would be silenced
-	if len(modified) < 2 {
-		prometheusAPIError(w, "need at least one matcher, got none", http.StatusBadRequest)
+	if err := EnforceSilence(&sil, enforced, r.silenceMatchers[lvalue]...); err != nil {
+		prometheusAPIError(w, "bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	sil.Matchers = modified
+
+	if r.silenceOwner != nil {
+		sil.CreatedBy = &creator
+	}
 
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(&sil); err != nil {
@@ -174,14 +233,37 @@ func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
 	req.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
 	req.ContentLength = int64(buf.Len())
 
-	r.handler.ServeHTTP(w, req)
+	r.forwardSilenceWrite(w, req, sil.ID)
+}
+
+// forwardSilenceWrite forwards the request modifying the silence and removes
+// the silence from the cache if the request succeeds.
+func (r *routes) forwardSilenceWrite(w http.ResponseWriter, req *http.Request, id string) {
+	if r.silenceCache == nil || id == "" {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	r.handler.ServeHTTP(sw, req)
+	if sw.status < http.StatusBadRequest {
+		r.silenceCache.invalidate(id)
+	}
 }
 
-// deleteSilence proxies HTTP requests to the Alertmanager /api/v2/silence/ endpoint.
+// deleteSilence proxies HTTP requests to the Alertmanager /api/v2/silence/{id} endpoint.
 func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
-	silID := strings.TrimPrefix(req.URL.Path, "/api/v2/silence/")
-	if silID == "" || silID == req.URL.Path {
-		prometheusAPIError(w, "bad request", http.StatusBadRequest)
+	silID := req.PathValue("id")
+
+	enforced, err := r.enforcedSilenceMatchers(req.Context())
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	creator, err := r.silenceCreator(req)
+	if err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
@@ -192,20 +274,177 @@ func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !hasMatcherForLabel(sil.Matchers, r.label, MustLabelValue(req.Context())) {
+	if !SilenceOwnedBy(sil, enforced) || !r.createdBy(sil, creator) {
 		prometheusAPIError(w, "forbidden", http.StatusForbidden)
 		return
 	}
 
 	req.URL.RawQuery = ""
-	r.handler.ServeHTTP(w, req)
+	r.forwardSilenceWrite(w, req, silID)
 }
 
-func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.GettableSilence, error) {
-	amc := client.New(
-		runtimeclient.New(r.upstream.Host, path.Join(r.upstream.Path, "/api/v2"), []string{r.upstream.Scheme}),
-		strfmt.Default,
+// EnforceSilence injects the enforced matchers into the silence like the proxy
+// does for the POST /api/v2/silences requests. The enforced matchers are
+// equality matchers (one per enforced label). They come first, followed by
+// the extra matchers, and the matchers of the silence on the same labels are
+// dropped.
+//
+// For an enforced regexp matcher, the matchers of the silence on the label
+// are kept instead if they select a subset of the values matched by the
+// expression: equality matchers must have a value matching the expression and
+// regexp matchers must be equal to the expression. The enforced matcher is
+// injected only if the silence has no matcher on the label.
+//
+// It returns an error if the silence has a negative matcher on an enforced
+// label or if it has no matcher besides the enforced and extra ones since it
+// would silence all the alerts of the tenant.
+func EnforceSilence(sil *models.PostableSilence, enforced []*labels.Matcher, extra ...*labels.Matcher) error {
+	var (
+		own    = map[string]models.Matchers{}
+		others models.Matchers
 	)
+	for _, m := range sil.Matchers {
+		if m.Name == nil {
+			others = append(others, m)
+			continue
+		}
+
+		if i := slices.IndexFunc(enforced, func(em *labels.Matcher) bool { return em.Name == *m.Name }); i >= 0 {
+			if !isEqualMatcher(m) {
+				return fmt.Errorf("negative matcher for the %q label isn't allowed", *m.Name)
+			}
+
+			if enforced[i].Type == labels.MatchRegexp {
+				if !matchesEnforcedRegexp(enforced[i], m) {
+					return fmt.Errorf("the matcher for the %q label doesn't match the enforced expression %q", *m.Name, enforced[i].Value)
+				}
+				own[*m.Name] = append(own[*m.Name], m)
+			}
+			continue
+		}
+
+		if hasMatcherName(extra, *m.Name) {
+			continue
+		}
+
+		others = append(others, m)
+	}
+
+	if len(others) == 0 {
+		return errors.New("need at least one matcher, got none")
+	}
+
+	modified := make(models.Matchers, 0, len(enforced)+len(extra)+len(sil.Matchers))
+	for _, m := range enforced {
+		if ms, found := own[m.Name]; found {
+			modified = append(modified, ms...)
+			continue
+		}
+		modified = append(modified, toModelMatcher(m))
+	}
+	for _, m := range extra {
+		modified = append(modified, toModelMatcher(m))
+	}
+	sil.Matchers = append(modified, others...)
+
+	return nil
+}
+
+// SilenceOwnedBy returns true if the silence belongs to the enforced
+// matchers, that is if it has a non-regexp equality matcher with the same
+// value for each enforced equality matcher and a non-negated matcher
+// selecting a subset of the values of each enforced regexp matcher (see
+// EnforceSilence). The proxy only allows tenants to update and expire the
+// silences they own.
+func SilenceOwnedBy(sil *models.GettableSilence, enforced []*labels.Matcher) bool {
+	for _, em := range enforced {
+		if !slices.ContainsFunc(sil.Matchers, func(m *models.Matcher) bool {
+			if m.Name == nil || *m.Name != em.Name || !isEqualMatcher(m) {
+				return false
+			}
+
+			if em.Type == labels.MatchRegexp {
+				return matchesEnforcedRegexp(em, m)
+			}
+
+			return m.Value != nil && *m.Value == em.Value && (m.IsRegex == nil || !*m.IsRegex)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesEnforcedRegexp returns true if the silence matcher selects a subset
+// of the values matched by the enforced regexp matcher.
+func matchesEnforcedRegexp(em *labels.Matcher, m *models.Matcher) bool {
+	if m.Value == nil {
+		return false
+	}
+
+	if m.IsRegex != nil && *m.IsRegex {
+		return *m.Value == em.Value
+	}
+
+	// The enforced matcher may not be compiled.
+	re, err := labels.NewMatcher(labels.MatchRegexp, em.Name, em.Value)
+	if err != nil {
+		return false
+	}
+
+	return re.Matches(*m.Value)
+}
+
+func (r *routes) enforcedSilenceMatchers(ctx context.Context) ([]*labels.Matcher, error) {
+	enforced := r.enforcedLabels(ctx)
+
+	ms := make([]*labels.Matcher, 0, len(enforced))
+	for i, el := range enforced {
+		m, err := alertmanagerMatcher(el, i == 0 && r.regexMatch)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
+
+// getSilenceByID returns the silence from the cache if enabled, from the
+// upstream otherwise.
+func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.GettableSilence, error) {
+	if r.silenceCache == nil {
+		return r.fetchSilence(ctx, id)
+	}
+
+	if sil, found := r.silenceCache.get(id); found {
+		return sil, nil
+	}
+
+	sil, err := r.fetchSilence(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r.silenceCache.add(id, sil)
+
+	return sil, nil
+}
+
+func (r *routes) fetchSilence(ctx context.Context, id string) (*models.GettableSilence, error) {
+	u := r.alertmanagerUpstream
+	rt := runtimeclient.New(u.Host, path.Join(u.Path, "/api/v2"), []string{u.Scheme})
+	if r.transport != nil {
+		rt.Transport = r.transport
+	}
+	if r.orgID != nil {
+		orgID := strings.Join(MustLabelValues(ctx), r.orgID.Separator)
+		rt.DefaultAuthentication = runtime.ClientAuthInfoWriterFunc(func(req runtime.ClientRequest, _ strfmt.Registry) error {
+			return req.SetHeaderParam(orgIDHeader, orgID)
+		})
+	}
+
+	amc := client.New(rt, strfmt.Default)
 	params := silence.NewGetSilenceParams().WithContext(ctx)
 	params.SetSilenceID(strfmt.UUID(id))
 	sil, err := amc.Silence.GetSilence(params)
@@ -215,11 +454,48 @@ func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.Gettabl
 	return sil.Payload, nil
 }
 
-func hasMatcherForLabel(matchers models.Matchers, name, value string) bool {
+// parseSilenceMatchers parses the additional silence matchers of the label
+// values.
+func parseSilenceMatchers(label string, matchers map[string][]string) (map[string][]*labels.Matcher, error) {
+	parsed := make(map[string][]*labels.Matcher, len(matchers))
+	for lvalue, ms := range matchers {
+		for _, s := range ms {
+			m, err := labels.ParseMatcher(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence matcher %q for %q: %w", s, lvalue, err)
+			}
+			if m.Name == label {
+				return nil, fmt.Errorf("invalid silence matcher %q for %q: the %q label is already enforced", s, lvalue, label)
+			}
+			parsed[lvalue] = append(parsed[lvalue], m)
+		}
+	}
+
+	return parsed, nil
+}
+
+func toModelMatcher(m *labels.Matcher) *models.Matcher {
+	var (
+		name    = m.Name
+		value   = m.Value
+		isRegex = m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp
+		isEqual = m.Type == labels.MatchEqual || m.Type == labels.MatchRegexp
+	)
+
+	return &models.Matcher{Name: &name, Value: &value, IsRegex: &isRegex, IsEqual: &isEqual}
+}
+
+func hasMatcherName(matchers []*labels.Matcher, name string) bool {
 	for _, m := range matchers {
-		if *m.Name == name && !*m.IsRegex && *m.Value == value {
+		if m.Name == name {
 			return true
 		}
 	}
 	return false
 }
+
+// isEqualMatcher returns true if the matcher isn't negated. The isEqual field
+// is optional and defaults to true.
+func isEqualMatcher(m *models.Matcher) bool {
+	return m.IsEqual == nil || *m.IsEqual
+}
@@ -21,10 +21,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/alertmanager/pkg/labels"
 )
 
 func TestListSilences(t *testing.T) {
@@ -80,7 +82,9 @@ func TestListSilences(t *testing.T) {
 			labelv:     []string{"tenant1-.*"},
 			regexMatch: true,
 			filters:    []string{`namespace=~"foo|default"`, `job="prometheus"`},
-			expCode:    http.StatusNotImplemented,
+			expCode:    http.StatusOK,
+			expFilters: []string{`namespace=~"tenant1-.*"`, `namespace=~"foo|default"`, `job="prometheus"`},
+			expBody:    okResponse,
 		},
 	} {
 		t.Run(strings.Join(tc.filters, "&"), func(t *testing.T) {
@@ -202,6 +206,33 @@ func getSilenceWithLabel(labelv string) http.Handler {
 	})
 }
 
+func getSilenceWithNegatedLabel(labelv string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `
+{
+  "id": "%s",
+  "status": {
+    "state": "active"
+  },
+  "updatedAt": "2020-01-15T09:06:23.419Z",
+  "comment": "comment",
+  "createdBy": "author",
+  "endsAt": "2020-02-13T13:00:02.084Z",
+  "matchers": [
+    {
+      "isEqual": false,
+      "isRegex": false,
+      "name": "%s",
+      "value": "%s"
+    }
+  ],
+  "startsAt": "2020-02-13T12:02:01.000Z"
+}
+				`, silID, proxyLabel, labelv)
+	})
+}
+
 func createSilenceWithLabel(labelv string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		var sil models.PostableSilence
@@ -256,13 +287,14 @@ func TestDeleteSilence(t *testing.T) {
 	}{
 		{
 			// No "namespace" parameter returns an error.
+			ID:      silID,
 			expCode: http.StatusBadRequest,
 		},
 		{
 			// Missing silence ID.
 			ID:      "",
 			labelv:  []string{"default"},
-			expCode: http.StatusBadRequest,
+			expCode: http.StatusNotFound,
 		},
 		{
 			// The silence doesn't exist upstream.
@@ -287,6 +319,13 @@ func TestDeleteSilence(t *testing.T) {
 			upstream: getSilenceWithLabel("not default"),
 			expCode:  http.StatusForbidden,
 		},
+		{
+			// The silence has a negative matcher for the label.
+			ID:       silID,
+			labelv:   []string{"default"},
+			upstream: getSilenceWithNegatedLabel("default"),
+			expCode:  http.StatusForbidden,
+		},
 		{
 			// The silence has the expected value for the label.
 			ID:     silID,
@@ -318,14 +357,40 @@ func TestDeleteSilence(t *testing.T) {
 		},
 		{
 			// Multiple label values are not supported.
+			ID:      silID,
 			labelv:  []string{"default", "something"},
 			expCode: http.StatusUnprocessableEntity,
 		},
 		{
-			// Regexp is not supported.
-			labelv:     []string{"default"},
+			// The silence's value for the label matches the regexp.
+			ID:         silID,
+			labelv:     []string{"def.*"},
+			regexMatch: true,
+			upstream: &chainedHandlers{
+				handlers: []http.Handler{
+					getSilenceWithLabel("default"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						w.Write([]byte("ok"))
+					}),
+				},
+			},
+			expCode: http.StatusOK,
+			expBody: []byte("ok"),
+		},
+		{
+			// The silence's value for the label doesn't match the regexp.
+			ID:         silID,
+			labelv:     []string{"def.*"},
 			regexMatch: true,
-			expCode:    http.StatusNotImplemented,
+			upstream:   getSilenceWithLabel("not default"),
+			expCode:    http.StatusForbidden,
+		},
+		{
+			// The regexp matches the empty string.
+			ID:         silID,
+			labelv:     []string{".*"},
+			regexMatch: true,
+			expCode:    http.StatusBadRequest,
 		},
 	} {
 		t.Run("", func(t *testing.T) {
@@ -376,9 +441,10 @@ func TestDeleteSilence(t *testing.T) {
 
 func TestUpdateSilence(t *testing.T) {
 	for _, tc := range []struct {
-		data     string
-		labelv   []string
-		upstream http.Handler
+		data       string
+		labelv     []string
+		upstream   http.Handler
+		regexMatch bool
 
 		expCode int
 		expBody []byte
@@ -428,6 +494,39 @@ func TestUpdateSilence(t *testing.T) {
 			expCode: http.StatusOK,
 			expBody: okResponse,
 		},
+		{
+			// Creation of a silence with a negative matcher for the label returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":false,"isEqual":false,"Name":"namespace","Value":"default"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: []string{"default"},
+
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Update of an existing silence with a negative matcher for the label is denied.
+			data: `{
+    "id":"` + silID + `",
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv:   []string{"default"},
+			upstream: getSilenceWithNegatedLabel("default"),
+
+			expCode: http.StatusForbidden,
+		},
 		{
 			// Creation of a silence without matcher returns an error.
 			data: `{
@@ -533,11 +632,69 @@ func TestUpdateSilence(t *testing.T) {
 			labelv:  []string{"default", "something"},
 			expCode: http.StatusUnprocessableEntity,
 		},
+		{
+			// Creation of a silence with a value matching the regexp is ok.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":false,"Name":"namespace","Value":"default"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv:     []string{"def.*"},
+			regexMatch: true,
+			upstream:   createSilenceWithLabel("default"),
+
+			expCode: http.StatusOK,
+			expBody: okResponse,
+		},
+		{
+			// Creation of a silence without namespace label gets the regexp.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv:     []string{"def.*"},
+			regexMatch: true,
+			upstream:   createSilenceWithLabel("def.*"),
+
+			expCode: http.StatusOK,
+			expBody: okResponse,
+		},
+		{
+			// Creation of a silence with a value not matching the regexp returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":false,"Name":"namespace","Value":"other"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv:     []string{"def.*"},
+			regexMatch: true,
+
+			expCode: http.StatusBadRequest,
+		},
 	} {
 		t.Run("", func(t *testing.T) {
 			m := newMockUpstream(tc.upstream)
 			defer m.Close()
-			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			var opts []Option
+			if tc.regexMatch {
+				opts = append(opts, WithRegexMatch())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -617,7 +774,19 @@ func TestGetAlertGroups(t *testing.T) {
 		},
 	} {
 		t.Run(strings.Join(tc.filters, "&"), func(t *testing.T) {
-			m := newMockUpstream(checkQueryHandler("", tc.queryParam, tc.expQueryValues...))
+			check := checkQueryHandler("", tc.queryParam, tc.expQueryValues...)
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				rec := httptest.NewRecorder()
+				check.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					w.WriteHeader(rec.Code)
+					w.Write(rec.Body.Bytes())
+					return
+				}
+
+				// Alert groups are returned as an array.
+				w.Write([]byte("[]"))
+			}))
 			defer m.Close()
 			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
 			if err != nil {
@@ -657,3 +826,775 @@ func TestGetAlertGroups(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterAlertGroups(t *testing.T) {
+	const groups = `[
+  {"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[
+    {"labels":{"alertname":"A","namespace":"ns1"}},
+    {"labels":{"alertname":"A","namespace":"ns2"}}
+  ]},
+  {"labels":{"alertname":"B"},"receiver":{"name":"default"},"alerts":[
+    {"labels":{"alertname":"B","namespace":"ns2"}}
+  ]},
+  {"labels":{"alertname":"C"},"receiver":{"name":"default"},"alerts":[
+    {"labels":{"alertname":"C"}}
+  ]}
+]`
+
+	for _, tc := range []struct {
+		name     string
+		labelv   []string
+		upstream string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:     "single value",
+			labelv:   []string{"ns1"},
+			upstream: groups,
+			expCode:  http.StatusOK,
+			expBody:  `[{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[{"labels":{"alertname":"A","namespace":"ns1"}}]}]`,
+		},
+		{
+			name:     "multiple values",
+			labelv:   []string{"ns1", "ns2"},
+			upstream: groups,
+			expCode:  http.StatusOK,
+			expBody:  `[{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[{"labels":{"alertname":"A","namespace":"ns1"}},{"labels":{"alertname":"A","namespace":"ns2"}}]},{"labels":{"alertname":"B"},"receiver":{"name":"default"},"alerts":[{"labels":{"alertname":"B","namespace":"ns2"}}]}]`,
+		},
+		{
+			name:     "no matching group",
+			labelv:   []string{"ns3"},
+			upstream: groups,
+			expCode:  http.StatusOK,
+			expBody:  `[]`,
+		},
+		{
+			name:     "invalid response",
+			labelv:   []string{"ns1"},
+			upstream: `{"status":"success"}`,
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.labelv}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/alerts/groups?"+q.Encode(), nil)
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body %s, got %s", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestFilterAlertGroupsMatchAnyLabel(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`[
+  {"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[
+    {"labels":{"alertname":"A","namespace":"ns1","cluster":"prod"}},
+    {"labels":{"alertname":"A","namespace":"ns1","cluster":"dev"}},
+    {"labels":{"alertname":"A","namespace":"ns2","cluster":"prod"}}
+  ]}
+]`))
+	}))
+	defer m.Close()
+
+	el := extraLabelEnforcer{
+		ExtractLabeler: HTTPFormEnforcer{ParameterName: proxyLabel},
+		name:           "cluster",
+		values:         []string{"prod"},
+	}
+	// The Alertmanager endpoints require all the labels.
+	r, err := NewRoutes(m.url, proxyLabel, el, WithLabelsMatchMode(MatchAnyLabel))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/alerts/groups?namespace=ns1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	exp := `[{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[{"labels":{"alertname":"A","namespace":"ns1","cluster":"prod"}}]}]`
+	if got := strings.TrimSpace(w.Body.String()); got != exp {
+		t.Fatalf("expected body %s, got %s", exp, got)
+	}
+}
+
+func TestReadOnlyTenants(t *testing.T) {
+	const silence = `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		data     string
+		labelv   string
+		upstream http.Handler
+		// skipInjection forwards the requests without injecting the label.
+		skipInjection bool
+
+		expCode int
+	}{
+		{
+			name:     "read-only tenant can list silences",
+			method:   http.MethodGet,
+			path:     "/api/v2/silences",
+			labelv:   "viewer",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:    "read-only tenant can't create silences",
+			method:  http.MethodPost,
+			path:    "/api/v2/silences",
+			data:    silence,
+			labelv:  "viewer",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "read-only tenant can't delete silences",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/" + silID,
+			labelv:  "viewer",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:          "read-only tenant can't create silences without label injection",
+			method:        http.MethodPost,
+			path:          "/api/v2/silences",
+			data:          silence,
+			labelv:        "viewer",
+			skipInjection: true,
+			expCode:       http.StatusForbidden,
+		},
+		{
+			name:    "read-only tenant can't post alerts",
+			method:  http.MethodPost,
+			path:    "/api/v2/alerts",
+			data:    `[{"labels":{"alertname":"foo"}}]`,
+			labelv:  "viewer",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:     "read-only tenant can list alerts",
+			method:   http.MethodGet,
+			path:     "/api/v2/alerts",
+			labelv:   "viewer",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("[]")) }),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "other tenants can create silences",
+			method:   http.MethodPost,
+			path:     "/api/v2/silences",
+			data:     silence,
+			labelv:   "default",
+			upstream: createSilenceWithLabel("default"),
+			expCode:  http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+			opts := []Option{WithReadOnlyTenants("viewer")}
+			if tc.skipInjection {
+				opts = append(opts, WithOrgIDHeader(OrgIDConfig{SkipInjection: true}))
+			}
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "http://alertmanager.example.com"+tc.path+"?"+proxyLabel+"="+tc.labelv, bytes.NewBufferString(tc.data))
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestSilenceMatchers(t *testing.T) {
+	_, err := NewRoutes(&url.URL{Scheme: "http", Host: "alertmanager.example.com"}, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithSilenceMatchers(map[string][]string{"default": {`namespace="other"`}}),
+	)
+	if err == nil {
+		t.Fatal("expected error for a matcher on the enforced label")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		matchers string
+
+		expCode     int
+		expMatchers []string
+	}{
+		{
+			name:        "matchers are appended",
+			matchers:    `{"isRegex":false,"name":"alertname","value":"foo"}`,
+			expCode:     http.StatusOK,
+			expMatchers: []string{`namespace="default"`, `cluster="prod"`, `severity=~"warning|info"`, `alertname="foo"`},
+		},
+		{
+			name:        "matchers with the same name are replaced",
+			matchers:    `{"isRegex":false,"name":"alertname","value":"foo"},{"isRegex":false,"name":"cluster","value":"dev"}`,
+			expCode:     http.StatusOK,
+			expMatchers: []string{`namespace="default"`, `cluster="prod"`, `severity=~"warning|info"`, `alertname="foo"`},
+		},
+		{
+			name:     "at least one matcher is required",
+			matchers: `{"isRegex":false,"name":"cluster","value":"dev"}`,
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var sil models.PostableSilence
+				if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
+					prometheusAPIError(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
+					return
+				}
+
+				var got []string
+				for _, m := range sil.Matchers {
+					op := "="
+					if *m.IsRegex {
+						op = "=~"
+					}
+					got = append(got, fmt.Sprintf("%s%s%q", *m.Name, op, *m.Value))
+				}
+				if !reflect.DeepEqual(got, tc.expMatchers) {
+					prometheusAPIError(w, fmt.Sprintf("expected matchers %v, got %v", tc.expMatchers, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithSilenceMatchers(map[string][]string{"default": {`cluster="prod"`, `severity=~"warning|info"`}}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			data := `{"comment":"foo","createdBy":"bar","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[` + tc.matchers + `]}`
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://alertmanager.example.com/api/v2/silences?namespace=default", bytes.NewBufferString(data)))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+// extraLabelEnforcer enforces an additional label with static values.
+type extraLabelEnforcer struct {
+	ExtractLabeler
+	name   string
+	values []string
+}
+
+func (e extraLabelEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return e.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		next(w, req.WithContext(withExtraLabelValues(req.Context(), e.name, e.values)))
+	})
+}
+
+func TestAlertmanagerMultipleLabels(t *testing.T) {
+	el := extraLabelEnforcer{
+		ExtractLabeler: HTTPFormEnforcer{ParameterName: proxyLabel},
+		name:           "cluster",
+		values:         []string{"prod"},
+	}
+
+	getSilence := func(matchers string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id":"%s","status":{"state":"active"},"updatedAt":"2020-01-15T09:06:23.419Z","comment":"comment","createdBy":"author","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01.000Z","matchers":[%s]}`, silID, matchers)
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		data     string
+		upstream http.Handler
+
+		expCode int
+	}{
+		{
+			name:   "filter parameters",
+			method: http.MethodGet,
+			path:   `/api/v2/alerts?filter=cluster="dev"&filter=foo="bar"`,
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				exp := []string{`namespace="default"`, `cluster="prod"`, `foo="bar"`}
+				if got := req.URL.Query()["filter"]; !reflect.DeepEqual(got, exp) {
+					prometheusAPIError(w, fmt.Sprintf("expected filters %v, got %v", exp, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:   "silence creation",
+			method: http.MethodPost,
+			path:   "/api/v2/silences",
+			data:   `{"comment":"foo","createdBy":"bar","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[{"isRegex":false,"name":"cluster","value":"dev"},{"isRegex":false,"name":"foo","value":"bar"}]}`,
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var sil models.PostableSilence
+				if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
+					prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				var got []string
+				for _, m := range sil.Matchers {
+					got = append(got, *m.Name+"="+*m.Value)
+				}
+				if exp := []string{"namespace=default", "cluster=prod", "foo=bar"}; !reflect.DeepEqual(got, exp) {
+					prometheusAPIError(w, fmt.Sprintf("expected matchers %v, got %v", exp, got), http.StatusInternalServerError)
+					return
+				}
+				w.Write(okResponse)
+			}),
+			expCode: http.StatusOK,
+		},
+		{
+			name:     "silence deletion without all the labels",
+			method:   http.MethodDelete,
+			path:     "/api/v2/silence/" + silID,
+			upstream: getSilence(`{"isRegex":false,"name":"namespace","value":"default"}`),
+			expCode:  http.StatusForbidden,
+		},
+		{
+			name:   "silence deletion with all the labels",
+			method: http.MethodDelete,
+			path:   "/api/v2/silence/" + silID,
+			upstream: &chainedHandlers{
+				handlers: []http.Handler{
+					getSilence(`{"isRegex":false,"name":"namespace","value":"default"},{"isRegex":false,"name":"cluster","value":"prod"}`),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }),
+				},
+			},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, el)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://alertmanager.example.com" + tc.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q.Set(proxyLabel, "default")
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, u.String(), bytes.NewBufferString(tc.data)))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestEnforceAlertmanagerFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		filters  []string
+		matchers []*labels.Matcher
+
+		exp    []string
+		expErr bool
+	}{
+		{
+			name:     "no filter",
+			matchers: []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"}},
+			exp:      []string{`namespace="ns1"`},
+		},
+		{
+			name:     "other filters",
+			filters:  []string{`job="a"`, `severity=~"critical|warning"`},
+			matchers: []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"}},
+			exp:      []string{`namespace="ns1"`, `job="a"`, `severity=~"critical|warning"`},
+		},
+		{
+			name:     "tenant filter is dropped",
+			filters:  []string{`namespace="ns2"`, `job="a"`},
+			matchers: []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"}},
+			exp:      []string{`namespace="ns1"`, `job="a"`},
+		},
+		{
+			name:     "tenant filter is kept with regexp",
+			filters:  []string{`namespace="ns2"`},
+			matchers: []*labels.Matcher{{Type: labels.MatchRegexp, Name: "namespace", Value: "ns1|ns2"}},
+			exp:      []string{`namespace=~"ns1|ns2"`, `namespace="ns2"`},
+		},
+		{
+			name:    "multiple labels",
+			filters: []string{`team="b"`},
+			matchers: []*labels.Matcher{
+				{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"},
+				{Type: labels.MatchEqual, Name: "team", Value: "a"},
+			},
+			exp: []string{`namespace="ns1"`, `team="a"`},
+		},
+		{
+			name:     "invalid filter",
+			filters:  []string{`job=~"a`},
+			matchers: []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"}},
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := EnforceAlertmanagerFilters(tc.filters, tc.matchers...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestEnforceSilence(t *testing.T) {
+	var (
+		equal = []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"}}
+		regex = []*labels.Matcher{{Type: labels.MatchRegexp, Name: "namespace", Value: "ns[12]"}}
+	)
+
+	for _, tc := range []struct {
+		name     string
+		matchers string
+		enforced []*labels.Matcher
+		extra    []*labels.Matcher
+
+		exp    string
+		expErr bool
+	}{
+		{
+			name:     "enforced matcher is added",
+			matchers: `[{"name":"job","value":"a","isRegex":false}]`,
+			exp:      `[{"isEqual":true,"isRegex":false,"name":"namespace","value":"ns1"},{"isRegex":false,"name":"job","value":"a"}]`,
+		},
+		{
+			name:     "tenant matcher is replaced",
+			matchers: `[{"name":"namespace","value":"ns2","isRegex":false},{"name":"job","value":"a","isRegex":false}]`,
+			exp:      `[{"isEqual":true,"isRegex":false,"name":"namespace","value":"ns1"},{"isRegex":false,"name":"job","value":"a"}]`,
+		},
+		{
+			name:     "extra matchers",
+			matchers: `[{"name":"env","value":"dev","isRegex":false},{"name":"job","value":"a","isRegex":false}]`,
+			extra:    []*labels.Matcher{{Type: labels.MatchEqual, Name: "env", Value: "prod"}},
+			exp:      `[{"isEqual":true,"isRegex":false,"name":"namespace","value":"ns1"},{"isEqual":true,"isRegex":false,"name":"env","value":"prod"},{"isRegex":false,"name":"job","value":"a"}]`,
+		},
+		{
+			name:     "negative tenant matcher",
+			matchers: `[{"name":"namespace","value":"ns2","isRegex":false,"isEqual":false},{"name":"job","value":"a","isRegex":false}]`,
+			expErr:   true,
+		},
+		{
+			name:     "no other matcher",
+			matchers: `[{"name":"namespace","value":"ns2","isRegex":false}]`,
+			expErr:   true,
+		},
+		{
+			name:     "regexp is added",
+			matchers: `[{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			exp:      `[{"isEqual":true,"isRegex":true,"name":"namespace","value":"ns[12]"},{"isRegex":false,"name":"job","value":"a"}]`,
+		},
+		{
+			name:     "tenant matchers matching the regexp are kept",
+			matchers: `[{"name":"job","value":"a","isRegex":false},{"name":"namespace","value":"ns2","isRegex":false},{"name":"namespace","value":"ns[12]","isRegex":true}]`,
+			enforced: regex,
+			exp:      `[{"isRegex":false,"name":"namespace","value":"ns2"},{"isRegex":true,"name":"namespace","value":"ns[12]"},{"isRegex":false,"name":"job","value":"a"}]`,
+		},
+		{
+			name:     "tenant matcher not matching the regexp",
+			matchers: `[{"name":"namespace","value":"ns3","isRegex":false},{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			expErr:   true,
+		},
+		{
+			name:     "tenant regexp matcher different from the regexp",
+			matchers: `[{"name":"namespace","value":"ns.+","isRegex":true},{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			expErr:   true,
+		},
+		{
+			name:     "negative tenant matcher with regexp",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":false,"isEqual":false},{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			expErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sil models.PostableSilence
+			if err := json.Unmarshal([]byte(`{"matchers":`+tc.matchers+`}`), &sil); err != nil {
+				t.Fatal(err)
+			}
+
+			enforced := tc.enforced
+			if enforced == nil {
+				enforced = equal
+			}
+			err := EnforceSilence(&sil, enforced, tc.extra...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := json.Marshal(sil.Matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.exp {
+				t.Fatalf("expected matchers %s, got %s", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestSilenceOwnedBy(t *testing.T) {
+	var (
+		equal = []*labels.Matcher{
+			{Type: labels.MatchEqual, Name: "namespace", Value: "ns1"},
+			{Type: labels.MatchEqual, Name: "team", Value: "a"},
+		}
+		regex = []*labels.Matcher{{Type: labels.MatchRegexp, Name: "namespace", Value: "ns[12]"}}
+	)
+
+	for _, tc := range []struct {
+		name     string
+		matchers string
+		enforced []*labels.Matcher
+
+		exp bool
+	}{
+		{
+			name:     "owned",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":false},{"name":"team","value":"a","isRegex":false,"isEqual":true},{"name":"job","value":"a","isRegex":false}]`,
+			exp:      true,
+		},
+		{
+			name:     "missing label",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":false},{"name":"job","value":"a","isRegex":false}]`,
+		},
+		{
+			name:     "other value",
+			matchers: `[{"name":"namespace","value":"ns2","isRegex":false},{"name":"team","value":"a","isRegex":false}]`,
+		},
+		{
+			name:     "regexp matcher",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":true},{"name":"team","value":"a","isRegex":false}]`,
+		},
+		{
+			name:     "negative matcher",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":false,"isEqual":false},{"name":"team","value":"a","isRegex":false}]`,
+		},
+		{
+			name:     "value matching the enforced regexp",
+			matchers: `[{"name":"namespace","value":"ns2","isRegex":false},{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			exp:      true,
+		},
+		{
+			name:     "enforced regexp",
+			matchers: `[{"name":"namespace","value":"ns[12]","isRegex":true},{"name":"job","value":"a","isRegex":false}]`,
+			enforced: regex,
+			exp:      true,
+		},
+		{
+			name:     "value not matching the enforced regexp",
+			matchers: `[{"name":"namespace","value":"ns3","isRegex":false}]`,
+			enforced: regex,
+		},
+		{
+			name:     "other regexp",
+			matchers: `[{"name":"namespace","value":"ns.+","isRegex":true}]`,
+			enforced: regex,
+		},
+		{
+			name:     "negative matcher with enforced regexp",
+			matchers: `[{"name":"namespace","value":"ns1","isRegex":false,"isEqual":false}]`,
+			enforced: regex,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sil models.GettableSilence
+			if err := json.Unmarshal([]byte(`{"matchers":`+tc.matchers+`}`), &sil); err != nil {
+				t.Fatal(err)
+			}
+
+			enforced := tc.enforced
+			if enforced == nil {
+				enforced = equal
+			}
+			if got := SilenceOwnedBy(&sil, enforced); got != tc.exp {
+				t.Fatalf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestSilenceOwnership(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		data   string
+		user   string
+
+		expCode int
+	}{
+		{
+			name:    "create silence",
+			method:  http.MethodPost,
+			path:    "/api/v2/silences",
+			data:    `{"comment":"foo","createdBy":"someone","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[{"isRegex":false,"name":"alertname","value":"foo"}]}`,
+			user:    "alice",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "create silence without identity",
+			method:  http.MethodPost,
+			path:    "/api/v2/silences",
+			data:    `{"comment":"foo","createdBy":"alice","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[{"isRegex":false,"name":"alertname","value":"foo"}]}`,
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "update own silence",
+			method:  http.MethodPost,
+			path:    "/api/v2/silences",
+			data:    `{"id":"` + silID + `","comment":"foo","createdBy":"author","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[{"isRegex":false,"name":"alertname","value":"foo"}]}`,
+			user:    "author",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "update silence of another user",
+			method:  http.MethodPost,
+			path:    "/api/v2/silences",
+			data:    `{"id":"` + silID + `","comment":"foo","createdBy":"author","endsAt":"2020-02-13T13:00:02.084Z","startsAt":"2020-02-13T12:02:01Z","matchers":[{"isRegex":false,"name":"alertname","value":"foo"}]}`,
+			user:    "alice",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "delete own silence",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/" + silID,
+			user:    "author",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "delete silence of another user",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/" + silID,
+			user:    "alice",
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			get := getSilenceWithLabel("default")
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.Method {
+				case http.MethodGet:
+					get.ServeHTTP(w, req)
+					return
+				case http.MethodPost:
+					var sil models.PostableSilence
+					if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
+						prometheusAPIError(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
+						return
+					}
+					if sil.CreatedBy == nil || *sil.CreatedBy != tc.user {
+						prometheusAPIError(w, fmt.Sprintf("expected creator %q, got %v", tc.user, sil.CreatedBy), http.StatusInternalServerError)
+						return
+					}
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithSilenceOwnership(HeaderIdentifier{Name: "X-User"}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(tc.method, "http://alertmanager.example.com"+tc.path+"?namespace=default", strings.NewReader(tc.data))
+			if tc.user != "" {
+				req.Header.Set("X-User", tc.user)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
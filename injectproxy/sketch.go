@@ -0,0 +1,164 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// hllPrecision gives a standard error of 1.04/sqrt(2^10) ~= 3%.
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+
+	// sketchBuckets is the number of sketches covering the sliding window.
+	sketchBuckets = 6
+)
+
+// hll is a HyperLogLog sketch.
+type hll [hllRegisters]uint8
+
+func (h *hll) add(x uint64) {
+	idx := x >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rho > h[idx] {
+		h[idx] = rho
+	}
+}
+
+func (h *hll) merge(o *hll) {
+	for i, r := range o {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+func (h *hll) estimate() float64 {
+	var (
+		m     = float64(hllRegisters)
+		sum   float64
+		zeros int
+	)
+	for _, r := range h {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return e
+}
+
+// hash64 returns the FNV-1a hash of the string, finalized with the
+// MurmurHash3 mixer to spread the bits evenly as required by HyperLogLog.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+// distinctCounter estimates the number of distinct values seen over a
+// sliding window. The window is split into sketchBuckets sketches which are
+// rotated as time passes so the memory usage is bounded.
+type distinctCounter struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	buckets  [sketchBuckets]hll
+	cur      int
+	start    time.Time
+
+	now func() time.Time
+}
+
+func newDistinctCounter(window time.Duration) *distinctCounter {
+	return &distinctCounter{
+		interval: window / sketchBuckets,
+		start:    time.Now(),
+		now:      time.Now,
+	}
+}
+
+// rotate drops the sketches which are older than the window.
+func (c *distinctCounter) rotate() {
+	now := c.now()
+	for i := 0; i < sketchBuckets && now.Sub(c.start) >= c.interval; i++ {
+		c.cur = (c.cur + 1) % sketchBuckets
+		c.buckets[c.cur] = hll{}
+		c.start = c.start.Add(c.interval)
+	}
+
+	if now.Sub(c.start) >= c.interval {
+		// All the sketches have been reset.
+		c.start = now
+	}
+}
+
+func (c *distinctCounter) observe(v string) {
+	x := hash64(v)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.rotate()
+	c.buckets[c.cur].add(x)
+}
+
+func (c *distinctCounter) estimate() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.rotate()
+
+	var h hll
+	for i := range c.buckets {
+		h.merge(&c.buckets[i])
+	}
+
+	return math.Round(h.estimate())
+}
+
+// observeLabelValues records the label values of the request.
+func (r *routes) observeLabelValues(next http.HandlerFunc) http.HandlerFunc {
+	if r.distinctValues == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, v := range MustLabelValues(req.Context()) {
+			r.distinctValues.observe(v)
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDistinctCounter(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 50000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			c := newDistinctCounter(time.Hour)
+			for i := 0; i < n; i++ {
+				// Duplicates don't change the estimation.
+				c.observe(fmt.Sprintf("tenant-%d", i))
+				c.observe(fmt.Sprintf("tenant-%d", i))
+			}
+
+			got := c.estimate()
+			if math.Abs(got-float64(n)) > 0.05*float64(n)+1 {
+				t.Fatalf("expected about %d, got %v", n, got)
+			}
+		})
+	}
+}
+
+func TestDistinctCounterWindow(t *testing.T) {
+	now := time.Now()
+	c := newDistinctCounter(time.Hour)
+	c.now = func() time.Time { return now }
+	c.start = now
+
+	c.observe("a")
+	c.observe("b")
+
+	now = now.Add(30 * time.Minute)
+	c.observe("c")
+	if got := c.estimate(); got != 3 {
+		t.Fatalf("expected 3, got %v", got)
+	}
+
+	// "a" and "b" are out of the window.
+	now = now.Add(40 * time.Minute)
+	if got := c.estimate(); got != 1 {
+		t.Fatalf("expected 1, got %v", got)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if got := c.estimate(); got != 0 {
+		t.Fatalf("expected 0, got %v", got)
+	}
+}
+
+func TestDistinctLabelValuesMetric(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPrometheusRegistry(reg), WithDistinctLabelValuesWindow(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, q := range []string{"namespace=ns1", "namespace=ns2&namespace=ns3", "namespace=ns1"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&"+q, nil))
+	}
+
+	exp := `
+# HELP prom_label_proxy_distinct_label_values Estimated number of distinct label values seen over the sliding window.
+# TYPE prom_label_proxy_distinct_label_values gauge
+prom_label_proxy_distinct_label_values{window="1h"} 3
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(exp), "prom_label_proxy_distinct_label_values"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	secretToken    = "<secret>"
+	tsdbStatusPath = "/api/v1/status/tsdb"
+)
+
+// statusEndpoints lists the /api/v1/status/<name> endpoints which can be
+// exposed with WithStatusEndpoints. They don't reveal information about other
+// tenants.
+var statusEndpoints = map[string]struct{}{
+	"buildinfo":   {},
+	"flags":       {},
+	"runtimeinfo": {},
+	"walreplay":   {},
+}
+
+// secretConfigKeys lists the configuration keys whose values are replaced by
+// secretToken in the /api/v1/status/config response. When the value is a
+// mapping or a sequence (e.g. HTTP headers), the whole value is replaced.
+var secretConfigKeys = map[string]struct{}{
+	"access_key":    {},
+	"bearer_token":  {},
+	"client_secret": {},
+	"credentials":   {},
+	"headers":       {},
+	"key":           {},
+	"password":      {},
+	"secret_key":    {},
+	"token":         {},
+}
+
+type configData struct {
+	YAML string `json:"yaml"`
+}
+
+// forbidden replies with "403 Forbidden" for endpoints which are explicitly
+// blocked by the proxy.
+func forbidden(w http.ResponseWriter, _ *http.Request) {
+	prometheusAPIError(w, "forbidden", http.StatusForbidden)
+}
+
+// unmatchedPathForbidden replies with "403 Forbidden" for the paths which
+// aren't handled by the proxy.
+func unmatchedPathForbidden(w http.ResponseWriter, req *http.Request) {
+	prometheusAPIError(w, fmt.Sprintf("forbidden: the %s path isn't handled by the proxy", req.URL.Path), http.StatusForbidden)
+}
+
+// filterConfig redacts the secrets from the Prometheus configuration returned
+// by the /api/v1/status/config endpoint.
+func (r *routes) filterConfig(_ []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var data configData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode config data: %w", err)
+	}
+
+	redacted, err := redactConfig(data.YAML)
+	if err != nil {
+		return nil, err
+	}
+
+	return &configData{YAML: redacted}, nil
+}
+
+// tsdbStat is an entry of the cardinality statistics returned by the
+// /api/v1/status/tsdb endpoint.
+type tsdbStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// tsdbStatusLists lists the cardinality statistics of the
+// /api/v1/status/tsdb response which can't be scoped to a tenant. They are
+// returned empty by filterTSDBStatus.
+var tsdbStatusLists = []string{
+	"seriesCountByMetricName",
+	"labelValueCountByLabelName",
+	"memoryInBytesByLabelName",
+}
+
+// filterTSDBStatus filters the cardinality statistics returned by the
+// /api/v1/status/tsdb endpoint. Only the "<label>=<value>" entries of
+// seriesCountByLabelValuePair matching the enforced label values are kept.
+func (r *routes) filterTSDBStatus(lvalues []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	m, err := r.newLabelMatcher(lvalues...)
+	if err != nil {
+		return nil, err
+	}
+
+	var o *rawObject
+	if err := json.Unmarshal(resp.Data, &o); err != nil {
+		return nil, fmt.Errorf("can't decode TSDB status data: %w", err)
+	}
+	if o == nil {
+		return resp.Data, nil
+	}
+
+	var pairs []tsdbStat
+	if err := o.decode("seriesCountByLabelValuePair", &pairs); err != nil {
+		return nil, err
+	}
+
+	filtered := []tsdbStat{}
+	for _, p := range pairs {
+		name, value, found := strings.Cut(p.Name, "=")
+		if found && name == m.Name && m.Matches(value) {
+			filtered = append(filtered, p)
+		}
+	}
+	if err := o.set("seriesCountByLabelValuePair", filtered); err != nil {
+		return nil, err
+	}
+
+	for _, k := range tsdbStatusLists {
+		if err := o.set(k, []tsdbStat{}); err != nil {
+			return nil, err
+		}
+	}
+
+	// The head stats (number of series, chunks, ...) cover the whole TSDB.
+	o.del("headStats")
+
+	return o, nil
+}
+
+func redactConfig(s string) (string, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(s), &n); err != nil {
+		return "", fmt.Errorf("can't decode the configuration: %w", err)
+	}
+
+	redactSecrets(&n)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&n); err != nil {
+		return "", fmt.Errorf("can't encode the configuration: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+func redactSecrets(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		for _, c := range n.Content {
+			redactSecrets(c)
+		}
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if _, found := secretConfigKeys[k.Value]; !found {
+			redactSecrets(v)
+			continue
+		}
+
+		if v.Kind == yaml.ScalarNode && v.Value == "" {
+			continue
+		}
+
+		n.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: secretToken}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const prometheusConfig = `global:
+  scrape_interval: 15s
+scrape_configs:
+  - job_name: prometheus
+    basic_auth:
+      username: admin
+      password: s3cr3t
+    static_configs:
+      - targets: ["localhost:9090"]
+  - job_name: node
+    authorization:
+      type: Bearer
+      credentials: t0k3n
+    bearer_token_file: /etc/token
+remote_write:
+  - url: http://remote.example.com
+    headers:
+      X-Api-Key: k3y
+    oauth2:
+      client_id: foo
+      client_secret: b4r
+`
+
+func validConfig() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]string{"yaml": prometheusConfig},
+		})
+	})
+}
+
+func TestStatusConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCode int
+	}{
+		{
+			name:    "blocked by default",
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "redacted",
+			opts:    []Option{WithRedactedConfigAPI()},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(validConfig())
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/status/config?namespace=ns1", nil)
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var apir struct {
+				Data configData `json:"data"`
+			}
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, secret := range []string{"s3cr3t", "t0k3n", "k3y", "b4r"} {
+				if strings.Contains(apir.Data.YAML, secret) {
+					t.Fatalf("expected secret %q to be redacted, got:\n%s", secret, apir.Data.YAML)
+				}
+			}
+
+			for _, s := range []string{"username: admin", "client_id: foo", "bearer_token_file: /etc/token", "password: <secret>"} {
+				if !strings.Contains(apir.Data.YAML, s) {
+					t.Fatalf("expected %q in the configuration, got:\n%s", s, apir.Data.YAML)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusEndpoints(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStatusEndpoints("flags", "tsdb"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStatusEndpoints("flags", "walreplay"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url     string
+		expCode int
+	}{
+		{
+			url:     "http://prometheus.example.com/api/v1/status/flags?namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			url:     "http://prometheus.example.com/api/v1/status/walreplay?namespace=ns1",
+			expCode: http.StatusOK,
+		},
+		{
+			// Missing label value.
+			url:     "http://prometheus.example.com/api/v1/status/flags",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			url:     "http://prometheus.example.com/api/v1/status/runtimeinfo?namespace=ns1",
+			expCode: http.StatusNotFound,
+		},
+		{
+			url:     "http://prometheus.example.com/api/v1/status/tsdb?namespace=ns1",
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+
+			if resp := w.Result(); resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+		})
+	}
+}
+
+const tsdbStatus = `{"status":"success","data":{` +
+	`"headStats":{"numSeries":6,"numLabelPairs":12,"chunkCount":6,"minTime":1,"maxTime":2},` +
+	`"seriesCountByMetricName":[{"name":"up","value":3},{"name":"secret_metric","value":3}],` +
+	`"labelValueCountByLabelName":[{"name":"namespace","value":3}],` +
+	`"memoryInBytesByLabelName":[{"name":"__name__","value":120}],` +
+	`"seriesCountByLabelValuePair":[{"name":"namespace=ns1","value":3},{"name":"namespace=ns2","value":2},{"name":"job=namespace=ns1","value":1},{"name":"namespace=ns3","value":1}]}}`
+
+func TestTSDBStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		opts   []Option
+
+		expCode int
+		expData string
+	}{
+		{
+			name:    "blocked by default",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "passthrough path",
+			labelv:  []string{"ns1"},
+			opts:    []Option{WithPassthroughPaths([]string{"/api/v1/status/tsdb"})},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "filtered",
+			labelv:  []string{"ns1"},
+			opts:    []Option{WithFilteredTSDBStatus()},
+			expCode: http.StatusOK,
+			expData: `{"seriesCountByMetricName":[],"labelValueCountByLabelName":[],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[{"name":"namespace=ns1","value":3}]}`,
+		},
+		{
+			name:    "filtered with multiple label values",
+			labelv:  []string{"ns1", "ns3"},
+			opts:    []Option{WithFilteredTSDBStatus()},
+			expCode: http.StatusOK,
+			expData: `{"seriesCountByMetricName":[],"labelValueCountByLabelName":[],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[{"name":"namespace=ns1","value":3},{"name":"namespace=ns3","value":1}]}`,
+		},
+		{
+			name:    "filtered with regex match",
+			labelv:  []string{"ns[12]"},
+			opts:    []Option{WithFilteredTSDBStatus(), WithRegexMatch()},
+			expCode: http.StatusOK,
+			expData: `{"seriesCountByMetricName":[],"labelValueCountByLabelName":[],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[{"name":"namespace=ns1","value":3},{"name":"namespace=ns2","value":2}]}`,
+		},
+		{
+			name:    "missing label value",
+			opts:    []Option{WithFilteredTSDBStatus()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tsdbStatus))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/status/tsdb?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expData == "" {
+				return
+			}
+
+			var apir struct {
+				Data json.RawMessage `json:"data"`
+			}
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(apir.Data) != tc.expData {
+				t.Fatalf("expected data:\n%s\ngot:\n%s", tc.expData, string(apir.Data))
+			}
+		})
+	}
+}
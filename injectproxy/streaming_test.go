@@ -0,0 +1,221 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgradeHandler switches to the "echo" protocol and sends back the lines
+// written by the client.
+func echoUpgradeHandler(t *testing.T, expQuery string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if q := req.URL.Query().Get("query"); q != expQuery {
+			http.Error(w, fmt.Sprintf("expected query %q, got %q", expQuery, q), http.StatusBadRequest)
+			return
+		}
+
+		if req.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "missing upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("can't hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+
+		_, _ = io.Copy(conn, brw)
+	})
+}
+
+func TestProtocolUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "access log",
+			opts: []Option{WithAccessLog(AccessLogConfig{})},
+		},
+		{
+			name: "audit log",
+			opts: []Option{WithAuditLogger(newTestAuditLogger(t, &bufferAuditSink{}))},
+		},
+		{
+			name: "query coalescing and ETags",
+			opts: []Option{WithQueryCoalescing(), WithETags()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(echoUpgradeHandler(t, `{app="foo",namespace="ns1"}`))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				append([]Option{WithBackend(BackendLoki)}, tc.opts...)...,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+`/loki/api/v1/tail?query={app="foo"}&namespace=ns1`, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "echo")
+			if err := req.Write(conn); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusSwitchingProtocols, resp.StatusCode, string(b))
+			}
+
+			for _, msg := range []string{"hello\n", "world\n"} {
+				if _, err := io.WriteString(conn, msg); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				got, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != msg {
+					t.Fatalf("expected %q, got %q", msg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		opts        []Option
+	}{
+		{
+			name:        "chunked response",
+			contentType: "application/json",
+		},
+		{
+			name:        "server-sent events with ETags",
+			contentType: "text/event-stream",
+			opts:        []Option{WithETags()},
+		},
+		{
+			name:        "flush interval",
+			contentType: "application/json",
+			opts:        []Option{WithFlushInterval(10 * time.Millisecond)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				_, _ = io.WriteString(w, "first\n")
+				_ = http.NewResponseController(w).Flush()
+
+				// The rest of the response is only sent once the client
+				// received the first chunk.
+				select {
+				case <-release:
+				case <-time.After(5 * time.Second):
+				}
+				_, _ = io.WriteString(w, "second\n")
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				append([]Option{WithBackend(BackendLoki)}, tc.opts...)...,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + `/loki/api/v1/query_range?query={app="foo"}&namespace=ns1`)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			br := bufio.NewReader(resp.Body)
+			read := make(chan string)
+			go func() {
+				l, _ := br.ReadString('\n')
+				read <- l
+			}()
+
+			select {
+			case l := <-read:
+				if l != "first\n" {
+					t.Fatalf("expected %q, got %q", "first\n", l)
+				}
+			case <-time.After(time.Second):
+				close(release)
+				t.Fatal("the first chunk wasn't flushed")
+			}
+			close(release)
+
+			rest, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(rest) != "second\n" {
+				t.Fatalf("expected %q, got %q", "second\n", string(rest))
+			}
+		})
+	}
+}
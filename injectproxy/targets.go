@@ -0,0 +1,58 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// filterTargets removes the active targets whose labels don't match the
+// enforced label values and the dropped targets whose discovered labels
+// don't match them.
+func (r *routes) filterTargets(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := filterJSONArray(resp.Data, []string{"activeTargets"}, func(t *rawObject) bool {
+		return m.matches(labelsAt(t, []string{"labels"}))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = filterJSONArray(data, []string{"droppedTargets"}, func(t *rawObject) bool {
+		return m.matches(labelsAt(t, []string{"discoveredLabels"}))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var o *rawObject
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("can't decode targets data: %w", err)
+	}
+	if o == nil {
+		return data, nil
+	}
+
+	// The number of dropped targets per scrape pool isn't scoped to the
+	// tenant.
+	o.del("droppedTargetCounts")
+
+	return o, nil
+}
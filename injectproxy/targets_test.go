@@ -0,0 +1,123 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTargets(t *testing.T) {
+	const targets = `{"status":"success","data":{` +
+		`"activeTargets":[` +
+		`{"discoveredLabels":{"__address__":"a:9090"},"labels":{"job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"},` +
+		`{"discoveredLabels":{"__address__":"b:9090"},"labels":{"job":"b","namespace":"ns2"},"scrapePool":"b","health":"up"}` +
+		`],` +
+		`"droppedTargets":[` +
+		`{"discoveredLabels":{"__address__":"c:9090","job":"c","namespace":"ns1"}},` +
+		`{"discoveredLabels":{"__address__":"d:9090","job":"d"}}` +
+		`],` +
+		`"droppedTargetCounts":{"c":1,"d":1}}}`
+
+	for _, tc := range []struct {
+		name     string
+		upstream string
+		url      string
+		opts     []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:     "single label value",
+			upstream: targets,
+			url:      "/api/v1/targets?namespace=ns1",
+			expCode:  http.StatusOK,
+			expBody: `{"status":"success","data":{` +
+				`"activeTargets":[{"discoveredLabels":{"__address__":"a:9090"},"labels":{"job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"}],` +
+				`"droppedTargets":[{"discoveredLabels":{"__address__":"c:9090","job":"c","namespace":"ns1"}}]}}`,
+		},
+		{
+			name:     "multiple label values",
+			upstream: targets,
+			url:      "/api/v1/targets?namespace=ns1&namespace=ns2",
+			expCode:  http.StatusOK,
+			expBody: `{"status":"success","data":{` +
+				`"activeTargets":[{"discoveredLabels":{"__address__":"a:9090"},"labels":{"job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"},{"discoveredLabels":{"__address__":"b:9090"},"labels":{"job":"b","namespace":"ns2"},"scrapePool":"b","health":"up"}],` +
+				`"droppedTargets":[{"discoveredLabels":{"__address__":"c:9090","job":"c","namespace":"ns1"}}]}}`,
+		},
+		{
+			name:     "regex match",
+			upstream: targets,
+			url:      "/api/v1/targets?namespace=ns.*",
+			opts:     []Option{WithRegexMatch()},
+			expCode:  http.StatusOK,
+			expBody: `{"status":"success","data":{` +
+				`"activeTargets":[{"discoveredLabels":{"__address__":"a:9090"},"labels":{"job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"},{"discoveredLabels":{"__address__":"b:9090"},"labels":{"job":"b","namespace":"ns2"},"scrapePool":"b","health":"up"}],` +
+				`"droppedTargets":[{"discoveredLabels":{"__address__":"c:9090","job":"c","namespace":"ns1"}}]}}`,
+		},
+		{
+			name:     "no matching target",
+			upstream: targets,
+			url:      "/api/v1/targets?namespace=ns3",
+			expCode:  http.StatusOK,
+			expBody:  `{"status":"success","data":{"activeTargets":[],"droppedTargets":[]}}`,
+		},
+		{
+			name:     "active targets only",
+			upstream: `{"status":"success","data":{"activeTargets":[{"labels":{"job":"a","namespace":"ns1"}},{"labels":{"job":"b"}}]}}`,
+			url:      "/api/v1/targets?namespace=ns1&state=active",
+			expCode:  http.StatusOK,
+			expBody:  `{"status":"success","data":{"activeTargets":[{"labels":{"job":"a","namespace":"ns1"}}]}}`,
+		},
+		{
+			name:     "invalid response",
+			upstream: `{"status":"success","data":{"activeTargets":1}}`,
+			url:      "/api/v1/targets?namespace=ns1",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v1/targets",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// storeMatchersParam is the Thanos Querier parameter selecting the stores
+// by their external labels.
+const storeMatchersParam = "storeMatch[]"
+
+// EnforceStoreMatchValues enforces the label matchers in the "storeMatch[]"
+// selectors of the Thanos Querier: the label matchers are appended to each
+// selector. Contrary to "match[]", no selector is added when the parameter
+// is missing since the Querier selects all the stores in this case. The
+// values are modified in place.
+func EnforceStoreMatchValues(e *PromQLEnforcer, v url.Values) error {
+	selectors := v[storeMatchersParam]
+	for i, s := range selectors {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrQueryParse, err)
+		}
+
+		selectors[i] = matchersToString(append(ms, e.matchers()...)...)
+	}
+
+	return nil
+}
+
+// filterStores removes the label sets of the Thanos stores which don't match
+// the enforced label values and the stores without matching label set.
+func (r *routes) filterStores(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+	m, err := r.newLabelsMatcher(lvalues, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var data *rawObject
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode stores data: %w", err)
+	}
+	if data == nil {
+		return resp.Data, nil
+	}
+
+	// The data maps the store types (e.g. "sidecar") to the stores.
+	for _, k := range data.keys {
+		var keepErr error
+		stores, err := filterJSONArray(data.values[k], nil, func(s *rawObject) bool {
+			var labelSets []labels.Labels
+			if err := s.decode("labelSets", &labelSets); err != nil {
+				keepErr = err
+				return false
+			}
+
+			filtered := []labels.Labels{}
+			for _, ls := range labelSets {
+				if m.matches(ls) {
+					filtered = append(filtered, ls)
+				}
+			}
+			if len(filtered) == 0 {
+				return false
+			}
+
+			if err := s.set("labelSets", filtered); err != nil {
+				keepErr = err
+				return false
+			}
+
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if keepErr != nil {
+			return nil, keepErr
+		}
+
+		data.setRaw(k, stores)
+	}
+
+	return data, nil
+}
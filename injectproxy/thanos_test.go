@@ -0,0 +1,200 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStoreMatch(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		url      string
+		body     url.Values
+		upstream http.Handler
+
+		expCode int
+	}{
+		{
+			name:     "query without storeMatch",
+			url:      "/api/v1/query?query=up&namespace=ns1&dedup=true&partial_response=false",
+			upstream: checkQueryHandler("", storeMatchersParam),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query with storeMatch",
+			url:      "/api/v1/query?query=up&namespace=ns1&" + url.Values{storeMatchersParam: []string{`{cluster="a"}`, `{cluster="b"}`}}.Encode(),
+			upstream: checkQueryHandler("", storeMatchersParam, `{cluster="a",namespace="ns1"}`, `{cluster="b",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query with multiple label values",
+			url:      "/api/v1/query_range?query=up&namespace=ns1&namespace=ns2&" + url.Values{storeMatchersParam: []string{`{cluster="a"}`}}.Encode(),
+			upstream: checkQueryHandler("", storeMatchersParam, `{cluster="a",namespace=~"ns1|ns2"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "POST query with storeMatch",
+			method:   http.MethodPost,
+			url:      "/api/v1/query?namespace=ns1",
+			body:     url.Values{queryParam: []string{"up"}, storeMatchersParam: []string{`{cluster="a"}`}},
+			upstream: checkFormHandler(storeMatchersParam, `{cluster="a",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "series with storeMatch",
+			url:      "/api/v1/series?namespace=ns1&" + url.Values{matchersParam: []string{"up"}, storeMatchersParam: []string{`{cluster="a"}`}}.Encode(),
+			upstream: checkQueryHandler("", storeMatchersParam, `{cluster="a",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "POST series with storeMatch",
+			method:   http.MethodPost,
+			url:      "/api/v1/series?namespace=ns1",
+			body:     url.Values{matchersParam: []string{"up"}, storeMatchersParam: []string{`{cluster="a"}`}},
+			upstream: checkFormHandler(storeMatchersParam, `{cluster="a",namespace="ns1"}`),
+			expCode:  http.StatusOK,
+		},
+		{
+			name:    "invalid storeMatch",
+			url:     "/api/v1/query?query=up&namespace=ns1&" + url.Values{storeMatchersParam: []string{`{cluster=}`}}.Encode(),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := tc.upstream
+			if upstream == nil {
+				upstream = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					http.Error(w, "unexpected request", http.StatusTeapot)
+				})
+			}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithBackend(BackendThanos))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "http://thanos.example.com"+tc.url, strings.NewReader(tc.body.Encode()))
+			if tc.body != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStores(t *testing.T) {
+	const stores = `{"status":"success","data":{` +
+		`"sidecar":[` +
+		`{"name":"a:10901","labelSets":[{"cluster":"a","namespace":"ns1"}]},` +
+		`{"name":"b:10901","labelSets":[{"cluster":"b","namespace":"ns2"}]}` +
+		`],` +
+		`"store":[` +
+		`{"name":"c:10901","labelSets":[{"namespace":"ns1"},{"namespace":"ns2"}]},` +
+		`{"name":"d:10901","labelSets":[]}` +
+		`]}}`
+
+	for _, tc := range []struct {
+		name     string
+		upstream string
+		url      string
+		opts     []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:     "single label value",
+			upstream: stores,
+			url:      "/api/v1/stores?namespace=ns1",
+			opts:     []Option{WithBackend(BackendThanos)},
+			expCode:  http.StatusOK,
+			expBody: `{"status":"success","data":{` +
+				`"sidecar":[{"name":"a:10901","labelSets":[{"cluster":"a","namespace":"ns1"}]}],` +
+				`"store":[{"name":"c:10901","labelSets":[{"namespace":"ns1"}]}]}}`,
+		},
+		{
+			name:     "multiple label values",
+			upstream: stores,
+			url:      "/api/v1/stores?namespace=ns1&namespace=ns2",
+			opts:     []Option{WithBackend(BackendThanos)},
+			expCode:  http.StatusOK,
+			expBody: `{"status":"success","data":{` +
+				`"sidecar":[{"name":"a:10901","labelSets":[{"cluster":"a","namespace":"ns1"}]},{"name":"b:10901","labelSets":[{"cluster":"b","namespace":"ns2"}]}],` +
+				`"store":[{"name":"c:10901","labelSets":[{"namespace":"ns1"},{"namespace":"ns2"}]}]}}`,
+		},
+		{
+			name:     "no matching store",
+			upstream: stores,
+			url:      "/api/v1/stores?namespace=ns3",
+			opts:     []Option{WithBackend(BackendThanos)},
+			expCode:  http.StatusOK,
+			expBody:  `{"status":"success","data":{"sidecar":[],"store":[]}}`,
+		},
+		{
+			name:     "invalid response",
+			upstream: `{"status":"success","data":{"sidecar":[{"name":"a:10901","labelSets":1}]}}`,
+			url:      "/api/v1/stores?namespace=ns1",
+			opts:     []Option{WithBackend(BackendThanos)},
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "not a Thanos backend",
+			upstream: stores,
+			url:      "/api/v1/stores?namespace=ns1",
+			expCode:  http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://thanos.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
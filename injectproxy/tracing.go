@@ -0,0 +1,135 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/prometheus-community/prom-label-proxy/injectproxy"
+
+	// Names of the spans covering the processing stages of the requests.
+	spanEnforce        = "enforce"
+	spanRewrite        = "rewrite"
+	spanModifyResponse = "modify response"
+)
+
+// WithTracerProvider instruments the proxy with OpenTelemetry: the requests
+// get a server span with child spans for the enforcement of the label values
+// ("enforce"), the rewriting of the request ("rewrite"), the upstream call
+// and the modification of the response ("modify response"). The W3C trace
+// context of the incoming requests is propagated to the upstream.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return optionFunc(func(o *options) {
+		o.tracerProvider = tp
+	})
+}
+
+// The baggage isn't propagated by the tracing instrumentation since the
+// header is forwarded as-is (or modified by WithTenantBaggage).
+var tracePropagator = propagation.TraceContext{}
+
+// traceHandler returns the handler creating the server spans.
+func (r *routes) traceHandler(next http.Handler, tp trace.TracerProvider) http.Handler {
+	return otelhttp.NewHandler(next, "prom-label-proxy",
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithPropagators(tracePropagator),
+	)
+}
+
+// traceTransport returns the round-tripper creating the client spans of the
+// upstream calls and injecting the trace context.
+func traceTransport(rt http.RoundTripper, tp trace.TracerProvider) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithPropagators(tracePropagator),
+	)
+}
+
+// stage holds the span of the current processing stage of a request.
+type stage struct {
+	span trace.Span
+}
+
+// end ends the span of the current stage (if any).
+func (s *stage) end() {
+	if s.span != nil {
+		s.span.End()
+		s.span = nil
+	}
+}
+
+// traceStage ends the span of the previous stage and starts a new span for
+// the given stage. The span ends when the next stage starts, when the request
+// is sent to the upstream or when the handler returns.
+func (r *routes) traceStage(name string, next http.HandlerFunc) http.HandlerFunc {
+	if r.tracer == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		s, ok := req.Context().Value(keyStage).(*stage)
+		if !ok {
+			s = &stage{}
+			req = req.WithContext(context.WithValue(req.Context(), keyStage, s))
+		}
+
+		s.end()
+		// The stage spans aren't stored in the context so that the upstream
+		// call is a child of the server span.
+		_, s.span = r.tracer.Start(req.Context(), name)
+		defer s.end()
+
+		next(w, req)
+	}
+}
+
+// endStage ends the span of the current stage when the request is sent to the
+// upstream.
+func endStage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s, ok := req.Context().Value(keyStage).(*stage); ok {
+			s.end()
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// traceLabelValues records the enforced label values in the server span.
+func (r *routes) traceLabelValues(next http.HandlerFunc) http.HandlerFunc {
+	if r.tracer == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		trace.SpanFromContext(req.Context()).SetAttributes(
+			attribute.String("prom_label_proxy.label", r.label),
+			attribute.StringSlice("prom_label_proxy.label_values", MustLabelValues(req.Context())),
+		)
+
+		next(w, req)
+	}
+}
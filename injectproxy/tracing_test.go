@@ -0,0 +1,111 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	const (
+		traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+		traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+	)
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		upstream string
+
+		expCode     int
+		expSpans    []string
+		expUpstream bool
+	}{
+		{
+			name:        "query",
+			url:         "/api/v1/query?query=up&namespace=ns1",
+			upstream:    `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			expCode:     http.StatusOK,
+			expSpans:    []string{spanEnforce, spanRewrite, "HTTP GET", "prom-label-proxy"},
+			expUpstream: true,
+		},
+		{
+			name:        "modified response",
+			url:         "/api/v1/rules?namespace=ns1",
+			upstream:    `{"status":"success","data":{"groups":[]}}`,
+			expCode:     http.StatusOK,
+			expSpans:    []string{spanEnforce, spanRewrite, spanModifyResponse, "HTTP GET", "prom-label-proxy"},
+			expUpstream: true,
+		},
+		{
+			name:     "missing label value",
+			url:      "/api/v1/query?query=up",
+			expCode:  http.StatusBadRequest,
+			expSpans: []string{spanEnforce, "prom-label-proxy"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var upstreamTraceparent string
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				upstreamTraceparent = req.Header.Get("Traceparent")
+				w.Write([]byte(tc.upstream))
+			}))
+			defer m.Close()
+
+			sr := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithTracerProvider(tp))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			req.Header.Set("Traceparent", traceparent)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			var names []string
+			for _, s := range sr.Ended() {
+				names = append(names, s.Name())
+				if got := s.SpanContext().TraceID().String(); got != traceID {
+					t.Fatalf("expected span %q to have trace ID %s, got %s", s.Name(), traceID, got)
+				}
+			}
+			slices.Sort(names)
+			exp := slices.Clone(tc.expSpans)
+			slices.Sort(exp)
+			if !slices.Equal(names, exp) {
+				t.Fatalf("expected spans %v, got %v", exp, names)
+			}
+
+			if !tc.expUpstream {
+				return
+			}
+			if len(upstreamTraceparent) != len(traceparent) || upstreamTraceparent[3:35] != traceID {
+				t.Fatalf("expected the trace context to be propagated to the upstream, got %q", upstreamTraceparent)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TransformAction is the action of a response transformation.
+type TransformAction string
+
+const (
+	// TransformDelete removes the field.
+	TransformDelete TransformAction = "delete"
+	// TransformRename renames the field (e.g. a label name).
+	TransformRename TransformAction = "rename"
+	// TransformRedact replaces the value of the field.
+	TransformRedact TransformAction = "redact"
+)
+
+// ResponseTransform is a declarative modification of the JSON responses of a
+// route.
+type ResponseTransform struct {
+	Action TransformAction
+	// Path is the dot-separated path of the field. A key followed by "[]"
+	// selects all the items of the array (e.g. "data.result[].metric.pod").
+	Path string
+	// To is the new name of the field for the rename action.
+	To string
+	// Value replaces the value of the field for the redact action. The
+	// default value is "<secret>".
+	Value string
+}
+
+// WithResponseTransforms applies the given transformations to the JSON
+// responses of the routes. The map's keys are the route paths. The
+// transformations run in order after the response filtering (if any).
+func WithResponseTransforms(transforms map[string][]ResponseTransform) Option {
+	return optionFunc(func(o *options) {
+		o.responseTransforms = transforms
+	})
+}
+
+// jsonPathSegment is a key of a transformation path.
+type jsonPathSegment struct {
+	key string
+	// each is true if the transformation applies to all the items of the
+	// array.
+	each bool
+}
+
+func parseTransformPath(p string) ([]jsonPathSegment, error) {
+	if p == "" {
+		return nil, errors.New("empty path")
+	}
+
+	var segs []jsonPathSegment
+	for _, s := range strings.Split(p, ".") {
+		seg := jsonPathSegment{key: strings.TrimSuffix(s, "[]")}
+		seg.each = seg.key != s
+		if seg.key == "" {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+		segs = append(segs, seg)
+	}
+
+	if segs[len(segs)-1].each {
+		return nil, fmt.Errorf("invalid path %q: the last key can't select array items", p)
+	}
+
+	return segs, nil
+}
+
+// transformer is a compiled response transformation.
+type transformer struct {
+	path []jsonPathSegment
+	f    func(o *rawObject, key string) error
+}
+
+func newTransformer(t ResponseTransform) (*transformer, error) {
+	path, err := parseTransformPath(t.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &transformer{path: path}
+	switch t.Action {
+	case TransformDelete:
+		tr.f = func(o *rawObject, key string) error {
+			o.del(key)
+			return nil
+		}
+	case TransformRename:
+		if t.To == "" {
+			return nil, fmt.Errorf("path %q: the rename action requires the new name", t.Path)
+		}
+		tr.f = func(o *rawObject, key string) error {
+			o.rename(key, t.To)
+			return nil
+		}
+	case TransformRedact:
+		value := t.Value
+		if value == "" {
+			value = secretToken
+		}
+		tr.f = func(o *rawObject, key string) error {
+			if _, found := o.values[key]; !found {
+				return nil
+			}
+			return o.set(key, value)
+		}
+	default:
+		return nil, fmt.Errorf("path %q: unsupported action %q", t.Path, t.Action)
+	}
+
+	return tr, nil
+}
+
+// apply runs the transformation on the JSON value.
+func (tr *transformer) apply(raw json.RawMessage) (json.RawMessage, error) {
+	return transformJSON(raw, tr.path, tr.f)
+}
+
+// transformJSON calls f with the object holding the last key of the path.
+// The values outside of the path are left untouched.
+func transformJSON(raw json.RawMessage, path []jsonPathSegment, f func(*rawObject, string) error) (json.RawMessage, error) {
+	var o *rawObject
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return nil, fmt.Errorf("can't decode %q: %w", path[0].key, err)
+	}
+	if o == nil {
+		return raw, nil
+	}
+
+	seg := path[0]
+	if len(path) == 1 {
+		if err := f(o, seg.key); err != nil {
+			return nil, err
+		}
+		return marshalJSON(o)
+	}
+
+	v, found := o.values[seg.key]
+	if !found {
+		return raw, nil
+	}
+
+	var err error
+	if seg.each {
+		var items []json.RawMessage
+		if err := json.Unmarshal(v, &items); err != nil {
+			return nil, fmt.Errorf("can't decode %q: %w", seg.key, err)
+		}
+
+		for i := range items {
+			if items[i], err = transformJSON(items[i], path[1:], f); err != nil {
+				return nil, err
+			}
+		}
+
+		if items != nil {
+			if v, err = marshalJSON(items); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if v, err = transformJSON(v, path[1:], f); err != nil {
+			return nil, err
+		}
+	}
+	o.setRaw(seg.key, v)
+
+	return marshalJSON(o)
+}
+
+// transformResponse returns a response modifier which applies the
+// transformations.
+func transformResponse(trs []*transformer) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			// Pass non-200 responses as-is.
+			return nil
+		}
+
+		raw, err := readJSONBody(resp)
+		if err != nil {
+			return fmt.Errorf("can't decode the response: %w", err)
+		}
+
+		for _, tr := range trs {
+			if raw, err = tr.apply(raw); err != nil {
+				return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+			}
+		}
+
+		replaceBody(resp, append(raw, '\n'))
+
+		return nil
+	}
+}
+
+// chainModifiers returns a response modifier which runs the modifiers in
+// order.
+func chainModifiers(modifiers ...func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, m := range modifiers {
+			if m == nil {
+				continue
+			}
+			if err := m(resp); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseTransforms(t *testing.T) {
+	const result = `{"status":"success","data":{"resultType":"vector","result":[` +
+		`{"metric":{"__name__":"up","namespace":"ns1","pod":"a","ip":"10.0.0.1"},"value":[1,"1"]},` +
+		`{"metric":{"__name__":"up","namespace":"ns1","pod":"b"},"value":[1,"0"]}` +
+		`],"stats":{"timings":{}}}}`
+
+	for _, tc := range []struct {
+		name       string
+		opts       []Option
+		transforms map[string][]ResponseTransform
+
+		expBody string
+		expCode int
+		expErr  bool
+	}{
+		{
+			name: "delete",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformDelete, Path: "data.result[].metric.ip"}},
+			},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod":"a"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod":"b"},"value":[1,"0"]}` +
+				`],"stats":{"timings":{}}}}`,
+		},
+		{
+			name: "rename",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformRename, Path: "data.result[].metric.pod", To: "pod_name"}},
+			},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod_name":"a","ip":"10.0.0.1"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod_name":"b"},"value":[1,"0"]}` +
+				`],"stats":{"timings":{}}}}`,
+		},
+		{
+			name: "redact",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {
+					{Action: TransformRedact, Path: "data.result[].metric.ip"},
+					{Action: TransformRedact, Path: "data.resultType", Value: "hidden"},
+				},
+			},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"resultType":"hidden","result":[` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod":"a","ip":"<secret>"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up","namespace":"ns1","pod":"b"},"value":[1,"0"]}` +
+				`],"stats":{"timings":{}}}}`,
+		},
+		{
+			name: "after the built-in modifiers",
+			opts: []Option{WithoutQueryStats()},
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformDelete, Path: "data.result"}},
+			},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"resultType":"vector"}}`,
+		},
+		{
+			name: "missing field",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformDelete, Path: "data.foo.bar"}},
+			},
+			expCode: http.StatusOK,
+			expBody: result,
+		},
+		{
+			name: "not an array",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformDelete, Path: "data.resultType[].foo"}},
+			},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name: "unknown route",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/foo": {{Action: TransformDelete, Path: "data"}},
+			},
+			expErr: true,
+		},
+		{
+			name: "unsupported action",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: "replace", Path: "data"}},
+			},
+			expErr: true,
+		},
+		{
+			name: "rename without name",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformRename, Path: "data"}},
+			},
+			expErr: true,
+		},
+		{
+			name: "invalid path",
+			transforms: map[string][]ResponseTransform{
+				"/api/v1/query": {{Action: TransformDelete, Path: "data.result[]"}},
+			},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(result))
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithResponseTransforms(tc.transforms))...)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
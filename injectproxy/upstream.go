@@ -0,0 +1,312 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessPaths are the upstream endpoints which are probed to check that
+// the upstream is ready. The readiness endpoint is implemented by Prometheus,
+// Thanos and Alertmanager while the build information endpoint is also
+// available for backends served under a path prefix (e.g. Mimir).
+var readinessPaths = []string{"/-/ready", "/api/v1/status/buildinfo"}
+
+// upstreamCheckInterval is the delay between 2 attempts of CheckUpstream.
+var upstreamCheckInterval = time.Second
+
+// WithUpstreamTransport configures the transport of the requests sent to the
+// upstream (e.g. with the TLS configuration of an HTTPS upstream).
+// http.DefaultTransport is used by default.
+func WithUpstreamTransport(rt http.RoundTripper) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamTransport = rt
+	})
+}
+
+// WithAlertmanagerUpstream forwards the requests for the Alertmanager API
+// (/api/v2/) to the given upstream instead of the default one. The
+// Alertmanager routes are registered even if the backend doesn't support
+// them.
+func WithAlertmanagerUpstream(u *url.URL) Option {
+	return optionFunc(func(o *options) {
+		o.alertmanagerUpstream = u
+	})
+}
+
+// WithRulesUpstream forwards the requests for the /api/v1/rules and
+// /api/v1/alerts endpoints to the given upstream (e.g. Thanos Ruler) instead
+// of the default one.
+func WithRulesUpstream(u *url.URL) Option {
+	return optionFunc(func(o *options) {
+		o.rulesUpstream = u
+	})
+}
+
+// upstreamDirector returns the director of the reverse proxy which selects
+// the upstream from the request's path and from the shard of the label
+// values (if any). A nil upstream falls back to the default one.
+func upstreamDirector(upstream, alertmanager, rules *url.URL, shards []*url.URL) func(*http.Request) {
+	defaultDirector := httputil.NewSingleHostReverseProxy(upstream).Director
+	if len(shards) > 0 {
+		defaultDirector = shardDirector(defaultDirector, shards)
+	}
+
+	director := func(u *url.URL) func(*http.Request) {
+		if u == nil {
+			return defaultDirector
+		}
+		return httputil.NewSingleHostReverseProxy(u).Director
+	}
+
+	var (
+		alertmanagerDirector = director(alertmanager)
+		rulesDirector        = director(rules)
+	)
+
+	return func(req *http.Request) {
+		switch p := req.URL.Path; {
+		case strings.HasPrefix(p, "/api/v2/"):
+			alertmanagerDirector(req)
+		case p == "/api/v1/rules" || p == "/api/v1/alerts":
+			rulesDirector(req)
+		default:
+			defaultDirector(req)
+		}
+	}
+}
+
+// TransportConfig configures the connections to the upstream. The zero values
+// keep the settings of http.DefaultTransport.
+type TransportConfig struct {
+	// TLSConfig is the TLS configuration of an HTTPS upstream.
+	TLSConfig *tls.Config
+	// MaxIdleConns is the maximum number of idle connections.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections to the
+	// upstream. The default value (http.DefaultMaxIdleConnsPerHost) is too
+	// low for proxies under heavy load: the connections exceeding it are
+	// closed after each request.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections to the upstream
+	// (including the active ones). Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout is the duration after which the idle connections are
+	// closed.
+	IdleConnTimeout time.Duration
+	// DialTimeout is the maximum duration to establish a TCP connection.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the maximum duration of the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// DisableKeepAlives closes the connections after each request.
+	DisableKeepAlives bool
+	// DisableHTTP2 prevents the use of HTTP/2 with HTTPS upstreams.
+	DisableHTTP2 bool
+}
+
+// NewUpstreamTransport returns the transport of the upstream requests
+// configured with cfg. It can be passed to WithUpstreamTransport.
+func NewUpstreamTransport(cfg TransportConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.TLSConfig != nil {
+		t.TLSClientConfig = cfg.TLSConfig
+	}
+	if cfg.MaxIdleConns > 0 {
+		t.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.DialTimeout > 0 {
+		// Same keep-alive period as http.DefaultTransport.
+		d := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+		t.DialContext = d.DialContext
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	t.DisableKeepAlives = cfg.DisableKeepAlives
+	if cfg.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil empty map disables HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if t.TLSClientConfig != nil {
+			// The upstream mustn't negotiate HTTP/2 with ALPN.
+			t.TLSClientConfig = t.TLSClientConfig.Clone()
+			t.TLSClientConfig.NextProtos = slices.DeleteFunc(slices.Clone(t.TLSClientConfig.NextProtos), func(p string) bool { return p == "h2" })
+		}
+	}
+
+	return t
+}
+
+// WithFlushInterval configures the interval between the flushes of the
+// response body to the client while the upstream response is copied. A
+// negative value flushes after each write. By default, the responses with an
+// unknown length (e.g. chunked query_range responses) and the server-sent
+// events are flushed immediately while the others are buffered.
+func WithFlushInterval(d time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.flushInterval = d
+	})
+}
+
+// CheckUpstream verifies that the upstream is reachable and ready to serve
+// requests. It retries until the context is done and returns the last error
+// if the upstream never responded successfully.
+func CheckUpstream(ctx context.Context, client *http.Client, upstream *url.URL) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var lastErr error
+	for {
+		err := checkUpstream(ctx, client, upstream)
+		if err == nil {
+			return nil
+		}
+
+		// Report the error of the previous attempt if the current one was
+		// interrupted because the context is done.
+		if ctx.Err() == nil || lastErr == nil {
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(upstreamCheckInterval):
+		}
+	}
+}
+
+// errNotProbed is the readiness error of UpstreamProber until the first probe
+// completes.
+var errNotProbed = errors.New("upstream not probed yet")
+
+// UpstreamProber checks periodically that the upstream is reachable and ready
+// to serve requests.
+type UpstreamProber struct {
+	client   *http.Client
+	upstream *url.URL
+	interval time.Duration
+
+	mtx sync.RWMutex
+	err error
+}
+
+// NewUpstreamProber returns a prober checking the upstream at the given
+// interval. The upstream isn't ready until the first probe succeeds.
+func NewUpstreamProber(client *http.Client, upstream *url.URL, interval time.Duration) *UpstreamProber {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &UpstreamProber{
+		client:   client,
+		upstream: upstream,
+		interval: interval,
+		err:      errNotProbed,
+	}
+}
+
+// Run probes the upstream until the context is done.
+func (p *UpstreamProber) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, p.interval)
+		err := checkUpstream(probeCtx, p.client, p.upstream)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.mtx.Lock()
+		p.err = err
+		p.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready returns the error of the last probe (nil if the upstream is ready).
+func (p *UpstreamProber) Ready() error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.err
+}
+
+func checkUpstream(ctx context.Context, client *http.Client, upstream *url.URL) error {
+	var errs []error
+	for _, p := range readinessPaths {
+		u := *upstream
+		u.Path = strings.TrimSuffix(u.Path, "/") + p
+
+		err := probe(ctx, client, u.String())
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return fmt.Errorf("upstream %s isn't ready: %w", upstream.Redacted(), errors.Join(errs...))
+}
+
+func probe(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("GET %s: unexpected status code %d: %q", req.URL.Redacted(), resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,553 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckUpstream(t *testing.T) {
+	upstreamCheckInterval = 10 * time.Millisecond
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		upstream http.HandlerFunc
+
+		expErr string
+	}{
+		{
+			name: "ready",
+			upstream: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/-/ready" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte("Prometheus Server is Ready.\n"))
+			},
+		},
+		{
+			name: "build information with path prefix",
+			path: "/prometheus",
+			upstream: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/prometheus/api/v1/status/buildinfo" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(`{"status":"success","data":{}}`))
+			},
+		},
+		{
+			name: "not ready",
+			upstream: func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			},
+			expErr: `unexpected status code 503: "Service Unavailable"`,
+		},
+		{
+			name:   "unreachable",
+			expErr: "upstream http://127.0.0.1:1 isn't ready",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, _ := url.Parse("http://127.0.0.1:1")
+			if tc.upstream != nil {
+				srv := httptest.NewServer(tc.upstream)
+				defer srv.Close()
+
+				u, _ = url.Parse(srv.URL + tc.path)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := CheckUpstream(ctx, nil, u)
+			if tc.expErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), tc.expErr) {
+				t.Fatalf("expected error containing %q, got %q", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckUpstreamRetries(t *testing.T) {
+	upstreamCheckInterval = 10 * time.Millisecond
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/-/ready" || calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := CheckUpstream(ctx, nil, u); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 calls, got %d", got)
+	}
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet && req.URL.Path == "/api/v2/silence/"+silID {
+			getSilenceWithLabel("default").ServeHTTP(w, req)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+		path   string
+
+		expCode int
+	}{
+		{
+			name:    "default transport",
+			path:    "/api/v1/query?query=up&namespace=default",
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:    "query",
+			opts:    []Option{WithUpstreamTransport(srv.Client().Transport)},
+			path:    "/api/v1/query?query=up&namespace=default",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "delete silence with default transport",
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/" + silID + "?namespace=default",
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:    "delete silence",
+			opts:    []Option{WithUpstreamTransport(srv.Client().Transport)},
+			method:  http.MethodDelete,
+			path:    "/api/v2/silence/" + silID + "?namespace=default",
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, "http://prometheus.example.com"+tc.path, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewUpstreamTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proto", req.Proto)
+		w.Header().Set("X-Close", fmt.Sprint(req.Close))
+		w.Write(okResponse)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, tc := range []struct {
+		name string
+		cfg  TransportConfig
+
+		expProto string
+		expClose string
+	}{
+		{
+			name:     "defaults",
+			cfg:      TransportConfig{TLSConfig: tlsConfig},
+			expProto: "HTTP/2.0",
+			expClose: "false",
+		},
+		{
+			name: "connection pooling",
+			cfg: TransportConfig{
+				TLSConfig:           tlsConfig,
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 10,
+				MaxConnsPerHost:     20,
+				IdleConnTimeout:     time.Minute,
+				DialTimeout:         time.Second,
+				TLSHandshakeTimeout: time.Second,
+			},
+			expProto: "HTTP/2.0",
+			expClose: "false",
+		},
+		{
+			name:     "HTTP/2 disabled",
+			cfg:      TransportConfig{TLSConfig: tlsConfig, DisableHTTP2: true},
+			expProto: "HTTP/1.1",
+			expClose: "false",
+		},
+		{
+			name:     "keep-alives disabled",
+			cfg:      TransportConfig{TLSConfig: tlsConfig, DisableHTTP2: true, DisableKeepAlives: true},
+			expProto: "HTTP/1.1",
+			expClose: "true",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamTransport(NewUpstreamTransport(tc.cfg)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("X-Proto"); got != tc.expProto {
+				t.Fatalf("expected protocol %q, got %q", tc.expProto, got)
+			}
+			if got := w.Header().Get("X-Close"); got != tc.expClose {
+				t.Fatalf("expected connection close %q, got %q", tc.expClose, got)
+			}
+		})
+	}
+
+	t.Run("pool settings", func(t *testing.T) {
+		tr := NewUpstreamTransport(TransportConfig{MaxIdleConnsPerHost: 50, IdleConnTimeout: time.Minute})
+		if tr.MaxIdleConnsPerHost != 50 {
+			t.Fatalf("expected 50 idle connections per host, got %d", tr.MaxIdleConnsPerHost)
+		}
+		if tr.IdleConnTimeout != time.Minute {
+			t.Fatalf("expected idle timeout %v, got %v", time.Minute, tr.IdleConnTimeout)
+		}
+
+		def := http.DefaultTransport.(*http.Transport)
+		if tr.MaxIdleConns != def.MaxIdleConns || tr.TLSHandshakeTimeout != def.TLSHandshakeTimeout {
+			t.Fatalf("expected the default settings to be kept")
+		}
+	})
+}
+
+func TestUpstreamProber(t *testing.T) {
+	var ready atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/-/ready" || !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	p := NewUpstreamProber(nil, u, 10*time.Millisecond)
+	if err := p.Ready(); err == nil {
+		t.Fatal("expected error before the first probe, got none")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(expReady bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			err := p.Ready()
+			if expReady && err == nil {
+				return
+			}
+			// The upstream must have been probed.
+			if !expReady && err != nil && strings.Contains(err.Error(), "503") {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("expected ready=%v, got error %v", expReady, p.Ready())
+	}
+
+	waitFor(false)
+	ready.Store(true)
+	waitFor(true)
+	ready.Store(false)
+	waitFor(false)
+}
+
+func TestMultipleUpstreams(t *testing.T) {
+	newUpstream := func(name string) *mockUpstream {
+		return newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case strings.HasPrefix(req.URL.Path, "/api/v2/"):
+				w.Write([]byte(`[]`))
+			case req.URL.Path == "/api/v1/rules":
+				w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+			default:
+				w.Write(okResponse)
+			}
+		}))
+	}
+
+	prometheus := newUpstream("prometheus")
+	defer prometheus.Close()
+	alertmanager := newUpstream("alertmanager")
+	defer alertmanager.Close()
+	ruler := newUpstream("ruler")
+	defer ruler.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		url  string
+
+		expUpstream string
+	}{
+		{
+			name:        "query with a single upstream",
+			url:         "/api/v1/query?query=up&namespace=ns1",
+			expUpstream: "prometheus",
+		},
+		{
+			name:        "alerts with a single upstream",
+			url:         "/api/v2/alerts?namespace=ns1",
+			expUpstream: "prometheus",
+		},
+		{
+			name:        "query",
+			opts:        []Option{WithAlertmanagerUpstream(alertmanager.url), WithRulesUpstream(ruler.url)},
+			url:         "/api/v1/query?query=up&namespace=ns1",
+			expUpstream: "prometheus",
+		},
+		{
+			name:        "Alertmanager alerts",
+			opts:        []Option{WithAlertmanagerUpstream(alertmanager.url), WithRulesUpstream(ruler.url)},
+			url:         "/api/v2/alerts?namespace=ns1",
+			expUpstream: "alertmanager",
+		},
+		{
+			name:        "rules",
+			opts:        []Option{WithAlertmanagerUpstream(alertmanager.url), WithRulesUpstream(ruler.url)},
+			url:         "/api/v1/rules?namespace=ns1",
+			expUpstream: "ruler",
+		},
+		{
+			name:        "rules without ruler upstream",
+			opts:        []Option{WithAlertmanagerUpstream(alertmanager.url)},
+			url:         "/api/v1/rules?namespace=ns1",
+			expUpstream: "prometheus",
+		},
+		{
+			name:        "Alertmanager routes added to the backend",
+			opts:        []Option{WithBackend(BackendPrometheus), WithAlertmanagerUpstream(alertmanager.url)},
+			url:         "/api/v2/alerts?namespace=ns1",
+			expUpstream: "alertmanager",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(prometheus.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("X-Upstream"); got != tc.expUpstream {
+				t.Fatalf("expected upstream %q, got %q", tc.expUpstream, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamShards(t *testing.T) {
+	newUpstream := func(name string) *mockUpstream {
+		return newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("Content-Type", "application/json")
+			if req.URL.Path == "/api/v1/rules" {
+				w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+				return
+			}
+			w.Write(okResponse)
+		}))
+	}
+
+	prometheus := newUpstream("prometheus")
+	defer prometheus.Close()
+	ruler := newUpstream("ruler")
+	defer ruler.Close()
+
+	var shards []*url.URL
+	for i := range 3 {
+		m := newUpstream(fmt.Sprintf("shard-%d", i))
+		defer m.Close()
+		shards = append(shards, m.url)
+	}
+
+	// Find label values belonging to different shards.
+	values := make([]string, len(shards))
+	for i := 0; slices.Contains(values, ""); i++ {
+		v := fmt.Sprintf("ns%d", i)
+		if s := shardOf(shards, v); values[s] == "" {
+			values[s] = v
+		}
+	}
+
+	r, err := NewRoutes(prometheus.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithUpstreamShards(shards),
+		WithRulesUpstream(ruler.url),
+		WithPassthroughPaths([]string{"/api/v1/status/buildinfo"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		url  string
+
+		expCode     int
+		expUpstream string
+	}{
+		{
+			name:        "first shard",
+			url:         "/api/v1/query?query=up&namespace=" + values[0],
+			expCode:     http.StatusOK,
+			expUpstream: "shard-0",
+		},
+		{
+			name:        "last shard",
+			url:         "/api/v1/series?match[]=up&namespace=" + values[2],
+			expCode:     http.StatusOK,
+			expUpstream: "shard-2",
+		},
+		{
+			name:        "multiple label values of the same shard",
+			url:         "/api/v1/query?query=up&namespace=" + values[1] + "&namespace=" + values[1],
+			expCode:     http.StatusOK,
+			expUpstream: "shard-1",
+		},
+		{
+			name:    "multiple label values of different shards",
+			url:     "/api/v1/query?query=up&namespace=" + values[0] + "&namespace=" + values[1],
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:        "rules upstream",
+			url:         "/api/v1/rules?namespace=" + values[0],
+			expCode:     http.StatusOK,
+			expUpstream: "ruler",
+		},
+		{
+			name:        "passthrough path",
+			url:         "/api/v1/status/buildinfo",
+			expCode:     http.StatusOK,
+			expUpstream: "prometheus",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("X-Upstream"); got != tc.expUpstream {
+				t.Fatalf("expected upstream %q, got %q", tc.expUpstream, got)
+			}
+		})
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	var shards []*url.URL
+	for i := range 4 {
+		shards = append(shards, &url.URL{Scheme: "http", Host: fmt.Sprintf("prometheus-%d:9090", i)})
+	}
+
+	counts := make([]int, len(shards))
+	for i := range 1000 {
+		v := fmt.Sprintf("ns%d", i)
+		s := shardOf(shards, v)
+		counts[s]++
+
+		// Removing the last shard only moves its label values.
+		if s != len(shards)-1 && shardOf(shards[:len(shards)-1], v) != s {
+			t.Fatalf("label value %q moved to another shard", v)
+		}
+	}
+
+	for i, c := range counts {
+		if c < 150 {
+			t.Fatalf("expected an even distribution, shard %d got %d label values out of 1000", i, c)
+		}
+	}
+}
@@ -15,18 +15,27 @@ package injectproxy
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 )
 
+// prometheusAPIError replies with the error message in the Prometheus API
+// format, or in the Alertmanager API format when configured for the request
+// (see WithErrorFormat). The failures to write the error are logged by the
+// logger of the routes (see WithLogger).
 func prometheusAPIError(w http.ResponseWriter, errorMessage string, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
 
-	res := map[string]string{"status": "error", "errorType": "prom-label-proxy", "error": errorMessage}
+	format, logger := responseAPIErrors(w)
+
+	var res interface{} = map[string]string{"status": "error", "errorType": "prom-label-proxy", "error": errorMessage}
+	if format == ErrorFormatAlertmanager {
+		// The Alertmanager API v2 returns the error message as a JSON string.
+		res = errorMessage
+	}
 
 	if err := json.NewEncoder(w).Encode(res); err != nil {
-		log.Printf("error: Failed to encode json: %v", err)
+		logger.Error("Failed to encode JSON", "err", err)
 	}
 }
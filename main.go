@@ -14,23 +14,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/metalmatze/signal/internalserver"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/prometheus-community/prom-label-proxy/injectproxy"
 )
@@ -53,67 +64,682 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// parseLabelFlag parses the definition of an additional enforced label.
+func parseLabelFlag(s string) (labelConfig, error) {
+	name, source, found := strings.Cut(s, "=")
+	if !found {
+		return labelConfig{Name: name}, nil
+	}
+
+	typ, value, _ := strings.Cut(source, ":")
+	if value == "" {
+		return labelConfig{}, fmt.Errorf("%q: missing value for the %q source", s, typ)
+	}
+
+	switch typ {
+	case "header":
+		return labelConfig{Name: name, Header: value}, nil
+	case "query":
+		return labelConfig{Name: name, QueryParam: value}, nil
+	case "static":
+		return labelConfig{Name: name, Values: strings.Split(value, ",")}, nil
+	}
+
+	return labelConfig{}, fmt.Errorf("%q: unknown value source %q, expected one of 'header', 'query' or 'static'", s, typ)
+}
+
+// checkRegexMatch verifies the static label value used as a regular
+// expression.
+func checkRegexMatch(values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	if len(values) > 1 {
+		return errors.New("regex match is limited to one label value")
+	}
+
+	compiledRegex, err := regexp.Compile(values[0])
+	if err != nil {
+		return fmt.Errorf("invalid regexp: %w", err)
+	}
+
+	if compiledRegex.MatchString("") {
+		return errors.New("regex should not match empty string")
+	}
+
+	return nil
+}
+
+// tlsVersions maps the values of the -tls-min-version flag to the TLS
+// versions.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// clientCertificateFields are the supported values of the
+// -tls-client-cert-label flag.
+var clientCertificateFields = []injectproxy.ClientCertificateField{
+	injectproxy.ClientCertificateCommonName,
+	injectproxy.ClientCertificateDNSNames,
+	injectproxy.ClientCertificateEmailAddresses,
+	injectproxy.ClientCertificateURIs,
+}
+
+// upstreamTLSConfig returns the TLS configuration of the upstream requests
+// or nil if none is set.
+func upstreamTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverName}
+
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in the CA file %q", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both -upstream-cert-file and -upstream-key-file must be set")
+		}
+
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{c}
+	}
+
+	return tlsConfig, nil
+}
+
+// newTracerProvider returns the tracer provider exporting the spans to the
+// OTLP/HTTP collector.
+func newTracerProvider(endpoint string, insecure bool, ratio float64) (*sdktrace.TracerProvider, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid -tracing-sampling-ratio flag %v, expected a value between 0 and 1", ratio)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	// The exporter connects lazily to the collector.
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "prom-label-proxy"))),
+	), nil
+}
+
+// newLogger returns the structured logger writing to the standard error.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level flag %q, expected one of 'debug', 'info', 'warn' or 'error'", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+
+	return nil, fmt.Errorf("invalid -log-format flag %q, expected one of 'logfmt' or 'json'", format)
+}
+
+// fatal logs the error message and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// addServer adds the actor running the HTTP server to the group. When the
+// group is interrupted, the server stops accepting new connections and waits
+// at most drainTimeout for the in-flight requests to complete before closing
+// the remaining connections.
+func addServer(g *run.Group, logger *slog.Logger, srv *http.Server, drainTimeout time.Duration, serve func() error) {
+	drained := make(chan struct{})
+	g.Add(func() error {
+		if err := serve(); err != nil {
+			return err
+		}
+
+		<-drained
+		return nil
+	}, func(error) {
+		// The interrupt functions are called one after the other, the
+		// servers are drained concurrently.
+		go func() {
+			defer close(drained)
+
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				if drainTimeout > 0 {
+					logger.Warn("Closing the connections with in-flight requests", "err", err)
+				}
+				srv.Close()
+			}
+		}()
+	})
+}
+
+// lastAuditHash verifies the chain of the existing audit log with the key and
+// returns the hash of its last record (empty if the file doesn't exist).
+func lastAuditHash(filename string, key []byte) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	return injectproxy.VerifyAuditLog(f, key)
+}
+
+// aclIdentifier returns the identifier of the clients for the label ACL.
+func aclIdentifier(s string) (injectproxy.Identifier, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "header":
+		if arg == "" {
+			return nil, errors.New("missing header name")
+		}
+		return injectproxy.HeaderIdentifier{Name: http.CanonicalHeaderKey(arg)}, nil
+	case "jwt-sub":
+		return injectproxy.JWTSubjectIdentifier{Header: arg}, nil
+	case "cert-cn":
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		return injectproxy.ClientCertificateIdentifier{}, nil
+	}
+
+	return nil, fmt.Errorf("invalid identity %q, expected 'header:<name>', 'jwt-sub', 'jwt-sub:<header>' or 'cert-cn'", s)
+}
+
+// adminIdentifier returns the identifier of the administrators for the admin
+// bypass. The JWT claims require the key verifying the signature of the
+// tokens.
+func adminIdentifier(s string, jwtKey []byte) (injectproxy.Identifier, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "secret-header":
+		if arg == "" {
+			return nil, errors.New("missing header name")
+		}
+		return injectproxy.SecretHeaderIdentifier{Name: http.CanonicalHeaderKey(arg)}, nil
+	case "jwt-claim":
+		claim, header, _ := strings.Cut(arg, ":")
+		if claim == "" {
+			return nil, errors.New("missing claim name")
+		}
+		if len(jwtKey) == 0 {
+			return nil, errors.New("the JWT claims require -admin-bypass-jwt-key-file to verify the tokens")
+		}
+		return injectproxy.JWTClaimIdentifier{Claim: claim, Header: header, Key: jwtKey}, nil
+	case "cert-cn":
+		return aclIdentifier(s)
+	}
+
+	return nil, fmt.Errorf("invalid identity %q, expected 'secret-header:<name>', 'jwt-claim:<claim>', 'jwt-claim:<claim>:<header>' or 'cert-cn'", s)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == promQLEnforceCommand {
+		os.Exit(runPromQLEnforce(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == rulesCheckCommand {
+		os.Exit(runRulesCheck(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	var (
 		insecureListenAddress  string
 		internalListenAddress  string
+		tlsListenAddress       string
+		tlsCertFile            string
+		tlsKeyFile             string
+		tlsQueryParam          string
+		tlsHeaderName          string
+		tlsMinVersion          string
+		tlsClientCAFile        string
+		tlsClientCertLabel     string
 		upstream               string
+		alertmanagerUpstream   string
+		rulesUpstream          string
+		upstreamShards         string // Comma-delimited string.
+		grpcUpstream           string
+		grpcServices           string // Comma-delimited string.
+		enableH2C              bool
+		upstreamCAFile         string
+		upstreamCertFile       string
+		upstreamKeyFile        string
+		upstreamServerName     string
+		upstreamTransport      injectproxy.TransportConfig
+		upstreamRetries        injectproxy.RetryConfig
 		queryParam             string
 		headerName             string
 		label                  string
+		extraLabels            arrayFlags
 		labelValues            arrayFlags
+		labelValuePrecedence   string // Comma-delimited string.
+		labelValueConflict     string
 		enableLabelAPIs        bool
 		unsafePassthroughPaths string // Comma-delimited string.
 		errorOnReplace         bool
+		errorOnUnselective     bool
+		errorOnLabelRewrite    bool
+		queryFrontendCompat    bool
 		regexMatch             bool
+		matchType              string
+		labelNormalization     string // Comma-delimited string.
 		headerUsesListSyntax   bool
 		rulesWithActiveAlerts  bool
+		redactedConfigAPI      bool
+		filteredTSDBStatus     bool
+		adminAPIs              bool
+		remoteWrite            bool
+		statusEndpoints        string // Comma-delimited string.
+		stripQueryStats        bool
+		stripEnforcedLabel     bool
+		deepFiltering          bool
+		federateFiltering      bool
+		metadataLimit          uint64
+		maxRewriteBytes        int64
+		maxRequestBodyBytes    int64
+		configFile             string
+		getBodyPolicy          string
+		enableETags            bool
+		distinctValuesWindow   time.Duration
+		upstreamCheckTimeout   time.Duration
+		upstreamProbeInterval  time.Duration
+		flushInterval          time.Duration
+		backend                string
+		disablePrometheus      bool
+		disableAlertmanager    bool
+		unmatchedPathPolicy    string
+		errorFormat            string
+		unmatchedPathRedirect  string
+		passthroughByDefault   string // Comma-delimited string.
+		enabledRoutes          string // Comma-delimited string.
+		disabledRoutes         string // Comma-delimited string.
+		accessLog              bool
+		tenantBaggage          bool
+		orgIDHeader            bool
+		orgIDSeparator         string
+		orgIDSkipInjection     bool
+		enforcedHeader         string
+		dryRun                 bool
+		queryCoalescing        bool
+		silenceCacheTTL        time.Duration
+		silenceCacheSize       int
+		policyURL              string
+		policyTimeout          time.Duration
+		accessLogSampleRate    uint64
+		accessLogExcludedPaths string // Comma-delimited string.
+		labelACLFile           string
+		labelACLIdentity       string
+		adminBypassFile        string
+		adminBypassIdentity    string
+		adminBypassJWTKeyFile  string
+		silenceOwnerIdentity   string
+		headerMappingFile      string
+		resolverURL            string
+		resolverTimeout        time.Duration
+		resolverCacheTTL       time.Duration
+		kubernetesAuth         bool
+		kubernetesAuthVerb     string
+		kubernetesAuthResource string
+		kubernetesAuthGroup    string
+		kubernetesAuthCacheTTL time.Duration
+		kubernetesForwardToken bool
+		auditLogFile           string
+		auditLogURL            string
+		auditLogKeyFile        string
+		shutdownTimeout        time.Duration
+		logLevel               string
+		logFormat              string
+		tracingEndpoint        string
+		tracingInsecure        bool
+		tracingSamplingRatio   float64
 	)
 
 	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flagset.StringVar(&insecureListenAddress, "insecure-listen-address", "", "The address the prom-label-proxy HTTP server should listen on.")
+	flagset.StringVar(&tlsListenAddress, "tls-listen-address", "", "The address the prom-label-proxy HTTPS server should listen on. It can be used together with -insecure-listen-address to serve both trusted and untrusted clients.")
+	flagset.StringVar(&tlsCertFile, "tls-cert-file", "", "Path to the TLS certificate file of the HTTPS server.")
+	flagset.StringVar(&tlsKeyFile, "tls-key-file", "", "Path to the TLS private key file of the HTTPS server.")
+	flagset.StringVar(&tlsQueryParam, "tls-query-param", "", "Name of the HTTP parameter that contains the tenant value for the requests received by the HTTPS server. By default, the HTTPS server extracts the tenant value like the HTTP server. At most one of -tls-query-param, -tls-header-name and -tls-client-cert-label should be given.")
+	flagset.StringVar(&tlsHeaderName, "tls-header-name", "", "Name of the HTTP header that contains the tenant value for the requests received by the HTTPS server. At most one of -tls-query-param, -tls-header-name and -tls-client-cert-label should be given.")
+	flagset.StringVar(&tlsMinVersion, "tls-min-version", "TLS12", "Minimum TLS version accepted by the HTTPS server: 'TLS10', 'TLS11', 'TLS12' or 'TLS13'.")
+	flagset.StringVar(&tlsClientCAFile, "tls-client-ca-file", "", "Path to the CA certificates file used to verify the client certificates. When specified, the HTTPS server requires a valid client certificate.")
+	flagset.StringVar(&tlsClientCertLabel, "tls-client-cert-label", "", "Field of the client certificate that contains the tenant value for the requests received by the HTTPS server: 'cn' (common name), 'dns-san', 'email-san' or 'uri-san' (subject alternative names). It requires -tls-client-ca-file. At most one of -tls-query-param, -tls-header-name and -tls-client-cert-label should be given.")
 	flagset.StringVar(&internalListenAddress, "internal-listen-address", "", "The address the internal prom-label-proxy HTTP server should listen on to expose metrics about itself.")
 	flagset.StringVar(&queryParam, "query-param", "", "Name of the HTTP parameter that contains the tenant value.At most one of -query-param, -header-name and -label-value should be given. If the flag isn't defined and neither -header-name nor -label-value is set, it will default to the value of the -label flag.")
 	flagset.StringVar(&headerName, "header-name", "", "Name of the HTTP header name that contains the tenant value. At most one of -query-param, -header-name and -label-value should be given.")
+	flagset.StringVar(&headerMappingFile, "header-mapping-file", "", "Path to a YAML or JSON file mapping the values of the -header-name header (e.g. user or organization identifiers) to the label values to enforce. The requests with unmapped header values are rejected with HTTP status code 403. The file is reloaded when the proxy receives a SIGHUP signal. It requires -header-name.")
+	flagset.StringVar(&resolverURL, "label-value-resolver-url", "", "URL of an HTTP endpoint resolving the tenants (the values of the -header-name header or of the -query-param parameter) to the label values to enforce. The tenant is sent in the 'tenant' query parameter and the endpoint replies with a JSON document like '{\"values\": [\"ns1\"]}'. The requests of tenants without label values are rejected with HTTP status code 403.")
+	flagset.DurationVar(&resolverTimeout, "label-value-resolver-timeout", 5*time.Second, "Timeout of the requests to -label-value-resolver-url.")
+	flagset.DurationVar(&resolverCacheTTL, "label-value-resolver-cache-ttl", time.Minute, "Duration for which the label values resolved by -label-value-resolver-url are cached. 0 disables the cache.")
+	flagset.StringVar(&configFile, "config.file", "", "Path to the configuration file (optional). The file is reloaded when the proxy receives a SIGHUP signal.")
 	flagset.StringVar(&upstream, "upstream", "", "The upstream URL to proxy to.")
-	flagset.StringVar(&label, "label", "", "The label name to enforce in all proxied PromQL queries.")
+	flagset.StringVar(&alertmanagerUpstream, "upstream-alertmanager", "", "The upstream URL of the Alertmanager API (/api/v2/). By default, the requests are proxied to -upstream. When specified, the Alertmanager routes are registered whatever the backend.")
+	flagset.StringVar(&rulesUpstream, "upstream-rules", "", "The upstream URL of the /api/v1/rules and /api/v1/alerts endpoints (e.g. Thanos Ruler). By default, the requests are proxied to -upstream.")
+	flagset.StringVar(&upstreamShards, "upstream-shards", "", "Comma delimited list of upstream URLs between which the tenants are sharded. When specified, the requests of the enforced routes are proxied to the shard selected by a consistent hash of the label value (the requests with label values of different shards are rejected with HTTP status code 400). The other requests are proxied to -upstream.")
+	flagset.StringVar(&upstreamCAFile, "upstream-ca-file", "", "Path to the CA certificates file used to verify the certificate of an HTTPS upstream. By default, the system's certificate pool is used.")
+	flagset.StringVar(&upstreamCertFile, "upstream-cert-file", "", "Path to the client certificate file presented to the upstream (requires -upstream-key-file).")
+	flagset.StringVar(&upstreamKeyFile, "upstream-key-file", "", "Path to the private key file of the client certificate presented to the upstream (requires -upstream-cert-file).")
+	flagset.StringVar(&upstreamServerName, "upstream-server-name", "", "Server name used to verify the certificate of an HTTPS upstream. By default, the host of the -upstream URL is used.")
+	flagset.IntVar(&upstreamTransport.MaxIdleConns, "upstream-max-idle-conns", 100, "Maximum number of idle connections kept open to the upstream.")
+	flagset.IntVar(&upstreamTransport.MaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle connections kept open to each upstream host. Under heavy load, a low value causes the connections to be closed after each request which can exhaust the ephemeral ports.")
+	flagset.IntVar(&upstreamTransport.MaxConnsPerHost, "upstream-max-conns-per-host", 0, "Maximum number of connections (active and idle) to each upstream host. The requests wait for a connection once the limit is reached. 0 means no limit.")
+	flagset.Int64Var(&maxRequestBodyBytes, "max-request-body-bytes", 0, "When greater than zero, the maximum size in bytes of the request bodies (e.g. the queries sent with POST) read by the proxy before enforcing the label. Larger requests fail with HTTP status code 413. 0 means no limit.")
+	flagset.DurationVar(&upstreamTransport.IdleConnTimeout, "upstream-idle-conn-timeout", 90*time.Second, "Duration after which the idle connections to the upstream are closed.")
+	flagset.DurationVar(&upstreamTransport.DialTimeout, "upstream-dial-timeout", 30*time.Second, "Maximum duration to establish a connection to the upstream.")
+	flagset.DurationVar(&upstreamTransport.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", 10*time.Second, "Maximum duration of the TLS handshake with an HTTPS upstream.")
+	flagset.BoolVar(&upstreamTransport.DisableKeepAlives, "upstream-disable-keep-alives", false, "When specified, the connections to the upstream are closed after each request.")
+	flagset.IntVar(&upstreamRetries.Retries, "upstream-retries", 0, "Maximum number of retries of the idempotent requests (GET and HEAD without body) when the upstream returns a 5xx status code or can't be reached. 0 disables the retries.")
+	flagset.DurationVar(&upstreamRetries.Backoff, "upstream-retry-backoff", 100*time.Millisecond, "Delay before the first retry of -upstream-retries, doubled for each following retry.")
+	flagset.DurationVar(&upstreamRetries.HedgeDelay, "upstream-hedge-delay", 0, "When greater than zero, a second identical request is sent for the idempotent requests which the upstream didn't answer within the delay and the first response is used. 0 disables the hedging.")
+	flagset.StringVar(&grpcServices, "grpc-passthrough-services", "", "Comma delimited list of gRPC services (e.g. 'thanos.Store') forwarded to the upstream without enforcement. The clients must use HTTP/2 (see -enable-h2c for the insecure listener). NOTE: the gRPC requests can access the data of all the tenants.")
+	flagset.StringVar(&grpcUpstream, "grpc-upstream", "", "The upstream URL of the -grpc-passthrough-services. With the 'http' scheme, the requests are sent with HTTP/2 over cleartext (h2c). By default, the requests are proxied to -upstream.")
+	flagset.BoolVar(&enableH2C, "enable-h2c", false, "When specified, the insecure listener accepts HTTP/2 over cleartext (h2c) connections in addition to HTTP/1.")
+	flagset.BoolVar(&upstreamTransport.DisableHTTP2, "upstream-disable-http2", false, "When specified, the proxy doesn't use HTTP/2 with an HTTPS upstream.")
+	flagset.DurationVar(&upstreamProbeInterval, "upstream-probe-interval", 0, "When greater than zero, the proxy probes the upstream (using the /-/ready or /api/v1/status/buildinfo endpoints) at this interval and the /-/ready endpoint of the internal server fails while the upstream isn't ready.")
+	flagset.DurationVar(&flushInterval, "flush-interval", 0, "Interval between the flushes of the response body to the client while copying the upstream response. A negative value flushes after each write. By default, the responses with an unknown length and the server-sent events are flushed immediately.")
+	flagset.DurationVar(&upstreamCheckTimeout, "upstream-check-timeout", 0, "When greater than zero, the proxy checks at startup that the upstream is reachable and ready (using the /-/ready or /api/v1/status/buildinfo endpoints) and exits if it isn't ready within this duration.")
+	flagset.StringVar(&backend, "backend", "", "Type of the upstream: 'prometheus', 'thanos', 'alertmanager', 'mimir' or 'loki'. The proxy registers only the routes supported by the backend, forwards its health endpoints without enforcement and enables the labels API when the backend supports it. "+
+		"When set to 'auto', the proxy detects the backend at startup by probing the upstream API. If empty, the Prometheus and Alertmanager routes are registered.")
+	flagset.BoolVar(&disablePrometheus, "disable-prometheus-routes", false, "When specified, the proxy doesn't register the Prometheus API routes (/federate and /api/v1/...).")
+	flagset.BoolVar(&disableAlertmanager, "disable-alertmanager-routes", false, "When specified, the proxy doesn't register the Alertmanager API routes (/api/v2/...).")
+	flagset.Func("label", "The label name to enforce in all proxied PromQL queries. It can be repeated to enforce additional labels: the value source of an additional label is given as 'name=header:<header name>', 'name=query:<parameter name>' or 'name=static:<value>[,<value>...]' and defaults to the query parameter with the same name as the label.", func(s string) error {
+		if label == "" {
+			label = s
+			return nil
+		}
+		return extraLabels.Set(s)
+	})
 	flagset.Var(&labelValues, "label-value", "A fixed label value to enforce in all proxied PromQL queries. At most one of -query-param, -header-name and -label-value should be given. It can be repeated in which case the proxy will enforce the union of values.")
+	flagset.StringVar(&labelValuePrecedence, "label-value-precedence", "", "Comma delimited list of the sources of the label values in order of precedence: 'header' (-header-name), 'query' (-query-param, defaulting to the -label flag) and 'static' (-label-value). When set, the sources are combined instead of being mutually exclusive (e.g. 'header,query,static').")
+	flagset.StringVar(&labelValueConflict, "label-value-conflict", "", "Behavior when several sources of -label-value-precedence provide label values: 'first' (default) uses the source with the highest precedence, 'reject' returns 400 Bad Request if the values differ.")
 	flagset.BoolVar(&enableLabelAPIs, "enable-label-apis", false, "When specified proxy allows to inject label to label APIs like /api/v1/labels and /api/v1/label/<name>/values. "+
 		"NOTE: Enable with care because filtering by matcher is not implemented in older versions of Prometheus (>= v2.24.0 required) and Thanos (>= v0.18.0 required, >= v0.23.0 recommended). If enabled and "+
 		"any labels endpoint does not support selectors, the injected matcher will have no effect.")
+	flagset.Int64Var(&maxRewriteBytes, "max-response-rewrite-bytes", 0, "When greater than zero, the maximum size in bytes of the (decompressed) upstream responses rewritten by the proxy (e.g. the /api/v1/rules and /api/v1/alerts responses). Larger responses fail with HTTP status code 502. 0 means no limit.")
+	flagset.Uint64Var(&metadataLimit, "metadata-limit", 0, "When greater than zero, the proxy ensures that the 'limit' parameter of the /api/v1/series, /api/v1/labels and /api/v1/label/<name>/values requests doesn't exceed this value (injecting it if needed). "+
+		"NOTE: the 'limit' parameter requires Prometheus >= v2.51.0.")
 	flagset.StringVar(&unsafePassthroughPaths, "unsafe-passthrough-paths", "", "Comma delimited allow list of exact HTTP path segments that should be allowed to hit upstream URL without any enforcement. "+
 		"This option is checked after Prometheus APIs, you cannot override enforced API endpoints to be not enforced with this option. Use carefully as it can easily cause a data leak if the provided path is an important "+
 		"API (like /api/v1/configuration) which isn't enforced by prom-label-proxy. NOTE: \"all\" matching paths like \"/\" or \"\" and regex are not allowed.")
+	flagset.StringVar(&passthroughByDefault, "passthrough-by-default", "", "Comma delimited list of the built-in routes (e.g. '/api/v1/query,/api/v1/query_range') which are enforced by the proxy. When specified, the requests for all the other paths are forwarded to the upstream without enforcement "+
+		"(except /api/v1/status/config and /api/v1/status/tsdb which remain forbidden unless -enable-redacted-config-api and -enable-filtered-tsdb-status are set). Use carefully as it exposes the full upstream API to the clients.")
+	flagset.StringVar(&enabledRoutes, "enabled-routes", "", "Comma delimited list of the built-in enforced routes (e.g. '/api/v1/query,/api/v1/query_range') which are enabled. When specified, the proxy replies with HTTP status code 404 to the requests of the other enforced routes.")
+	flagset.StringVar(&disabledRoutes, "disabled-routes", "", "Comma delimited list of the built-in routes (e.g. '/federate,/api/v2/silences') which are disabled: the proxy replies with HTTP status code 404 instead of enforcing the requests.")
 	flagset.BoolVar(&errorOnReplace, "error-on-replace", false, "When specified, the proxy will return HTTP status code 400 if the query already contains a label matcher that differs from the one the proxy would inject.")
+	flagset.BoolVar(&errorOnUnselective, "error-on-unselective-query", false, "When specified, the proxy will return HTTP status code 400 if the query or the match[] parameters contain a selector without any matcher besides the enforced label (e.g. '{job=~\".*\"}') since it would select all the series of the tenant.")
+	flagset.BoolVar(&errorOnLabelRewrite, "error-on-label-rewrite", false, "When specified, the proxy will return HTTP status code 400 if the query calls label_replace() or label_join() with the enforced label as destination (e.g. 'label_replace(up, \"namespace\", \"other\", \"\", \"\")') since the results would carry label values which weren't enforced.")
+	flagset.BoolVar(&queryFrontendCompat, "query-frontend-compat", false, "When specified, the proxy enforces the label in the sharded sub-queries embedded in the __embedded_queries__ selectors and validates the sharding headers (Sharding-Control and X-Query-Sharding) of the query requests. It should be enabled when the upstream is a query frontend (e.g. Mimir or Thanos).")
+	flagset.StringVar(&getBodyPolicy, "get-body-policy", string(injectproxy.GETBodyIgnore), "Policy for GET requests with a body on the query and matcher endpoints: 'ignore' forwards the request (the upstream ignores the body), 'reject' returns HTTP status code 400 and 'enforce' moves the form-encoded body parameters to the URL query string before enforcing them.")
+	flagset.StringVar(&unmatchedPathPolicy, "unmatched-path-policy", string(injectproxy.UnmatchedPathNotFound), "Policy for the requests which don't match any enforced or passthrough route: 'not-found' returns HTTP status code 404, 'forbidden' returns HTTP status code 403 with an explanatory message and 'redirect' redirects the client to the URL given by -unmatched-path-redirect-url.")
+	flagset.StringVar(&errorFormat, "error-format", string(injectproxy.ErrorFormatAuto), "Format of the error responses returned by the proxy: 'prometheus' (JSON object of the Prometheus API), 'alertmanager' (JSON string of the Alertmanager API v2) or 'auto' which returns Alertmanager errors for the /api/v2/ paths and Prometheus errors otherwise.")
+	flagset.StringVar(&unmatchedPathRedirect, "unmatched-path-redirect-url", "", "URL (e.g. a documentation page) to which the requests are redirected when -unmatched-path-policy is 'redirect'.")
+	flagset.StringVar(&labelNormalization, "label-value-normalization", "", "Comma delimited list of normalizations applied (in order) to the label values extracted from the requests before they are enforced: 'lowercase' and 'trim' (leading and trailing white spaces).")
+	flagset.StringVar(&matchType, "match-type", "equal", "Type of the matcher enforcing a single label value in the PromQL expressions and the match[] selectors: 'equal' (e.g. namespace=\"a\") or 'regexp' (e.g. namespace=~\"a\"). Multiple label values are always enforced with a regexp matcher.")
 	flagset.BoolVar(&regexMatch, "regex-match", false, "When specified, the tenant name is treated as a regular expression. In this case, only one tenant name should be provided.")
 	flagset.BoolVar(&headerUsesListSyntax, "header-uses-list-syntax", false, "When specified, the header line value will be parsed as a comma-separated list. This allows a single tenant header line to specify multiple tenant names.")
 	flagset.BoolVar(&rulesWithActiveAlerts, "rules-with-active-alerts", false, "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels.")
+	flagset.StringVar(&statusEndpoints, "enable-status-endpoints", "", "Comma delimited list of /api/v1/status/<name> endpoints which are forwarded to the upstream without enforcement. "+
+		"Supported values are 'buildinfo', 'flags', 'runtimeinfo' and 'walreplay'.")
+	flagset.BoolVar(&deepFiltering, "enable-deep-filtering", false, "When specified, the proxy removes the series which don't match the enforced label from the /api/v1/series responses and builds the /api/v1/labels and /api/v1/label/<name>/values responses from the matching series. It protects against upstreams which ignore the 'match[]' selectors at the cost of more expensive requests.")
+	flagset.BoolVar(&federateFiltering, "enable-federate-filtering", false, "When specified, the proxy requests the text exposition format for the /federate endpoint and removes the series which don't match the enforced label from the responses. It protects against upstreams which don't apply the 'match[]' selectors as expected.")
+	flagset.BoolVar(&stripQueryStats, "strip-query-stats", false, "When specified, the proxy removes the execution statistics (requested with the 'stats' parameter) from the /api/v1/query and /api/v1/query_range responses.")
+	flagset.BoolVar(&stripEnforcedLabel, "strip-enforced-label", false, "When specified, the proxy removes the enforced label from the series of the /api/v1/query and /api/v1/query_range responses.")
+	flagset.BoolVar(&enableETags, "enable-etags", false, "When specified, the proxy sets the ETag header on successful responses to GET requests and honors the If-None-Match header with 304 responses. The upstream is still queried for every request.")
+	flagset.DurationVar(&distinctValuesWindow, "distinct-label-values-window", 0, "When greater than zero, the proxy exposes the prom_label_proxy_distinct_label_values metric which estimates the number of distinct label values seen over this sliding window.")
+	flagset.BoolVar(&accessLog, "enable-access-log", false, "When specified, the proxy logs the requests it handles.")
+	flagset.Uint64Var(&accessLogSampleRate, "access-log-sample-rate", 1, "When greater than 1, only one successful request out of this number is logged. The failed requests (status code >= 400) are always logged.")
+	flagset.StringVar(&accessLogExcludedPaths, "access-log-excluded-paths", "/healthz", "Comma delimited list of paths which are never logged.")
+	flagset.StringVar(&auditLogFile, "audit-log-file", "", "Path to the file where the proxy appends the audit records of the requests handled by the enforced routes (one JSON record per line, each record holding the HMAC of the previous one). The chain of the existing records is verified at startup. It requires -audit-log-key-file.")
+	flagset.StringVar(&auditLogURL, "audit-log-url", "", "URL where the proxy sends the audit records of the requests handled by the enforced routes (one POST request per record). The chain restarts at each start of the proxy. At most one of -audit-log-file and -audit-log-url should be given. It requires -audit-log-key-file.")
+	flagset.StringVar(&auditLogKeyFile, "audit-log-key-file", "", "Path to the file holding the secret key of the HMAC chaining the audit records.")
+	flagset.BoolVar(&tenantBaggage, "enable-tenant-baggage", false, "When specified, the proxy adds the enforced label values to the W3C baggage header of the upstream requests.")
+	flagset.BoolVar(&dryRun, "dry-run", false, "When specified, the proxy evaluates the enforcement of the requests, logs and counts what would be rewritten or denied but forwards the original requests and returns the upstream responses unmodified.")
+	flagset.BoolVar(&orgIDHeader, "enable-org-id-header", false, "When specified, the proxy sets the X-Scope-OrgID header of the upstream requests to the enforced label values (for Cortex, Mimir and Loki). The header sent by the clients is always removed.")
+	flagset.StringVar(&orgIDSeparator, "org-id-separator", "|", "Separator joining the label values in the X-Scope-OrgID header.")
+	flagset.BoolVar(&orgIDSkipInjection, "org-id-skip-injection", false, "When specified with -enable-org-id-header, the requests are forwarded without injecting the label matchers nor filtering the responses: the upstream restricts the data to the tenants of the X-Scope-OrgID header.")
+	flagset.StringVar(&enforcedHeader, "forward-enforced-header", "", "When specified, the name of the header (e.g. X-Prom-Label-Proxy-Values) set on the upstream requests to the enforced label values joined with ','. The header sent by the clients is always removed.")
+	flagset.BoolVar(&queryCoalescing, "enable-query-coalescing", false, "When specified, identical requests to the query endpoints which are in flight at the same time are coalesced into a single upstream request.")
+	flagset.DurationVar(&silenceCacheTTL, "silence-cache-ttl", 0, "When greater than zero, the silences fetched from Alertmanager to check the ownership of the updated and deleted silences are cached for this duration.")
+	flagset.IntVar(&silenceCacheSize, "silence-cache-size", 1000, "Maximum number of silences cached when -silence-cache-ttl is set.")
+	flagset.StringVar(&policyURL, "policy-url", "", "URL of the Open Policy Agent decision (e.g. 'http://opa:8181/v1/data/prom_label_proxy/decision'). When specified, the proxy gets the label values to enforce from the policy instead of the -query-param, -header-name and -label-value flags.")
+	flagset.DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "Maximum duration to wait for the in-flight requests to complete when the proxy receives a SIGINT or SIGTERM signal. The proxy stops accepting new connections immediately and closes the remaining connections after this duration.")
+	flagset.DurationVar(&policyTimeout, "policy-timeout", 5*time.Second, "Timeout of the requests to the Open Policy Agent.")
+	flagset.StringVar(&labelACLFile, "label-acl-file", "", "Path to a YAML file mapping the client identities to the label values they are allowed to request. The requests for other label values are rejected with HTTP status code 403. The file is reloaded when the proxy receives a SIGHUP signal. It requires -label-acl-identity.")
+	flagset.StringVar(&labelACLIdentity, "label-acl-identity", "", "Source of the client identity for -label-acl-file: 'header:<name>' (value of the HTTP header), 'jwt-sub' or 'jwt-sub:<header>' (subject of the JWT bearer token found in the Authorization header or in the given header, the token's signature isn't verified) or 'cert-cn' (common name of the verified client certificate).")
+	flagset.StringVar(&adminBypassFile, "admin-bypass-file", "", "Path to a YAML file listing the identities of the administrators whose requests are forwarded to the upstream without enforcement (whatever the path). The bypassed requests are logged and recorded in the audit log. It requires -admin-bypass-identity.")
+	flagset.StringVar(&adminBypassIdentity, "admin-bypass-identity", "", "Source of the administrator identity for -admin-bypass-file: 'secret-header:<name>' (shared secret in the HTTP header, never forwarded to the upstream), 'jwt-claim:<claim>' or 'jwt-claim:<claim>:<header>' (string or array of strings claim of the JWT bearer token found in the Authorization header or in the given header, the token must be signed with HS256 and the key of -admin-bypass-jwt-key-file) or 'cert-cn' (common name of the verified client certificate).")
+	flagset.StringVar(&adminBypassJWTKeyFile, "admin-bypass-jwt-key-file", "", "Path to the file holding the HMAC key verifying the HS256 signature of the tokens for -admin-bypass-identity 'jwt-claim'. The unsigned tokens, the tokens with another algorithm or signature and the expired tokens are refused.")
+	flagset.StringVar(&silenceOwnerIdentity, "silence-ownership-identity", "", "When specified, the identity of the requester is recorded as the creator of the silences and only the creator can update or delete a silence. Same syntax as -label-acl-identity.")
+	flagset.BoolVar(&kubernetesAuth, "kubernetes-auth", false, "When specified, the requests must carry a Kubernetes bearer token in the Authorization header. The token is verified with the TokenReview API of the cluster's API server (the proxy must run in the cluster) and the user must be allowed to access -kubernetes-auth-resource in each enforced label value (namespace) according to the SubjectAccessReview API. The namespaces must be requested explicitly. The Authorization header isn't forwarded to the upstream unless -kubernetes-auth-forward-token is set.")
+	flagset.StringVar(&kubernetesAuthVerb, "kubernetes-auth-verb", "get", "Verb checked by -kubernetes-auth.")
+	flagset.StringVar(&kubernetesAuthResource, "kubernetes-auth-resource", "pods", "Namespaced resource checked by -kubernetes-auth.")
+	flagset.StringVar(&kubernetesAuthGroup, "kubernetes-auth-group", "", "API group of -kubernetes-auth-resource (e.g. 'metrics.k8s.io'). The core group is used by default.")
+	flagset.DurationVar(&kubernetesAuthCacheTTL, "kubernetes-auth-cache-ttl", time.Minute, "Duration for which the token and access reviews of -kubernetes-auth are cached. 0 disables the cache.")
+	flagset.BoolVar(&kubernetesForwardToken, "kubernetes-auth-forward-token", false, "When specified with -kubernetes-auth, the Authorization header holding the user's token is forwarded to the upstream.")
+	flagset.BoolVar(&adminAPIs, "enable-admin-apis", false, "When specified, the proxy forwards the requests to the /api/v1/admin/tsdb/clean_tombstones and /api/v1/admin/tsdb/snapshot endpoints to the upstream without enforcement. Otherwise the endpoints return 403. The /api/v1/admin/tsdb/delete_series endpoint is always enforced.")
+	flagset.BoolVar(&remoteWrite, "enable-remote-write", false, "When specified, the proxy accepts the remote write requests on the /api/v1/write endpoint. The enforced label is injected into the series without it and the requests with series of other label values are rejected.")
+	flagset.BoolVar(&redactedConfigAPI, "enable-redacted-config-api", false, "When specified, the proxy allows access to the /api/v1/status/config endpoint with the secrets redacted from the configuration. Otherwise the endpoint returns 403.")
+	flagset.BoolVar(&filteredTSDBStatus, "enable-filtered-tsdb-status", false, "When specified, the proxy allows access to the /api/v1/status/tsdb endpoint with the cardinality statistics filtered to the series count of the enforced label values. Otherwise the endpoint returns 403.")
+
+	flagset.StringVar(&tracingEndpoint, "tracing-endpoint", "", "Address (host:port) of the OpenTelemetry collector receiving the traces with the OTLP/HTTP protocol. When specified, the proxy creates spans for the requests and propagates the W3C trace context to the upstream.")
+	flagset.BoolVar(&tracingInsecure, "tracing-insecure", false, "When specified, the traces are sent to the -tracing-endpoint collector over HTTP instead of HTTPS.")
+	flagset.Float64Var(&tracingSamplingRatio, "tracing-sampling-ratio", 1, "Ratio of the traces started by the proxy which are sampled (between 0 and 1). The sampling decision of the incoming trace context is always honored.")
+	flagset.StringVar(&logLevel, "log-level", "info", "Only log messages with the given severity or above: 'debug', 'info', 'warn' or 'error'.")
+	flagset.StringVar(&logFormat, "log-format", "logfmt", "Output format of the log messages: 'logfmt' or 'json'.")
 
 	//nolint: errcheck // Parse() will exit on error.
 	flagset.Parse(os.Args[1:])
-	if label == "" {
-		log.Fatalf("-label flag cannot be empty")
+
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	// The messages of the standard log package are also sent to the logger.
+	slog.SetDefault(logger)
+
+	var flagLabels []labelConfig
+	if label != "" {
+		if strings.Contains(label, "=") {
+			fatal("the first -label flag can't define the value source, use -query-param, -header-name or -label-value instead")
+		}
 
-	if len(labelValues) == 0 && queryParam == "" && headerName == "" {
-		queryParam = label
+		lc := labelConfig{Name: label, QueryParam: queryParam, Header: headerName, Values: labelValues, OnConflict: labelValueConflict}
+		if labelValuePrecedence != "" {
+			lc.Precedence = strings.Split(labelValuePrecedence, ",")
+		} else if len(labelValues) > 0 {
+			if queryParam != "" || headerName != "" {
+				fatal("at most one of -query-param, -header-name and -label-value must be set")
+			}
+		} else if queryParam != "" && headerName != "" {
+			fatal("at most one of -query-param, -header-name and -label-value must be set")
+		}
+
+		flagLabels = append(flagLabels, lc)
+		for _, s := range extraLabels {
+			lc, err := parseLabelFlag(s)
+			if err != nil {
+				fatal("Invalid -label flag", "err", err)
+			}
+			flagLabels = append(flagLabels, lc)
+		}
+	} else if queryParam != "" || headerName != "" || len(labelValues) > 0 || labelValuePrecedence != "" {
+		fatal("-query-param, -header-name, -label-value and -label-value-precedence require the -label flag")
+	}
+
+	if headerMappingFile != "" && headerName == "" {
+		fatal("-header-mapping-file requires -header-name")
+	}
+
+	if headerMappingFile != "" && labelValuePrecedence != "" {
+		fatal("-header-mapping-file can't be used with -label-value-precedence")
+	}
+
+	if resolverURL != "" && (headerMappingFile != "" || policyURL != "") {
+		fatal("-label-value-resolver-url can't be used with -header-mapping-file or -policy-url")
 	}
 
-	if len(labelValues) > 0 {
-		if queryParam != "" || headerName != "" {
-			log.Fatalf("at most one of -query-param, -header-name and -label-value must be set")
+	if policyURL != "" && (queryParam != "" || headerName != "" || len(labelValues) > 0 || labelValuePrecedence != "") {
+		fatal("-query-param, -header-name, -label-value and -label-value-precedence can't be used with -policy-url")
+	}
+
+	cfg := &config{}
+	if configFile != "" {
+		var err error
+		cfg, err = loadConfig(configFile)
+		if err != nil {
+			fatal("Failed to load the configuration", "err", err)
+		}
+	}
+
+	if _, err := cfg.enforcedLabels(flagLabels); err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+
+	if tlsListenAddress != "" {
+		if _, _, err := cfg.certFiles(tlsCertFile, tlsKeyFile); err != nil {
+			fatal("Invalid configuration", "err", err)
+		}
+		n := 0
+		for _, v := range []string{tlsQueryParam, tlsHeaderName, tlsClientCertLabel} {
+			if v != "" {
+				n++
+			}
+		}
+		if n > 1 {
+			fatal("at most one of -tls-query-param, -tls-header-name and -tls-client-cert-label must be set")
+		}
+		if _, found := tlsVersions[tlsMinVersion]; !found {
+			fatal("Invalid -tls-min-version flag, expected one of 'TLS10', 'TLS11', 'TLS12' or 'TLS13'", "value", tlsMinVersion)
 		}
-	} else if queryParam != "" && headerName != "" {
-		log.Fatalf("at most one of -query-param, -header-name and -label-value must be set")
+		if tlsClientCertLabel != "" {
+			if tlsClientCAFile == "" {
+				fatal("-tls-client-cert-label requires -tls-client-ca-file")
+			}
+			if !slices.Contains(clientCertificateFields, injectproxy.ClientCertificateField(tlsClientCertLabel)) {
+				fatal("Invalid -tls-client-cert-label flag, expected one of 'cn', 'dns-san', 'email-san' or 'uri-san'", "value", tlsClientCertLabel)
+			}
+		}
+	} else if tlsQueryParam != "" || tlsHeaderName != "" || tlsClientCertLabel != "" || tlsClientCAFile != "" {
+		fatal("-tls-query-param, -tls-header-name, -tls-client-cert-label and -tls-client-ca-file require -tls-listen-address")
 	}
 
-	upstreamURL, err := url.Parse(upstream)
+	upstreamURL, err := cfg.upstreamURL(upstream)
 	if err != nil {
-		log.Fatalf("Failed to build parse upstream URL: %v", err)
+		fatal("Invalid configuration", "err", err)
+	}
+
+	var kubernetesReviewer *injectproxy.KubernetesReviewer
+	if kubernetesAuth {
+		kubernetesReviewer, err = injectproxy.NewInClusterKubernetesReviewer()
+		if err != nil {
+			fatal("Failed to configure the Kubernetes authorization", "err", err)
+		}
+	} else if kubernetesForwardToken {
+		fatal("-kubernetes-auth-forward-token requires -kubernetes-auth")
+	}
+
+	var identifier injectproxy.Identifier
+	if labelACLFile != "" {
+		identifier, err = aclIdentifier(labelACLIdentity)
+		if err != nil {
+			fatal("Invalid -label-acl-identity flag", "err", err)
+		}
+	} else if labelACLIdentity != "" {
+		fatal("-label-acl-identity requires -label-acl-file")
+	}
+
+	var adminBypass *injectproxy.AdminBypass
+	if adminBypassFile != "" {
+		var jwtKey []byte
+		if adminBypassJWTKeyFile != "" {
+			jwtKey, err = os.ReadFile(adminBypassJWTKeyFile)
+			if err != nil {
+				fatal("Failed to read the JWT key", "err", err)
+			}
+			jwtKey = bytes.TrimSpace(jwtKey)
+		}
+		id, err := adminIdentifier(adminBypassIdentity, jwtKey)
+		if err != nil {
+			fatal("Invalid -admin-bypass-identity flag", "err", err)
+		}
+		admins, err := loadAdmins(adminBypassFile)
+		if err != nil {
+			fatal("Failed to load the administrators", "err", err)
+		}
+		adminBypass = &injectproxy.AdminBypass{Identifier: id, Admins: admins}
+	} else if adminBypassIdentity != "" || adminBypassJWTKeyFile != "" {
+		fatal("-admin-bypass-identity and -admin-bypass-jwt-key-file require -admin-bypass-file")
 	}
 
-	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
-		log.Fatalf("Invalid scheme for upstream URL %q, only 'http' and 'https' are supported", upstream)
+	upstreamTransport.TLSConfig, err = upstreamTLSConfig(upstreamCAFile, upstreamCertFile, upstreamKeyFile, upstreamServerName)
+	if err != nil {
+		fatal("Invalid upstream TLS configuration", "err", err)
+	}
+	if upstreamTransport.MaxIdleConns < 0 || upstreamTransport.MaxIdleConnsPerHost < 0 || upstreamTransport.MaxConnsPerHost < 0 {
+		fatal("The upstream connection limits can't be negative")
+	}
+
+	transport := injectproxy.NewUpstreamTransport(upstreamTransport)
+	upstreamClient := &http.Client{Transport: transport}
+
+	if upstreamCheckTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+		err := injectproxy.CheckUpstream(ctx, upstreamClient, upstreamURL)
+		cancel()
+		if err != nil {
+			fatal("Failed to check the upstream", "err", err)
+		}
+		logger.Info("Upstream is ready", "upstream", upstreamURL.Redacted())
+	}
+
+	if backend == "auto" {
+		timeout := upstreamCheckTimeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		b, err := injectproxy.DetectBackend(ctx, upstreamClient, upstreamURL)
+		cancel()
+		if err != nil {
+			fatal("Failed to detect the backend, use the -backend flag to set it explicitly", "err", err)
+		}
+		logger.Info("Detected the backend", "backend", b)
+		backend = string(b)
 	}
 
 	reg := prometheus.NewRegistry()
@@ -122,82 +748,579 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	opts := []injectproxy.Option{injectproxy.WithPrometheusRegistry(reg)}
+	reloadSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prom_label_proxy_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	reloadSuccess.Set(1)
+	reg.MustRegister(reloadSuccess)
+
+	denyList := injectproxy.NewDenyList()
+	if err := cfg.blockTenants(denyList, nil); err != nil {
+		fatal("Failed to load the configuration", "err", err)
+	}
+
+	opts := []injectproxy.Option{injectproxy.WithDenyList(denyList), injectproxy.WithLogger(logger)}
+
+	var tp *sdktrace.TracerProvider
+	if tracingEndpoint != "" {
+		tp, err = newTracerProvider(tracingEndpoint, tracingInsecure, tracingSamplingRatio)
+		if err != nil {
+			fatal("Failed to configure tracing", "err", err)
+		}
+		opts = append(opts, injectproxy.WithTracerProvider(tp))
+	}
+
+	opts = append(opts, injectproxy.WithUpstreamTransport(transport))
+
+	if upstreamRetries.Retries > 0 || upstreamRetries.HedgeDelay > 0 {
+		opts = append(opts, injectproxy.WithUpstreamRetries(upstreamRetries))
+	}
+
+	if flushInterval != 0 {
+		opts = append(opts, injectproxy.WithFlushInterval(flushInterval))
+	}
+
+	if backend != "" {
+		opts = append(opts, injectproxy.WithBackend(injectproxy.Backend(backend)))
+	}
+
+	if disablePrometheus {
+		opts = append(opts, injectproxy.WithoutPrometheusRoutes())
+	}
+
+	if disableAlertmanager {
+		opts = append(opts, injectproxy.WithoutAlertmanagerRoutes())
+	}
+
+	if alertmanagerUpstream != "" {
+		if disableAlertmanager {
+			fatal("-upstream-alertmanager and -disable-alertmanager-routes can't be used together")
+		}
+
+		u, err := parseUpstreamURL(alertmanagerUpstream)
+		if err != nil {
+			fatal("Invalid -upstream-alertmanager flag", "err", err)
+		}
+		opts = append(opts, injectproxy.WithAlertmanagerUpstream(u))
+	}
+
+	if silenceOwnerIdentity != "" {
+		id, err := aclIdentifier(silenceOwnerIdentity)
+		if err != nil {
+			fatal("Invalid -silence-ownership-identity flag", "err", err)
+		}
+		opts = append(opts, injectproxy.WithSilenceOwnership(id))
+	}
+
+	if rulesUpstream != "" {
+		u, err := parseUpstreamURL(rulesUpstream)
+		if err != nil {
+			fatal("Invalid -upstream-rules flag", "err", err)
+		}
+		opts = append(opts, injectproxy.WithRulesUpstream(u))
+	}
+
+	if upstreamShards != "" {
+		var shards []*url.URL
+		for _, shard := range strings.Split(upstreamShards, ",") {
+			u, err := parseUpstreamURL(shard)
+			if err != nil {
+				fatal("Invalid -upstream-shards flag", "err", err)
+			}
+			shards = append(shards, u)
+		}
+		opts = append(opts, injectproxy.WithUpstreamShards(shards))
+	}
+
+	if grpcServices != "" {
+		gp := injectproxy.GRPCPassthrough{Services: strings.Split(grpcServices, ",")}
+		if grpcUpstream != "" {
+			u, err := parseUpstreamURL(grpcUpstream)
+			if err != nil {
+				fatal("Invalid -grpc-upstream flag", "err", err)
+			}
+			gp.Upstream = u
+		}
+		opts = append(opts, injectproxy.WithGRPCPassthrough(gp))
+	} else if grpcUpstream != "" {
+		fatal("-grpc-upstream requires -grpc-passthrough-services")
+	}
+
 	if enableLabelAPIs {
 		opts = append(opts, injectproxy.WithEnabledLabelsAPI())
 	}
 
-	if len(unsafePassthroughPaths) > 0 {
-		opts = append(opts, injectproxy.WithPassthroughPaths(strings.Split(unsafePassthroughPaths, ",")))
+	if maxRewriteBytes < 0 {
+		fatal("-max-response-rewrite-bytes can't be negative")
+	}
+	if maxRewriteBytes > 0 {
+		opts = append(opts, injectproxy.WithMaxResponseRewriteBytes(maxRewriteBytes))
+	}
+	if maxRequestBodyBytes < 0 {
+		fatal("-max-request-body-bytes can't be negative")
+	}
+	if maxRequestBodyBytes > 0 {
+		opts = append(opts, injectproxy.WithMaxRequestBodyBytes(maxRequestBodyBytes))
+	}
+
+	if metadataLimit > 0 {
+		opts = append(opts, injectproxy.WithMetadataLimit(metadataLimit))
+	}
+
+	if len(passthroughByDefault) > 0 {
+		opts = append(opts, injectproxy.WithPassthroughByDefault(strings.Split(passthroughByDefault, ",")))
+	}
+
+	if len(enabledRoutes) > 0 {
+		opts = append(opts, injectproxy.WithEnabledRoutes(strings.Split(enabledRoutes, ",")...))
+	}
+
+	if len(disabledRoutes) > 0 {
+		opts = append(opts, injectproxy.WithDisabledRoutes(strings.Split(disabledRoutes, ",")...))
 	}
 
 	if errorOnReplace {
 		opts = append(opts, injectproxy.WithErrorOnReplace())
 	}
 
+	if getBodyPolicy != string(injectproxy.GETBodyIgnore) {
+		opts = append(opts, injectproxy.WithGETBodyPolicy(injectproxy.GETBodyPolicy(getBodyPolicy)))
+	}
+
+	switch injectproxy.UnmatchedPathPolicy(unmatchedPathPolicy) {
+	case injectproxy.UnmatchedPathNotFound:
+	case injectproxy.UnmatchedPathRedirect:
+		opts = append(opts, injectproxy.WithUnmatchedPathRedirect(unmatchedPathRedirect))
+	default:
+		opts = append(opts, injectproxy.WithUnmatchedPathPolicy(injectproxy.UnmatchedPathPolicy(unmatchedPathPolicy)))
+	}
+
+	if errorFormat != string(injectproxy.ErrorFormatAuto) {
+		opts = append(opts, injectproxy.WithErrorFormat(injectproxy.ErrorFormat(errorFormat)))
+	}
+
+	if errorOnUnselective {
+		opts = append(opts, injectproxy.WithErrorOnUnselectiveQuery())
+	}
+
+	if queryFrontendCompat {
+		opts = append(opts, injectproxy.WithQueryFrontendCompat())
+	}
+
+	if errorOnLabelRewrite {
+		opts = append(opts, injectproxy.WithErrorOnLabelRewrite())
+	}
+
 	if rulesWithActiveAlerts {
 		opts = append(opts, injectproxy.WithActiveAlerts())
 	}
 
+	if redactedConfigAPI {
+		opts = append(opts, injectproxy.WithRedactedConfigAPI())
+	}
+
+	if filteredTSDBStatus {
+		opts = append(opts, injectproxy.WithFilteredTSDBStatus())
+	}
+
+	if adminAPIs {
+		opts = append(opts, injectproxy.WithAdminAPIs())
+	}
+
+	if remoteWrite {
+		opts = append(opts, injectproxy.WithRemoteWrite())
+	}
+
+	if distinctValuesWindow > 0 {
+		opts = append(opts, injectproxy.WithDistinctLabelValuesWindow(distinctValuesWindow))
+	}
+
+	if accessLog {
+		cfg := injectproxy.AccessLogConfig{SampleRate: accessLogSampleRate}
+		if len(accessLogExcludedPaths) > 0 {
+			cfg.ExcludedPaths = strings.Split(accessLogExcludedPaths, ",")
+		}
+		opts = append(opts, injectproxy.WithAccessLog(cfg))
+	}
+
+	var auditKey []byte
+	if auditLogFile != "" || auditLogURL != "" {
+		if auditLogKeyFile == "" {
+			fatal("-audit-log-key-file is required for the audit log")
+		}
+		b, err := os.ReadFile(auditLogKeyFile)
+		if err != nil {
+			fatal("Failed to read the audit log key", "err", err)
+		}
+		auditKey = bytes.TrimSpace(b)
+	} else if auditLogKeyFile != "" {
+		fatal("-audit-log-key-file requires -audit-log-file or -audit-log-url")
+	}
+
+	var auditSink injectproxy.AuditSink
+	auditCfg := injectproxy.AuditConfig{Key: auditKey, Registerer: reg, Logger: logger}
+	switch {
+	case auditLogFile != "" && auditLogURL != "":
+		fatal("at most one of -audit-log-file and -audit-log-url must be set")
+	case auditLogFile != "":
+		prevHash, err := lastAuditHash(auditLogFile, auditKey)
+		if err != nil {
+			fatal("Failed to verify the audit log", "err", err)
+		}
+		auditCfg.PrevHash = prevHash
+
+		sink, err := injectproxy.NewFileAuditSink(auditLogFile)
+		if err != nil {
+			fatal("Failed to open the audit log", "err", err)
+		}
+		defer sink.Close()
+		auditSink = sink
+	case auditLogURL != "":
+		if _, err := url.Parse(auditLogURL); err != nil {
+			fatal("Invalid -audit-log-url flag", "err", err)
+		}
+
+		auditSink = injectproxy.HTTPAuditSink{URL: auditLogURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	if auditSink != nil {
+		auditLogger, err := injectproxy.NewAuditLogger(auditSink, auditCfg)
+		if err != nil {
+			fatal("Failed to create the audit logger", "err", err)
+		}
+		// The pending records are written before the sink is closed.
+		defer auditLogger.Close()
+
+		opts = append(opts, injectproxy.WithAuditLogger(auditLogger))
+	}
+
+	if dryRun {
+		logger.Warn("Running in dry-run mode, the label isn't enforced")
+		opts = append(opts, injectproxy.WithDryRun())
+	}
+
+	if adminBypass != nil {
+		logger.Warn("Admin bypass enabled, the requests of the administrators aren't enforced")
+		opts = append(opts, injectproxy.WithAdminBypass(*adminBypass))
+	}
+
+	if orgIDHeader {
+		opts = append(opts, injectproxy.WithOrgIDHeader(injectproxy.OrgIDConfig{Separator: orgIDSeparator, SkipInjection: orgIDSkipInjection}))
+	} else if orgIDSkipInjection {
+		fatal("-org-id-skip-injection requires -enable-org-id-header")
+	}
+
+	if enforcedHeader != "" {
+		opts = append(opts, injectproxy.WithForwardEnforcedHeader(enforcedHeader))
+	}
+
+	if tenantBaggage {
+		opts = append(opts, injectproxy.WithTenantBaggage())
+	}
+
+	if queryCoalescing {
+		opts = append(opts, injectproxy.WithQueryCoalescing())
+	}
+
+	if silenceCacheTTL > 0 {
+		opts = append(opts, injectproxy.WithSilenceCache(silenceCacheTTL, silenceCacheSize))
+	}
+
+	if enableETags {
+		opts = append(opts, injectproxy.WithETags())
+	}
+
+	if deepFiltering {
+		opts = append(opts, injectproxy.WithDeepFiltering())
+	}
+
+	if federateFiltering {
+		opts = append(opts, injectproxy.WithFederateFiltering())
+	}
+
+	if stripQueryStats {
+		opts = append(opts, injectproxy.WithoutQueryStats())
+	}
+
+	if stripEnforcedLabel {
+		opts = append(opts, injectproxy.WithoutEnforcedLabel())
+	}
+
+	if len(statusEndpoints) > 0 {
+		opts = append(opts, injectproxy.WithStatusEndpoints(strings.Split(statusEndpoints, ",")...))
+	}
+
 	if regexMatch {
-		if len(labelValues) > 0 {
-			if len(labelValues) > 1 {
-				log.Fatalf("Regex match is limited to one label value")
+		opts = append(opts, injectproxy.WithRegexMatch())
+	}
+
+	switch matchType {
+	case "equal":
+	case "regexp":
+		opts = append(opts, injectproxy.WithMatchType(labels.MatchRegexp))
+	default:
+		fatal("Invalid -match-type flag, only 'equal' and 'regexp' are supported", "match-type", matchType)
+	}
+
+	if labelNormalization != "" {
+		var normalizers []injectproxy.LabelValueNormalizer
+		for _, n := range strings.Split(labelNormalization, ",") {
+			switch strings.TrimSpace(n) {
+			case "lowercase":
+				normalizers = append(normalizers, injectproxy.LowercaseLabelValues)
+			case "trim":
+				normalizers = append(normalizers, injectproxy.TrimLabelValues)
+			default:
+				fatal("Invalid -label-value-normalization flag, only 'lowercase' and 'trim' are supported", "label-value-normalization", n)
 			}
+		}
+		opts = append(opts, injectproxy.WithLabelValueNormalizers(normalizers...))
+	}
 
-			compiledRegex, err := regexp.Compile(labelValues[0])
+	if policyURL != "" {
+		u, err := url.Parse(policyURL)
+		if err != nil {
+			fatal("Invalid -policy-url flag", "err", err)
+		}
+		opts = append(opts, injectproxy.WithPolicyEvaluator(&injectproxy.OPAEvaluator{URL: u, Client: &http.Client{Timeout: policyTimeout}}))
+	}
+
+	var tlsExtractLabeler injectproxy.ExtractLabeler
+	switch {
+	case tlsQueryParam != "":
+		tlsExtractLabeler = injectproxy.HTTPFormEnforcer{ParameterName: tlsQueryParam}
+	case tlsHeaderName != "":
+		tlsExtractLabeler = injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(tlsHeaderName), ParseListSyntax: headerUsesListSyntax}
+	case tlsClientCertLabel != "":
+		tlsExtractLabeler = injectproxy.ClientCertificateEnforcer{Field: injectproxy.ClientCertificateField(tlsClientCertLabel)}
+	}
+
+	// build creates the routes for the given configuration. It is called at
+	// startup and when the proxy receives SIGHUP.
+	build := func(cfg *config) (*generation, error) {
+		upstreamURL, err := cfg.upstreamURL(upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		labels, err := cfg.enforcedLabels(flagLabels)
+		if err != nil {
+			return nil, err
+		}
+
+		if regexMatch {
+			if err := checkRegexMatch(labels[0].Values); err != nil {
+				return nil, err
+			}
+		}
+
+		extractLabeler, err := labels[0].extractLabeler(headerUsesListSyntax)
+		if err != nil {
+			return nil, err
+		}
+
+		if headerMappingFile != "" {
+			mapping, err := loadHeaderMapping(headerMappingFile)
 			if err != nil {
-				log.Fatalf("Invalid regexp: %v", err.Error())
-				return
+				return nil, err
 			}
+			extractLabeler = injectproxy.HeaderMappingEnforcer{Name: http.CanonicalHeaderKey(headerName), ParseListSyntax: headerUsesListSyntax, Mapping: mapping}
+		}
 
-			if compiledRegex.MatchString("") {
-				log.Fatalf("Regex should not match empty string")
-				return
+		if resolverURL != "" {
+			u, err := url.Parse(resolverURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label value resolver URL: %w", err)
 			}
+			extractLabeler = injectproxy.NewResolvingEnforcer(
+				&injectproxy.HTTPLabelValueResolver{URL: u, Client: &http.Client{Timeout: resolverTimeout}},
+				extractLabeler,
+				resolverCacheTTL,
+			)
 		}
 
-		opts = append(opts, injectproxy.WithRegexMatch())
+		if kubernetesReviewer != nil {
+			ke := injectproxy.NewKubernetesEnforcer(
+				kubernetesReviewer,
+				extractLabeler,
+				injectproxy.KubernetesAccess{Verb: kubernetesAuthVerb, Group: kubernetesAuthGroup, Resource: kubernetesAuthResource},
+				kubernetesAuthCacheTTL,
+			)
+			ke.ForwardToken = kubernetesForwardToken
+			extractLabeler = ke
+		}
+
+		opts := append(slices.Clone(opts), cfg.options()...)
+		for _, l := range labels[1:] {
+			el, err := l.extractLabeler(headerUsesListSyntax)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, injectproxy.WithExtraLabel(l.Name, el))
+		}
+
+		var passthroughPaths []string
+		if len(unsafePassthroughPaths) > 0 {
+			passthroughPaths = strings.Split(unsafePassthroughPaths, ",")
+		}
+		passthroughPaths = append(passthroughPaths, cfg.PassthroughPaths...)
+		if len(passthroughPaths) > 0 {
+			opts = append(opts, injectproxy.WithPassthroughPaths(passthroughPaths))
+		}
+
+		if labelACLFile != "" {
+			acl, err := loadLabelACL(labelACLFile)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, injectproxy.WithLabelACL(identifier, acl))
+		}
+
+		gen := &generation{registry: prometheus.NewRegistry()}
+
+		routesOpts := append(slices.Clone(opts), injectproxy.WithPrometheusRegistry(gen.registry))
+		if tlsExtractLabeler != nil {
+			// Each listener has its own routes, the metrics are distinguished
+			// by the listener label.
+			routesOpts = append(slices.Clone(opts), injectproxy.WithPrometheusRegistry(prometheus.WrapRegistererWith(prometheus.Labels{"listener": "http"}, gen.registry)))
+		}
+
+		gen.routes, err = injectproxy.NewRoutes(upstreamURL, labels[0].Name, extractLabeler, routesOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create injectproxy Routes: %w", err)
+		}
+
+		gen.tlsRoutes = gen.routes
+		if tlsExtractLabeler != nil {
+			tlsOpts := append(slices.Clone(opts), injectproxy.WithPrometheusRegistry(prometheus.WrapRegistererWith(prometheus.Labels{"listener": "https"}, gen.registry)))
+			gen.tlsRoutes, err = injectproxy.NewRoutes(upstreamURL, labels[0].Name, tlsExtractLabeler, tlsOpts...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create injectproxy Routes for the HTTPS server: %w", err)
+			}
+		}
+
+		return gen, nil
 	}
 
-	var extractLabeler injectproxy.ExtractLabeler
-	switch {
-	case len(labelValues) > 0:
-		extractLabeler = injectproxy.StaticLabelEnforcer(labelValues)
-	case queryParam != "":
-		extractLabeler = injectproxy.HTTPFormEnforcer{ParameterName: queryParam}
-	case headerName != "":
-		extractLabeler = injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(headerName), ParseListSyntax: headerUsesListSyntax}
+	var cur current
+	gen, err := build(cfg)
+	if err != nil {
+		fatal("Failed to load the configuration", "err", err)
+	}
+	cur.set(gen)
+
+	var cert certificate
+	if tlsListenAddress != "" {
+		certFile, keyFile, _ := cfg.certFiles(tlsCertFile, tlsKeyFile)
+		c, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			fatal("Failed to load the TLS certificate", "err", err)
+		}
+		cert.set(c)
 	}
 
 	var g run.Group
 
-	{
+	var prober *injectproxy.UpstreamProber
+	if upstreamProbeInterval > 0 {
+		prober = injectproxy.NewUpstreamProber(upstreamClient, upstreamURL, upstreamProbeInterval)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			prober.Run(ctx)
+			return nil
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	if insecureListenAddress != "" || tlsListenAddress == "" {
 		// Run the insecure HTTP server.
-		routes, err := injectproxy.NewRoutes(upstreamURL, label, extractLabeler, opts...)
+		mux := http.NewServeMux()
+		mux.Handle("/", cur.handler(false))
+
+		l, err := net.Listen("tcp", insecureListenAddress)
 		if err != nil {
-			log.Fatalf("Failed to create injectproxy Routes: %v", err)
+			fatal("Failed to listen on insecure address", "err", err)
+		}
+
+		var h http.Handler = mux
+		if enableH2C {
+			h = injectproxy.NewH2CHandler(h)
 		}
+		srv := &http.Server{Handler: h}
+
+		addServer(&g, logger, srv, shutdownTimeout, func() error {
+			logger.Info("Listening insecurely", "address", l.Addr().String())
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				logger.Error("Server stopped", "err", err)
+				return err
+			}
+			return nil
+		})
+	}
 
+	if tlsListenAddress != "" {
+		// Run the HTTPS server.
 		mux := http.NewServeMux()
-		mux.Handle("/", routes)
+		mux.Handle("/", cur.handler(true))
 
-		l, err := net.Listen("tcp", insecureListenAddress)
+		l, err := net.Listen("tcp", tlsListenAddress)
 		if err != nil {
-			log.Fatalf("Failed to listen on insecure address: %v", err)
+			fatal("Failed to listen on TLS address", "err", err)
 		}
 
-		srv := &http.Server{Handler: mux}
+		tlsConfig := &tls.Config{
+			GetCertificate: cert.getCertificate,
+			MinVersion:     tlsVersions[tlsMinVersion],
+		}
+		if tlsClientCAFile != "" {
+			b, err := os.ReadFile(tlsClientCAFile)
+			if err != nil {
+				fatal("Failed to read the client CA file", "err", err)
+			}
 
-		g.Add(func() error {
-			log.Printf("Listening insecurely on %v", l.Addr())
-			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
-				log.Printf("Server stopped with %v", err)
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(b) {
+				fatal("No certificate found in the client CA file", "file", tlsClientCAFile)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		srv := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+
+		addServer(&g, logger, srv, shutdownTimeout, func() error {
+			logger.Info("Listening securely", "address", l.Addr().String())
+			if err := srv.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+				logger.Error("TLS server stopped", "err", err)
 				return err
 			}
 			return nil
+		})
+
+		// Reload the certificate when its files are updated (e.g. renewed
+		// by cert-manager).
+		ticker := time.NewTicker(certificateCheckInterval)
+		done := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-ticker.C:
+					reloaded, err := cert.reloadIfModified()
+					if err != nil {
+						logger.Error("Failed to reload the TLS certificate", "err", err)
+						continue
+					}
+					if reloaded {
+						logger.Info("TLS certificate reloaded")
+					}
+				case <-done:
+					return nil
+				}
+			}
 		}, func(error) {
-			srv.Close()
+			ticker.Stop()
+			close(done)
 		})
 	}
 
@@ -205,21 +1328,38 @@ func main() {
 		// Run the internal HTTP server.
 		h := internalserver.NewHandler(
 			internalserver.WithName("Internal prom-label-proxy API"),
-			internalserver.WithPrometheusRegistry(reg),
 			internalserver.WithPProf(),
 		)
+		h.AddEndpoint("/metrics", "Exposes Prometheus metrics", promhttp.HandlerFor(prometheus.Gatherers{reg, &cur}, promhttp.HandlerOpts{}).ServeHTTP)
+		h.AddEndpoint("/-/healthy", "Liveness of the proxy", func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprintln(w, "prom-label-proxy is Healthy.")
+		})
+		h.AddEndpoint("/-/ready", "Readiness of the proxy (and of the upstream with -upstream-probe-interval)", func(w http.ResponseWriter, _ *http.Request) {
+			if prober != nil {
+				if err := prober.Ready(); err != nil {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+			}
+			fmt.Fprintln(w, "prom-label-proxy is Ready.")
+		})
+		h.AddEndpoint("/-/routes", "Routes handled by the proxy", func(w http.ResponseWriter, req *http.Request) {
+			cur.get().routes.RoutesHandler()(w, req)
+		})
+		h.AddEndpoint("/-/blocked-tenants", "Label values blocked by the proxy (GET to list, PUT/DELETE with the 'value' parameter to update)", denyList.ServeHTTP)
+
 		// Run the HTTP server.
 		l, err := net.Listen("tcp", internalListenAddress)
 		if err != nil {
-			log.Fatalf("Failed to listen on internal address: %v", err)
+			fatal("Failed to listen on internal address", "err", err)
 		}
 
 		srv := &http.Server{Handler: h}
 
 		g.Add(func() error {
-			log.Printf("Listening on %v for metrics and pprof", l.Addr())
+			logger.Info("Listening for metrics and pprof", "address", l.Addr().String())
 			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
-				log.Printf("Internal server stopped with %v", err)
+				logger.Error("Internal server stopped", "err", err)
 				return err
 			}
 			return nil
@@ -228,13 +1368,35 @@ func main() {
 		})
 	}
 
+	if configFile != "" || headerMappingFile != "" || labelACLFile != "" {
+		rl := &reloader{
+			filename: configFile,
+			build:    build,
+			cur:      &cur,
+			denyList: denyList,
+			cfg:      cfg,
+		}
+		if tlsListenAddress != "" {
+			rl.cert, rl.tlsCertFile, rl.tlsKeyFile = &cert, tlsCertFile, tlsKeyFile
+		}
+		addReloader(&g, logger, rl, reloadSuccess)
+	}
+
 	g.Add(run.SignalHandler(context.Background(), syscall.SIGINT, syscall.SIGTERM))
 
 	if err := g.Run(); err != nil {
 		if !errors.As(err, &run.SignalError{}) {
-			log.Printf("Server stopped with %v", err)
+			logger.Error("Server stopped", "err", err)
 			os.Exit(1)
 		}
-		log.Print("Caught signal; exiting gracefully...")
+		logger.Info("Caught signal; exiting gracefully...")
+	}
+
+	if tp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Error("Failed to flush the traces", "err", err)
+		}
 	}
 }
@@ -0,0 +1,154 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/oklog/run"
+)
+
+func TestAddServerDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		requestTime  time.Duration
+		drainTimeout time.Duration
+
+		expCompleted bool
+		// minStop and maxStop bound the duration between the interrupt
+		// and the end of the group.
+		minStop time.Duration
+		maxStop time.Duration
+	}{
+		{
+			name:         "in-flight request completes",
+			requestTime:  200 * time.Millisecond,
+			drainTimeout: 5 * time.Second,
+			expCompleted: true,
+			minStop:      150 * time.Millisecond,
+			maxStop:      3 * time.Second,
+		},
+		{
+			name:         "in-flight request exceeds the drain timeout",
+			requestTime:  10 * time.Second,
+			drainTimeout: 200 * time.Millisecond,
+			minStop:      150 * time.Millisecond,
+			maxStop:      3 * time.Second,
+		},
+		{
+			name:         "no drain",
+			requestTime:  10 * time.Second,
+			drainTimeout: 0,
+			maxStop:      3 * time.Second,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var (
+				started  = make(chan struct{})
+				released = make(chan struct{})
+			)
+			defer close(released)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				close(started)
+				select {
+				case <-time.After(tc.requestTime):
+				case <-released:
+				}
+				io.WriteString(w, "ok")
+			})}
+
+			var g run.Group
+			addServer(&g, slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)), srv, tc.drainTimeout, func() error {
+				if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+				return nil
+			})
+			// Interrupt the group once the request is in flight.
+			g.Add(func() error {
+				<-started
+				return nil
+			}, func(error) {})
+
+			type result struct {
+				body string
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + l.Addr().String())
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				results <- result{body: string(b), err: err}
+			}()
+
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				if err := g.Run(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+
+			select {
+			case <-started:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the request didn't reach the server")
+			}
+			start := time.Now()
+
+			select {
+			case <-stopped:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the server didn't stop")
+			}
+			d := time.Since(start)
+			if d < tc.minStop || d > tc.maxStop {
+				t.Fatalf("expected the server to stop after [%v, %v], got %v", tc.minStop, tc.maxStop, d)
+			}
+
+			res := <-results
+			if tc.expCompleted {
+				if res.err != nil || res.body != "ok" {
+					t.Fatalf("expected the request to complete, got %q (err: %v)", res.body, res.err)
+				}
+				return
+			}
+			if res.err == nil {
+				t.Fatalf("expected the connection to be closed, got %q", res.body)
+			}
+
+			// The listener is closed.
+			if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+				t.Fatal("expected the listener to be closed")
+			}
+		})
+	}
+}
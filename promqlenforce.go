@@ -0,0 +1,188 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+const promQLEnforceCommand = "promql-enforce"
+
+// Exit codes of the promql-enforce subcommand.
+const (
+	exitOK           = 0
+	exitEnforceError = 1
+	exitUsageError   = 2
+)
+
+// parseLabelMatcher parses a label matcher given as <name><op><value> where
+// the operator is one of '=', '!=', '=~' and '!~' (e.g. 'namespace=~"a|b"'
+// or namespace=a). The value can be quoted.
+func parseLabelMatcher(s string) (*labels.Matcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, fmt.Errorf("%q: expected <name><op><value>", s)
+	}
+
+	name, rest := s[:i], s[i:]
+	var typ labels.MatchType
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		typ, rest = labels.MatchRegexp, rest[2:]
+	case strings.HasPrefix(rest, "!~"):
+		typ, rest = labels.MatchNotRegexp, rest[2:]
+	case strings.HasPrefix(rest, "!="):
+		typ, rest = labels.MatchNotEqual, rest[2:]
+	case strings.HasPrefix(rest, "="):
+		typ, rest = labels.MatchEqual, rest[1:]
+	default:
+		return nil, fmt.Errorf("%q: invalid operator", s)
+	}
+
+	if len(rest) >= 2 && rest[0] == '"' && rest[len(rest)-1] == '"' {
+		rest = rest[1 : len(rest)-1]
+	}
+
+	return labels.NewMatcher(typ, name, rest)
+}
+
+// query is a PromQL expression read from the arguments, a file or stdin.
+type query struct {
+	source string
+	expr   string
+}
+
+// readQueries returns the non-empty lines of r, one query per line.
+func readQueries(name string, r io.Reader) ([]query, error) {
+	var (
+		queries []query
+		line    int
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line++
+		if expr := strings.TrimSpace(s.Text()); expr != "" {
+			queries = append(queries, query{source: fmt.Sprintf("%s:%d", name, line), expr: expr})
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return queries, nil
+}
+
+// runPromQLEnforce implements the promql-enforce subcommand which rewrites
+// PromQL expressions offline (e.g. to validate dashboards and rules in CI).
+// The rewritten queries are written to stdout, one per line, and the errors
+// to stderr. It returns the exit code of the process.
+func runPromQLEnforce(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var (
+		matchers       arrayFlags
+		files          arrayFlags
+		errorOnReplace bool
+	)
+
+	flagset := flag.NewFlagSet(promQLEnforceCommand, flag.ContinueOnError)
+	flagset.SetOutput(stderr)
+	flagset.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s [flags] [query...]\n\n", os.Args[0], promQLEnforceCommand)
+		fmt.Fprintln(stderr, "Enforces the label matchers in the PromQL queries given as arguments, read from the -file flags or from stdin (one query per line).")
+		fmt.Fprintln(stderr, "The rewritten queries are written to stdout. The exit code is 1 if any query can't be enforced and 2 on usage errors.")
+		fmt.Fprintln(stderr)
+		flagset.PrintDefaults()
+	}
+	flagset.Var(&matchers, "label-matcher", "Label matcher to enforce, e.g. 'namespace=default' or 'namespace=~\"a|b\"'. It can be repeated.")
+	flagset.Var(&files, "file", "File to read the queries from, one query per line ('-' reads from stdin). It can be repeated.")
+	flagset.BoolVar(&errorOnReplace, "error-on-replace", false, "When specified, a query with a label matcher conflicting with the enforced ones fails instead of having it replaced.")
+
+	if err := flagset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsageError
+	}
+
+	if len(matchers) == 0 {
+		fmt.Fprintln(stderr, "at least one -label-matcher flag is required")
+		return exitUsageError
+	}
+
+	ms := make([]*labels.Matcher, 0, len(matchers))
+	for _, s := range matchers {
+		m, err := parseLabelMatcher(s)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid -label-matcher flag: %v\n", err)
+			return exitUsageError
+		}
+		ms = append(ms, m)
+	}
+
+	var queries []query
+	for i, expr := range flagset.Args() {
+		queries = append(queries, query{source: fmt.Sprintf("arg:%d", i+1), expr: expr})
+	}
+
+	if len(files) == 0 && len(queries) == 0 {
+		files = append(files, "-")
+	}
+
+	for _, name := range files {
+		var (
+			qs  []query
+			err error
+		)
+		if name == "-" {
+			qs, err = readQueries("stdin", stdin)
+		} else {
+			var f *os.File
+			f, err = os.Open(name)
+			if err == nil {
+				qs, err = readQueries(name, f)
+				f.Close()
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsageError
+		}
+		queries = append(queries, qs...)
+	}
+
+	e := injectproxy.NewPromQLEnforcer(errorOnReplace, ms...)
+	code := exitOK
+	for _, q := range queries {
+		rewritten, err := e.Enforce(q.expr)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", q.source, err)
+			code = exitEnforceError
+			continue
+		}
+		fmt.Fprintln(stdout, rewritten)
+	}
+
+	return code
+}
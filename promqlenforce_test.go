@@ -0,0 +1,158 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunPromQLEnforce(t *testing.T) {
+	queryFile := filepath.Join(t.TempDir(), "queries.txt")
+	if err := os.WriteFile(queryFile, []byte("up\n\nsum(rate(http_requests_total[5m]))\n"), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		args  []string
+		stdin string
+
+		expCode   int
+		expStdout string
+		expStderr string
+	}{
+		{
+			name:      "queries as arguments",
+			args:      []string{"-label-matcher", "namespace=ns1", "up", `rate(http_requests_total{namespace="x"}[5m])`},
+			expCode:   exitOK,
+			expStdout: "up{namespace=\"ns1\"}\nrate(http_requests_total{namespace=\"ns1\"}[5m])\n",
+		},
+		{
+			name:      "queries from stdin",
+			args:      []string{"-label-matcher", `namespace=~"a|b"`},
+			stdin:     "up\n\n  process_start_time_seconds  \n",
+			expCode:   exitOK,
+			expStdout: "up{namespace=~\"a|b\"}\nprocess_start_time_seconds{namespace=~\"a|b\"}\n",
+		},
+		{
+			name:      "queries from a file",
+			args:      []string{"-label-matcher", "namespace=ns1", "-label-matcher", "cluster!=dev", "-file", queryFile},
+			expCode:   exitOK,
+			expStdout: "up{cluster!=\"dev\",namespace=\"ns1\"}\nsum(rate(http_requests_total{cluster!=\"dev\",namespace=\"ns1\"}[5m]))\n",
+		},
+		{
+			name:      "conflicting matcher",
+			args:      []string{"-error-on-replace", "-label-matcher", "namespace=ns1", `up{namespace="x"}`, "up"},
+			expCode:   exitEnforceError,
+			expStdout: "up{namespace=\"ns1\"}\n",
+			expStderr: "arg:1: conflicting label matcher",
+		},
+		{
+			name:      "invalid query",
+			args:      []string{"-label-matcher", "namespace=ns1", "-file", "-"},
+			stdin:     "up\nup{\n",
+			expCode:   exitEnforceError,
+			expStdout: "up{namespace=\"ns1\"}\n",
+			expStderr: "stdin:2: failed to parse query string",
+		},
+		{
+			name:      "missing matcher",
+			args:      []string{"up"},
+			expCode:   exitUsageError,
+			expStderr: "at least one -label-matcher flag is required",
+		},
+		{
+			name:      "invalid matcher",
+			args:      []string{"-label-matcher", "namespace", "up"},
+			expCode:   exitUsageError,
+			expStderr: "invalid -label-matcher flag",
+		},
+		{
+			name:      "missing file",
+			args:      []string{"-label-matcher", "namespace=ns1", "-file", filepath.Join(t.TempDir(), "missing.txt")},
+			expCode:   exitUsageError,
+			expStderr: "no such file or directory",
+		},
+		{
+			name:      "unknown flag",
+			args:      []string{"-foo"},
+			expCode:   exitUsageError,
+			expStderr: "flag provided but not defined: -foo",
+		},
+		{
+			name:      "help",
+			args:      []string{"-h"},
+			expCode:   exitOK,
+			expStderr: "The rewritten queries are written to stdout.",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runPromQLEnforce(tc.args, strings.NewReader(tc.stdin), &stdout, &stderr)
+
+			if code != tc.expCode {
+				t.Fatalf("expected exit code %d, got %d: %s", tc.expCode, code, stderr.String())
+			}
+			if stdout.String() != tc.expStdout {
+				t.Fatalf("expected stdout %q, got %q", tc.expStdout, stdout.String())
+			}
+			if tc.expStderr == "" && stderr.Len() > 0 {
+				t.Fatalf("expected empty stderr, got %q", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tc.expStderr) {
+				t.Fatalf("expected stderr to contain %q, got %q", tc.expStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestParseLabelMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		in string
+
+		exp    string
+		expErr bool
+	}{
+		{in: "namespace=default", exp: `namespace="default"`},
+		{in: `namespace="default"`, exp: `namespace="default"`},
+		{in: "namespace!=default", exp: `namespace!="default"`},
+		{in: `namespace=~"a|b"`, exp: `namespace=~"a|b"`},
+		{in: "namespace!~a.*", exp: `namespace!~"a.*"`},
+		{in: "namespace=", exp: `namespace=""`},
+		{in: "namespace", expErr: true},
+		{in: "=default", expErr: true},
+		{in: "namespace!default", expErr: true},
+		{in: "namespace=~(", expErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			m, err := parseLabelMatcher(tc.in)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if m.String() != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, m)
+			}
+		})
+	}
+}
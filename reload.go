@@ -0,0 +1,249 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// proxyRoutes is implemented by the routes of the proxy.
+type proxyRoutes interface {
+	http.Handler
+	RoutesHandler() http.HandlerFunc
+}
+
+// generation holds the routes built from a configuration. The metrics of the
+// routes are registered in a dedicated registry since the routes of the next
+// configuration register the same metrics.
+type generation struct {
+	routes    proxyRoutes
+	tlsRoutes proxyRoutes
+	registry  *prometheus.Registry
+}
+
+// current holds the generation serving the requests. The in-flight requests
+// complete with the generation they started with when the configuration is
+// reloaded.
+type current struct {
+	gen atomic.Pointer[generation]
+}
+
+func (c *current) get() *generation {
+	return c.gen.Load()
+}
+
+func (c *current) set(gen *generation) {
+	c.gen.Store(gen)
+}
+
+// handler returns the handler of the HTTP or HTTPS listener.
+func (c *current) handler(tls bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if tls {
+			c.get().tlsRoutes.ServeHTTP(w, req)
+			return
+		}
+
+		c.get().routes.ServeHTTP(w, req)
+	})
+}
+
+// Gather implements the prometheus.Gatherer interface.
+func (c *current) Gather() ([]*dto.MetricFamily, error) {
+	return c.get().registry.Gather()
+}
+
+// reloader applies the configuration file to the running proxy. The new
+// routes serve the new requests while the in-flight requests complete with
+// the previous ones. Nothing is changed if the configuration is invalid.
+type reloader struct {
+	// filename is the configuration file, empty when the proxy is only
+	// configured by the flags. The routes are still rebuilt to reload the
+	// files given by the flags (e.g. -header-mapping-file).
+	filename string
+	// build returns the routes of the configuration.
+	build    func(*config) (*generation, error)
+	cur      *current
+	denyList *injectproxy.DenyList
+	// cert is the certificate of the HTTPS listener, nil without HTTPS
+	// listener.
+	cert        *certificate
+	tlsCertFile string
+	tlsKeyFile  string
+
+	// cfg is the configuration currently applied.
+	cfg *config
+}
+
+func (rl *reloader) reload() error {
+	cfg := &config{}
+	if rl.filename != "" {
+		var err error
+		cfg, err = loadConfig(rl.filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	gen, err := rl.build(cfg)
+	if err != nil {
+		return err
+	}
+
+	var c *loadedCertificate
+	if rl.cert != nil {
+		certFile, keyFile, err := cfg.certFiles(rl.tlsCertFile, rl.tlsKeyFile)
+		if err != nil {
+			return err
+		}
+
+		c, err = loadCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.blockTenants(rl.denyList, rl.cfg); err != nil {
+		return err
+	}
+
+	if rl.cert != nil {
+		rl.cert.set(c)
+	}
+	rl.cur.set(gen)
+	rl.cfg = cfg
+
+	return nil
+}
+
+// addReloader adds the actor reloading the configuration when the process
+// receives SIGHUP. The gauge records whether the last reload succeeded.
+func addReloader(g *run.Group, logger *slog.Logger, rl *reloader, success prometheus.Gauge) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	g.Add(func() error {
+		for {
+			select {
+			case <-hup:
+				if err := rl.reload(); err != nil {
+					logger.Error("Failed to reload the configuration", "err", err)
+					success.Set(0)
+					continue
+				}
+				logger.Info("Configuration reloaded")
+				success.Set(1)
+			case <-done:
+				return nil
+			}
+		}
+	}, func(error) {
+		signal.Stop(hup)
+		close(done)
+	})
+}
+
+// certificateCheckInterval is the delay between 2 checks of the certificate
+// files of the HTTPS listener.
+const certificateCheckInterval = 30 * time.Second
+
+// certificate holds the certificate of the HTTPS listener which can be
+// replaced at runtime.
+type certificate struct {
+	cert atomic.Pointer[loadedCertificate]
+}
+
+// loadedCertificate is a certificate with the files it was loaded from.
+type loadedCertificate struct {
+	tls.Certificate
+	certFile string
+	keyFile  string
+	modTime  time.Time
+}
+
+func loadCertificate(certFile, keyFile string) (*loadedCertificate, error) {
+	modTime, err := lastModified(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+
+	return &loadedCertificate{Certificate: c, certFile: certFile, keyFile: keyFile, modTime: modTime}, nil
+}
+
+func (c *certificate) set(cert *loadedCertificate) {
+	c.cert.Store(cert)
+}
+
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &c.cert.Load().Certificate, nil
+}
+
+// reloadIfModified reloads the certificate if its files were modified since
+// they were loaded. It returns true if the certificate was reloaded.
+func (c *certificate) reloadIfModified() (bool, error) {
+	cur := c.cert.Load()
+
+	modTime, err := lastModified(cur.certFile, cur.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to check the TLS certificate: %w", err)
+	}
+	if !modTime.After(cur.modTime) {
+		return false, nil
+	}
+
+	cert, err := loadCertificate(cur.certFile, cur.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	// Don't override the certificate of a configuration reloaded meanwhile.
+	return c.cert.CompareAndSwap(cur, cert), nil
+}
+
+// lastModified returns the most recent modification time of the files.
+func lastModified(files ...string) (time.Time, error) {
+	var last time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+
+	return last, nil
+}
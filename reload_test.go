@@ -0,0 +1,338 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// TestMain runs the proxy instead of the tests when the test binary is started
+// by startProxy.
+func TestMain(m *testing.M) {
+	if os.Getenv("PROM_LABEL_PROXY_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// startProxy runs the proxy with the given flags in a child process. It
+// returns the process, the address of the insecure listener and the standard
+// error of the process.
+func startProxy(t *testing.T, args ...string) (*os.Process, string, *bytes.Buffer) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], append(args, "-insecure-listen-address", addr)...)
+	cmd.Env = append(os.Environ(), "PROM_LABEL_PROXY_TEST_MAIN=1")
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	})
+
+	return cmd.Process, addr, &stderr
+}
+
+// upstreamRoutes are the routes built by the test, they only record the
+// upstream of their configuration.
+type upstreamRoutes struct {
+	http.Handler
+	upstream string
+}
+
+func (upstreamRoutes) RoutesHandler() http.HandlerFunc { return nil }
+
+// notifyingGauge reports the values set on the gauge.
+type notifyingGauge struct {
+	prometheus.Gauge
+	values chan float64
+}
+
+func (g notifyingGauge) Set(v float64) {
+	g.Gauge.Set(v)
+	g.values <- v
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yml")
+
+	build := func(cfg *config) (*generation, error) {
+		if cfg.Upstream == "" {
+			return nil, errors.New("missing upstream")
+		}
+
+		return &generation{routes: upstreamRoutes{upstream: cfg.Upstream}, registry: prometheus.NewRegistry()}, nil
+	}
+
+	cfg := &config{Upstream: "http://a", BlockedTenants: map[string]denial{"ns1": {}}}
+	gen, err := build(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var cur current
+	cur.set(gen)
+
+	denyList := injectproxy.NewDenyList()
+	if err := cfg.blockTenants(denyList, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	success := notifyingGauge{
+		Gauge:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "prom_label_proxy_config_last_reload_successful"}),
+		values: make(chan float64),
+	}
+
+	var g run.Group
+	addReloader(&g, slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)), &reloader{
+		filename: filename,
+		build:    build,
+		cur:      &cur,
+		denyList: denyList,
+		cfg:      cfg,
+	}, success)
+
+	stop := make(chan struct{})
+	g.Add(func() error {
+		<-stop
+		return nil
+	}, func(error) {})
+
+	stopped := make(chan error)
+	go func() { stopped <- g.Run() }()
+	defer func() {
+		close(stop)
+		if err := <-stopped; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config string
+
+		expSuccess  float64
+		expUpstream string
+		expBlocked  []string
+	}{
+		{
+			name:        "valid configuration",
+			config:      "upstream: http://b\nblocked_tenants:\n  ns2: {}\n",
+			expSuccess:  1,
+			expUpstream: "http://b",
+			expBlocked:  []string{"ns2"},
+		},
+		{
+			name:        "invalid YAML",
+			config:      "upstream: [\n",
+			expSuccess:  0,
+			expUpstream: "http://b",
+			expBlocked:  []string{"ns2"},
+		},
+		{
+			name:        "unknown field",
+			config:      "upstream: http://c\nblocked_tenants:\n  ns3: {}\nfoo: bar\n",
+			expSuccess:  0,
+			expUpstream: "http://b",
+			expBlocked:  []string{"ns2"},
+		},
+		{
+			name:        "routes can't be built",
+			config:      "blocked_tenants:\n  ns3: {}\n",
+			expSuccess:  0,
+			expUpstream: "http://b",
+			expBlocked:  []string{"ns2"},
+		},
+		{
+			name:        "invalid blocked tenant",
+			config:      "upstream: http://c\nblocked_tenants:\n  ns3:\n    status_code: 200\n",
+			expSuccess:  0,
+			expUpstream: "http://b",
+			expBlocked:  []string{"ns2"},
+		},
+		{
+			name:        "valid configuration after errors",
+			config:      "upstream: http://c\n",
+			expSuccess:  1,
+			expUpstream: "http://c",
+			expBlocked:  []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(filename, []byte(tc.config), 0o600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := p.Signal(syscall.SIGHUP); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			select {
+			case v := <-success.values:
+				if v != tc.expSuccess {
+					t.Fatalf("expected reload success %v, got %v", tc.expSuccess, v)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the configuration wasn't reloaded")
+			}
+
+			if got := cur.get().routes.(upstreamRoutes).upstream; got != tc.expUpstream {
+				t.Fatalf("expected upstream %q, got %q", tc.expUpstream, got)
+			}
+
+			blocked := []string{}
+			for lv := range denyList.List() {
+				blocked = append(blocked, lv)
+			}
+			slices.Sort(blocked)
+			if !reflect.DeepEqual(blocked, tc.expBlocked) {
+				t.Fatalf("expected blocked tenants %v, got %v", tc.expBlocked, blocked)
+			}
+		})
+	}
+}
+
+func TestReloadFlagFilesOnSignal(t *testing.T) {
+	// The upstream returns the query it received.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Query", req.FormValue("query"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		path     string
+		header   http.Header
+		file     string
+		reloaded string
+
+		expCode          int
+		expQuery         string
+		expReloadedCode  int
+		expReloadedQuery string
+	}{
+		{
+			name:             "header mapping",
+			args:             []string{"-label", "namespace", "-header-name", "X-Tenant", "-header-mapping-file"},
+			path:             "/api/v1/query?query=up",
+			header:           http.Header{"X-Tenant": []string{"alice"}},
+			file:             "alice: [ns1]\n",
+			reloaded:         "alice: [ns2]\n",
+			expCode:          http.StatusOK,
+			expQuery:         `up{namespace="ns1"}`,
+			expReloadedCode:  http.StatusOK,
+			expReloadedQuery: `up{namespace="ns2"}`,
+		},
+		{
+			name:            "label ACL",
+			args:            []string{"-label", "namespace", "-label-acl-identity", "header:X-User", "-label-acl-file"},
+			path:            "/api/v1/query?query=up&namespace=ns2",
+			header:          http.Header{"X-User": []string{"alice"}},
+			file:            "alice: [ns1, ns2]\n",
+			reloaded:        "alice: [ns1]\n",
+			expCode:         http.StatusOK,
+			expQuery:        `up{namespace="ns2"}`,
+			expReloadedCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "file.yml")
+			if err := os.WriteFile(filename, []byte(tc.file), 0o600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			p, addr, stderr := startProxy(t, append(tc.args, filename, "-upstream", upstream.URL)...)
+
+			// waitFor sends the request until the proxy replies with the
+			// expected response.
+			waitFor := func(expCode int, expQuery string) {
+				t.Helper()
+
+				var (
+					code  int
+					query string
+				)
+				for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+					req, err := http.NewRequest(http.MethodGet, "http://"+addr+tc.path, nil)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					req.Header = tc.header.Clone()
+
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						continue
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+
+					code, query = resp.StatusCode, resp.Header.Get("X-Query")
+					if code == expCode && query == expQuery {
+						return
+					}
+				}
+				t.Fatalf("expected status code %d and query %q, got %d and %q\n%s", expCode, expQuery, code, query, stderr.String())
+			}
+
+			waitFor(tc.expCode, tc.expQuery)
+
+			if err := os.WriteFile(filename, []byte(tc.reloaded), 0o600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := p.Signal(syscall.SIGHUP); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			waitFor(tc.expReloadedCode, tc.expReloadedQuery)
+		})
+	}
+}
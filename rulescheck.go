@@ -0,0 +1,282 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+const rulesCheckCommand = "rules-check"
+
+// rulesChecker verifies that the rules of Prometheus rule files comply with
+// the enforced label matchers.
+type rulesChecker struct {
+	enforcer *injectproxy.PromQLEnforcer
+	matchers []*labels.Matcher
+	strict   bool
+
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// checkFile checks the rules of the given file. It returns the number of
+// violations and the rewritten file content if any rule has been changed.
+func (rc *rulesChecker) checkFile(name string) (int, []byte, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if _, errs := rulefmt.Parse(content); len(errs) > 0 {
+		return 0, nil, fmt.Errorf("%s: %w", name, errors.Join(errs...))
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(doc.Content) == 0 {
+		return 0, nil, nil
+	}
+
+	var (
+		violations int
+		changed    bool
+	)
+	report := func(w io.Writer, group, rule *yaml.Node, format string, args ...any) {
+		fmt.Fprintf(w, "%s:%d: group %q, rule %q: %s\n", name, rule.Line, group.Value, ruleName(rule), fmt.Sprintf(format, args...))
+	}
+
+	groups := mappingValue(doc.Content[0], "groups")
+	if groups == nil {
+		return 0, nil, nil
+	}
+	for _, g := range groups.Content {
+		group := mappingValue(g, "name")
+		rules := mappingValue(g, "rules")
+		if rules == nil {
+			continue
+		}
+
+		for _, rule := range rules.Content {
+			expr := mappingValue(rule, "expr")
+
+			rewritten, err := rc.enforcer.Enforce(expr.Value)
+			if err != nil {
+				report(rc.stderr, group, rule, "%v", err)
+				violations++
+				continue
+			}
+
+			// The enforcer formats the expression, compare with the
+			// formatted original.
+			if e, err := parser.ParseExpr(expr.Value); err == nil && e.String() != rewritten {
+				if rc.strict {
+					report(rc.stderr, group, rule, "the expression doesn't carry the enforced label")
+					violations++
+				} else {
+					report(rc.stdout, group, rule, "expression rewritten to %q", rewritten)
+				}
+				expr.Value = rewritten
+				changed = true
+			}
+
+			lbls := mappingValue(rule, "labels")
+			for _, m := range rc.matchers {
+				if v := mappingValue(lbls, m.Name); v != nil {
+					if !m.Matches(v.Value) {
+						report(rc.stderr, group, rule, "label %s=%q doesn't match the enforced matcher %s", m.Name, v.Value, m)
+						violations++
+					}
+					continue
+				}
+
+				// Only the label of an equality matcher can be
+				// added to the rule.
+				if m.Type != labels.MatchEqual {
+					continue
+				}
+
+				if rc.strict {
+					report(rc.stderr, group, rule, "the labels don't carry the enforced label %q", m.Name)
+					violations++
+				} else {
+					report(rc.stdout, group, rule, "label %s=%q added", m.Name, m.Value)
+				}
+				if lbls == nil {
+					lbls = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+					rule.Content = append(rule.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "labels"}, lbls)
+				}
+				lbls.Content = append(lbls.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: m.Name},
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: m.Value},
+				)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return violations, nil, nil
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return violations, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := enc.Close(); err != nil {
+		return violations, nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return violations, buf.Bytes(), nil
+}
+
+// mappingValue returns the value of the key in a YAML mapping node or nil if
+// it doesn't exist.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// ruleName returns the name of the alerting or recording rule.
+func ruleName(rule *yaml.Node) string {
+	if n := mappingValue(rule, "alert"); n != nil {
+		return n.Value
+	}
+
+	if n := mappingValue(rule, "record"); n != nil {
+		return n.Value
+	}
+
+	return ""
+}
+
+// runRulesCheck implements the rules-check subcommand which verifies that the
+// rules of Prometheus rule files carry (or can safely receive) the enforced
+// label matchers, optionally rewriting the files in place. It returns the
+// exit code of the process.
+func runRulesCheck(args []string, stdout, stderr io.Writer) int {
+	var (
+		matchers arrayFlags
+		write    bool
+		strict   bool
+	)
+
+	flagset := flag.NewFlagSet(rulesCheckCommand, flag.ContinueOnError)
+	flagset.SetOutput(stderr)
+	flagset.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s [flags] file...\n\n", os.Args[0], rulesCheckCommand)
+		fmt.Fprintln(stderr, "Verifies that the expressions and the labels of the rules carry (or can safely receive) the enforced label matchers.")
+		fmt.Fprintln(stderr, "The exit code is 1 if any rule violates the enforced matchers and 2 on usage errors.")
+		fmt.Fprintln(stderr)
+		flagset.PrintDefaults()
+	}
+	flagset.Var(&matchers, "label-matcher", "Label matcher to enforce, e.g. 'namespace=default' or 'namespace=~\"a|b\"'. It can be repeated.")
+	flagset.BoolVar(&write, "write", false, "When specified, the rule files are rewritten in place with the enforced expressions and labels.")
+	flagset.BoolVar(&strict, "strict", false, "When specified, the rules which don't already carry the enforced label are violations instead of being rewritten.")
+
+	if err := flagset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsageError
+	}
+
+	if len(matchers) == 0 {
+		fmt.Fprintln(stderr, "at least one -label-matcher flag is required")
+		return exitUsageError
+	}
+
+	if flagset.NArg() == 0 {
+		fmt.Fprintln(stderr, "at least one rule file is required")
+		return exitUsageError
+	}
+
+	if write && strict {
+		fmt.Fprintln(stderr, "-write and -strict are mutually exclusive")
+		return exitUsageError
+	}
+
+	ms := make([]*labels.Matcher, 0, len(matchers))
+	for _, s := range matchers {
+		m, err := parseLabelMatcher(s)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid -label-matcher flag: %v\n", err)
+			return exitUsageError
+		}
+		ms = append(ms, m)
+	}
+
+	rc := &rulesChecker{
+		// Conflicting matchers are violations rather than being replaced.
+		enforcer: injectproxy.NewPromQLEnforcer(true, ms...),
+		matchers: ms,
+		strict:   strict,
+		stdout:   stdout,
+		stderr:   stderr,
+	}
+
+	code := exitOK
+	for _, name := range flagset.Args() {
+		violations, content, err := rc.checkFile(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			code = exitEnforceError
+			continue
+		}
+
+		if violations > 0 {
+			code = exitEnforceError
+			continue
+		}
+
+		if write && content != nil {
+			fi, err := os.Stat(name)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				code = exitEnforceError
+				continue
+			}
+			if err := os.WriteFile(name, content, fi.Mode().Perm()); err != nil {
+				fmt.Fprintln(stderr, err)
+				code = exitEnforceError
+			}
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunRulesCheck(t *testing.T) {
+	const (
+		rules = `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum(up) by (job)
+      - alert: Down
+        expr: up{namespace="ns1"} == 0
+        labels:
+          namespace: ns1
+          severity: page
+`
+		enforcedRules = `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up{namespace="ns1"})
+        labels:
+          namespace: ns1
+      - alert: Down
+        expr: up{namespace="ns1"} == 0
+        labels:
+          namespace: ns1
+          severity: page
+`
+	)
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		content string
+
+		expCode   int
+		expStdout string
+		expStderr string
+		expFile   string
+	}{
+		{
+			name:    "rules rewritten",
+			args:    []string{"-label-matcher", "namespace=ns1"},
+			content: rules,
+			expCode: exitOK,
+			expStdout: `FILE:4: group "g", rule "job:up:sum": expression rewritten to "sum by (job) (up{namespace=\"ns1\"})"
+FILE:4: group "g", rule "job:up:sum": label namespace="ns1" added
+`,
+			expFile: rules,
+		},
+		{
+			name:    "rules written",
+			args:    []string{"-write", "-label-matcher", "namespace=ns1"},
+			content: rules,
+			expCode: exitOK,
+			expStdout: `FILE:4: group "g", rule "job:up:sum": expression rewritten to "sum by (job) (up{namespace=\"ns1\"})"
+FILE:4: group "g", rule "job:up:sum": label namespace="ns1" added
+`,
+			expFile: enforcedRules,
+		},
+		{
+			name:    "compliant rules",
+			args:    []string{"-strict", "-label-matcher", "namespace=ns1"},
+			content: enforcedRules,
+			expCode: exitOK,
+			expFile: enforcedRules,
+		},
+		{
+			name:      "strict mode",
+			args:      []string{"-strict", "-label-matcher", "namespace=ns1"},
+			content:   rules,
+			expCode:   exitEnforceError,
+			expStderr: `FILE:4: group "g", rule "job:up:sum": the expression doesn't carry the enforced label`,
+			expFile:   rules,
+		},
+		{
+			name:    "conflicting expression",
+			args:    []string{"-write", "-label-matcher", "namespace=ns2"},
+			content: rules,
+			expCode: exitEnforceError,
+			expStdout: `FILE:4: group "g", rule "job:up:sum": expression rewritten to "sum by (job) (up{namespace=\"ns2\"})"
+FILE:4: group "g", rule "job:up:sum": label namespace="ns2" added
+`,
+			expStderr: `FILE:6: group "g", rule "Down": conflicting label matcher`,
+			// The files with violations aren't rewritten.
+			expFile: rules,
+		},
+		{
+			name:      "conflicting label",
+			args:      []string{"-label-matcher", "namespace=ns2"},
+			content:   "groups:\n  - name: g\n    rules:\n      - record: foo\n        expr: up{namespace=\"ns2\"}\n        labels:\n          namespace: ns1\n",
+			expCode:   exitEnforceError,
+			expStderr: `FILE:4: group "g", rule "foo": label namespace="ns1" doesn't match the enforced matcher namespace="ns2"`,
+			expFile:   "groups:\n  - name: g\n    rules:\n      - record: foo\n        expr: up{namespace=\"ns2\"}\n        labels:\n          namespace: ns1\n",
+		},
+		{
+			name:      "invalid rule file",
+			args:      []string{"-label-matcher", "namespace=ns1"},
+			content:   "groups:\n  - name: g\n    rules:\n      - record: foo\n        expr: up{\n",
+			expCode:   exitEnforceError,
+			expStderr: "FILE: ",
+			expFile:   "groups:\n  - name: g\n    rules:\n      - record: foo\n        expr: up{\n",
+		},
+		{
+			name:      "missing matcher",
+			content:   rules,
+			expCode:   exitUsageError,
+			expStderr: "at least one -label-matcher flag is required",
+			expFile:   rules,
+		},
+		{
+			name:      "invalid matcher",
+			args:      []string{"-label-matcher", "namespace"},
+			content:   rules,
+			expCode:   exitUsageError,
+			expStderr: "invalid -label-matcher flag",
+			expFile:   rules,
+		},
+		{
+			name:      "write and strict",
+			args:      []string{"-write", "-strict", "-label-matcher", "namespace=ns1"},
+			content:   rules,
+			expCode:   exitUsageError,
+			expStderr: "-write and -strict are mutually exclusive",
+			expFile:   rules,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "rules.yml")
+			if err := os.WriteFile(name, []byte(tc.content), 0o600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := runRulesCheck(append(tc.args, name), &stdout, &stderr)
+
+			if code != tc.expCode {
+				t.Fatalf("expected exit code %d, got %d: %s", tc.expCode, code, stderr.String())
+			}
+			if exp := strings.ReplaceAll(tc.expStdout, "FILE", name); stdout.String() != exp {
+				t.Fatalf("expected stdout %q, got %q", exp, stdout.String())
+			}
+			if tc.expStderr == "" && stderr.Len() > 0 {
+				t.Fatalf("expected empty stderr, got %q", stderr.String())
+			}
+			if exp := strings.ReplaceAll(tc.expStderr, "FILE", name); !strings.Contains(stderr.String(), exp) {
+				t.Fatalf("expected stderr to contain %q, got %q", exp, stderr.String())
+			}
+
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(b) != tc.expFile {
+				t.Fatalf("expected file\n%s\ngot\n%s", tc.expFile, string(b))
+			}
+		})
+	}
+}
+
+func TestRunRulesCheckWithoutFile(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runRulesCheck([]string{"-label-matcher", "namespace=ns1"}, &stdout, &stderr); code != exitUsageError {
+		t.Fatalf("expected exit code %d, got %d", exitUsageError, code)
+	}
+	if !strings.Contains(stderr.String(), "at least one rule file is required") {
+		t.Fatalf("unexpected stderr %q", stderr.String())
+	}
+}